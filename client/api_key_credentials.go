@@ -0,0 +1,31 @@
+package client
+
+import (
+	"context"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// APIKeyCredentials authenticates every call with an API key in the x-api-key header,
+// for machine clients that cannot log in with a password.
+type APIKeyCredentials struct {
+	apiKey    string
+	enableTLS bool
+}
+
+// NewAPIKeyCredentials creates new APIKeyCredentials. The key is only sent over TLS if enableTLS is true.
+func NewAPIKeyCredentials(apiKey string, enableTLS bool) *APIKeyCredentials {
+	return &APIKeyCredentials{apiKey, enableTLS}
+}
+
+// GetRequestMetadata returns the header with the API key.
+func (creds *APIKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"x-api-key": creds.apiKey}, nil
+}
+
+// RequireTransportSecurity tells if the key can only be sent over TLS.
+func (creds *APIKeyCredentials) RequireTransportSecurity() bool {
+	return creds.enableTLS
+}
+
+var _ credentials.PerRPCCredentials = (*APIKeyCredentials)(nil)
@@ -2,37 +2,103 @@ package client
 
 import (
 	"context"
+	"fmt"
 	"learngrpc/pcbook/pb"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // AuthClient is the client for authentication service.
+// It is not safe for concurrent use, the AuthInterceptor serializes its calls.
 type AuthClient struct {
 	service pb.AuthServiceClient
 	username string
 	password string
+	refreshToken string
+	totpCode func(ctx context.Context) (string, error)
 }
 
 // NewAuthClient creates a new AuthClient.
 func NewAuthClient(cc *grpc.ClientConn, username, password string) *AuthClient {
 	service := pb.NewAuthServiceClient(cc)
 	return &AuthClient{
-		service, username, password,
+		service, username, password, "", nil,
 	}
 }
 
-// Login logs in and returns the token.
-func (client *AuthClient) Login() (string, error) {
+// SetTOTPCodeFunc sets the function that returns the current TOTP code of the user,
+// for logins that require two-factor authentication.
+func (client *AuthClient) SetTOTPCodeFunc(totpCode func(ctx context.Context) (string, error)) {
+	client.totpCode = totpCode
+}
+
+// Login logs in and returns the access token, keeping the refresh token for Refresh.
+// If the server asks for a second factor, it completes the login with a TOTP code.
+func (client *AuthClient) Login(ctx context.Context) (string, error) {
 	req := &pb.LoginRequest{
 		Username: client.username,
 		Password: client.password,
 	}
 
-	res, err := client.service.Login(context.Background(), req)
+	res, err := client.service.Login(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	if res.GetChallenge() != "" {
+		return client.completeLogin(ctx, res)
+	}
+
+	client.refreshToken = res.GetRefreshToken()
+	return res.GetToken(), nil
+}
+
+func (client *AuthClient) completeLogin(ctx context.Context, login *pb.LoginResponse) (string, error) {
+	if client.totpCode == nil {
+		return "", fmt.Errorf("user %s requires a TOTP code to log in", client.username)
+	}
+
+	code, err := client.totpCode(ctx)
+	if err != nil {
+		return "", fmt.Errorf("cannot get TOTP code: %w", err)
+	}
+
+	req := &pb.CompleteLoginRequest{
+		Challenge: login.GetChallenge(),
+		TotpCode:  code,
+	}
+
+	res, err := client.service.CompleteLogin(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	client.refreshToken = res.GetRefreshToken()
+	return res.GetToken(), nil
+}
+
+// Refresh returns a new access token using the refresh token of the last login or refresh.
+// It logs in again if there is no refresh token, or if the session has expired or was revoked.
+func (client *AuthClient) Refresh(ctx context.Context) (string, error) {
+	if client.refreshToken == "" {
+		return client.Login(ctx)
+	}
+
+	req := &pb.RefreshTokenRequest{
+		RefreshToken: client.refreshToken,
+	}
+
+	res, err := client.service.RefreshToken(ctx, req)
+	if status.Code(err) == codes.Unauthenticated {
+		client.refreshToken = ""
+		return client.Login(ctx)
+	}
 	if err != nil {
 		return "", err
 	}
 
+	client.refreshToken = res.GetRefreshToken()
 	return res.GetToken(), nil
 }
\ No newline at end of file
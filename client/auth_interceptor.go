@@ -2,121 +2,224 @@ package client
 
 import (
 	"context"
+	"fmt"
 	"learngrpc/pcbook/service"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/golang-jwt/jwt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+	minRefreshRetryDelay = time.Second
+	maxRefreshRetryDelay = 30 * time.Second
 )
 
 // AuthInterceptor is the client interceptor for authentication and authorization.
+// It refreshes the access token in the background before it expires,
+// until the context given to NewAuthInterceptor is canceled.
 type AuthInterceptor struct {
-	authClient *AuthClient
+	authClient  *AuthClient
 	authMethods map[string]bool
+
+	mutex       sync.RWMutex // protects the access token and its expiry
 	accessToken string
+	expiresAt   time.Time
+
+	refreshMutex sync.Mutex    // serializes the calls to the auth client
+	refreshed    chan struct{} // wakes up the background refresh when the token changed
 }
 
-// NewAuthInterceptor creates a new AuthInterceptor.
-func NewAuthInterceptor(authClient *AuthClient, authMethods map[string]bool, refreshDuration time.Duration) (*AuthInterceptor, error) {
+// NewAuthInterceptor creates a new AuthInterceptor, which logs in before returning.
+func NewAuthInterceptor(ctx context.Context, authClient *AuthClient, authMethods map[string]bool) (*AuthInterceptor, error) {
 	interceptor := &AuthInterceptor{
-		authClient,
-		authMethods,
-		"",
-	}	
+		authClient:  authClient,
+		authMethods: authMethods,
+		refreshed:   make(chan struct{}, 1),
+	}
 
-	err := interceptor.scheduleRefreshToken(refreshDuration)
+	err := interceptor.refreshToken(ctx, "")
 	if err != nil {
 		return nil, err
 	}
 
+	go interceptor.scheduleRefreshToken(ctx)
 	return interceptor, nil
 }
 
-func (interceptor *AuthInterceptor) scheduleRefreshToken(refreshDuration time.Duration) error {
-	err := interceptor.refreshToken()
-	if err != nil {
-		return err
-	}
+// scheduleRefreshToken refreshes the token when 4/5 of its remaining lifetime have passed,
+// and retries with a backoff on errors.
+func (interceptor *AuthInterceptor) scheduleRefreshToken(ctx context.Context) {
+	retryDelay := time.Duration(0)
+	for {
+		wait := retryDelay
+		if wait == 0 {
+			_, expiresAt := interceptor.token()
+			wait = time.Until(expiresAt) * 4 / 5
+		}
 
-	go func() {
-		wait := refreshDuration
-		for {
-			time.Sleep(wait)
-			err := interceptor.refreshToken()
-			if err != nil {
-				wait = time.Second
-			} else {
-				wait = refreshDuration
-			}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-interceptor.refreshed:
+			// refreshed by a retried call, compute the wait from the new token
+			timer.Stop()
+			retryDelay = 0
+			continue
+		case <-timer.C:
 		}
-	}()
 
-	return nil
+		token, _ := interceptor.token()
+		err := interceptor.refreshToken(ctx, token)
+		if err == nil {
+			retryDelay = 0
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("cannot refresh token: %v", err)
+		retryDelay *= 2
+		if retryDelay < minRefreshRetryDelay {
+			retryDelay = minRefreshRetryDelay
+		}
+		if retryDelay > maxRefreshRetryDelay {
+			retryDelay = maxRefreshRetryDelay
+		}
+	}
 }
 
-func (interceptor *AuthInterceptor) refreshToken() error {
-	token, err := interceptor.authClient.Login()
+// refreshToken gets a new token, unless the current token is no longer staleToken
+// because it was refreshed concurrently.
+func (interceptor *AuthInterceptor) refreshToken(ctx context.Context, staleToken string) error {
+	interceptor.refreshMutex.Lock()
+	defer interceptor.refreshMutex.Unlock()
+
+	if token, _ := interceptor.token(); token != staleToken {
+		return nil
+	}
+
+	token, err := interceptor.authClient.Refresh(ctx)
 	if err != nil {
 		return err
 	}
 
+	claims := &jwt.StandardClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(token, claims)
+	if err != nil {
+		return fmt.Errorf("cannot parse token: %w", err)
+	}
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	interceptor.mutex.Lock()
 	interceptor.accessToken = token
+	interceptor.expiresAt = expiresAt
+	interceptor.mutex.Unlock()
+
+	select {
+	case interceptor.refreshed <- struct{}{}:
+	default:
+	}
 
-	log.Printf("refreshed token: %v", token)
+	log.Printf("refreshed token, expires at %v", expiresAt)
 	return nil
 }
 
+func (interceptor *AuthInterceptor) token() (string, time.Time) {
+	interceptor.mutex.RLock()
+	defer interceptor.mutex.RUnlock()
+
+	return interceptor.accessToken, interceptor.expiresAt
+}
+
 // Unary returns a new unary client interceptor for authentication and authorization.
+// A call rejected as unauthenticated is retried once with a refreshed token.
 func (interceptor *AuthInterceptor) Unary() grpc.UnaryClientInterceptor {
 	return func(
-		ctx context.Context, 
-		method string, 
-		req, reply interface{}, 
-		cc *grpc.ClientConn, 
-		invoker grpc.UnaryInvoker, 
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
 		opts ...grpc.CallOption,
-		) error {
+	) error {
 		log.Printf("--> unary interceptor: %v", method)
 
-		if interceptor.authMethods[method] {
-			return invoker(interceptor.attachToken(ctx), method, req, reply, cc, opts...)
+		if !interceptor.authMethods[method] {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		token, _ := interceptor.token()
+		err := invoker(attachToken(ctx, token), method, req, reply, cc, opts...)
+		if status.Code(err) != codes.Unauthenticated {
+			return err
+		}
+
+		refreshErr := interceptor.refreshToken(ctx, token)
+		if refreshErr != nil {
+			log.Printf("cannot refresh token: %v", refreshErr)
+			return err
 		}
 
-		return invoker(ctx, method, req, reply, cc, opts...)
-	}	
+		token, _ = interceptor.token()
+		return invoker(attachToken(ctx, token), method, req, reply, cc, opts...)
+	}
 }
 
-func (interceptor *AuthInterceptor) attachToken(ctx context.Context) context.Context {
-	return metadata.AppendToOutgoingContext(ctx, "authorization", interceptor.accessToken)
+func attachToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", token)
 }
 
 // Stream returns a new stream client interceptor for authentication and authorization.
 func (interceptor *AuthInterceptor) Stream() grpc.StreamClientInterceptor {
 	return func(
-		ctx context.Context, 
-		desc *grpc.StreamDesc, 
-		cc *grpc.ClientConn, 
-		method string, 
-		streamer grpc.Streamer, 
+		ctx context.Context,
+		desc *grpc.StreamDesc,
+		cc *grpc.ClientConn,
+		method string,
+		streamer grpc.Streamer,
 		opts ...grpc.CallOption,
-		) (grpc.ClientStream, error) {
-			log.Printf("--> stream interceptor: %v", method)
-			
-			if interceptor.authMethods[method] {
-				return streamer(interceptor.attachToken(ctx), desc, cc, method, opts...)
-			}
-			return streamer(ctx, desc, cc, method, opts...)
+	) (grpc.ClientStream, error) {
+		log.Printf("--> stream interceptor: %v", method)
+
+		if interceptor.authMethods[method] {
+			token, _ := interceptor.token()
+			return streamer(attachToken(ctx, token), desc, cc, method, opts...)
+		}
+		return streamer(ctx, desc, cc, method, opts...)
 	}
 }
 
 // NewAuthMethods returns a map of methods that require authentication.
-// The map is created from the service definition of accessible roles.
+// The map is created from the methods of the registered services that are not public
+// in the default authorization policy.
 func NewAuthMethods() map[string]bool {
-	accessibleRoles := service.NewAccessibleRoles()
+	policy := service.NewDefaultPolicy()
 	authMethods := make(map[string]bool)
-	for method := range accessibleRoles {
-		authMethods[method] = true
-	}
+
+	protoregistry.GlobalFiles.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		services := file.Services()
+		for i := 0; i < services.Len(); i++ {
+			methods := services.Get(i).Methods()
+			for j := 0; j < methods.Len(); j++ {
+				method := fmt.Sprintf("/%s/%s", services.Get(i).FullName(), methods.Get(j).Name())
+				if public, _ := policy.Access(method); !public {
+					authMethods[method] = true
+				}
+			}
+		}
+		return true
+	})
+
 	return authMethods
-}
\ No newline at end of file
+}
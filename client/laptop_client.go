@@ -1,7 +1,6 @@
 package client
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -16,6 +15,12 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+const (
+	uploadChunkSize  = 32 * 1024
+	maxRetryAttempts = 5
+	retryBackoff     = 200 * time.Millisecond
+)
+
 // LaptopClient is the client for laptop service.
 type LaptopClient struct {
 	service pb.LaptopServiceClient
@@ -88,66 +93,114 @@ func logLaptop(laptop *pb.Laptop) {
 	log.Print(" + price: ", laptop.GetPriceUsd(), "usd")
 }
 
-// UploadImage uploads an image for a laptop.
-func (laptopClient *LaptopClient) UploadImage(laptopID string, imagePath string) {
+// UploadImage uploads an image for a laptop, and returns the ID of the saved image.
+// The image is sent in chunks through an upload session, which is resumed
+// from the committed offset after a transient error.
+func (laptopClient *LaptopClient) UploadImage(laptopID string, imagePath string) (string, error) {
 	file, err := os.Open(imagePath)
 	if err != nil {
-		log.Fatalf("cannot open image file: %v", err)
+		return "", fmt.Errorf("cannot open image file: %w", err)
 	}
 	defer file.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	stream, err := laptopClient.service.UploadImage(ctx)
-	if err != nil {
-		log.Fatalf("cannot upload image: %v", err)
-	}
-
-	req := &pb.UploadImageRequest{
-		Data: &pb.UploadImageRequest_Info{
+	var startRes *pb.StartImageUploadResponse
+	err = laptopClient.retry(func(ctx context.Context) error {
+		req := &pb.StartImageUploadRequest{
 			Info: &pb.ImageInfo{
 				LaptopId: laptopID,
 				ImageType: filepath.Ext(imagePath),
 			},
-		},
-	}
-
-	err = stream.Send(req)
+		}
+		startRes, err = laptopClient.service.StartImageUpload(ctx, req)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("cannot send image info: %v", err)
+		return "", fmt.Errorf("cannot start image upload: %w", err)
 	}
+	uploadID := startRes.GetUploadId()
 
-	reader := bufio.NewReader(file)
-	buffer := make([]byte, 1024)
+	buffer := make([]byte, uploadChunkSize)
+	offset := uint64(0)
 	for {
-		n, err := reader.Read(buffer)
-		if err == io.EOF {
-			break
+		n, err := file.ReadAt(buffer, int64(offset))
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("cannot read image file: %w", err)
 		}
-		if err != nil {
-			log.Fatalf("cannot read image file: %v", err)
+		if n == 0 {
+			break
 		}
 
-		req := &pb.UploadImageRequest{
-			Data: &pb.UploadImageRequest_ChunkData{
-				ChunkData: buffer[:n],
-			},
-		}
+		chunkStart := offset
+		err = laptopClient.retry(func(ctx context.Context) error {
+			if offset < chunkStart || offset >= chunkStart+uint64(n) {
+				// the server committed another part of the file, which is read again from there
+				return nil
+			}
+
+			req := &pb.UploadImageChunkRequest{
+				UploadId: uploadID,
+				Offset: offset,
+				ChunkData: buffer[offset-chunkStart:n],
+			}
+			res, err := laptopClient.service.UploadImageChunk(ctx, req)
+			if err == nil {
+				offset = res.GetCommittedSize()
+				return nil
+			}
 
-		err = stream.Send(req)
+			if isTransientError(err) {
+				// the chunk may or may not have been committed, ask the server where to resume
+				statusRes, statusErr := laptopClient.service.GetImageUploadStatus(ctx, &pb.GetImageUploadStatusRequest{UploadId: uploadID})
+				if statusErr == nil {
+					offset = statusRes.GetCommittedSize()
+				}
+			}
+			return err
+		})
 		if err != nil {
-			err2 := stream.RecvMsg(nil)
-			log.Fatalf("cannot send image chunk: %v| %v", err, err2)
+			return "", fmt.Errorf("cannot upload image chunk: %w", err)
 		}
 	}
 
-	res, err := stream.CloseAndRecv()
+	var res *pb.UploadImageResponse
+	err = laptopClient.retry(func(ctx context.Context) error {
+		res, err = laptopClient.service.FinishImageUpload(ctx, &pb.FinishImageUploadRequest{UploadId: uploadID})
+		return err
+	})
 	if err != nil {
-		log.Fatalf("cannot receive response: %v", err)
+		return "", fmt.Errorf("cannot finish image upload: %w", err)
+	}
+
+	log.Printf("image uploaded with id: %s", res.GetId())
+	return res.GetId(), nil
+}
+
+// retry calls fn with a fresh timeout until it succeeds, fails with a non-transient error
+// or runs out of attempts.
+func (laptopClient *LaptopClient) retry(fn func(ctx context.Context) error) error {
+	wait := retryBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := fn(ctx)
+		cancel()
+
+		if err == nil || !isTransientError(err) || attempt == maxRetryAttempts {
+			return err
+		}
+
+		log.Printf("attempt %d failed: %v, retrying in %v", attempt, err, wait)
+		time.Sleep(wait)
+		wait *= 2
 	}
+}
 
-	log.Printf("image uploaded with id: %s", res.GetId())	
+func isTransientError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	default:
+		return false
+	}
 }
 
 // RateLaptop rates a laptop.
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
@@ -10,7 +11,7 @@ import (
 	"learngrpc/pcbook/pb"
 	sample "learngrpc/pcbook/samples"
 	"log"
-	"time"
+	"os"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -42,7 +43,10 @@ func testUploadImage(laptopClient *client.LaptopClient) {
 	imagePath := "from/macbook-air-gold-2015-16.jpg"
 	laptop := sample.NewLaptop()
 	laptopClient.CreateLaptop(laptop)
-	laptopClient.UploadImage(laptop.GetId(), imagePath)
+	_, err := laptopClient.UploadImage(laptop.GetId(), imagePath)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func testRateLaptop(laptopClient *client.LaptopClient) {
@@ -74,12 +78,11 @@ func testRateLaptop(laptopClient *client.LaptopClient) {
 
 const (
 	// change username to user1 to test persion denied
-	username        = "admin1"
-	password        = "secret"
-	refreshDuration = 30 * time.Second
-	caCertFile      = "cert/ca-cert.pem"
-	certFile        = "cert/client-cert.pem"
-	keyFile         = "cert/client-key.pem"
+	username   = "admin1"
+	password   = "secret"
+	caCertFile = "cert/ca-cert.pem"
+	certFile   = "cert/client-cert.pem"
+	keyFile    = "cert/client-key.pem"
 )
 
 func loadTLSCredentials() (credentials.TransportCredentials, error) {
@@ -113,6 +116,7 @@ func main() {
 
 	serverAddress := flag.String("address", "", "the server address")
 	enableTLS := flag.Bool("tls", false, "enable TLS for RPC")
+	apiKey := flag.String("api-key", os.Getenv("PCBOOK_API_KEY"), "the API key to authenticate with instead of logging in")
 	flag.Parse()
 	log.Printf("dial server %s TLS = %t", *serverAddress, *enableTLS)
 
@@ -125,6 +129,16 @@ func main() {
 		transportOption = grpc.WithTransportCredentials(tlsCredentials)
 	}
 
+	// machine clients send their API key with every call
+	if *apiKey != "" {
+		conn, err := grpc.Dial(*serverAddress, transportOption, grpc.WithPerRPCCredentials(client.NewAPIKeyCredentials(*apiKey, *enableTLS)))
+		if err != nil {
+			log.Fatalf("cannot dial server: %v", err)
+		}
+		testRateLaptop(client.NewLaptopClient(conn))
+		return
+	}
+
 	// create a new gRPC client
 	conn, err := grpc.Dial(*serverAddress, transportOption)
 	if err != nil {
@@ -134,7 +148,10 @@ func main() {
 	authMethods := client.NewAuthMethods()
 	authClient := client.NewAuthClient(conn, username, password)
 
-	interceptor, err := client.NewAuthInterceptor(authClient, authMethods, refreshDuration)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interceptor, err := client.NewAuthInterceptor(ctx, authClient, authMethods)
 	if err != nil {
 		log.Fatalf("cannot create auth interceptor: %v", err)
 	}
@@ -12,42 +12,70 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 )
 
-func sendUsers(userStore service.UserStore) error {
-	// create 2 users
-	err := createUser(userStore, "admin1", "secret", "admin")
+func sendUsers(userStore service.UserStore, mfaRequiredRoles []string) error {
+	// create 3 users
+	err := createUser(userStore, "admin1", "secret", "admin", "", mfaRequiredRoles)
 	if err != nil {
 		return err
 	}
-	return createUser(userStore, "user1", "secret", "user")
+	err = createUser(userStore, "seller1", "secret", "seller", "acme", mfaRequiredRoles)
+	if err != nil {
+		return err
+	}
+	return createUser(userStore, "user1", "secret", "user", "", mfaRequiredRoles)
 }
 
-func createUser(userStore service.UserStore, username, password, role string) error {
+func createUser(userStore service.UserStore, username, password, role, team string, mfaRequiredRoles []string) error {
 	user, err := service.NewUser(username, password, role)
 	if err != nil {
 		return err
 	}
+	user.Team = team
+
+	for _, mfaRequiredRole := range mfaRequiredRoles {
+		if mfaRequiredRole != role {
+			continue
+		}
+		// the user cannot log in to enroll, so it is enrolled with a secret to add to an authenticator app
+		user.TOTPSecret, err = service.NewTOTPSecret()
+		if err != nil {
+			return err
+		}
+		log.Printf("seeded user %s requires two-factor authentication: %s", username, service.TOTPURI(username, user.TOTPSecret))
+	}
 
 	return userStore.Save(user)
 }
 
 const (
-	secretKey     = "longjohnsilver"
-	tokenDuration = 15 * time.Minute
-	certFile      = "cert/server-cert.pem"
-	keyFile       = "cert/server-key.pem"
-	caCertFile    = "cert/ca-cert.pem"
+	secretKey          = "longjohnsilver"
+	tokenDuration      = 15 * time.Minute
+	refreshTokenTTL    = 7 * 24 * time.Hour
+	loginChallengeTTL  = 5 * time.Minute
+	uploadSessionTTL   = 10 * time.Minute
+	variantWorkers     = 4
+	variantQueueSize   = 100
+	imageGCGracePeriod = time.Hour
+	certFile           = "cert/server-cert.pem"
+	keyFile            = "cert/server-key.pem"
+	caCertFile         = "cert/ca-cert.pem"
 )
 
-func loadTLSCredentials() (credentials.TransportCredentials, error) {
+func loadTLSCredentials(clientAuth tls.ClientAuthType) (credentials.TransportCredentials, error) {
 	// load CA certificate
 	pemClientCA, err := ioutil.ReadFile(caCertFile)
 	if err != nil {
@@ -69,7 +97,7 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 	// create credentials and return it
 	config := &tls.Config{
 		Certificates: []tls.Certificate{serverCert},
-		ClientAuth:   tls.NoClientCert,
+		ClientAuth:   clientAuth,
 		ClientCAs:    certPool,
 	}
 	return credentials.NewTLS(config), nil
@@ -78,17 +106,24 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 func runGRPCServer(
 	authServer pb.AuthServiceServer,
 	laptopServer pb.LaptopServiceServer,
-	jwtManager *service.JWTManager,
+	reviewServer pb.ReviewServiceServer,
+	auditServer pb.AuditServiceServer,
+	forwardedPeerInterceptor *service.ForwardedPeerInterceptor,
+	authInterceptor *service.AuthInterceptor,
+	auditInterceptor *service.AuditInterceptor,
+	policyFile string,
 	enableTLS bool,
+	clientAuth tls.ClientAuthType,
 	listener net.Listener,
 ) error {
-	authInterceptor := service.NewAuthInterceptor(jwtManager, service.NewAccessibleRoles())
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(authInterceptor.Unary()),
-		grpc.StreamInterceptor(authInterceptor.Stream()),
+		// the client address of the gateway requests is restored first, then the audit interceptor runs
+		// to also record the calls that the auth interceptor denies
+		grpc.ChainUnaryInterceptor(forwardedPeerInterceptor.Unary(), auditInterceptor.Unary(), authInterceptor.Unary()),
+		grpc.ChainStreamInterceptor(forwardedPeerInterceptor.Stream(), auditInterceptor.Stream(), authInterceptor.Stream()),
 	}
 	if enableTLS {
-		tlsCredentials, err := loadTLSCredentials()
+		tlsCredentials, err := loadTLSCredentials(clientAuth)
 		if err != nil {
 			log.Fatal("cannot load TLS credentials: ", err)
 		}
@@ -99,21 +134,146 @@ func runGRPCServer(
 
 	pb.RegisterAuthServiceServer(grpcServer, authServer)
 	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	pb.RegisterReviewServiceServer(grpcServer, reviewServer)
+	pb.RegisterAuditServiceServer(grpcServer, auditServer)
 	reflection.Register(grpcServer)
 
+	err := authInterceptor.Policy().CheckCoverage(grpcServer)
+	if err != nil {
+		return err
+	}
+	if policyFile != "" {
+		go reloadPolicyOnSignal(policyFile, authInterceptor, grpcServer)
+	}
+
+	go stopOnSignal(grpcServer.GracefulStop)
+
 	log.Printf("start GRPC server on port %s TLS = %t ", listener.Addr().String(), enableTLS)
 	return grpcServer.Serve(listener)
 }
 
+// stopOnSignal calls stop at the first SIGINT or SIGTERM, so that the server returns
+// and the deferred cleanups of main run, e.g. the queued image variants are generated.
+func stopOnSignal(stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Printf("received %v, stopping server", sig)
+	stop()
+}
+
+// reloadPolicyOnSignal reloads the policy file on SIGHUP. The current policy is kept
+// if the new one is invalid or does not cover every method of the server.
+func reloadPolicyOnSignal(policyFile string, authInterceptor *service.AuthInterceptor, grpcServer *grpc.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		policy, err := service.LoadPolicy(policyFile)
+		if err == nil {
+			err = policy.CheckCoverage(grpcServer)
+		}
+		if err != nil {
+			log.Printf("cannot reload policy: %v", err)
+			continue
+		}
+
+		authInterceptor.SetPolicy(policy)
+		log.Printf("reloaded policy file %s", policyFile)
+	}
+}
+
+// newClientAuth returns how the TLS server verifies client certificates. Callers can use
+// a certificate instead of a token if there is an identity table, so it is verified if given.
+func newClientAuth(requireClientCert bool, certIdentities *service.CertIdentityTable) tls.ClientAuthType {
+	if requireClientCert {
+		return tls.RequireAndVerifyClientCert
+	}
+	if certIdentities != nil {
+		return tls.VerifyClientCertIfGiven
+	}
+	return tls.NoClientCert
+}
+
+func newCertIdentityTable(certIdentityFile string) (*service.CertIdentityTable, error) {
+	if certIdentityFile == "" {
+		return nil, nil
+	}
+	return service.LoadCertIdentityTable(certIdentityFile)
+}
+
+func newOIDCVerifier(oidcConfigFile string) (*service.OIDCVerifier, error) {
+	if oidcConfigFile == "" {
+		return nil, nil
+	}
+
+	config, err := service.LoadOIDCConfig(oidcConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	return service.NewOIDCVerifier(*config, nil), nil
+}
+
+func newLDAPUserStore(ldapConfigFile string, local service.UserStore, mfaRequiredRoles []string) (*service.LDAPUserStore, error) {
+	if ldapConfigFile == "" {
+		return nil, nil
+	}
+
+	config, err := service.LoadLDAPConfig(ldapConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// the directory users cannot log in before they enroll, so they could never enroll
+	roles := []string{config.DefaultRole}
+	for _, groupRole := range config.GroupRoles {
+		roles = append(roles, groupRole.Role)
+	}
+	for _, role := range roles {
+		for _, mfaRequiredRole := range mfaRequiredRoles {
+			if role == mfaRequiredRole {
+				return nil, fmt.Errorf("ldap users cannot have role %s, which requires two-factor authentication", role)
+			}
+		}
+	}
+	return service.NewLDAPUserStore(*config, local), nil
+}
+
+func newPasswordPolicy(passwordPolicyFile string) (*service.PasswordPolicy, error) {
+	if passwordPolicyFile == "" {
+		return service.DefaultPasswordPolicy(), nil
+	}
+	return service.LoadPasswordPolicy(passwordPolicyFile)
+}
+
+func newPolicy(policyFile string) (*service.Policy, error) {
+	if policyFile == "" {
+		return service.NewDefaultPolicy(), nil
+	}
+	return service.LoadPolicy(policyFile)
+}
+
 func runRESTServer(
 	authServer pb.AuthServiceServer,
 	laptopServer pb.LaptopServiceServer,
+	reviewServer pb.ReviewServiceServer,
 	jwtManager *service.JWTManager,
 	enableTLS bool,
 	listener net.Listener,
 	grpcEndpoint string,
+	gatewaySecret string,
 ) error {
-	mux := runtime.NewServeMux()
+	mux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(matchIncomingHeader),
+		// the secret proves to the gRPC server that the x-forwarded-for header comes from the gateway
+		runtime.WithMetadata(func(ctx context.Context, r *http.Request) metadata.MD {
+			if gatewaySecret == "" {
+				return nil
+			}
+			return metadata.Pairs(service.GatewaySecretHeader, gatewaySecret)
+		}),
+	)
 	dialOptions := []grpc.DialOption{grpc.WithInsecure()}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -128,11 +288,120 @@ func runRESTServer(
 	if err != nil {
 		return err
 	}
+	err = pb.RegisterReviewServiceHandlerFromEndpoint(ctx, mux, grpcEndpoint, dialOptions)
+	if err != nil {
+		return err
+	}
+	err = pb.RegisterAuditServiceHandlerFromEndpoint(ctx, mux, grpcEndpoint, dialOptions)
+	if err != nil {
+		return err
+	}
+
+	conn, err := grpc.DialContext(ctx, grpcEndpoint, dialOptions...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = service.RegisterMultipartUploadHandler(mux, pb.NewLaptopServiceClient(conn))
+	if err != nil {
+		return err
+	}
+	err = service.RegisterJWKSHandler(mux, jwtManager)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: mux}
+	stopped := make(chan struct{})
+	go stopOnSignal(func() {
+		// Shutdown waits for the requests in progress, after Serve returned
+		err := server.Shutdown(context.Background())
+		if err != nil {
+			log.Printf("cannot shut down REST server: %v", err)
+		}
+		close(stopped)
+	})
+
 	log.Printf("start REST server on port %s TLS = %t ", listener.Addr().String(), enableTLS)
 	if enableTLS {
-		return http.ServeTLS(listener, mux, certFile, keyFile)
+		err = server.ServeTLS(listener, certFile, keyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err == http.ErrServerClosed {
+		<-stopped
+		return nil
+	}
+	return err
+}
+
+// matchIncomingHeader forwards the API key header of REST requests to the gRPC server,
+// in addition to the headers forwarded by default, except the ones that only the gateway sets.
+func matchIncomingHeader(key string) (string, bool) {
+	if strings.EqualFold(key, "x-api-key") {
+		return "x-api-key", true
+	}
+	name, ok := runtime.DefaultHeaderMatcher(key)
+	if strings.EqualFold(name, service.GatewaySecretHeader) || strings.EqualFold(name, "x-forwarded-for") {
+		return "", false
+	}
+	return name, ok
+}
+
+func newImageStore(storeType string, imageFolder string, s3Config service.S3Config) (service.ImageStore, error) {
+	switch storeType {
+	case "disk":
+		return service.NewDiskImageStore(imageFolder), nil
+	case "s3":
+		if s3Config.Endpoint == "" || s3Config.Bucket == "" {
+			return nil, fmt.Errorf("s3 image store requires -s3-endpoint and -s3-bucket")
+		}
+		return service.NewS3ImageStore(s3Config), nil
+	default:
+		return nil, fmt.Errorf("unknown image store type: %s", storeType)
+	}
+}
+
+func newAuditLog(auditLogFile string) (*service.FileAuditLog, error) {
+	if auditLogFile == "" {
+		return nil, nil
+	}
+	return service.NewFileAuditLog(auditLogFile)
+}
+
+func newFileRatingStore(ratingFile string, scoreRange service.ScoreRange) (*service.FileRatingStore, error) {
+	if ratingFile == "" {
+		return nil, nil
+	}
+	return service.NewFileRatingStore(ratingFile, scoreRange)
+}
+
+func newJWTManager(keyFile string, previousKeyFiles string, rotationWindow time.Duration) (*service.JWTManager, error) {
+	if keyFile == "" {
+		return service.NewJWTManager(secretKey, tokenDuration), nil
+	}
+
+	key, err := service.LoadSigningKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	jwtManager, err := service.NewJWTManagerWithKey(key, tokenDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	until := time.Now().Add(rotationWindow)
+	for _, filename := range strings.Split(previousKeyFiles, ",") {
+		if filename == "" {
+			continue
+		}
+		previousKey, err := service.LoadSigningKey(filename)
+		if err != nil {
+			return nil, err
+		}
+		jwtManager.AddPreviousKey(previousKey, until)
 	}
-	return http.Serve(listener, mux)
+
+	return jwtManager, nil
 }
 
 func main() {
@@ -140,20 +409,161 @@ func main() {
 	enableTLS := flag.Bool("tls", false, "enable TLS for RPC")
 	serverType := flag.String("type", "grpc", "the server type (grpc or rest)")
 	endPoint := flag.String("endpoint", "", "the server endpoint")
+	imageStoreType := flag.String("image-store", "disk", "the image store type (disk or s3)")
+	imageFolder := flag.String("image-folder", "img", "the folder of the disk image store")
+	s3Endpoint := flag.String("s3-endpoint", "", "the S3-compatible endpoint URL of the s3 image store")
+	s3Region := flag.String("s3-region", "us-east-1", "the region of the s3 image store")
+	s3Bucket := flag.String("s3-bucket", "", "the bucket of the s3 image store")
+	s3AccessKey := flag.String("s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "the access key ID of the s3 image store")
+	s3SecretKey := flag.String("s3-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "the secret access key of the s3 image store")
+	maxImagesPerLaptop := flag.Int("max-images-per-laptop", 0, "the maximum number of images per laptop, enforced by each server (0 is unlimited)")
+	maxImageBytes := flag.Int64("max-image-bytes", 0, "the maximum number of bytes of all images, enforced by each server (0 is unlimited)")
+	imageGCInterval := flag.Duration("image-gc-interval", 10*time.Minute, "the interval of the image garbage collection (0 disables it)")
+	minScore := flag.Float64("min-score", service.DefaultScoreRange.Min, "the minimum accepted laptop score")
+	maxScore := flag.Float64("max-score", service.DefaultScoreRange.Max, "the maximum accepted laptop score")
+	ratingFile := flag.String("rating-file", "", "the journal file of the persistent rating store (empty keeps ratings in memory)")
+	inviteOnly := flag.Bool("invite-only", false, "only allow users to register with an invite code")
+	bannedWordsFile := flag.String("banned-words-file", "", "the file of words, one per line, that flag a review for moderation")
+	jwtKeyFile := flag.String("jwt-key-file", "", "the PEM file of the RSA or P-256 private key that signs tokens (empty signs with HS256)")
+	jwtPreviousKeyFiles := flag.String("jwt-previous-key-files", "", "the comma-separated PEM files of the previous keys that still verify tokens")
+	jwtRotationWindow := flag.Duration("jwt-rotation-window", tokenDuration, "how long the previous keys verify tokens after startup")
+	policyFile := flag.String("policy-file", "", "the YAML or JSON authorization policy file, reloaded on SIGHUP (empty uses the default policy)")
+	requireClientCert := flag.Bool("require-client-cert", false, "require and verify a client certificate signed by the CA with TLS")
+	certIdentityFile := flag.String("cert-identity-file", "", "the YAML or JSON file that maps client certificates to users, who then need no token")
+	oidcConfigFile := flag.String("oidc-config-file", "", "the YAML or JSON file of the OpenID Connect identity provider whose ID tokens ExchangeToken accepts")
+	auditLogFile := flag.String("audit-log-file", "", "the hash-chained JSON lines file of the audit log (empty writes the audit events to the standard logger)")
+	ldapConfigFile := flag.String("ldap-config-file", "", "the YAML or JSON file of the LDAP directory whose users log in with their directory password")
+	passwordPolicyFile := flag.String("password-policy-file", "", "the YAML or JSON file of the password policy, with the lengths, deny list and hash algorithm (empty uses bcrypt with no rules)")
+	mfaRequiredRolesFlag := flag.String("mfa-required-roles", "", "the comma-separated roles that must log in with a TOTP code, e.g. admin")
+	trustedProxiesFlag := flag.String("trusted-proxies", "", "the comma-separated IP addresses or CIDR ranges of the REST gateways whose x-forwarded-for header gives the client address, e.g. 127.0.0.1 (empty trusts no gateway)")
+	gatewaySecret := flag.String("gateway-secret", os.Getenv("GATEWAY_SECRET"), "the secret that the REST gateway sends, and the gRPC server requires, to trust its x-forwarded-for header")
 	flag.Parse()
 
-	userStore := service.NewInMemoryUserStore()
-	jwtManager := service.NewJWTManager(secretKey, tokenDuration)
-	authServer := service.NewAuthServer(userStore, jwtManager)
+	var mfaRequiredRoles []string
+	if *mfaRequiredRolesFlag != "" {
+		mfaRequiredRoles = strings.Split(*mfaRequiredRolesFlag, ",")
+	}
+	localUserStore := service.NewInMemoryUserStore()
+	var userStore service.UserStore = localUserStore
+	var authenticator service.Authenticator
+	ldapUserStore, err := newLDAPUserStore(*ldapConfigFile, localUserStore, mfaRequiredRoles)
+	if err != nil {
+		log.Fatal("cannot create LDAP user store: ", err)
+	}
+	if ldapUserStore != nil {
+		defer ldapUserStore.Close()
+		userStore = ldapUserStore
+		authenticator = ldapUserStore
+	}
+	passwordPolicy, err := newPasswordPolicy(*passwordPolicyFile)
+	if err != nil {
+		log.Fatal("cannot load password policy: ", err)
+	}
+	jwtManager, err := newJWTManager(*jwtKeyFile, *jwtPreviousKeyFiles, *jwtRotationWindow)
+	if err != nil {
+		log.Fatal("cannot create JWT manager: ", err)
+	}
+	revocationList := service.NewInMemoryRevocationList()
+	policy, err := newPolicy(*policyFile)
+	if err != nil {
+		log.Fatal("cannot load policy: ", err)
+	}
+	certIdentities, err := newCertIdentityTable(*certIdentityFile)
+	if err != nil {
+		log.Fatal("cannot load client certificate identities: ", err)
+	}
+	apiKeyStore := service.NewInMemoryAPIKeyStore()
+	oidcVerifier, err := newOIDCVerifier(*oidcConfigFile)
+	if err != nil {
+		log.Fatal("cannot create OIDC verifier: ", err)
+	}
+	auditLog, err := newAuditLog(*auditLogFile)
+	if err != nil {
+		log.Fatal("cannot open audit log: ", err)
+	}
+	var auditSink service.AuditSink = service.NewLogAuditSink()
+	if auditLog != nil {
+		defer auditLog.Close()
+		auditSink = auditLog
+	}
+	trustedProxies, err := service.ParseTrustedProxies(*trustedProxiesFlag)
+	if err != nil {
+		log.Fatal("cannot parse trusted proxies: ", err)
+	}
+	if len(trustedProxies) > 0 && *gatewaySecret == "" {
+		log.Fatal("trusted proxies require a gateway secret")
+	}
+	forwardedPeerInterceptor := service.NewForwardedPeerInterceptor(trustedProxies, *gatewaySecret)
+	auditInterceptor := service.NewAuditInterceptor(auditSink)
+	authInterceptor := service.NewAuthInterceptor(jwtManager, revocationList, apiKeyStore, certIdentities, policy)
+	authServer := service.NewAuthServer(
+		userStore,
+		service.NewInMemoryInviteStore(),
+		service.NewInMemoryRefreshTokenStore(refreshTokenTTL),
+		revocationList,
+		apiKeyStore,
+		service.NewInMemoryLoginChallengeStore(loginChallengeTTL),
+		service.NewLoginThrottle(service.DefaultUserLockoutPolicy, service.DefaultIPLockoutPolicy, auditSink),
+		oidcVerifier,
+		authenticator,
+		passwordPolicy,
+		jwtManager,
+		mfaRequiredRoles,
+		*inviteOnly,
+	)
 
 	laptopStore := service.NewInMemoryLaptopStore()
-	imageStore := service.NewDiskImageStore("img")
-	ratingStore := service.NewInMemoryRatingStore()
-	err := sendUsers(userStore)
+	imageStore, err := newImageStore(*imageStoreType, *imageFolder, service.S3Config{
+		Endpoint:        *s3Endpoint,
+		Region:          *s3Region,
+		Bucket:          *s3Bucket,
+		AccessKeyID:     *s3AccessKey,
+		SecretAccessKey: *s3SecretKey,
+	})
+	if err != nil {
+		log.Fatal("cannot create image store: ", err)
+	}
+	scoreRange := service.ScoreRange{Min: *minScore, Max: *maxScore}
+	err = scoreRange.ValidateRange()
+	if err != nil {
+		log.Fatal("invalid score range: ", err)
+	}
+	fileRatingStore, err := newFileRatingStore(*ratingFile, scoreRange)
+	if err != nil {
+		log.Fatal("cannot create rating store: ", err)
+	}
+	var ratingStore service.RatingStore = service.NewInMemoryRatingStore(scoreRange)
+	if fileRatingStore != nil {
+		defer fileRatingStore.Close()
+		ratingStore = fileRatingStore
+	}
+	uploadStore := service.NewInMemoryUploadSessionStore(uploadSessionTTL)
+	variantGenerator := service.NewImageVariantGenerator(imageStore, variantWorkers, variantQueueSize)
+	defer variantGenerator.Close()
+	// the seeded users are local, and can log in when the directory is down
+	err = sendUsers(localUserStore, mfaRequiredRoles)
 	if err != nil {
 		log.Fatal(err)
 	}
-	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
+	imageQuota := service.ImageQuota{
+		MaxImagesPerLaptop: *maxImagesPerLaptop,
+		MaxTotalBytes:      *maxImageBytes,
+	}
+	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore, uploadStore, variantGenerator, imageQuota, service.NewOwnershipAuthorizer())
+	var wordFilter *service.BannedWordFilter
+	if *bannedWordsFile != "" {
+		wordFilter, err = service.LoadBannedWordFilter(*bannedWordsFile)
+		if err != nil {
+			log.Fatal("cannot load banned words: ", err)
+		}
+	}
+	reviewServer := service.NewReviewServer(service.NewInMemoryReviewStore(), laptopStore, ratingStore, wordFilter)
+
+	if *imageGCInterval > 0 {
+		imageGC := service.NewImageGarbageCollector(imageStore, laptopStore, imageGCGracePeriod)
+		imageGC.Start(*imageGCInterval)
+		defer imageGC.Stop()
+	}
 
 	address := fmt.Sprintf("localhost:%d", *port)
 	listener, err := net.Listen("tcp", address)
@@ -162,9 +572,9 @@ func main() {
 	}
 
 	if *serverType == "grpc" {
-		err = runGRPCServer(authServer, laptopServer, jwtManager, *enableTLS, listener)
+		err = runGRPCServer(authServer, laptopServer, reviewServer, service.NewAuditServer(auditLog), forwardedPeerInterceptor, authInterceptor, auditInterceptor, *policyFile, *enableTLS, newClientAuth(*requireClientCert, certIdentities), listener)
 	} else {
-		err = runRESTServer(authServer, laptopServer, jwtManager, *enableTLS, listener, *endPoint)
+		err = runRESTServer(authServer, laptopServer, reviewServer, jwtManager, *enableTLS, listener, *endPoint, *gatewaySecret)
 	}
 	if err != nil {
 		log.Fatal("cannot start server.", err)
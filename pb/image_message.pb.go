@@ -0,0 +1,418 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.1
+// 	protoc        v3.21.6
+// source: image_message.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Image_Variant int32
+
+const (
+	Image_UNSPECIFIED   Image_Variant = 0
+	Image_ORIGINAL      Image_Variant = 1
+	Image_THUMBNAIL_128 Image_Variant = 2
+	Image_PREVIEW_512   Image_Variant = 3
+)
+
+// Enum value maps for Image_Variant.
+var (
+	Image_Variant_name = map[int32]string{
+		0: "UNSPECIFIED",
+		1: "ORIGINAL",
+		2: "THUMBNAIL_128",
+		3: "PREVIEW_512",
+	}
+	Image_Variant_value = map[string]int32{
+		"UNSPECIFIED":   0,
+		"ORIGINAL":      1,
+		"THUMBNAIL_128": 2,
+		"PREVIEW_512":   3,
+	}
+)
+
+func (x Image_Variant) Enum() *Image_Variant {
+	p := new(Image_Variant)
+	*p = x
+	return p
+}
+
+func (x Image_Variant) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Image_Variant) Descriptor() protoreflect.EnumDescriptor {
+	return file_image_message_proto_enumTypes[0].Descriptor()
+}
+
+func (Image_Variant) Type() protoreflect.EnumType {
+	return &file_image_message_proto_enumTypes[0]
+}
+
+func (x Image_Variant) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Image_Variant.Descriptor instead.
+func (Image_Variant) EnumDescriptor() ([]byte, []int) {
+	return file_image_message_proto_rawDescGZIP(), []int{0, 0}
+}
+
+type Image_VariantInfo_State int32
+
+const (
+	Image_VariantInfo_UNKNOWN Image_VariantInfo_State = 0
+	Image_VariantInfo_PENDING Image_VariantInfo_State = 1
+	Image_VariantInfo_READY   Image_VariantInfo_State = 2
+	Image_VariantInfo_FAILED  Image_VariantInfo_State = 3
+)
+
+// Enum value maps for Image_VariantInfo_State.
+var (
+	Image_VariantInfo_State_name = map[int32]string{
+		0: "UNKNOWN",
+		1: "PENDING",
+		2: "READY",
+		3: "FAILED",
+	}
+	Image_VariantInfo_State_value = map[string]int32{
+		"UNKNOWN": 0,
+		"PENDING": 1,
+		"READY":   2,
+		"FAILED":  3,
+	}
+)
+
+func (x Image_VariantInfo_State) Enum() *Image_VariantInfo_State {
+	p := new(Image_VariantInfo_State)
+	*p = x
+	return p
+}
+
+func (x Image_VariantInfo_State) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Image_VariantInfo_State) Descriptor() protoreflect.EnumDescriptor {
+	return file_image_message_proto_enumTypes[1].Descriptor()
+}
+
+func (Image_VariantInfo_State) Type() protoreflect.EnumType {
+	return &file_image_message_proto_enumTypes[1]
+}
+
+func (x Image_VariantInfo_State) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Image_VariantInfo_State.Descriptor instead.
+func (Image_VariantInfo_State) EnumDescriptor() ([]byte, []int) {
+	return file_image_message_proto_rawDescGZIP(), []int{0, 0, 0}
+}
+
+type Image struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id        string               `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	LaptopId  string               `protobuf:"bytes,2,opt,name=laptop_id,json=laptopId,proto3" json:"laptop_id,omitempty"`
+	ImageType string               `protobuf:"bytes,3,opt,name=image_type,json=imageType,proto3" json:"image_type,omitempty"`
+	Size      uint64               `protobuf:"varint,4,opt,name=size,proto3" json:"size,omitempty"`
+	Variants  []*Image_VariantInfo `protobuf:"bytes,5,rep,name=variants,proto3" json:"variants,omitempty"`
+}
+
+func (x *Image) Reset() {
+	*x = Image{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_image_message_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Image) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Image) ProtoMessage() {}
+
+func (x *Image) ProtoReflect() protoreflect.Message {
+	mi := &file_image_message_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Image.ProtoReflect.Descriptor instead.
+func (*Image) Descriptor() ([]byte, []int) {
+	return file_image_message_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Image) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Image) GetLaptopId() string {
+	if x != nil {
+		return x.LaptopId
+	}
+	return ""
+}
+
+func (x *Image) GetImageType() string {
+	if x != nil {
+		return x.ImageType
+	}
+	return ""
+}
+
+func (x *Image) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *Image) GetVariants() []*Image_VariantInfo {
+	if x != nil {
+		return x.Variants
+	}
+	return nil
+}
+
+type Image_VariantInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Variant Image_Variant           `protobuf:"varint,1,opt,name=variant,proto3,enum=techschool.pcbook.Image_Variant" json:"variant,omitempty"`
+	State   Image_VariantInfo_State `protobuf:"varint,2,opt,name=state,proto3,enum=techschool.pcbook.Image_VariantInfo_State" json:"state,omitempty"`
+	Width   uint32                  `protobuf:"varint,3,opt,name=width,proto3" json:"width,omitempty"`
+	Height  uint32                  `protobuf:"varint,4,opt,name=height,proto3" json:"height,omitempty"`
+	Size    uint64                  `protobuf:"varint,5,opt,name=size,proto3" json:"size,omitempty"`
+	Error   string                  `protobuf:"bytes,6,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *Image_VariantInfo) Reset() {
+	*x = Image_VariantInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_image_message_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Image_VariantInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Image_VariantInfo) ProtoMessage() {}
+
+func (x *Image_VariantInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_image_message_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Image_VariantInfo.ProtoReflect.Descriptor instead.
+func (*Image_VariantInfo) Descriptor() ([]byte, []int) {
+	return file_image_message_proto_rawDescGZIP(), []int{0, 0}
+}
+
+func (x *Image_VariantInfo) GetVariant() Image_Variant {
+	if x != nil {
+		return x.Variant
+	}
+	return Image_UNSPECIFIED
+}
+
+func (x *Image_VariantInfo) GetState() Image_VariantInfo_State {
+	if x != nil {
+		return x.State
+	}
+	return Image_VariantInfo_UNKNOWN
+}
+
+func (x *Image_VariantInfo) GetWidth() uint32 {
+	if x != nil {
+		return x.Width
+	}
+	return 0
+}
+
+func (x *Image_VariantInfo) GetHeight() uint32 {
+	if x != nil {
+		return x.Height
+	}
+	return 0
+}
+
+func (x *Image_VariantInfo) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *Image_VariantInfo) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+var File_image_message_proto protoreflect.FileDescriptor
+
+var file_image_message_proto_rawDesc = []byte{
+	0x0a, 0x13, 0x69, 0x6d, 0x61, 0x67, 0x65, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x11, 0x74, 0x65, 0x63, 0x68, 0x73, 0x63, 0x68, 0x6f, 0x6f,
+	0x6c, 0x2e, 0x70, 0x63, 0x62, 0x6f, 0x6f, 0x6b, 0x22, 0x97, 0x04, 0x0a, 0x05, 0x49, 0x6d, 0x61,
+	0x67, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02,
+	0x69, 0x64, 0x12, 0x1b, 0x0a, 0x09, 0x6c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x5f, 0x69, 0x64, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x6c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x49, 0x64, 0x12,
+	0x1d, 0x0a, 0x0a, 0x69, 0x6d, 0x61, 0x67, 0x65, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x09, 0x69, 0x6d, 0x61, 0x67, 0x65, 0x54, 0x79, 0x70, 0x65, 0x12, 0x12,
+	0x0a, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x73, 0x69,
+	0x7a, 0x65, 0x12, 0x40, 0x0a, 0x08, 0x76, 0x61, 0x72, 0x69, 0x61, 0x6e, 0x74, 0x73, 0x18, 0x05,
+	0x20, 0x03, 0x28, 0x0b, 0x32, 0x24, 0x2e, 0x74, 0x65, 0x63, 0x68, 0x73, 0x63, 0x68, 0x6f, 0x6f,
+	0x6c, 0x2e, 0x70, 0x63, 0x62, 0x6f, 0x6f, 0x6b, 0x2e, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x2e, 0x56,
+	0x61, 0x72, 0x69, 0x61, 0x6e, 0x74, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x08, 0x76, 0x61, 0x72, 0x69,
+	0x61, 0x6e, 0x74, 0x73, 0x1a, 0x9d, 0x02, 0x0a, 0x0b, 0x56, 0x61, 0x72, 0x69, 0x61, 0x6e, 0x74,
+	0x49, 0x6e, 0x66, 0x6f, 0x12, 0x3a, 0x0a, 0x07, 0x76, 0x61, 0x72, 0x69, 0x61, 0x6e, 0x74, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x20, 0x2e, 0x74, 0x65, 0x63, 0x68, 0x73, 0x63, 0x68, 0x6f,
+	0x6f, 0x6c, 0x2e, 0x70, 0x63, 0x62, 0x6f, 0x6f, 0x6b, 0x2e, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x2e,
+	0x56, 0x61, 0x72, 0x69, 0x61, 0x6e, 0x74, 0x52, 0x07, 0x76, 0x61, 0x72, 0x69, 0x61, 0x6e, 0x74,
+	0x12, 0x40, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x74, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32,
+	0x2a, 0x2e, 0x74, 0x65, 0x63, 0x68, 0x73, 0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x2e, 0x70, 0x63, 0x62,
+	0x6f, 0x6f, 0x6b, 0x2e, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x2e, 0x56, 0x61, 0x72, 0x69, 0x61, 0x6e,
+	0x74, 0x49, 0x6e, 0x66, 0x6f, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x65, 0x52, 0x05, 0x73, 0x74, 0x61,
+	0x74, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x77, 0x69, 0x64, 0x74, 0x68, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x0d, 0x52, 0x05, 0x77, 0x69, 0x64, 0x74, 0x68, 0x12, 0x16, 0x0a, 0x06, 0x68, 0x65, 0x69, 0x67,
+	0x68, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x68, 0x65, 0x69, 0x67, 0x68, 0x74,
+	0x12, 0x12, 0x0a, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04,
+	0x73, 0x69, 0x7a, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x06, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x22, 0x38, 0x0a, 0x05, 0x53, 0x74,
+	0x61, 0x74, 0x65, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x10, 0x00,
+	0x12, 0x0b, 0x0a, 0x07, 0x50, 0x45, 0x4e, 0x44, 0x49, 0x4e, 0x47, 0x10, 0x01, 0x12, 0x09, 0x0a,
+	0x05, 0x52, 0x45, 0x41, 0x44, 0x59, 0x10, 0x02, 0x12, 0x0a, 0x0a, 0x06, 0x46, 0x41, 0x49, 0x4c,
+	0x45, 0x44, 0x10, 0x03, 0x22, 0x4c, 0x0a, 0x07, 0x56, 0x61, 0x72, 0x69, 0x61, 0x6e, 0x74, 0x12,
+	0x0f, 0x0a, 0x0b, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00,
+	0x12, 0x0c, 0x0a, 0x08, 0x4f, 0x52, 0x49, 0x47, 0x49, 0x4e, 0x41, 0x4c, 0x10, 0x01, 0x12, 0x11,
+	0x0a, 0x0d, 0x54, 0x48, 0x55, 0x4d, 0x42, 0x4e, 0x41, 0x49, 0x4c, 0x5f, 0x31, 0x32, 0x38, 0x10,
+	0x02, 0x12, 0x0f, 0x0a, 0x0b, 0x50, 0x52, 0x45, 0x56, 0x49, 0x45, 0x57, 0x5f, 0x35, 0x31, 0x32,
+	0x10, 0x03, 0x42, 0x22, 0x0a, 0x18, 0x63, 0x6f, 0x6d, 0x2e, 0x74, 0x65, 0x63, 0x68, 0x73, 0x63,
+	0x68, 0x6f, 0x6f, 0x6c, 0x2e, 0x70, 0x63, 0x62, 0x6f, 0x6f, 0x6b, 0x2e, 0x70, 0x62, 0x50, 0x01,
+	0x5a, 0x04, 0x2e, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_image_message_proto_rawDescOnce sync.Once
+	file_image_message_proto_rawDescData = file_image_message_proto_rawDesc
+)
+
+func file_image_message_proto_rawDescGZIP() []byte {
+	file_image_message_proto_rawDescOnce.Do(func() {
+		file_image_message_proto_rawDescData = protoimpl.X.CompressGZIP(file_image_message_proto_rawDescData)
+	})
+	return file_image_message_proto_rawDescData
+}
+
+var file_image_message_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_image_message_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_image_message_proto_goTypes = []interface{}{
+	(Image_Variant)(0),           // 0: techschool.pcbook.Image.Variant
+	(Image_VariantInfo_State)(0), // 1: techschool.pcbook.Image.VariantInfo.State
+	(*Image)(nil),                // 2: techschool.pcbook.Image
+	(*Image_VariantInfo)(nil),    // 3: techschool.pcbook.Image.VariantInfo
+}
+var file_image_message_proto_depIdxs = []int32{
+	3, // 0: techschool.pcbook.Image.variants:type_name -> techschool.pcbook.Image.VariantInfo
+	0, // 1: techschool.pcbook.Image.VariantInfo.variant:type_name -> techschool.pcbook.Image.Variant
+	1, // 2: techschool.pcbook.Image.VariantInfo.state:type_name -> techschool.pcbook.Image.VariantInfo.State
+	3, // [3:3] is the sub-list for method output_type
+	3, // [3:3] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_image_message_proto_init() }
+func file_image_message_proto_init() {
+	if File_image_message_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_image_message_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Image); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_image_message_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Image_VariantInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_image_message_proto_rawDesc,
+			NumEnums:      2,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_image_message_proto_goTypes,
+		DependencyIndexes: file_image_message_proto_depIdxs,
+		EnumInfos:         file_image_message_proto_enumTypes,
+		MessageInfos:      file_image_message_proto_msgTypes,
+	}.Build()
+	File_image_message_proto = out.File
+	file_image_message_proto_rawDesc = nil
+	file_image_message_proto_goTypes = nil
+	file_image_message_proto_depIdxs = nil
+}
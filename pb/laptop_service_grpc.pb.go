@@ -24,8 +24,21 @@ const _ = grpc.SupportPackageIsVersion7
 type LaptopServiceClient interface {
 	CreateLaptop(ctx context.Context, in *CreateLaptopRequest, opts ...grpc.CallOption) (*CreateLaptopResponse, error)
 	SearchLaptop(ctx context.Context, in *SearchLaptopRequest, opts ...grpc.CallOption) (LaptopService_SearchLaptopClient, error)
+	// UploadImage is served over REST by a custom multipart/form-data handler
+	// on POST /v1/laptop/upload_image, as a JSON body cannot carry a stream.
 	UploadImage(ctx context.Context, opts ...grpc.CallOption) (LaptopService_UploadImageClient, error)
+	StartImageUpload(ctx context.Context, in *StartImageUploadRequest, opts ...grpc.CallOption) (*StartImageUploadResponse, error)
+	UploadImageChunk(ctx context.Context, in *UploadImageChunkRequest, opts ...grpc.CallOption) (*UploadImageChunkResponse, error)
+	GetImageUploadStatus(ctx context.Context, in *GetImageUploadStatusRequest, opts ...grpc.CallOption) (*GetImageUploadStatusResponse, error)
+	FinishImageUpload(ctx context.Context, in *FinishImageUploadRequest, opts ...grpc.CallOption) (*UploadImageResponse, error)
+	ListLaptopImages(ctx context.Context, in *ListLaptopImagesRequest, opts ...grpc.CallOption) (*ListLaptopImagesResponse, error)
+	DownloadImage(ctx context.Context, in *DownloadImageRequest, opts ...grpc.CallOption) (LaptopService_DownloadImageClient, error)
+	GetImageUsage(ctx context.Context, in *GetImageUsageRequest, opts ...grpc.CallOption) (*GetImageUsageResponse, error)
 	RateLaptop(ctx context.Context, opts ...grpc.CallOption) (LaptopService_RateLaptopClient, error)
+	GetLaptopRating(ctx context.Context, in *GetLaptopRatingRequest, opts ...grpc.CallOption) (*GetLaptopRatingResponse, error)
+	BatchGetLaptopRatings(ctx context.Context, in *BatchGetLaptopRatingsRequest, opts ...grpc.CallOption) (*BatchGetLaptopRatingsResponse, error)
+	ListTopRatedLaptops(ctx context.Context, in *ListTopRatedLaptopsRequest, opts ...grpc.CallOption) (*ListTopRatedLaptopsResponse, error)
+	ListTrendingLaptops(ctx context.Context, in *ListTrendingLaptopsRequest, opts ...grpc.CallOption) (*ListTrendingLaptopsResponse, error)
 }
 
 type laptopServiceClient struct {
@@ -111,8 +124,94 @@ func (x *laptopServiceUploadImageClient) CloseAndRecv() (*UploadImageResponse, e
 	return m, nil
 }
 
+func (c *laptopServiceClient) StartImageUpload(ctx context.Context, in *StartImageUploadRequest, opts ...grpc.CallOption) (*StartImageUploadResponse, error) {
+	out := new(StartImageUploadResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/StartImageUpload", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) UploadImageChunk(ctx context.Context, in *UploadImageChunkRequest, opts ...grpc.CallOption) (*UploadImageChunkResponse, error) {
+	out := new(UploadImageChunkResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/UploadImageChunk", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) GetImageUploadStatus(ctx context.Context, in *GetImageUploadStatusRequest, opts ...grpc.CallOption) (*GetImageUploadStatusResponse, error) {
+	out := new(GetImageUploadStatusResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/GetImageUploadStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) FinishImageUpload(ctx context.Context, in *FinishImageUploadRequest, opts ...grpc.CallOption) (*UploadImageResponse, error) {
+	out := new(UploadImageResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/FinishImageUpload", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) ListLaptopImages(ctx context.Context, in *ListLaptopImagesRequest, opts ...grpc.CallOption) (*ListLaptopImagesResponse, error) {
+	out := new(ListLaptopImagesResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/ListLaptopImages", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) DownloadImage(ctx context.Context, in *DownloadImageRequest, opts ...grpc.CallOption) (LaptopService_DownloadImageClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LaptopService_ServiceDesc.Streams[2], "/techschool.pcbook.LaptopService/DownloadImage", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &laptopServiceDownloadImageClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LaptopService_DownloadImageClient interface {
+	Recv() (*DownloadImageResponse, error)
+	grpc.ClientStream
+}
+
+type laptopServiceDownloadImageClient struct {
+	grpc.ClientStream
+}
+
+func (x *laptopServiceDownloadImageClient) Recv() (*DownloadImageResponse, error) {
+	m := new(DownloadImageResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *laptopServiceClient) GetImageUsage(ctx context.Context, in *GetImageUsageRequest, opts ...grpc.CallOption) (*GetImageUsageResponse, error) {
+	out := new(GetImageUsageResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/GetImageUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *laptopServiceClient) RateLaptop(ctx context.Context, opts ...grpc.CallOption) (LaptopService_RateLaptopClient, error) {
-	stream, err := c.cc.NewStream(ctx, &LaptopService_ServiceDesc.Streams[2], "/techschool.pcbook.LaptopService/RateLaptop", opts...)
+	stream, err := c.cc.NewStream(ctx, &LaptopService_ServiceDesc.Streams[3], "/techschool.pcbook.LaptopService/RateLaptop", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -142,14 +241,63 @@ func (x *laptopServiceRateLaptopClient) Recv() (*RateLaptopResponse, error) {
 	return m, nil
 }
 
+func (c *laptopServiceClient) GetLaptopRating(ctx context.Context, in *GetLaptopRatingRequest, opts ...grpc.CallOption) (*GetLaptopRatingResponse, error) {
+	out := new(GetLaptopRatingResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/GetLaptopRating", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) BatchGetLaptopRatings(ctx context.Context, in *BatchGetLaptopRatingsRequest, opts ...grpc.CallOption) (*BatchGetLaptopRatingsResponse, error) {
+	out := new(BatchGetLaptopRatingsResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/BatchGetLaptopRatings", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) ListTopRatedLaptops(ctx context.Context, in *ListTopRatedLaptopsRequest, opts ...grpc.CallOption) (*ListTopRatedLaptopsResponse, error) {
+	out := new(ListTopRatedLaptopsResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/ListTopRatedLaptops", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) ListTrendingLaptops(ctx context.Context, in *ListTrendingLaptopsRequest, opts ...grpc.CallOption) (*ListTrendingLaptopsResponse, error) {
+	out := new(ListTrendingLaptopsResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/ListTrendingLaptops", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LaptopServiceServer is the server API for LaptopService service.
 // All implementations must embed UnimplementedLaptopServiceServer
 // for forward compatibility
 type LaptopServiceServer interface {
 	CreateLaptop(context.Context, *CreateLaptopRequest) (*CreateLaptopResponse, error)
 	SearchLaptop(*SearchLaptopRequest, LaptopService_SearchLaptopServer) error
+	// UploadImage is served over REST by a custom multipart/form-data handler
+	// on POST /v1/laptop/upload_image, as a JSON body cannot carry a stream.
 	UploadImage(LaptopService_UploadImageServer) error
+	StartImageUpload(context.Context, *StartImageUploadRequest) (*StartImageUploadResponse, error)
+	UploadImageChunk(context.Context, *UploadImageChunkRequest) (*UploadImageChunkResponse, error)
+	GetImageUploadStatus(context.Context, *GetImageUploadStatusRequest) (*GetImageUploadStatusResponse, error)
+	FinishImageUpload(context.Context, *FinishImageUploadRequest) (*UploadImageResponse, error)
+	ListLaptopImages(context.Context, *ListLaptopImagesRequest) (*ListLaptopImagesResponse, error)
+	DownloadImage(*DownloadImageRequest, LaptopService_DownloadImageServer) error
+	GetImageUsage(context.Context, *GetImageUsageRequest) (*GetImageUsageResponse, error)
 	RateLaptop(LaptopService_RateLaptopServer) error
+	GetLaptopRating(context.Context, *GetLaptopRatingRequest) (*GetLaptopRatingResponse, error)
+	BatchGetLaptopRatings(context.Context, *BatchGetLaptopRatingsRequest) (*BatchGetLaptopRatingsResponse, error)
+	ListTopRatedLaptops(context.Context, *ListTopRatedLaptopsRequest) (*ListTopRatedLaptopsResponse, error)
+	ListTrendingLaptops(context.Context, *ListTrendingLaptopsRequest) (*ListTrendingLaptopsResponse, error)
 	mustEmbedUnimplementedLaptopServiceServer()
 }
 
@@ -166,9 +314,42 @@ func (UnimplementedLaptopServiceServer) SearchLaptop(*SearchLaptopRequest, Lapto
 func (UnimplementedLaptopServiceServer) UploadImage(LaptopService_UploadImageServer) error {
 	return status.Errorf(codes.Unimplemented, "method UploadImage not implemented")
 }
+func (UnimplementedLaptopServiceServer) StartImageUpload(context.Context, *StartImageUploadRequest) (*StartImageUploadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartImageUpload not implemented")
+}
+func (UnimplementedLaptopServiceServer) UploadImageChunk(context.Context, *UploadImageChunkRequest) (*UploadImageChunkResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UploadImageChunk not implemented")
+}
+func (UnimplementedLaptopServiceServer) GetImageUploadStatus(context.Context, *GetImageUploadStatusRequest) (*GetImageUploadStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetImageUploadStatus not implemented")
+}
+func (UnimplementedLaptopServiceServer) FinishImageUpload(context.Context, *FinishImageUploadRequest) (*UploadImageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FinishImageUpload not implemented")
+}
+func (UnimplementedLaptopServiceServer) ListLaptopImages(context.Context, *ListLaptopImagesRequest) (*ListLaptopImagesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListLaptopImages not implemented")
+}
+func (UnimplementedLaptopServiceServer) DownloadImage(*DownloadImageRequest, LaptopService_DownloadImageServer) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadImage not implemented")
+}
+func (UnimplementedLaptopServiceServer) GetImageUsage(context.Context, *GetImageUsageRequest) (*GetImageUsageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetImageUsage not implemented")
+}
 func (UnimplementedLaptopServiceServer) RateLaptop(LaptopService_RateLaptopServer) error {
 	return status.Errorf(codes.Unimplemented, "method RateLaptop not implemented")
 }
+func (UnimplementedLaptopServiceServer) GetLaptopRating(context.Context, *GetLaptopRatingRequest) (*GetLaptopRatingResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLaptopRating not implemented")
+}
+func (UnimplementedLaptopServiceServer) BatchGetLaptopRatings(context.Context, *BatchGetLaptopRatingsRequest) (*BatchGetLaptopRatingsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchGetLaptopRatings not implemented")
+}
+func (UnimplementedLaptopServiceServer) ListTopRatedLaptops(context.Context, *ListTopRatedLaptopsRequest) (*ListTopRatedLaptopsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListTopRatedLaptops not implemented")
+}
+func (UnimplementedLaptopServiceServer) ListTrendingLaptops(context.Context, *ListTrendingLaptopsRequest) (*ListTrendingLaptopsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListTrendingLaptops not implemented")
+}
 func (UnimplementedLaptopServiceServer) mustEmbedUnimplementedLaptopServiceServer() {}
 
 // UnsafeLaptopServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -247,6 +428,135 @@ func (x *laptopServiceUploadImageServer) Recv() (*UploadImageRequest, error) {
 	return m, nil
 }
 
+func _LaptopService_StartImageUpload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartImageUploadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).StartImageUpload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/StartImageUpload",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).StartImageUpload(ctx, req.(*StartImageUploadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_UploadImageChunk_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UploadImageChunkRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).UploadImageChunk(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/UploadImageChunk",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).UploadImageChunk(ctx, req.(*UploadImageChunkRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_GetImageUploadStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetImageUploadStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).GetImageUploadStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/GetImageUploadStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).GetImageUploadStatus(ctx, req.(*GetImageUploadStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_FinishImageUpload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FinishImageUploadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).FinishImageUpload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/FinishImageUpload",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).FinishImageUpload(ctx, req.(*FinishImageUploadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_ListLaptopImages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListLaptopImagesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).ListLaptopImages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/ListLaptopImages",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).ListLaptopImages(ctx, req.(*ListLaptopImagesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_DownloadImage_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadImageRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LaptopServiceServer).DownloadImage(m, &laptopServiceDownloadImageServer{stream})
+}
+
+type LaptopService_DownloadImageServer interface {
+	Send(*DownloadImageResponse) error
+	grpc.ServerStream
+}
+
+type laptopServiceDownloadImageServer struct {
+	grpc.ServerStream
+}
+
+func (x *laptopServiceDownloadImageServer) Send(m *DownloadImageResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _LaptopService_GetImageUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetImageUsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).GetImageUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/GetImageUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).GetImageUsage(ctx, req.(*GetImageUsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _LaptopService_RateLaptop_Handler(srv interface{}, stream grpc.ServerStream) error {
 	return srv.(LaptopServiceServer).RateLaptop(&laptopServiceRateLaptopServer{stream})
 }
@@ -273,6 +583,78 @@ func (x *laptopServiceRateLaptopServer) Recv() (*RateLaptopRequest, error) {
 	return m, nil
 }
 
+func _LaptopService_GetLaptopRating_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetLaptopRatingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).GetLaptopRating(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/GetLaptopRating",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).GetLaptopRating(ctx, req.(*GetLaptopRatingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_BatchGetLaptopRatings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchGetLaptopRatingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).BatchGetLaptopRatings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/BatchGetLaptopRatings",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).BatchGetLaptopRatings(ctx, req.(*BatchGetLaptopRatingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_ListTopRatedLaptops_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTopRatedLaptopsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).ListTopRatedLaptops(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/ListTopRatedLaptops",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).ListTopRatedLaptops(ctx, req.(*ListTopRatedLaptopsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_ListTrendingLaptops_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTrendingLaptopsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).ListTrendingLaptops(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/ListTrendingLaptops",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).ListTrendingLaptops(ctx, req.(*ListTrendingLaptopsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // LaptopService_ServiceDesc is the grpc.ServiceDesc for LaptopService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -284,6 +666,46 @@ var LaptopService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "CreateLaptop",
 			Handler:    _LaptopService_CreateLaptop_Handler,
 		},
+		{
+			MethodName: "StartImageUpload",
+			Handler:    _LaptopService_StartImageUpload_Handler,
+		},
+		{
+			MethodName: "UploadImageChunk",
+			Handler:    _LaptopService_UploadImageChunk_Handler,
+		},
+		{
+			MethodName: "GetImageUploadStatus",
+			Handler:    _LaptopService_GetImageUploadStatus_Handler,
+		},
+		{
+			MethodName: "FinishImageUpload",
+			Handler:    _LaptopService_FinishImageUpload_Handler,
+		},
+		{
+			MethodName: "ListLaptopImages",
+			Handler:    _LaptopService_ListLaptopImages_Handler,
+		},
+		{
+			MethodName: "GetImageUsage",
+			Handler:    _LaptopService_GetImageUsage_Handler,
+		},
+		{
+			MethodName: "GetLaptopRating",
+			Handler:    _LaptopService_GetLaptopRating_Handler,
+		},
+		{
+			MethodName: "BatchGetLaptopRatings",
+			Handler:    _LaptopService_BatchGetLaptopRatings_Handler,
+		},
+		{
+			MethodName: "ListTopRatedLaptops",
+			Handler:    _LaptopService_ListTopRatedLaptops_Handler,
+		},
+		{
+			MethodName: "ListTrendingLaptops",
+			Handler:    _LaptopService_ListTrendingLaptops_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -296,6 +718,11 @@ var LaptopService_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _LaptopService_UploadImage_Handler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "DownloadImage",
+			Handler:       _LaptopService_DownloadImage_Handler,
+			ServerStreams: true,
+		},
 		{
 			StreamName:    "RateLaptop",
 			Handler:       _LaptopService_RateLaptop_Handler,
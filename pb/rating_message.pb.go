@@ -0,0 +1,270 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.1
+// 	protoc        v3.21.6
+// source: rating_message.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type LaptopRating struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	LaptopId      string                 `protobuf:"bytes,1,opt,name=laptop_id,json=laptopId,proto3" json:"laptop_id,omitempty"`
+	RatedCount    uint32                 `protobuf:"varint,2,opt,name=rated_count,json=ratedCount,proto3" json:"rated_count,omitempty"`
+	AverageScore  float64                `protobuf:"fixed64,3,opt,name=average_score,json=averageScore,proto3" json:"average_score,omitempty"`
+	MedianScore   float64                `protobuf:"fixed64,4,opt,name=median_score,json=medianScore,proto3" json:"median_score,omitempty"`
+	BayesianScore float64                `protobuf:"fixed64,5,opt,name=bayesian_score,json=bayesianScore,proto3" json:"bayesian_score,omitempty"`
+	Histogram     []*LaptopRating_Bucket `protobuf:"bytes,6,rep,name=histogram,proto3" json:"histogram,omitempty"`
+}
+
+func (x *LaptopRating) Reset() {
+	*x = LaptopRating{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_rating_message_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *LaptopRating) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LaptopRating) ProtoMessage() {}
+
+func (x *LaptopRating) ProtoReflect() protoreflect.Message {
+	mi := &file_rating_message_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LaptopRating.ProtoReflect.Descriptor instead.
+func (*LaptopRating) Descriptor() ([]byte, []int) {
+	return file_rating_message_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *LaptopRating) GetLaptopId() string {
+	if x != nil {
+		return x.LaptopId
+	}
+	return ""
+}
+
+func (x *LaptopRating) GetRatedCount() uint32 {
+	if x != nil {
+		return x.RatedCount
+	}
+	return 0
+}
+
+func (x *LaptopRating) GetAverageScore() float64 {
+	if x != nil {
+		return x.AverageScore
+	}
+	return 0
+}
+
+func (x *LaptopRating) GetMedianScore() float64 {
+	if x != nil {
+		return x.MedianScore
+	}
+	return 0
+}
+
+func (x *LaptopRating) GetBayesianScore() float64 {
+	if x != nil {
+		return x.BayesianScore
+	}
+	return 0
+}
+
+func (x *LaptopRating) GetHistogram() []*LaptopRating_Bucket {
+	if x != nil {
+		return x.Histogram
+	}
+	return nil
+}
+
+type LaptopRating_Bucket struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Score float64 `protobuf:"fixed64,1,opt,name=score,proto3" json:"score,omitempty"`
+	Count uint32  `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`
+}
+
+func (x *LaptopRating_Bucket) Reset() {
+	*x = LaptopRating_Bucket{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_rating_message_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *LaptopRating_Bucket) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LaptopRating_Bucket) ProtoMessage() {}
+
+func (x *LaptopRating_Bucket) ProtoReflect() protoreflect.Message {
+	mi := &file_rating_message_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LaptopRating_Bucket.ProtoReflect.Descriptor instead.
+func (*LaptopRating_Bucket) Descriptor() ([]byte, []int) {
+	return file_rating_message_proto_rawDescGZIP(), []int{0, 0}
+}
+
+func (x *LaptopRating_Bucket) GetScore() float64 {
+	if x != nil {
+		return x.Score
+	}
+	return 0
+}
+
+func (x *LaptopRating_Bucket) GetCount() uint32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+var File_rating_message_proto protoreflect.FileDescriptor
+
+var file_rating_message_proto_rawDesc = []byte{
+	0x0a, 0x14, 0x72, 0x61, 0x74, 0x69, 0x6e, 0x67, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x11, 0x74, 0x65, 0x63, 0x68, 0x73, 0x63, 0x68, 0x6f,
+	0x6f, 0x6c, 0x2e, 0x70, 0x63, 0x62, 0x6f, 0x6f, 0x6b, 0x22, 0xb7, 0x02, 0x0a, 0x0c, 0x4c, 0x61,
+	0x70, 0x74, 0x6f, 0x70, 0x52, 0x61, 0x74, 0x69, 0x6e, 0x67, 0x12, 0x1b, 0x0a, 0x09, 0x6c, 0x61,
+	0x70, 0x74, 0x6f, 0x70, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x6c,
+	0x61, 0x70, 0x74, 0x6f, 0x70, 0x49, 0x64, 0x12, 0x1f, 0x0a, 0x0b, 0x72, 0x61, 0x74, 0x65, 0x64,
+	0x5f, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0a, 0x72, 0x61,
+	0x74, 0x65, 0x64, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x12, 0x23, 0x0a, 0x0d, 0x61, 0x76, 0x65, 0x72,
+	0x61, 0x67, 0x65, 0x5f, 0x73, 0x63, 0x6f, 0x72, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x01, 0x52,
+	0x0c, 0x61, 0x76, 0x65, 0x72, 0x61, 0x67, 0x65, 0x53, 0x63, 0x6f, 0x72, 0x65, 0x12, 0x21, 0x0a,
+	0x0c, 0x6d, 0x65, 0x64, 0x69, 0x61, 0x6e, 0x5f, 0x73, 0x63, 0x6f, 0x72, 0x65, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x01, 0x52, 0x0b, 0x6d, 0x65, 0x64, 0x69, 0x61, 0x6e, 0x53, 0x63, 0x6f, 0x72, 0x65,
+	0x12, 0x25, 0x0a, 0x0e, 0x62, 0x61, 0x79, 0x65, 0x73, 0x69, 0x61, 0x6e, 0x5f, 0x73, 0x63, 0x6f,
+	0x72, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0d, 0x62, 0x61, 0x79, 0x65, 0x73, 0x69,
+	0x61, 0x6e, 0x53, 0x63, 0x6f, 0x72, 0x65, 0x12, 0x44, 0x0a, 0x09, 0x68, 0x69, 0x73, 0x74, 0x6f,
+	0x67, 0x72, 0x61, 0x6d, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x26, 0x2e, 0x74, 0x65, 0x63,
+	0x68, 0x73, 0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x2e, 0x70, 0x63, 0x62, 0x6f, 0x6f, 0x6b, 0x2e, 0x4c,
+	0x61, 0x70, 0x74, 0x6f, 0x70, 0x52, 0x61, 0x74, 0x69, 0x6e, 0x67, 0x2e, 0x42, 0x75, 0x63, 0x6b,
+	0x65, 0x74, 0x52, 0x09, 0x68, 0x69, 0x73, 0x74, 0x6f, 0x67, 0x72, 0x61, 0x6d, 0x1a, 0x34, 0x0a,
+	0x06, 0x42, 0x75, 0x63, 0x6b, 0x65, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x73, 0x63, 0x6f, 0x72, 0x65,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x01, 0x52, 0x05, 0x73, 0x63, 0x6f, 0x72, 0x65, 0x12, 0x14, 0x0a,
+	0x05, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x63, 0x6f,
+	0x75, 0x6e, 0x74, 0x42, 0x22, 0x0a, 0x18, 0x63, 0x6f, 0x6d, 0x2e, 0x74, 0x65, 0x63, 0x68, 0x73,
+	0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x2e, 0x70, 0x63, 0x62, 0x6f, 0x6f, 0x6b, 0x2e, 0x70, 0x62, 0x50,
+	0x01, 0x5a, 0x04, 0x2e, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_rating_message_proto_rawDescOnce sync.Once
+	file_rating_message_proto_rawDescData = file_rating_message_proto_rawDesc
+)
+
+func file_rating_message_proto_rawDescGZIP() []byte {
+	file_rating_message_proto_rawDescOnce.Do(func() {
+		file_rating_message_proto_rawDescData = protoimpl.X.CompressGZIP(file_rating_message_proto_rawDescData)
+	})
+	return file_rating_message_proto_rawDescData
+}
+
+var file_rating_message_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_rating_message_proto_goTypes = []interface{}{
+	(*LaptopRating)(nil),        // 0: techschool.pcbook.LaptopRating
+	(*LaptopRating_Bucket)(nil), // 1: techschool.pcbook.LaptopRating.Bucket
+}
+var file_rating_message_proto_depIdxs = []int32{
+	1, // 0: techschool.pcbook.LaptopRating.histogram:type_name -> techschool.pcbook.LaptopRating.Bucket
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_rating_message_proto_init() }
+func file_rating_message_proto_init() {
+	if File_rating_message_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_rating_message_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*LaptopRating); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_rating_message_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*LaptopRating_Bucket); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_rating_message_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_rating_message_proto_goTypes,
+		DependencyIndexes: file_rating_message_proto_depIdxs,
+		MessageInfos:      file_rating_message_proto_msgTypes,
+	}.Build()
+	File_rating_message_proto = out.File
+	file_rating_message_proto_rawDesc = nil
+	file_rating_message_proto_goTypes = nil
+	file_rating_message_proto_depIdxs = nil
+}
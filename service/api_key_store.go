@@ -0,0 +1,195 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrAPIKeyNotFound is returned when an API key does not exist, was revoked or has expired.
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+const (
+	apiKeyPrefix     = "pcb_"
+	apiKeyIDSize     = 6  // random bytes of the public part of a key
+	apiKeySecretSize = 32 // random bytes of the secret part of a key
+)
+
+// APIKey is a key for a machine client, which authenticates with a role and a team without a password.
+// A key looks like "pcb_<id>_<secret>": the "pcb_<id>" prefix identifies it, and the store
+// only keeps a hash of the whole key.
+type APIKey struct {
+	Prefix     string
+	Name       string
+	Role       string
+	Team       string
+	CreatedBy  string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time // zero if the key never expires
+	LastUsedAt time.Time // zero if the key was never used
+	Revoked    bool
+}
+
+// Username returns the username of the claims of a caller authenticated with the key.
+// It contains a ':', which usernames cannot, so that a key never acts as a user.
+func (key *APIKey) Username() string {
+	return "apikey:" + key.Prefix
+}
+
+// APIKeyStore is a store for API keys.
+type APIKeyStore interface {
+	// Create creates a new API key from the given fields, and returns it with the secret key.
+	Create(key *APIKey) (*APIKey, string, error)
+	// List returns all the keys, including the revoked ones, by creation time.
+	List() ([]*APIKey, error)
+	// Revoke revokes the key with the given prefix.
+	Revoke(prefix string) (*APIKey, error)
+	// Verify returns the key that matches a secret key and records that it was used.
+	// It returns ErrAPIKeyNotFound if the key is unknown, revoked or expired.
+	Verify(secret string) (*APIKey, error)
+}
+
+// InMemoryAPIKeyStore is an in-memory store for API keys.
+type InMemoryAPIKeyStore struct {
+	mutex sync.Mutex
+	keys  map[string]*apiKeyEntry // by prefix
+}
+
+type apiKeyEntry struct {
+	APIKey
+	hash string
+}
+
+// NewInMemoryAPIKeyStore creates a new InMemoryAPIKeyStore.
+func NewInMemoryAPIKeyStore() *InMemoryAPIKeyStore {
+	return &InMemoryAPIKeyStore{
+		keys: make(map[string]*apiKeyEntry),
+	}
+}
+
+// Create creates a new API key from the given fields, and returns it with the secret key.
+func (store *InMemoryAPIKeyStore) Create(key *APIKey) (*APIKey, string, error) {
+	id, err := randomHex(apiKeyIDSize)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot generate api key id: %w", err)
+	}
+	secret, err := randomHex(apiKeySecretSize)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot generate api key: %w", err)
+	}
+
+	entry := &apiKeyEntry{APIKey: *key}
+	entry.Prefix = apiKeyPrefix + id
+	entry.CreatedAt = time.Now()
+	entry.LastUsedAt = time.Time{}
+	entry.Revoked = false
+
+	fullKey := entry.Prefix + "_" + secret
+	entry.hash = hashAPIKey(fullKey)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.keys[entry.Prefix] != nil {
+		return nil, "", fmt.Errorf("api key prefix already exists: %s", entry.Prefix)
+	}
+	store.keys[entry.Prefix] = entry
+
+	other := entry.APIKey
+	return &other, fullKey, nil
+}
+
+// List returns all the keys, including the revoked ones, by creation time.
+func (store *InMemoryAPIKeyStore) List() ([]*APIKey, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	keys := make([]*APIKey, 0, len(store.keys))
+	for _, entry := range store.keys {
+		other := entry.APIKey
+		keys = append(keys, &other)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].Prefix < keys[j].Prefix
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// Revoke revokes the key with the given prefix. Revoking a revoked key does nothing.
+func (store *InMemoryAPIKeyStore) Revoke(prefix string) (*APIKey, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entry := store.keys[prefix]
+	if entry == nil {
+		return nil, ErrAPIKeyNotFound
+	}
+	entry.Revoked = true
+
+	other := entry.APIKey
+	return &other, nil
+}
+
+// Verify returns the key that matches a secret key and records that it was used.
+func (store *InMemoryAPIKeyStore) Verify(secret string) (*APIKey, error) {
+	prefix := apiKeyPrefixOf(secret)
+	if prefix == "" {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entry := store.keys[prefix]
+	if entry == nil || subtle.ConstantTimeCompare([]byte(entry.hash), []byte(hashAPIKey(secret))) != 1 {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	now := time.Now()
+	if entry.Revoked || (!entry.ExpiresAt.IsZero() && now.After(entry.ExpiresAt)) {
+		return nil, ErrAPIKeyNotFound
+	}
+	entry.LastUsedAt = now
+
+	other := entry.APIKey
+	return &other, nil
+}
+
+// apiKeyPrefixOf returns the prefix of a secret key, or "" if it is not a key.
+func apiKeyPrefixOf(secret string) string {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return ""
+	}
+	i := strings.Index(secret[len(apiKeyPrefix):], "_")
+	if i <= 0 {
+		return ""
+	}
+	return secret[:len(apiKeyPrefix)+i]
+}
+
+func hashAPIKey(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// randomHex returns size random bytes encoded in hex,
+// which unlike base64url never contains the '_' separator of API keys.
+func randomHex(size int) (string, error) {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
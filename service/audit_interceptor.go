@@ -0,0 +1,269 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// auditReadOnlyPrefixes are the prefixes of the methods that change nothing, which are only
+// audited when the caller is not authenticated or not allowed.
+var auditReadOnlyPrefixes = []string{"Get", "BatchGet", "List", "Search", "Download", "ServerReflection"}
+
+// auditResourceFields are the request and response fields that identify a resource, by kind.
+var auditResourceFields = []struct {
+	field protoreflect.Name
+	kind  string
+}{
+	{"review_id", "review"},
+	{"image_id", "image"},
+	{"upload_id", "upload"},
+	{"laptop_id", "laptop"},
+	{"username", "user"},
+	{"prefix", "apikey"},
+}
+
+// auditResourceMessages are the messages whose id field identifies a resource, by kind.
+var auditResourceMessages = map[protoreflect.Name]string{
+	"Laptop":               "laptop",
+	"Review":               "review",
+	"Image":                "image",
+	"CreateLaptopResponse": "laptop",
+	"UploadImageResponse":  "image",
+}
+
+// AuditInterceptor is a server interceptor that records an audit event for each call
+// that changes data, and for each call that is denied.
+// A stream that acts on several resources, e.g. rates several laptops, records an event for each of them.
+// It must run before the AuthInterceptor, so that it also sees the denied calls.
+type AuditInterceptor struct {
+	auditSink AuditSink
+}
+
+// NewAuditInterceptor creates a new AuditInterceptor that records the events to auditSink.
+func NewAuditInterceptor(auditSink AuditSink) *AuditInterceptor {
+	return &AuditInterceptor{auditSink: auditSink}
+}
+
+// auditCall collects the caller and resources of a call while it runs.
+type auditCall struct {
+	mutex     sync.Mutex
+	claims    *UserClaims
+	resources []string
+	seen      map[string]bool
+}
+
+// addResource adds a resource of the call, if it is not empty and not already added.
+// The caller must hold the lock.
+func (call *auditCall) addResource(resource string) {
+	if resource == "" || call.seen[resource] {
+		return
+	}
+	if call.seen == nil {
+		call.seen = make(map[string]bool)
+	}
+	call.seen[resource] = true
+	call.resources = append(call.resources, resource)
+}
+
+type auditCallKey struct{}
+
+// setAuditClaims records the verified claims of the caller for the audit event of the call, if it has one.
+func setAuditClaims(ctx context.Context, claims *UserClaims) {
+	call, ok := ctx.Value(auditCallKey{}).(*auditCall)
+	if !ok {
+		return
+	}
+
+	call.mutex.Lock()
+	defer call.mutex.Unlock()
+	call.claims = claims
+}
+
+// Unary returns a new unary server interceptor that audits the calls.
+func (interceptor *AuditInterceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		call := &auditCall{}
+		res, err := handler(context.WithValue(ctx, auditCallKey{}, call), req)
+
+		// the resource of a response, e.g. the ID of a created laptop, is more precise than the one of its request
+		resource := auditResource(res)
+		if resource == "" {
+			resource = auditResource(req)
+		}
+		call.mutex.Lock()
+		call.addResource(resource)
+		call.mutex.Unlock()
+
+		interceptor.record(ctx, call, info.FullMethod, err)
+		return res, err
+	}
+}
+
+// Stream returns a new stream server interceptor that audits the calls,
+// with the resources of the messages of the client.
+func (interceptor *AuditInterceptor) Stream() grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		call := &auditCall{}
+		ctx := context.WithValue(stream.Context(), auditCallKey{}, call)
+		err := handler(srv, &auditServerStream{ServerStream: stream, ctx: ctx, call: call})
+
+		interceptor.record(stream.Context(), call, info.FullMethod, err)
+		return err
+	}
+}
+
+func (interceptor *AuditInterceptor) record(ctx context.Context, call *auditCall, method string, err error) {
+	code := status.Code(err)
+	if isReadOnlyMethod(method) && code != codes.Unauthenticated && code != codes.PermissionDenied {
+		return
+	}
+
+	call.mutex.Lock()
+	defer call.mutex.Unlock()
+
+	resources := call.resources
+	if len(resources) == 0 {
+		resources = []string{""}
+	}
+	for _, resource := range resources {
+		event := &AuditEvent{
+			Time:     time.Now(),
+			Action:   "rpc",
+			Method:   method,
+			Resource: resource,
+			Code:     code.String(),
+			Peer:     peerAddress(ctx),
+		}
+		if call.claims != nil {
+			event.Actor = call.claims.Username
+			event.Role = call.claims.Role
+		}
+		if err != nil {
+			event.Detail = status.Convert(err).Message()
+		}
+
+		recordErr := interceptor.auditSink.Record(event)
+		if recordErr != nil {
+			log.Printf("cannot record audit event of %s: %v", method, recordErr)
+		}
+	}
+}
+
+// auditServerStream is a server stream that records the resources of the messages of the client.
+type auditServerStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	call *auditCall
+}
+
+// Context returns the context of the stream.
+func (stream *auditServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+// RecvMsg receives a message from the client.
+func (stream *auditServerStream) RecvMsg(m interface{}) error {
+	err := stream.ServerStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+
+	resource := auditResource(m)
+
+	stream.call.mutex.Lock()
+	defer stream.call.mutex.Unlock()
+
+	stream.call.addResource(resource)
+	return nil
+}
+
+func isReadOnlyMethod(fullMethod string) bool {
+	name := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	for _, prefix := range auditReadOnlyPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// auditResource returns the resource that a message identifies, e.g. "laptop:<id>", or an empty string.
+func auditResource(m interface{}) string {
+	message, ok := m.(proto.Message)
+	if !ok {
+		return ""
+	}
+	return findAuditResource(message.ProtoReflect(), 2)
+}
+
+// findAuditResource looks for a resource in the fields of a message,
+// and then in the fields of its message fields down to the given depth.
+func findAuditResource(message protoreflect.Message, depth int) string {
+	if !message.IsValid() {
+		return ""
+	}
+	fields := message.Descriptor().Fields()
+
+	kind, ok := auditResourceMessages[message.Descriptor().Name()]
+	if ok {
+		field := fields.ByName("id")
+		if field != nil && message.Get(field).String() != "" {
+			return kind + ":" + message.Get(field).String()
+		}
+	}
+
+	for _, resourceField := range auditResourceFields {
+		field := fields.ByName(resourceField.field)
+		if field == nil || field.Kind() != protoreflect.StringKind || field.Cardinality() == protoreflect.Repeated {
+			continue
+		}
+		value := message.Get(field).String()
+		if value != "" {
+			return resourceField.kind + ":" + value
+		}
+	}
+
+	if depth == 0 {
+		return ""
+	}
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		if field.Kind() != protoreflect.MessageKind || field.Cardinality() == protoreflect.Repeated || !message.Has(field) {
+			continue
+		}
+		resource := findAuditResource(message.Get(field).Message(), depth-1)
+		if resource != "" {
+			return resource
+		}
+	}
+	return ""
+}
+
+// peerAddress returns the address of the client, or an empty string.
+func peerAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	return p.Addr.String()
+}
@@ -0,0 +1,139 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"learngrpc/pcbook/pb"
+	"learngrpc/pcbook/service"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestAuditInterceptor(t *testing.T) {
+	t.Parallel()
+
+	auditLog, err := service.NewFileAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() { auditLog.Close() })
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	authInterceptor := service.NewAuthInterceptor(jwtManager, service.NewInMemoryRevocationList(), nil, nil, service.NewDefaultPolicy())
+	auditInterceptor := service.NewAuditInterceptor(auditLog)
+
+	token := func(username string, role string) string {
+		token, err := jwtManager.Generate(&service.User{Username: username, Role: role}, "")
+		require.NoError(t, err)
+		return token
+	}
+	call := func(method string, token string, req interface{}, res interface{}, handlerErr error) {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}})
+		if token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", token))
+		}
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		auditInterceptor.Unary()(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return authInterceptor.Unary()(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return res, handlerErr
+			})
+		})
+	}
+
+	call(
+		"/techschool.pcbook.LaptopService/CreateLaptop",
+		token("seller1", "seller"),
+		&pb.CreateLaptopRequest{Laptop: &pb.Laptop{}},
+		&pb.CreateLaptopResponse{Id: "laptop1"},
+		nil,
+	)
+	call(
+		"/techschool.pcbook.AuthService/Login",
+		"",
+		&pb.LoginRequest{Username: "user1", Password: "wrong"},
+		(*pb.LoginResponse)(nil),
+		status.Errorf(codes.NotFound, "invalid username or password"),
+	)
+	call("/techschool.pcbook.AuthService/DisableUser", token("user1", "user"), &pb.DisableUserRequest{Username: "admin1"}, nil, nil)
+	call("/techschool.pcbook.AuthService/ListUsers", "", &pb.ListUsersRequest{}, nil, nil)
+	call("/techschool.pcbook.ReviewService/UpdateReview", token("user1", "user"), &pb.UpdateReviewRequest{ReviewId: "review1"}, nil, nil)
+
+	// the calls that change nothing are not recorded, unless they are denied
+	call("/techschool.pcbook.LaptopService/GetLaptopRating", "", &pb.GetLaptopRatingRequest{LaptopId: "laptop1"}, &pb.GetLaptopRatingResponse{}, nil)
+
+	// a stream records each laptop it rates
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", token("user1", "user")))
+	stream := &testServerStream{ctx: ctx, messages: []proto.Message{
+		&pb.RateLaptopRequest{LaptopId: "laptop1", Score: 8},
+		&pb.RateLaptopRequest{LaptopId: "laptop2", Score: 5},
+		&pb.RateLaptopRequest{LaptopId: "laptop1", Score: 9},
+	}}
+	info := &grpc.StreamServerInfo{FullMethod: "/techschool.pcbook.LaptopService/RateLaptop", IsClientStream: true, IsServerStream: true}
+	err = auditInterceptor.Stream()(nil, stream, info, func(srv interface{}, stream grpc.ServerStream) error {
+		return authInterceptor.Stream()(srv, stream, info, func(srv interface{}, stream grpc.ServerStream) error {
+			for {
+				err := stream.RecvMsg(&pb.RateLaptopRequest{})
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+		})
+	})
+	require.NoError(t, err)
+
+	records, more, err := auditLog.Query(service.AuditQuery{}, 10)
+	require.NoError(t, err)
+	require.False(t, more)
+
+	type record struct {
+		actor, role, method, resource, code string
+	}
+	var got []record
+	for _, r := range records {
+		require.Equal(t, "rpc", r.Action)
+		require.Equal(t, "10.0.0.1:1234", r.Peer)
+		require.False(t, r.Time.IsZero())
+		got = append(got, record{r.Actor, r.Role, r.Method, r.Resource, r.Code})
+	}
+	require.Equal(t, []record{
+		{"seller1", "seller", "/techschool.pcbook.LaptopService/CreateLaptop", "laptop:laptop1", "OK"},
+		{"", "", "/techschool.pcbook.AuthService/Login", "user:user1", "NotFound"},
+		{"user1", "user", "/techschool.pcbook.AuthService/DisableUser", "user:admin1", "PermissionDenied"},
+		{"", "", "/techschool.pcbook.AuthService/ListUsers", "", "Unauthenticated"},
+		{"user1", "user", "/techschool.pcbook.ReviewService/UpdateReview", "review:review1", "OK"},
+		{"user1", "user", "/techschool.pcbook.LaptopService/RateLaptop", "laptop:laptop1", "OK"},
+		{"user1", "user", "/techschool.pcbook.LaptopService/RateLaptop", "laptop:laptop2", "OK"},
+	}, got)
+}
+
+// testServerStream is a server stream that receives the given messages from the client.
+type testServerStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	messages []proto.Message
+}
+
+func (stream *testServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (stream *testServerStream) RecvMsg(m interface{}) error {
+	if len(stream.messages) == 0 {
+		return io.EOF
+	}
+	proto.Merge(m.(proto.Message), stream.messages[0])
+	stream.messages = stream.messages[1:]
+	return nil
+}
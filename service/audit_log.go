@@ -0,0 +1,263 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrAuditLogTampered is returned when a record of an audit log was changed, removed or inserted.
+var ErrAuditLogTampered = errors.New("audit log is tampered")
+
+// AuditRecord is an audit event in the hash chain of an audit log. Its hash covers the event,
+// its sequence number and the hash of the previous record, so that changing, removing or
+// inserting a record breaks the chain from there on.
+type AuditRecord struct {
+	Seq uint64 `json:"seq"`
+	AuditEvent
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// AuditQuery selects the records of an audit log. The empty fields match all records.
+type AuditQuery struct {
+	Actor    string
+	Resource string
+	Since    time.Time // inclusive
+	Until    time.Time // exclusive
+	AfterSeq uint64    // only the records after this sequence number, to continue a previous query
+}
+
+func (query *AuditQuery) match(record *AuditRecord) bool {
+	return record.Seq > query.AfterSeq &&
+		(query.Actor == "" || record.Actor == query.Actor) &&
+		(query.Resource == "" || record.Resource == query.Resource) &&
+		(query.Since.IsZero() || !record.Time.Before(query.Since)) &&
+		(query.Until.IsZero() || record.Time.Before(query.Until))
+}
+
+// FileAuditLog is an AuditSink that appends the events as hash-chained JSON lines to a file.
+// Every record is synced before Record returns.
+type FileAuditLog struct {
+	mutex    sync.Mutex // serializes the writes, and protects the head of the chain
+	filename string
+	file     *os.File
+	lastSeq  uint64
+	headHash string
+}
+
+// NewFileAuditLog opens the audit log file, creating it if needed, and verifies its hash chain.
+// It returns an error wrapping ErrAuditLogTampered if the chain is broken.
+func NewFileAuditLog(filename string) (*FileAuditLog, error) {
+	err := truncateIncompleteLine(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	lastSeq, headHash, err := VerifyAuditLog(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+
+	auditLog := &FileAuditLog{
+		filename: filename,
+		file:     file,
+		lastSeq:  lastSeq,
+		headHash: headHash,
+	}
+	return auditLog, nil
+}
+
+// Record appends an event to the audit log.
+func (auditLog *FileAuditLog) Record(event *AuditEvent) error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	record := &AuditRecord{
+		Seq:        auditLog.lastSeq + 1,
+		AuditEvent: *event,
+		PrevHash:   auditLog.headHash,
+	}
+	record.Time = record.Time.UTC()
+
+	var err error
+	record.Hash, err = record.computeHash()
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot encode audit record: %w", err)
+	}
+
+	_, err = auditLog.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("cannot write audit log: %w", err)
+	}
+
+	err = auditLog.file.Sync()
+	if err != nil {
+		return fmt.Errorf("cannot sync audit log: %w", err)
+	}
+
+	auditLog.lastSeq = record.Seq
+	auditLog.headHash = record.Hash
+	return nil
+}
+
+// Query returns at most limit records that match the query, by sequence number,
+// and tells if there are more.
+func (auditLog *FileAuditLog) Query(query AuditQuery, limit int) ([]*AuditRecord, bool, error) {
+	var records []*AuditRecord
+	more := false
+	err := readAuditLog(auditLog.filename, func(record *AuditRecord) error {
+		if !query.match(record) {
+			return nil
+		}
+		if len(records) == limit {
+			more = true
+			return io.EOF
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return records, more, nil
+}
+
+// Verify verifies the hash chain of the audit log, and returns the number of records and the hash of the last one.
+func (auditLog *FileAuditLog) Verify() (uint64, string, error) {
+	return VerifyAuditLog(auditLog.filename)
+}
+
+// Close closes the audit log file.
+func (auditLog *FileAuditLog) Close() error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	return auditLog.file.Close()
+}
+
+// VerifyAuditLog verifies the hash chain of an audit log file, and returns the number of records
+// and the hash of the last one. It returns an error wrapping ErrAuditLogTampered if the chain is broken.
+// Removing the last records leaves a valid chain, which only a head hash kept elsewhere reveals.
+func VerifyAuditLog(filename string) (uint64, string, error) {
+	lastSeq := uint64(0)
+	headHash := ""
+	err := readAuditLog(filename, func(record *AuditRecord) error {
+		if record.Seq != lastSeq+1 {
+			return fmt.Errorf("%w: record %d follows record %d", ErrAuditLogTampered, record.Seq, lastSeq)
+		}
+		if record.PrevHash != headHash {
+			return fmt.Errorf("%w: record %d is not chained to the previous one", ErrAuditLogTampered, record.Seq)
+		}
+
+		hash, err := record.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != record.Hash {
+			return fmt.Errorf("%w: record %d does not match its hash", ErrAuditLogTampered, record.Seq)
+		}
+
+		lastSeq = record.Seq
+		headHash = record.Hash
+		return nil
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	return lastSeq, headHash, nil
+}
+
+// computeHash returns the hex SHA-256 hash of the record without its hash.
+func (record *AuditRecord) computeHash() (string, error) {
+	unhashed := *record
+	unhashed.Hash = ""
+
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", fmt.Errorf("cannot encode audit record: %w", err)
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// readAuditLog calls visit for each record of an audit log file until it returns an error.
+// A missing file has no records, and an incomplete last line, which is being written, is ignored.
+func readAuditLog(filename string, visit func(record *AuditRecord) error) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open audit log: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read audit log: %w", err)
+		}
+
+		record := &AuditRecord{}
+		err = json.Unmarshal(line, record)
+		if err != nil {
+			return fmt.Errorf("%w: cannot decode line %d: %v", ErrAuditLogTampered, lineNumber, err)
+		}
+
+		err = visit(record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// truncateIncompleteLine removes the incomplete last line that a crash during a write leaves,
+// so that the next record starts on a new line.
+func truncateIncompleteLine(filename string) error {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read audit log: %w", err)
+	}
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+
+	size := bytes.LastIndexByte(data, '\n') + 1
+	log.Printf("removing incomplete last line of audit log %s", filename)
+	err = os.Truncate(filename, int64(size))
+	if err != nil {
+		return fmt.Errorf("cannot truncate audit log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"learngrpc/pcbook/pb"
+	"learngrpc/pcbook/service"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := service.NewFileAuditLog(filename)
+	require.NoError(t, err)
+
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	events := []*service.AuditEvent{
+		{Time: start, Action: "rpc", Actor: "seller1", Role: "seller", Method: "/techschool.pcbook.LaptopService/CreateLaptop", Resource: "laptop:1", Code: "OK"},
+		{Time: start.Add(time.Minute), Action: "rpc", Actor: "user1", Role: "user", Method: "/techschool.pcbook.LaptopService/RateLaptop", Resource: "laptop:1", Code: "OK"},
+		{Time: start.Add(2 * time.Minute), Action: "login.lockout", Resource: "user:user1", Peer: "10.0.0.1"},
+	}
+	for _, event := range events[:2] {
+		require.NoError(t, auditLog.Record(event))
+	}
+	require.NoError(t, auditLog.Close())
+
+	// the chain continues after a restart
+	auditLog, err = service.NewFileAuditLog(filename)
+	require.NoError(t, err)
+	t.Cleanup(func() { auditLog.Close() })
+	require.NoError(t, auditLog.Record(events[2]))
+
+	server := service.NewAuditServer(auditLog)
+	query := func(req *pb.QueryAuditRecordsRequest) []uint64 {
+		res, err := server.QueryAuditRecords(context.Background(), req)
+		require.NoError(t, err)
+
+		var seqs []uint64
+		for _, record := range res.GetRecords() {
+			seqs = append(seqs, record.GetSeq())
+		}
+		return seqs
+	}
+	require.Equal(t, []uint64{1, 2, 3}, query(&pb.QueryAuditRecordsRequest{}))
+	require.Equal(t, []uint64{2}, query(&pb.QueryAuditRecordsRequest{Actor: "user1"}))
+	require.Equal(t, []uint64{1, 2}, query(&pb.QueryAuditRecordsRequest{Resource: "laptop:1"}))
+	require.Equal(t, []uint64{2, 3}, query(&pb.QueryAuditRecordsRequest{Since: timestamppb.New(start.Add(time.Minute))}))
+	require.Equal(t, []uint64{1}, query(&pb.QueryAuditRecordsRequest{Until: timestamppb.New(start.Add(time.Minute))}))
+
+	res, err := server.QueryAuditRecords(context.Background(), &pb.QueryAuditRecordsRequest{PageSize: 2})
+	require.NoError(t, err)
+	require.Len(t, res.GetRecords(), 2)
+	require.Equal(t, "seller1", res.GetRecords()[0].GetActor())
+	require.Equal(t, "OK", res.GetRecords()[0].GetCode())
+	require.True(t, start.Equal(res.GetRecords()[0].GetTime().AsTime()))
+	require.Equal(t, []uint64{3}, query(&pb.QueryAuditRecordsRequest{PageSize: 2, PageToken: res.GetNextPageToken()}))
+
+	_, err = server.QueryAuditRecords(context.Background(), &pb.QueryAuditRecordsRequest{
+		Since: timestamppb.New(start),
+		Until: timestamppb.New(start),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	verified, err := server.VerifyAuditLog(context.Background(), &pb.VerifyAuditLogRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), verified.GetRecordCount())
+	require.NotEmpty(t, verified.GetHeadHash())
+
+	_, err = service.NewAuditServer(nil).VerifyAuditLog(context.Background(), &pb.VerifyAuditLogRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	// a crash during a write leaves an incomplete last line, which is removed at the next start
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	crashed := filepath.Join(t.TempDir(), "audit.jsonl")
+	require.NoError(t, os.WriteFile(crashed, append(append([]byte(nil), data...), `{"seq":4,"time":`...), 0o600))
+	crashedLog, err := service.NewFileAuditLog(crashed)
+	require.NoError(t, err)
+	require.NoError(t, crashedLog.Record(events[0]))
+	require.NoError(t, crashedLog.Close())
+	count, _, err := service.VerifyAuditLog(crashed)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), count)
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	testCases := []struct {
+		name   string
+		tamper func() []byte
+	}{
+		{
+			name: "changed",
+			tamper: func() []byte {
+				return bytes.Replace(data, []byte(`"actor":"user1"`), []byte(`"actor":"user2"`), 1)
+			},
+		},
+		{
+			name: "removed",
+			tamper: func() []byte {
+				return bytes.Join([][]byte{lines[0], lines[2]}, nil)
+			},
+		},
+		{
+			name: "reordered",
+			tamper: func() []byte {
+				return bytes.Join([][]byte{lines[1], lines[0], lines[2]}, nil)
+			},
+		},
+		{
+			name: "garbled",
+			tamper: func() []byte {
+				return bytes.Join([][]byte{lines[0], []byte("not json\n"), lines[2]}, nil)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tampered := filepath.Join(t.TempDir(), tc.name+".jsonl")
+		require.NoError(t, os.WriteFile(tampered, tc.tamper(), 0o600))
+
+		_, _, err := service.VerifyAuditLog(tampered)
+		require.ErrorIs(t, err, service.ErrAuditLogTampered, tc.name)
+		_, err = service.NewFileAuditLog(tampered)
+		require.ErrorIs(t, err, service.ErrAuditLogTampered, tc.name)
+	}
+}
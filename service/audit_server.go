@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"learngrpc/pcbook/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// AuditServer is the server for the audit service, which lets admins query and verify the audit log.
+type AuditServer struct {
+	auditLog *FileAuditLog
+	pb.UnimplementedAuditServiceServer
+}
+
+// NewAuditServer creates a new AuditServer. If auditLog is nil, the audit events are not kept
+// and the RPCs are unimplemented.
+func NewAuditServer(auditLog *FileAuditLog) *AuditServer {
+	return &AuditServer{auditLog: auditLog}
+}
+
+// QueryAuditRecords is a unary RPC to list the audit records of an actor, a resource or a time range page by page.
+func (server *AuditServer) QueryAuditRecords(ctx context.Context, req *pb.QueryAuditRecordsRequest) (*pb.QueryAuditRecordsResponse, error) {
+	if server.auditLog == nil {
+		return nil, status.Errorf(codes.Unimplemented, "audit log is not enabled")
+	}
+
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultAuditPageSize
+	}
+	if pageSize > maxAuditPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, "page size must not exceed %d", maxAuditPageSize)
+	}
+
+	afterSeq, err := decodePageToken(req.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "page token is invalid")
+	}
+
+	query := AuditQuery{
+		Actor:    req.GetActor(),
+		Resource: req.GetResource(),
+		AfterSeq: uint64(afterSeq),
+	}
+	if req.GetSince() != nil {
+		query.Since = req.GetSince().AsTime()
+	}
+	if req.GetUntil() != nil {
+		query.Until = req.GetUntil().AsTime()
+	}
+	if !query.Since.IsZero() && !query.Until.IsZero() && !query.Since.Before(query.Until) {
+		return nil, status.Errorf(codes.InvalidArgument, "since must be before until")
+	}
+
+	records, more, err := server.auditLog.Query(query, pageSize)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot query audit log: %v", err)
+	}
+
+	res := &pb.QueryAuditRecordsResponse{}
+	for _, record := range records {
+		res.Records = append(res.Records, toPbAuditRecord(record))
+	}
+	if more {
+		res.NextPageToken = encodePageToken(int(records[len(records)-1].Seq))
+	}
+	return res, nil
+}
+
+// VerifyAuditLog is a unary RPC to verify the hash chain of the audit log.
+// It returns a DataLoss error if a record was changed, removed or inserted.
+func (server *AuditServer) VerifyAuditLog(ctx context.Context, req *pb.VerifyAuditLogRequest) (*pb.VerifyAuditLogResponse, error) {
+	if server.auditLog == nil {
+		return nil, status.Errorf(codes.Unimplemented, "audit log is not enabled")
+	}
+
+	count, headHash, err := server.auditLog.Verify()
+	if errors.Is(err, ErrAuditLogTampered) {
+		return nil, status.Errorf(codes.DataLoss, "%v", err)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot verify audit log: %v", err)
+	}
+
+	res := &pb.VerifyAuditLogResponse{
+		RecordCount: count,
+		HeadHash:    headHash,
+	}
+	return res, nil
+}
+
+func toPbAuditRecord(record *AuditRecord) *pb.AuditRecord {
+	return &pb.AuditRecord{
+		Seq:      record.Seq,
+		Time:     timestamppb.New(record.Time),
+		Action:   record.Action,
+		Actor:    record.Actor,
+		Role:     record.Role,
+		Method:   record.Method,
+		Resource: record.Resource,
+		Code:     record.Code,
+		Peer:     record.Peer,
+		Detail:   record.Detail,
+		Hash:     record.Hash,
+	}
+}
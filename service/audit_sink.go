@@ -0,0 +1,42 @@
+package service
+
+import (
+	"log"
+	"time"
+)
+
+// AuditEvent is a security-relevant event, such as an account lockout or a call that changes data.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`             // what happened, e.g. "login.lockout" or "rpc"
+	Actor    string    `json:"actor,omitempty"`    // who caused it, if known
+	Role     string    `json:"role,omitempty"`     // the role of the actor, if known
+	Method   string    `json:"method,omitempty"`   // the full gRPC method of a call
+	Resource string    `json:"resource,omitempty"` // what it happened to, e.g. "user:user1"
+	Code     string    `json:"code,omitempty"`     // the status code of a call, e.g. "PermissionDenied"
+	Peer     string    `json:"peer,omitempty"`     // the address of the client, if known
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// AuditSink receives audit events.
+type AuditSink interface {
+	Record(event *AuditEvent) error
+}
+
+// LogAuditSink writes audit events to the standard logger.
+type LogAuditSink struct{}
+
+// NewLogAuditSink creates a new LogAuditSink.
+func NewLogAuditSink() *LogAuditSink {
+	return &LogAuditSink{}
+}
+
+// Record writes an audit event to the standard logger.
+func (sink *LogAuditSink) Record(event *AuditEvent) error {
+	log.Printf(
+		"audit: %s action=%s actor=%q role=%q method=%q resource=%q code=%q peer=%q detail=%q",
+		event.Time.Format(time.RFC3339), event.Action, event.Actor, event.Role, event.Method,
+		event.Resource, event.Code, event.Peer, event.Detail,
+	)
+	return nil
+}
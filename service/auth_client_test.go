@@ -0,0 +1,146 @@
+package service_test
+
+import (
+	"context"
+	"learngrpc/pcbook/client"
+	"learngrpc/pcbook/pb"
+	"learngrpc/pcbook/service"
+	"net"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientAuthInterceptorRefreshesBeforeExpiry(t *testing.T) {
+	t.Parallel()
+
+	jwtManager, err := service.NewJWTManagerWithKey(newTestSigningKey(t), 2*time.Second)
+	require.NoError(t, err)
+	counter, serverAddress := startTestAuthServer(t, jwtManager)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	authService := newTestAuthServiceClient(t, ctx, serverAddress)
+
+	// calls race with the refreshes in the background
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				_, err := authService.ListUsers(context.Background(), &pb.ListUsersRequest{})
+				if err != nil {
+					errs <- err
+					return
+				}
+				time.Sleep(250 * time.Millisecond)
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, <-errs)
+	}
+	require.GreaterOrEqual(t, counter.calls("RefreshToken"), 1)
+	require.Zero(t, counter.calls("Unauthenticated"))
+
+	// no more refresh once the context is canceled
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	refreshes := counter.calls("RefreshToken")
+	time.Sleep(2 * time.Second)
+	require.Equal(t, refreshes, counter.calls("RefreshToken"))
+}
+
+func TestClientAuthInterceptorRetriesUnauthenticated(t *testing.T) {
+	t.Parallel()
+
+	jwtManager, err := service.NewJWTManagerWithKey(newTestSigningKey(t), time.Minute)
+	require.NoError(t, err)
+	counter, serverAddress := startTestAuthServer(t, jwtManager)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	authService := newTestAuthServiceClient(t, ctx, serverAddress)
+
+	_, err = authService.ListUsers(context.Background(), &pb.ListUsersRequest{})
+	require.NoError(t, err)
+
+	// the tokens signed with the old key are rejected at once
+	err = jwtManager.Rotate(newTestSigningKey(t), 0)
+	require.NoError(t, err)
+
+	_, err = authService.ListUsers(context.Background(), &pb.ListUsersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 1, counter.calls("Unauthenticated"))
+	require.Equal(t, 1, counter.calls("RefreshToken"))
+	require.Equal(t, 3, counter.calls("ListUsers"))
+}
+
+// methodCounter counts the calls of each method, and the calls rejected as unauthenticated.
+type methodCounter struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func (counter *methodCounter) unary(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	res, err := handler(ctx, req)
+
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.counts[path.Base(info.FullMethod)]++
+	if status.Code(err) == codes.Unauthenticated {
+		counter.counts["Unauthenticated"]++
+	}
+	return res, err
+}
+
+func (counter *methodCounter) calls(name string) int {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	return counter.counts[name]
+}
+
+func startTestAuthServer(t *testing.T, jwtManager *service.JWTManager) (*methodCounter, string) {
+	revocationList := service.NewInMemoryRevocationList()
+	authServer := newTestAuthServerWithTokens(t, false, jwtManager, revocationList)
+	interceptor := service.NewAuthInterceptor(jwtManager, revocationList, nil, nil, service.NewDefaultPolicy())
+
+	counter := &methodCounter{counts: make(map[string]int)}
+	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(counter.unary, interceptor.Unary()))
+	pb.RegisterAuthServiceServer(grpcServer, authServer)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return counter, listener.Addr().String()
+}
+
+func newTestAuthServiceClient(t *testing.T, ctx context.Context, serverAddress string) pb.AuthServiceClient {
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	authClient := client.NewAuthClient(conn, "admin1", "secret")
+	interceptor, err := client.NewAuthInterceptor(ctx, authClient, client.NewAuthMethods())
+	require.NoError(t, err)
+
+	authConn, err := grpc.Dial(serverAddress, grpc.WithInsecure(), grpc.WithUnaryInterceptor(interceptor.Unary()))
+	require.NoError(t, err)
+	t.Cleanup(func() { authConn.Close() })
+
+	return pb.NewAuthServiceClient(authConn)
+}
@@ -2,8 +2,9 @@ package service
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
+	"sync"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -14,17 +15,50 @@ import (
 // AuthInterceptor is a server interceptor for authentication and authrization.
 type AuthInterceptor struct {
 	jwtManager *JWTManager
-	accessibleRols map[string][]string
+	revocationList RevocationList
+	apiKeyStore APIKeyStore
+	certIdentities *CertIdentityTable
+	mutex sync.RWMutex
+	policy *Policy
 }
 
 // NewAuthInterceptor creates a new AuthInterceptor.
-func NewAuthInterceptor(jwtManager *JWTManager, accessibleRols map[string][]string) *AuthInterceptor {
+// Tokens whose ID or session ID is in revocationList are rejected.
+// If apiKeyStore is not nil, a caller can authenticate with an API key in the x-api-key header.
+// If certIdentities is not nil, a caller without a token can authenticate with
+// a verified client certificate that is in the table.
+func NewAuthInterceptor(
+	jwtManager *JWTManager,
+	revocationList RevocationList,
+	apiKeyStore APIKeyStore,
+	certIdentities *CertIdentityTable,
+	policy *Policy,
+) *AuthInterceptor {
 	return &AuthInterceptor{
-		jwtManager,
-		accessibleRols,
+		jwtManager: jwtManager,
+		revocationList: revocationList,
+		apiKeyStore: apiKeyStore,
+		certIdentities: certIdentities,
+		policy: policy,
 	}
 }
 
+// Policy returns the authorization policy of the interceptor.
+func (interceptor *AuthInterceptor) Policy() *Policy {
+	interceptor.mutex.RLock()
+	defer interceptor.mutex.RUnlock()
+
+	return interceptor.policy
+}
+
+// SetPolicy replaces the authorization policy, e.g. when the policy file is reloaded.
+func (interceptor *AuthInterceptor) SetPolicy(policy *Policy) {
+	interceptor.mutex.Lock()
+	defer interceptor.mutex.Unlock()
+
+	interceptor.policy = policy
+}
+
 // Unary returns a new unary server interceptor for authentication and authorization.
 func (interceptor *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
 	return func (
@@ -35,7 +69,7 @@ func (interceptor *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
 	) (resp interface{}, err error) {
 		log.Println("--> unary interceptor: ", info.FullMethod)
 
-		err = interceptor.authorize(ctx, info.FullMethod) 
+		ctx, err = interceptor.authorize(ctx, info.FullMethod) 
 		if err != nil {
 			return nil, err
 		}
@@ -54,58 +88,128 @@ func (interceptor *AuthInterceptor) Stream() grpc.StreamServerInterceptor {
 	) error {
 		log.Println("--> stream interceptor: ", info.FullMethod)
 
-		err := interceptor.authorize(stream.Context(), info.FullMethod) 
+		ctx, err := interceptor.authorize(stream.Context(), info.FullMethod) 
 		if err != nil {
 			return  err
 		}
 
-		return handler(srv, stream)
+		return handler(srv, &serverStreamWithContext{stream, ctx})
 	}
 }
 
-func (interceptor *AuthInterceptor) authorize(ctx context.Context, fullMethod string) error {
+// authorize checks that the caller may access the RPC, and returns the context
+// with the verified user claims attached when a token or client certificate is required.
+func (interceptor *AuthInterceptor) authorize(ctx context.Context, fullMethod string) (context.Context, error) {
 
 	// check if the user has the role to access the RPC
-	accessibleRoles, ok := interceptor.accessibleRols[fullMethod]
-	if !ok {
-		// no role is specified, public RPC
-		return nil
+	public, accessibleRoles := interceptor.Policy().Access(fullMethod)
+	if public {
+		return ctx, nil
 	}
-
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		return status.Errorf(codes.Unauthenticated, "metadata is not provided")
+	if len(accessibleRoles) == 0 {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is denied by the authorization policy", fullMethod)
 	}
 
-	values := md["authorization"]
-	if len(values) == 0 {
-		return status.Errorf(codes.Unauthenticated, "authorization token is not provided")
-	}
-	
-	accessibletoken := values[0]
-	claims, err := interceptor.jwtManager.Verify(accessibletoken)
+	claims, err := interceptor.authenticate(ctx)
 	if err != nil {
-		return status.Errorf(codes.Unauthenticated, "accessibletoken is invalid: %v", err)
+		return nil, err
 	}
+	setAuditClaims(ctx, claims)
 
 	for _, role := range accessibleRoles {
 		if role == claims.Role {
-			return nil
+			return ContextWithUserClaims(ctx, claims), nil
 		}
 	}
 
-	return status.Errorf(codes.PermissionDenied, "role %s cannot access %s", claims.Role, fullMethod)
+	return nil, status.Errorf(codes.PermissionDenied, "role %s cannot access %s", claims.Role, fullMethod)
 }	
 
-// NewAccessibleRoles creates a new map of accessible roles.
-func NewAccessibleRoles() map[string][]string {
-	packagePath := "techschool.pcbook"
-	laptopServicePath := fmt.Sprintf("/%s.LaptopService/", packagePath)
-	// if RPC calls are not in the same package, we need to use the full path
-	// if calls are not in the map, they are public to everyone
-	return map[string][]string{
-		laptopServicePath + "CreateLaptop": {"admin"},
-		laptopServicePath + "UploadImage": {"admin"},
-		laptopServicePath + "RateLaptop": {"admin", "user"},
+// authenticate returns the verified claims of the caller, from the access token if any,
+// or else from the API key, or else from the client certificate of the peer.
+func (interceptor *AuthInterceptor) authenticate(ctx context.Context) (*UserClaims, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md["authorization"]
+	if len(values) > 0 {
+		return interceptor.verifyToken(values[0])
+	}
+
+	values = md["x-api-key"]
+	if len(values) > 0 && interceptor.apiKeyStore != nil {
+		return interceptor.verifyAPIKey(values[0])
 	}
-}
\ No newline at end of file
+
+	if interceptor.certIdentities != nil {
+		claims, err := interceptor.certIdentities.claimsFromPeerCert(ctx)
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "client certificate is not accepted: %v", err)
+		}
+		if claims != nil {
+			return claims, nil
+		}
+	}
+
+	return nil, status.Errorf(codes.Unauthenticated, "authorization token is not provided")
+}
+
+// verifyToken verifies an access token that is not revoked.
+func (interceptor *AuthInterceptor) verifyToken(accessToken string) (*UserClaims, error) {
+	claims, err := interceptor.jwtManager.Verify(accessToken)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "access token is invalid: %v", err)
+	}
+
+	for _, id := range []string{claims.Id, claims.SessionID} {
+		revoked, err := interceptor.revocationList.IsRevoked(id)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot check token revocation: %v", err)
+		}
+		if revoked {
+			return nil, status.Errorf(codes.Unauthenticated, "access token is revoked")
+		}
+	}
+
+	return claims, nil
+}
+
+// verifyAPIKey verifies an API key, and returns claims with its role and team.
+func (interceptor *AuthInterceptor) verifyAPIKey(secret string) (*UserClaims, error) {
+	key, err := interceptor.apiKeyStore.Verify(secret)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, status.Errorf(codes.Unauthenticated, "api key is invalid, revoked or expired")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot verify api key: %v", err)
+	}
+
+	claims := &UserClaims{
+		Username: key.Username(),
+		Role:     key.Role,
+		Team:     key.Team,
+	}
+	return claims, nil
+}
+
+type userClaimsKey struct{}
+
+// ContextWithUserClaims returns a copy of ctx that carries the verified claims of the caller.
+func ContextWithUserClaims(ctx context.Context, claims *UserClaims) context.Context {
+	return context.WithValue(ctx, userClaimsKey{}, claims)
+}
+
+// UserClaimsFromContext returns the verified claims of the caller, if any.
+func UserClaimsFromContext(ctx context.Context) (*UserClaims, bool) {
+	claims, ok := ctx.Value(userClaimsKey{}).(*UserClaims)
+	return claims, ok
+}
+
+// serverStreamWithContext is a server stream whose context carries the user claims.
+type serverStreamWithContext struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the context of the stream.
+func (stream *serverStreamWithContext) Context() context.Context {
+	return stream.ctx
+}
@@ -2,46 +2,1037 @@ package service
 
 import (
 	"context"
+	"errors"
 	"learngrpc/pcbook/pb"
+	"log"
+	"net"
+	"regexp"
+	"time"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+const (
+	defaultRole         = "user"
+	inviteTTL           = 7 * 24 * time.Hour
+	defaultUserPageSize = 50
+	maxUserPageSize     = 500
+)
+
+// knownRoles are the roles that can be given to a user.
+var knownRoles = map[string]bool{
+	"admin":  true,
+	"seller": true,
+	"user":   true,
+}
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+var teamPattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// errInvalidSecondFactor is returned when the TOTP code or recovery code of a login is wrong or already used.
+var errInvalidSecondFactor = status.Errorf(codes.Unauthenticated, "invalid two-factor authentication code, log in again")
+
 // AuthServer is the server for authentication service.
 type AuthServer struct {
 	userStore UserStore
+	inviteStore InviteStore
+	refreshTokenStore RefreshTokenStore
+	revocationList RevocationList
+	apiKeyStore APIKeyStore
+	loginChallengeStore LoginChallengeStore
+	loginThrottle *LoginThrottle
+	oidcVerifier *OIDCVerifier
+	authenticator Authenticator
+	passwordPolicy *PasswordPolicy
 	jwtManager *JWTManager
+	mfaRequiredRoles map[string]bool
+	inviteOnly bool
 	pb.UnimplementedAuthServiceServer
 }
 
 // NewAuthServer creates a new AuthServer.
-func NewAuthServer(userStore UserStore, jwtManager *JWTManager) *AuthServer {
+// If loginThrottle is not nil, it delays and locks out the logins after failed attempts.
+// If oidcVerifier is not nil, users can log in with the ID tokens of an identity provider.
+// If authenticator is not nil, it checks the passwords at login instead of the password hashes of userStore.
+// The new passwords must follow passwordPolicy, which is the default policy if it is nil.
+// The users with one of mfaRequiredRoles must log in with a TOTP code, or with a second factor at the identity
+// provider, and cannot log in until they enroll: they get such a role only once enrolled.
+// If inviteOnly is true, users can only register with an invite code created by an admin.
+func NewAuthServer(
+	userStore UserStore,
+	inviteStore InviteStore,
+	refreshTokenStore RefreshTokenStore,
+	revocationList RevocationList,
+	apiKeyStore APIKeyStore,
+	loginChallengeStore LoginChallengeStore,
+	loginThrottle *LoginThrottle,
+	oidcVerifier *OIDCVerifier,
+	authenticator Authenticator,
+	passwordPolicy *PasswordPolicy,
+	jwtManager *JWTManager,
+	mfaRequiredRoles []string,
+	inviteOnly bool,
+) *AuthServer {
+	mfaRequired := make(map[string]bool)
+	for _, role := range mfaRequiredRoles {
+		mfaRequired[role] = true
+	}
+
+	if passwordPolicy == nil {
+		passwordPolicy = DefaultPasswordPolicy()
+	}
+
 	return &AuthServer{
 		userStore: userStore,
+		inviteStore: inviteStore,
+		refreshTokenStore: refreshTokenStore,
+		revocationList: revocationList,
+		apiKeyStore: apiKeyStore,
+		loginChallengeStore: loginChallengeStore,
+		loginThrottle: loginThrottle,
+		oidcVerifier: oidcVerifier,
+		authenticator: authenticator,
+		passwordPolicy: passwordPolicy,
 		jwtManager: jwtManager,
+		mfaRequiredRoles: mfaRequired,
+		inviteOnly: inviteOnly,
 	}
 }
 
-// Login is a unary RPC to login.
+// Login is a unary RPC to login, which starts a new session with an access and refresh token pair.
+// If the user enrolled in two-factor authentication, it returns a challenge instead,
+// and CompleteLogin with a TOTP code starts the session. A user whose role requires two-factor
+// authentication cannot log in before enrolling, which is done with EnrollTotp before getting the role.
+// After failed attempts, the next ones for the same username or from the same IP must wait,
+// and get a ResourceExhausted error with the delay whether or not the password is correct.
+// If the password hash uses an outdated algorithm or cost, it is replaced by one of the password policy.
 func (server *AuthServer)	Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
-	user, err := server.userStore.Find(req.GetUsername())
+	attempt, err := server.beginLoginAttempt(req.GetUsername(), peerIP(ctx))
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+		return nil, err
+	}
+	defer attempt.end()
+
+	user, err := server.authenticate(req.GetUsername(), req.GetPassword())
+	if err != nil {
+		return nil, err
 	}
 
-	if user == nil || !user.IsCorrectPassword(req.GetPassword()) {
+	if user == nil {
+		attempt.fail()
 		return nil, status.Errorf(codes.NotFound, "invalid username or password")
 	}
 
-	token, err := server.jwtManager.Generate(user)
+	if user.Disabled {
+		return nil, status.Errorf(codes.PermissionDenied, "user is disabled")
+	}
+
+	server.rehashPassword(user, req.GetPassword())
+
+	if user.HasTOTP() {
+		return server.startLoginChallenge(user)
+	}
+	if server.mfaRequiredRoles[user.Role] {
+		return nil, status.Errorf(codes.FailedPrecondition, "role %s requires two-factor authentication, which user %s has not enrolled in", user.Role, user.Username)
+	}
+
+	attempt.succeed()
+
+	token, refreshToken, err := server.startSession(user, false)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot generate token: %v", err)
+		return nil, err
 	}
 
 	res := &pb.LoginResponse{
 		Token: token,
+		RefreshToken: refreshToken,
 	}	
 
 	return res, nil
 }
+
+// CompleteLogin is a unary RPC to pass the second step of a login with a TOTP code or a recovery code,
+// which starts a new session. A challenge can only be used once, even if the code is wrong.
+func (server *AuthServer) CompleteLogin(ctx context.Context, req *pb.CompleteLoginRequest) (*pb.CompleteLoginResponse, error) {
+	challenge, err := server.loginChallengeStore.Find(req.GetChallenge())
+	if errors.Is(err, ErrLoginChallengeNotFound) {
+		return nil, status.Errorf(codes.Unauthenticated, "login challenge is invalid or expired, log in again")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find login challenge: %v", err)
+	}
+
+	attempt, err := server.beginLoginAttempt(challenge.Username, peerIP(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer attempt.end()
+
+	// the challenge is deleted before it is used, so that concurrent calls cannot both use it
+	err = server.loginChallengeStore.Delete(challenge.ID)
+	if errors.Is(err, ErrLoginChallengeNotFound) {
+		return nil, status.Errorf(codes.Unauthenticated, "login challenge is invalid or expired, log in again")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot delete login challenge: %v", err)
+	}
+
+	// the code is checked and used in one step, so that it cannot be used again concurrently
+	now := time.Now()
+	user, err := server.modifyUser(challenge.Username, func(user *User) error {
+		if user.Disabled {
+			return status.Errorf(codes.PermissionDenied, "user is disabled")
+		}
+
+		ok := false
+		if req.GetTotpCode() != "" && user.HasTOTP() {
+			ok = user.CheckTOTP(req.GetTotpCode(), now)
+		} else if req.GetRecoveryCode() != "" && user.HasTOTP() {
+			ok = user.UseRecoveryCode(req.GetRecoveryCode())
+		}
+		if !ok {
+			return errInvalidSecondFactor
+		}
+		return nil
+	})
+	if err == errInvalidSecondFactor {
+		attempt.fail()
+	}
+	if err != nil {
+		return nil, err
+	}
+	attempt.succeed()
+
+	res := &pb.CompleteLoginResponse{}
+
+	res.Token, res.RefreshToken, err = server.startSession(user, true)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ExchangeToken is a unary RPC to log in with an ID token of the identity provider, which starts a new session.
+// The role and team of the user come from its groups, and the user is created at its first login.
+// Local users cannot log in this way, so that the identity provider cannot take over their accounts.
+func (server *AuthServer) ExchangeToken(ctx context.Context, req *pb.ExchangeTokenRequest) (*pb.ExchangeTokenResponse, error) {
+	if server.oidcVerifier == nil {
+		return nil, status.Errorf(codes.Unimplemented, "no identity provider is configured")
+	}
+
+	identity, err := server.oidcVerifier.Verify(ctx, req.GetIdToken())
+	if errors.Is(err, ErrOIDCNoRole) {
+		return nil, status.Errorf(codes.PermissionDenied, "user %s is in no group that has access", identity.Username)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "cannot verify id token: %v", err)
+	}
+	if !usernamePattern.MatchString(identity.Username) {
+		return nil, status.Errorf(codes.PermissionDenied, "username %q of the identity provider is not a valid username", identity.Username)
+	}
+
+	user, err := server.provisionUser(identity)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, status.Errorf(codes.PermissionDenied, "user is disabled")
+	}
+	if server.mfaRequiredRoles[user.Role] && !identity.MFA {
+		return nil, status.Errorf(codes.PermissionDenied, "role %s requires a second factor at the identity provider", user.Role)
+	}
+
+	token, refreshToken, err := server.startSession(user, identity.MFA)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.ExchangeTokenResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		User:         toPbUserAccount(user),
+	}
+	return res, nil
+}
+
+// RefreshToken is a unary RPC to exchange a refresh token for a new token pair.
+// A refresh token can only be used once: if it is used again, the whole session is revoked,
+// because either the user or an attacker holds a stolen copy of it.
+func (server *AuthServer) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	refreshToken, err := server.refreshTokenStore.Rotate(req.GetRefreshToken())
+	if errors.Is(err, ErrRefreshTokenReused) {
+		log.Printf("refresh token of user %s was reused, revoking session", refreshToken.Username)
+
+		err = server.revokeSession(refreshToken.FamilyID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "refresh token was already used, the session is revoked")
+	}
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return nil, status.Errorf(codes.Unauthenticated, "refresh token is invalid or expired")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot rotate refresh token: %v", err)
+	}
+
+	// the role or status of the user may have changed since the login
+	user, err := server.findUser(refreshToken.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		err = server.revokeSession(refreshToken.FamilyID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "user is disabled")
+	}
+	if server.mfaRequiredRoles[user.Role] && !refreshToken.MFA {
+		err = server.revokeSession(refreshToken.FamilyID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "role %s requires two-factor authentication, log in again", user.Role)
+	}
+
+	token, err := server.jwtManager.Generate(user, refreshToken.FamilyID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate token: %v", err)
+	}
+
+	res := &pb.RefreshTokenResponse{
+		Token:        token,
+		RefreshToken: refreshToken.Token,
+	}
+	return res, nil
+}
+
+// Logout is a unary RPC to revoke the session of the caller,
+// so that neither its access token nor its refresh token can be used anymore.
+func (server *AuthServer) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "user claims are not provided")
+	}
+
+	err := server.revocationList.Revoke(claims.Id, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot revoke token: %v", err)
+	}
+
+	if claims.SessionID != "" {
+		err = server.revokeSession(claims.SessionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &pb.LogoutResponse{}, nil
+}
+
+// Register is a unary RPC to create a new user, with the role and team of the invite if a code is given.
+func (server *AuthServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	username := req.GetUsername()
+	if !usernamePattern.MatchString(username) {
+		return nil, status.Errorf(codes.InvalidArgument, "username must have 3 to 32 letters, digits, '_', '.' or '-'")
+	}
+	err := server.passwordPolicy.Check(req.GetPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	existing, err := server.userStore.Find(username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+	if existing != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "user already exists: %s", username)
+	}
+
+	role := defaultRole
+	team := ""
+	if server.inviteOnly || req.GetInviteCode() != "" {
+		if req.GetInviteCode() == "" {
+			return nil, status.Errorf(codes.PermissionDenied, "an invite code is required to register")
+		}
+
+		invite, err := server.inviteStore.Redeem(req.GetInviteCode())
+		if errors.Is(err, ErrInviteNotFound) {
+			return nil, status.Errorf(codes.PermissionDenied, "invite code is invalid or expired")
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot redeem invite: %v", err)
+		}
+		role = invite.Role
+		team = invite.Team
+	}
+
+	user := &User{
+		Username: username,
+		Role: role,
+		Team: team,
+	}
+
+	err = user.SetPassword(req.GetPassword(), server.passwordPolicy.Hasher())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create user: %v", err)
+	}
+
+	err = server.userStore.Save(user)
+	if errors.Is(err, ErrAlreadyExists) {
+		return nil, status.Errorf(codes.AlreadyExists, "user already exists: %s", username)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot save user: %v", err)
+	}
+	log.Printf("registered user %s with role %s", username, role)
+
+	res := &pb.RegisterResponse{
+		Username: user.Username,
+		Role:     user.Role,
+		Team:     user.Team,
+	}
+	return res, nil
+}
+
+// CreateInvite is a unary RPC to create a single-use invite code to register a user with a role and a team.
+func (server *AuthServer) CreateInvite(ctx context.Context, req *pb.CreateInviteRequest) (*pb.CreateInviteResponse, error) {
+	role := req.GetRole()
+	if role == "" {
+		role = defaultRole
+	}
+	if !knownRoles[role] {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown role: %s", role)
+	}
+	// a new user cannot log in before enrolling, so it gets such a role once enrolled, with SetUserRole
+	if server.mfaRequiredRoles[role] {
+		return nil, status.Errorf(codes.FailedPrecondition, "role %s requires two-factor authentication, which a new user has not enrolled in", role)
+	}
+	if req.GetTeam() != "" && !teamPattern.MatchString(req.GetTeam()) {
+		return nil, status.Errorf(codes.InvalidArgument, "team must have 1 to 64 letters, digits, '_', '.' or '-'")
+	}
+
+	invite, err := server.inviteStore.Create(role, req.GetTeam(), inviteTTL)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create invite: %v", err)
+	}
+
+	res := &pb.CreateInviteResponse{
+		Code:       invite.Code,
+		ExpireTime: timestamppb.New(invite.ExpiresAt),
+	}
+	return res, nil
+}
+
+// ChangePassword is a unary RPC to change the password of the caller, which requires the old password.
+func (server *AuthServer) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "user claims are not provided")
+	}
+
+	err := server.passwordPolicy.Check(req.GetNewPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "new %v", err)
+	}
+
+	user, err := server.findUser(claims.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, status.Errorf(codes.PermissionDenied, "user is disabled")
+	}
+	if user.Issuer != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "the password of user %s is managed by %s", user.Username, user.Issuer)
+	}
+	if !user.IsCorrectPassword(req.GetOldPassword()) {
+		return nil, status.Errorf(codes.PermissionDenied, "old password is incorrect")
+	}
+
+	// the password is hashed before the user is locked, since it is slow
+	hashedPassword, err := server.passwordPolicy.Hasher().Hash(req.GetNewPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot set password: %v", err)
+	}
+
+	_, err = server.modifyUser(user.Username, func(stored *User) error {
+		if stored.Disabled {
+			return status.Errorf(codes.PermissionDenied, "user is disabled")
+		}
+		if stored.HashedPassword != user.HashedPassword {
+			return status.Errorf(codes.Aborted, "password was changed concurrently")
+		}
+		stored.HashedPassword = hashedPassword
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ChangePasswordResponse{}, nil
+}
+
+// EnrollTotp is a unary RPC to start the two-factor authentication enrollment of the caller.
+// It returns a new TOTP secret, which ConfirmTotp enables with a first code.
+func (server *AuthServer) EnrollTotp(ctx context.Context, req *pb.EnrollTotpRequest) (*pb.EnrollTotpResponse, error) {
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "user claims are not provided")
+	}
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create totp secret: %v", err)
+	}
+
+	user, err := server.modifyUser(claims.Username, func(user *User) error {
+		if user.HasTOTP() {
+			return status.Errorf(codes.FailedPrecondition, "two-factor authentication is already enabled")
+		}
+		user.PendingTOTPSecret = secret
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.EnrollTotpResponse{Enrollment: toPbTotpEnrollment(user)}, nil
+}
+
+// ConfirmTotp is a unary RPC to enable the two-factor authentication of the caller with a first code.
+// It returns the one-time recovery codes.
+func (server *AuthServer) ConfirmTotp(ctx context.Context, req *pb.ConfirmTotpRequest) (*pb.ConfirmTotpResponse, error) {
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "user claims are not provided")
+	}
+
+	var recoveryCodes []string
+	now := time.Now()
+	user, err := server.modifyUser(claims.Username, func(user *User) error {
+		if user.HasTOTP() {
+			return status.Errorf(codes.FailedPrecondition, "two-factor authentication is already enabled")
+		}
+		if user.PendingTOTPSecret == "" {
+			return status.Errorf(codes.FailedPrecondition, "two-factor authentication enrollment is not started")
+		}
+		if !user.CheckTOTP(req.GetCode(), now) {
+			return status.Errorf(codes.InvalidArgument, "invalid two-factor authentication code")
+		}
+
+		var err error
+		recoveryCodes, err = confirmTOTP(user)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("user %s enrolled in two-factor authentication", user.Username)
+
+	return &pb.ConfirmTotpResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+// ListUsers is a unary RPC to list the users by username, page by page.
+func (server *AuthServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultUserPageSize
+	}
+	if pageSize > maxUserPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, "page size must not exceed %d", maxUserPageSize)
+	}
+
+	offset, err := decodePageToken(req.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "page token is invalid")
+	}
+
+	users, total, err := server.userStore.List(offset, pageSize)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list users: %v", err)
+	}
+
+	res := &pb.ListUsersResponse{}
+	for _, user := range users {
+		res.Users = append(res.Users, toPbUserAccount(user))
+	}
+	if offset+len(users) < total {
+		res.NextPageToken = encodePageToken(offset + len(users))
+	}
+
+	return res, nil
+}
+
+// SetUserRole is a unary RPC to change the role of another user.
+// The sessions of the user are revoked, so that the new role applies from the next login.
+func (server *AuthServer) SetUserRole(ctx context.Context, req *pb.SetUserRoleRequest) (*pb.SetUserRoleResponse, error) {
+	if !knownRoles[req.GetRole()] {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown role: %s", req.GetRole())
+	}
+
+	user, err := server.modifyOtherUser(ctx, req.GetUsername(), func(user *User) error {
+		if server.mfaRequiredRoles[req.GetRole()] && !user.HasTOTP() {
+			return status.Errorf(codes.FailedPrecondition, "role %s requires two-factor authentication, which user %s has not enrolled in", req.GetRole(), user.Username)
+		}
+		user.Role = req.GetRole()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("set role of user %s to %s", user.Username, user.Role)
+
+	err = server.revokeUserSessions(user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SetUserRoleResponse{User: toPbUserAccount(user)}, nil
+}
+
+// DisableUser is a unary RPC to prevent another user from logging in, and to revoke their sessions.
+func (server *AuthServer) DisableUser(ctx context.Context, req *pb.DisableUserRequest) (*pb.DisableUserResponse, error) {
+	user, err := server.modifyOtherUser(ctx, req.GetUsername(), func(user *User) error {
+		user.Disabled = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("disabled user %s", user.Username)
+
+	err = server.revokeUserSessions(user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.DisableUserResponse{User: toPbUserAccount(user)}, nil
+}
+
+// UnlockUser is a unary RPC to forget the failed login attempts of a user, which can log in again at once.
+func (server *AuthServer) UnlockUser(ctx context.Context, req *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error) {
+	user, err := server.findUser(req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	wasLocked := false
+	if server.loginThrottle != nil {
+		wasLocked = server.loginThrottle.Unlock(user.Username)
+	}
+	log.Printf("unlocked user %s", user.Username)
+
+	res := &pb.UnlockUserResponse{
+		User:      toPbUserAccount(user),
+		WasLocked: wasLocked,
+	}
+	return res, nil
+}
+
+// CreateApiKey is a unary RPC to create an API key for a machine client with a role, a team and an optional expiry.
+// The secret key is only returned in the response.
+func (server *AuthServer) CreateApiKey(ctx context.Context, req *pb.CreateApiKeyRequest) (*pb.CreateApiKeyResponse, error) {
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "user claims are not provided")
+	}
+
+	if !usernamePattern.MatchString(req.GetName()) {
+		return nil, status.Errorf(codes.InvalidArgument, "name must have 3 to 32 letters, digits, '_', '.' or '-'")
+	}
+	if !knownRoles[req.GetRole()] {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown role: %s", req.GetRole())
+	}
+	if req.GetTeam() != "" && !teamPattern.MatchString(req.GetTeam()) {
+		return nil, status.Errorf(codes.InvalidArgument, "team must have 1 to 64 letters, digits, '_', '.' or '-'")
+	}
+
+	key := &APIKey{
+		Name:      req.GetName(),
+		Role:      req.GetRole(),
+		Team:      req.GetTeam(),
+		CreatedBy: claims.Username,
+	}
+	if req.GetExpireTime() != nil {
+		err := req.GetExpireTime().CheckValid()
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "expire time is invalid: %v", err)
+		}
+		key.ExpiresAt = req.GetExpireTime().AsTime()
+		if !key.ExpiresAt.After(time.Now()) {
+			return nil, status.Errorf(codes.InvalidArgument, "expire time must be in the future")
+		}
+	}
+
+	key, secret, err := server.apiKeyStore.Create(key)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create api key: %v", err)
+	}
+	log.Printf("user %s created api key %s for %s with role %s", claims.Username, key.Prefix, key.Name, key.Role)
+
+	res := &pb.CreateApiKeyResponse{
+		ApiKey: toPbApiKey(key),
+		Key:    secret,
+	}
+	return res, nil
+}
+
+// ListApiKeys is a unary RPC to list the API keys by creation time, without their secrets.
+func (server *AuthServer) ListApiKeys(ctx context.Context, req *pb.ListApiKeysRequest) (*pb.ListApiKeysResponse, error) {
+	keys, err := server.apiKeyStore.List()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list api keys: %v", err)
+	}
+
+	res := &pb.ListApiKeysResponse{}
+	for _, key := range keys {
+		res.ApiKeys = append(res.ApiKeys, toPbApiKey(key))
+	}
+	return res, nil
+}
+
+// RevokeApiKey is a unary RPC to revoke an API key, which is rejected from the next call on.
+func (server *AuthServer) RevokeApiKey(ctx context.Context, req *pb.RevokeApiKeyRequest) (*pb.RevokeApiKeyResponse, error) {
+	key, err := server.apiKeyStore.Revoke(req.GetPrefix())
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, status.Errorf(codes.NotFound, "api key not found: %s", req.GetPrefix())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot revoke api key: %v", err)
+	}
+	log.Printf("revoked api key %s", key.Prefix)
+
+	return &pb.RevokeApiKeyResponse{ApiKey: toPbApiKey(key)}, nil
+}
+
+// provisionUser creates or updates the user of an identity verified by the identity provider.
+// The username claim only names the account: an existing user is only logged in if it was
+// created for the same subject of the provider, so that a reused username cannot take it over.
+func (server *AuthServer) provisionUser(identity *OIDCIdentity) (*User, error) {
+	issuer := server.oidcVerifier.Issuer()
+
+	user, err := server.userStore.Find(identity.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+
+	if user == nil {
+		user = &User{
+			Username: identity.Username,
+			Role:     identity.Role,
+			Team:     identity.Team,
+			Issuer:   issuer,
+			Subject:  identity.Subject,
+		}
+		err = server.userStore.Save(user)
+		if errors.Is(err, ErrAlreadyExists) {
+			return nil, status.Errorf(codes.Aborted, "user %s was created concurrently, retry", user.Username)
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot save user: %v", err)
+		}
+		log.Printf("provisioned user %s with role %s from %s", user.Username, user.Role, issuer)
+		return user, nil
+	}
+
+	if user.Issuer != issuer {
+		return nil, status.Errorf(codes.PermissionDenied, "user %s is not managed by the identity provider", user.Username)
+	}
+	// the username claim can be reused by another user of the provider, while the subject cannot
+	if user.Subject == "" || user.Subject != identity.Subject {
+		return nil, status.Errorf(codes.PermissionDenied, "user %s belongs to another subject of the identity provider", user.Username)
+	}
+
+	// the groups at the identity provider are the source of truth
+	if user.Role != identity.Role || user.Team != identity.Team {
+		user, err = server.modifyUser(user.Username, func(user *User) error {
+			user.Role = identity.Role
+			user.Team = identity.Team
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("updated role of user %s to %s from %s", user.Username, user.Role, issuer)
+	}
+	return user, nil
+}
+
+// startLoginChallenge returns a challenge for the second step of the login of an enrolled user.
+func (server *AuthServer) startLoginChallenge(user *User) (*pb.LoginResponse, error) {
+	challenge, err := server.loginChallengeStore.Create(user.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create login challenge: %v", err)
+	}
+
+	return &pb.LoginResponse{Challenge: challenge.ID}, nil
+}
+
+// startSession starts a new session for a user, and returns its access and refresh tokens.
+func (server *AuthServer) startSession(user *User, mfa bool) (string, string, error) {
+	refreshToken, err := server.refreshTokenStore.Issue(user.Username, mfa)
+	if err != nil {
+		return "", "", status.Errorf(codes.Internal, "cannot issue refresh token: %v", err)
+	}
+
+	token, err := server.jwtManager.Generate(user, refreshToken.FamilyID)
+	if err != nil {
+		return "", "", status.Errorf(codes.Internal, "cannot generate token: %v", err)
+	}
+	return token, refreshToken.Token, nil
+}
+
+// confirmTOTP enables the pending TOTP secret of a user whose first code was checked,
+// and returns new recovery codes.
+func confirmTOTP(user *User) ([]string, error) {
+	recoveryCodes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create recovery codes: %v", err)
+	}
+
+	user.TOTPSecret = user.PendingTOTPSecret
+	user.PendingTOTPSecret = ""
+	user.RecoveryCodeHashes = hashes
+	return recoveryCodes, nil
+}
+
+// modifyOtherUser changes a user that is not the caller, so that admins cannot lock themselves out.
+func (server *AuthServer) modifyOtherUser(ctx context.Context, username string, change func(user *User) error) (*User, error) {
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "user claims are not provided")
+	}
+	if claims.Username == username {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot change your own account")
+	}
+
+	return server.modifyUser(username, change)
+}
+
+// revokeSession revokes the refresh tokens of a session, and the access tokens issued for it
+// until they would have expired.
+func (server *AuthServer) revokeSession(sessionID string) error {
+	err := server.refreshTokenStore.RevokeFamily(sessionID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot revoke refresh tokens: %v", err)
+	}
+
+	err = server.revocationList.Revoke(sessionID, time.Now().Add(server.jwtManager.TokenDuration()))
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot revoke session: %v", err)
+	}
+	return nil
+}
+
+// revokeUserSessions revokes all the sessions of a user, like revokeSession.
+func (server *AuthServer) revokeUserSessions(username string) error {
+	sessionIDs, err := server.refreshTokenStore.RevokeUser(username)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot revoke refresh tokens: %v", err)
+	}
+
+	for _, sessionID := range sessionIDs {
+		err = server.revocationList.Revoke(sessionID, time.Now().Add(server.jwtManager.TokenDuration()))
+		if err != nil {
+			return status.Errorf(codes.Internal, "cannot revoke session: %v", err)
+		}
+	}
+	log.Printf("revoked %d sessions of user %s", len(sessionIDs), username)
+	return nil
+}
+
+// authenticate returns the user if the password is correct, or nil if the username or password is invalid.
+func (server *AuthServer) authenticate(username string, password string) (*User, error) {
+	if server.authenticator != nil {
+		user, err := server.authenticator.Authenticate(username, password)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "cannot authenticate user: %v", err)
+		}
+		return user, nil
+	}
+
+	user, err := server.userStore.Find(username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+	if user == nil || !user.IsCorrectPassword(password) {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// rehashPassword replaces the password hash of a user who just logged in, if it uses another algorithm
+// or cost than the password policy. A failure is only logged, since the old hash still works.
+func (server *AuthServer) rehashPassword(user *User, password string) {
+	hasher := server.passwordPolicy.Hasher()
+	if user.Issuer != "" || user.HashedPassword == "" || !hasher.NeedsRehash(user.HashedPassword) {
+		return
+	}
+
+	// only the hash is replaced, and only if the password was not changed since the login
+	hashedPassword, err := hasher.Hash(password)
+	if err == nil {
+		_, err = server.userStore.Modify(user.Username, func(stored *User) error {
+			if stored.HashedPassword == user.HashedPassword {
+				stored.HashedPassword = hashedPassword
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		log.Printf("cannot rehash password of user %s: %v", user.Username, err)
+		return
+	}
+	log.Printf("rehashed password of user %s", user.Username)
+}
+
+func (server *AuthServer) findUser(username string) (*User, error) {
+	user, err := server.userStore.Find(username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+	if user == nil {
+		return nil, status.Errorf(codes.NotFound, "user not found: %s", username)
+	}
+	return user, nil
+}
+
+// modifyUser changes an existing user in one step with change, and returns the changed user.
+// The status errors returned by change are returned as is.
+func (server *AuthServer) modifyUser(username string, change func(user *User) error) (*User, error) {
+	user, err := server.userStore.Modify(username, change)
+	if err == nil {
+		return user, nil
+	}
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, status.Errorf(codes.NotFound, "user not found: %s", username)
+	}
+	if _, ok := status.FromError(err); ok {
+		return nil, err
+	}
+	return nil, status.Errorf(codes.Internal, "cannot update user: %v", err)
+}
+
+// loginAttempt is a login attempt that began in the login throttle of the server, if it has one.
+type loginAttempt struct {
+	throttle *LoginThrottle
+	username string
+	ip       string
+	ended    bool
+}
+
+// beginLoginAttempt begins a login attempt, or returns a ResourceExhausted error if it must wait.
+// The attempt must be ended, by end if it neither succeeded nor failed.
+func (server *AuthServer) beginLoginAttempt(username string, ip string) (*loginAttempt, error) {
+	attempt := &loginAttempt{
+		throttle: server.loginThrottle,
+		username: username,
+		ip:       ip,
+	}
+	if attempt.throttle == nil {
+		attempt.ended = true
+		return attempt, nil
+	}
+
+	wait := attempt.throttle.Begin(username, ip)
+	if wait > 0 {
+		return nil, tooManyLoginAttempts(wait)
+	}
+	return attempt, nil
+}
+
+// succeed ends the attempt as a success.
+func (attempt *loginAttempt) succeed() {
+	if !attempt.ended {
+		attempt.throttle.RecordSuccess(attempt.username, attempt.ip)
+		attempt.ended = true
+	}
+}
+
+// fail ends the attempt as a failure.
+func (attempt *loginAttempt) fail() {
+	if !attempt.ended {
+		attempt.throttle.RecordFailure(attempt.username, attempt.ip)
+		attempt.ended = true
+	}
+}
+
+// end ends the attempt if it has not ended yet, e.g. because of an error or a disabled user,
+// so that the next attempts need not wait for it.
+func (attempt *loginAttempt) end() {
+	if !attempt.ended {
+		attempt.throttle.Release(attempt.username, attempt.ip)
+		attempt.ended = true
+	}
+}
+
+// tooManyLoginAttempts returns the error of a throttled login, which is the same
+// for a delay and a lockout so that it tells nothing about the account.
+func tooManyLoginAttempts(wait time.Duration) error {
+	st := status.New(codes.ResourceExhausted, "too many failed login attempts, retry later")
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// peerIP returns the IP address of the client, or "" if it is unknown.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	if addr, ok := p.Addr.(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+func toPbTotpEnrollment(user *User) *pb.TotpEnrollment {
+	return &pb.TotpEnrollment{
+		Secret:     user.PendingTOTPSecret,
+		OtpauthUri: TOTPURI(user.Username, user.PendingTOTPSecret),
+	}
+}
+
+func toPbUserAccount(user *User) *pb.UserAccount {
+	return &pb.UserAccount{
+		Username: user.Username,
+		Role:     user.Role,
+		Disabled: user.Disabled,
+		Team:     user.Team,
+		Issuer:   user.Issuer,
+	}
+}
+
+func toPbApiKey(key *APIKey) *pb.ApiKey {
+	pbKey := &pb.ApiKey{
+		Prefix:     key.Prefix,
+		Name:       key.Name,
+		Role:       key.Role,
+		Team:       key.Team,
+		CreatedBy:  key.CreatedBy,
+		CreateTime: timestamppb.New(key.CreatedAt),
+		Revoked:    key.Revoked,
+	}
+	if !key.ExpiresAt.IsZero() {
+		pbKey.ExpireTime = timestamppb.New(key.ExpiresAt)
+	}
+	if !key.LastUsedAt.IsZero() {
+		pbKey.LastUseTime = timestamppb.New(key.LastUsedAt)
+	}
+	return pbKey
+}
@@ -0,0 +1,775 @@
+package service_test
+
+import (
+	"context"
+	"learngrpc/pcbook/pb"
+	"learngrpc/pcbook/service"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAuthServerRegister(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name       string
+		inviteOnly bool
+		inviteRole string
+		username   string
+		password   string
+		role       string
+		code       codes.Code
+	}{
+		{
+			name:     "open_signup",
+			username: "alice",
+			password: "secret",
+			role:     "user",
+			code:     codes.OK,
+		},
+		{
+			name:       "open_signup_with_invite",
+			inviteRole: "admin",
+			username:   "alice",
+			password:   "secret",
+			role:       "admin",
+			code:       codes.OK,
+		},
+		{
+			name:       "invite_only",
+			inviteOnly: true,
+			inviteRole: "user",
+			username:   "alice",
+			password:   "secret",
+			role:       "user",
+			code:       codes.OK,
+		},
+		{
+			name:       "invite_only_without_invite",
+			inviteOnly: true,
+			username:   "alice",
+			password:   "secret",
+			code:       codes.PermissionDenied,
+		},
+		{
+			name:     "already_exists",
+			username: "admin1",
+			password: "secret",
+			code:     codes.AlreadyExists,
+		},
+		{
+			name:     "invalid_username",
+			username: "a b",
+			password: "secret",
+			code:     codes.InvalidArgument,
+		},
+		{
+			name:     "empty_password",
+			username: "alice",
+			code:     codes.InvalidArgument,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := newTestAuthServer(t, tc.inviteOnly)
+			admin := contextWithTestClaims("admin1", "admin")
+
+			inviteCode := ""
+			if tc.inviteRole != "" {
+				invite, err := server.CreateInvite(admin, &pb.CreateInviteRequest{Role: tc.inviteRole})
+				require.NoError(t, err)
+				inviteCode = invite.GetCode()
+			}
+
+			res, err := server.Register(context.Background(), &pb.RegisterRequest{
+				Username:   tc.username,
+				Password:   tc.password,
+				InviteCode: inviteCode,
+			})
+			require.Equal(t, tc.code, status.Code(err))
+			if tc.code != codes.OK {
+				return
+			}
+			require.Equal(t, tc.role, res.GetRole())
+
+			_, err = server.Login(context.Background(), &pb.LoginRequest{Username: tc.username, Password: tc.password})
+			require.NoError(t, err)
+
+			// an invite can only be used once
+			if inviteCode != "" {
+				_, err = server.Register(context.Background(), &pb.RegisterRequest{
+					Username:   "bob",
+					Password:   "secret",
+					InviteCode: inviteCode,
+				})
+				require.Equal(t, codes.PermissionDenied, status.Code(err))
+			}
+		})
+	}
+}
+
+func TestAuthServerAccountManagement(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAuthServer(t, false)
+	admin := contextWithTestClaims("admin1", "admin")
+	user := contextWithTestClaims("user1", "user")
+
+	_, err := server.ChangePassword(user, &pb.ChangePasswordRequest{OldPassword: "wrong", NewPassword: "new-secret"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = server.ChangePassword(user, &pb.ChangePasswordRequest{OldPassword: "secret", NewPassword: "new-secret"})
+	require.NoError(t, err)
+
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "new-secret"})
+	require.NoError(t, err)
+
+	list, err := server.ListUsers(admin, &pb.ListUsersRequest{PageSize: 1})
+	require.NoError(t, err)
+	require.Len(t, list.GetUsers(), 1)
+	require.Equal(t, "admin1", list.GetUsers()[0].GetUsername())
+
+	list, err = server.ListUsers(admin, &pb.ListUsersRequest{PageSize: 1, PageToken: list.GetNextPageToken()})
+	require.NoError(t, err)
+	require.Len(t, list.GetUsers(), 1)
+	require.Equal(t, "user1", list.GetUsers()[0].GetUsername())
+	require.Empty(t, list.GetNextPageToken())
+
+	_, err = server.SetUserRole(admin, &pb.SetUserRoleRequest{Username: "user1", Role: "superuser"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = server.SetUserRole(admin, &pb.SetUserRoleRequest{Username: "admin1", Role: "user"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = server.SetUserRole(admin, &pb.SetUserRoleRequest{Username: "nobody", Role: "user"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	roleRes, err := server.SetUserRole(admin, &pb.SetUserRoleRequest{Username: "user1", Role: "admin"})
+	require.NoError(t, err)
+	require.Equal(t, "admin", roleRes.GetUser().GetRole())
+
+	disableRes, err := server.DisableUser(admin, &pb.DisableUserRequest{Username: "user1"})
+	require.NoError(t, err)
+	require.True(t, disableRes.GetUser().GetDisabled())
+
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "new-secret"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = server.ChangePassword(user, &pb.ChangePasswordRequest{OldPassword: "new-secret", NewPassword: "other"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestAuthServerPasswordPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := service.ParsePasswordPolicy([]byte(`
+min_length: 8
+deny_list: [password]
+algorithm: argon2id
+argon2id: {time: 1, memory: 64, threads: 1}
+`))
+	require.NoError(t, err)
+
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUser("user1", "old-secret", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	server := service.NewAuthServer(
+		userStore,
+		service.NewInMemoryInviteStore(),
+		service.NewInMemoryRefreshTokenStore(time.Hour),
+		service.NewInMemoryRevocationList(),
+		service.NewInMemoryAPIKeyStore(),
+		service.NewInMemoryLoginChallengeStore(time.Minute),
+		nil,
+		nil,
+		nil,
+		policy,
+		service.NewJWTManager("secret", time.Minute),
+		nil,
+		false,
+	)
+
+	_, err = server.Register(context.Background(), &pb.RegisterRequest{Username: "alice", Password: "short"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.Register(context.Background(), &pb.RegisterRequest{Username: "alice", Password: "PASSWORD"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.Register(context.Background(), &pb.RegisterRequest{Username: "alice", Password: "long-enough"})
+	require.NoError(t, err)
+
+	alice, err := userStore.Find("alice")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(alice.HashedPassword, "$argon2id$"))
+
+	// the bcrypt hash of the user is replaced by an argon2id one at login
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "old-secret"})
+	require.NoError(t, err)
+
+	rehashed, err := userStore.Find("user1")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(rehashed.HashedPassword, "$argon2id$"))
+
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "old-secret"})
+	require.NoError(t, err)
+
+	found, err := userStore.Find("user1")
+	require.NoError(t, err)
+	require.Equal(t, rehashed.HashedPassword, found.HashedPassword)
+
+	ctx := contextWithTestClaims("user1", "user")
+	_, err = server.ChangePassword(ctx, &pb.ChangePasswordRequest{OldPassword: "old-secret", NewPassword: "password"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.ChangePassword(ctx, &pb.ChangePasswordRequest{OldPassword: "old-secret", NewPassword: "new-secret"})
+	require.NoError(t, err)
+
+	// the rehash at login only replaces the hash, and keeps the changes made during the login
+	admin := contextWithTestClaims("admin1", "admin")
+	for _, username := range []string{"user2", "user3", "user4", "user5"} {
+		user, err := service.NewUser(username, "old-secret", "user")
+		require.NoError(t, err)
+		require.NoError(t, userStore.Save(user))
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Login(context.Background(), &pb.LoginRequest{Username: username, Password: "old-secret"})
+		}()
+		// while the login checks the bcrypt hash
+		time.Sleep(10 * time.Millisecond)
+		_, err = server.DisableUser(admin, &pb.DisableUserRequest{Username: username})
+		require.NoError(t, err)
+		wg.Wait()
+
+		found, err := userStore.Find(username)
+		require.NoError(t, err)
+		require.True(t, found.Disabled, username)
+	}
+}
+
+func TestAuthServerRefreshToken(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	revocationList := service.NewInMemoryRevocationList()
+	server := newTestAuthServerWithTokens(t, false, jwtManager, revocationList)
+	interceptor := service.NewAuthInterceptor(jwtManager, revocationList, nil, nil, service.NewDefaultPolicy())
+
+	login, err := server.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.NoError(t, err)
+	require.NotEmpty(t, login.GetRefreshToken())
+
+	refreshed, err := server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.NoError(t, err)
+	require.NotEqual(t, login.GetRefreshToken(), refreshed.GetRefreshToken())
+	require.NoError(t, callWithTestToken(interceptor, refreshed.GetToken()))
+
+	// reusing a rotated token revokes the whole session
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Equal(t, codes.Unauthenticated, status.Code(callWithTestToken(interceptor, refreshed.GetToken())))
+
+	// other sessions are not affected
+	other, err := server.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.NoError(t, err)
+	require.NoError(t, callWithTestToken(interceptor, other.GetToken()))
+
+	claims, err := jwtManager.Verify(other.GetToken())
+	require.NoError(t, err)
+	_, err = server.Logout(service.ContextWithUserClaims(context.Background(), claims), &pb.LogoutRequest{})
+	require.NoError(t, err)
+
+	require.Equal(t, codes.Unauthenticated, status.Code(callWithTestToken(interceptor, other.GetToken())))
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: other.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: "unknown"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// changing the role or disabling a user revokes all of their sessions
+	admin := contextWithTestClaims("admin1", "admin")
+	var sessions []*pb.LoginResponse
+	for i := 0; i < 2; i++ {
+		login, err := server.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "secret"})
+		require.NoError(t, err)
+		sessions = append(sessions, login)
+	}
+
+	_, err = server.SetUserRole(admin, &pb.SetUserRoleRequest{Username: "user1", Role: "admin"})
+	require.NoError(t, err)
+	for _, session := range sessions {
+		require.Equal(t, codes.Unauthenticated, status.Code(callWithTestToken(interceptor, session.GetToken())))
+		_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: session.GetRefreshToken()})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	}
+
+	login, err = server.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.NoError(t, err)
+	require.NoError(t, callWithTestToken(interceptor, login.GetToken()))
+
+	_, err = server.DisableUser(admin, &pb.DisableUserRequest{Username: "user1"})
+	require.NoError(t, err)
+	require.Equal(t, codes.Unauthenticated, status.Code(callWithTestToken(interceptor, login.GetToken())))
+}
+
+func TestAuthServerLoginThrottle(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	for _, username := range []string{"user1", "user2"} {
+		user, err := service.NewUser(username, "secret", "user")
+		require.NoError(t, err)
+		require.NoError(t, userStore.Save(user))
+	}
+
+	userPolicy := service.LockoutPolicy{
+		FreeFailures:    2,
+		BaseDelay:       50 * time.Millisecond,
+		MaxDelay:        time.Second,
+		LockoutFailures: 4,
+		LockoutDuration: time.Hour,
+	}
+	auditSink := &testAuditSink{}
+	server := service.NewAuthServer(
+		userStore,
+		service.NewInMemoryInviteStore(),
+		service.NewInMemoryRefreshTokenStore(time.Hour),
+		service.NewInMemoryRevocationList(),
+		service.NewInMemoryAPIKeyStore(),
+		service.NewInMemoryLoginChallengeStore(time.Minute),
+		service.NewLoginThrottle(userPolicy, service.DefaultIPLockoutPolicy, auditSink),
+		nil,
+		nil,
+		nil,
+		service.NewJWTManager("secret", time.Minute),
+		nil,
+		false,
+	)
+
+	attacker := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}})
+	login := func(ctx context.Context, username string, password string) (codes.Code, time.Duration, string) {
+		_, err := server.Login(ctx, &pb.LoginRequest{Username: username, Password: password})
+		st := status.Convert(err)
+		retryDelay := time.Duration(0)
+		for _, detail := range st.Details() {
+			if retryInfo, ok := detail.(*errdetails.RetryInfo); ok {
+				retryDelay = retryInfo.GetRetryDelay().AsDuration()
+			}
+		}
+		return st.Code(), retryDelay, st.Message()
+	}
+
+	for i := 0; i < 2; i++ {
+		code, _, _ := login(attacker, "user1", "wrong")
+		require.Equal(t, codes.NotFound, code)
+	}
+
+	// the next attempt must wait, even with the correct password
+	code, retryDelay, backoffMessage := login(attacker, "user1", "secret")
+	require.Equal(t, codes.ResourceExhausted, code)
+	require.Greater(t, retryDelay, time.Duration(0))
+	require.LessOrEqual(t, retryDelay, 50*time.Millisecond)
+
+	time.Sleep(60 * time.Millisecond)
+	code, _, _ = login(attacker, "user1", "wrong")
+	require.Equal(t, codes.NotFound, code)
+	time.Sleep(110 * time.Millisecond)
+	code, _, _ = login(attacker, "user1", "wrong")
+	require.Equal(t, codes.NotFound, code)
+	require.Equal(t, []string{"login.lockout user:user1"}, auditSink.events())
+
+	// a lockout looks like a delay, only longer
+	code, retryDelay, lockoutMessage := login(attacker, "user1", "secret")
+	require.Equal(t, codes.ResourceExhausted, code)
+	require.Greater(t, retryDelay, 59*time.Minute)
+	require.Equal(t, backoffMessage, lockoutMessage)
+
+	// other users are not affected
+	code, _, _ = login(context.Background(), "user2", "secret")
+	require.Equal(t, codes.OK, code)
+
+	_, err := server.UnlockUser(contextWithTestClaims("admin1", "admin"), &pb.UnlockUserRequest{Username: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	unlocked, err := server.UnlockUser(contextWithTestClaims("admin1", "admin"), &pb.UnlockUserRequest{Username: "user1"})
+	require.NoError(t, err)
+	require.True(t, unlocked.GetWasLocked())
+
+	code, _, _ = login(attacker, "user1", "secret")
+	require.Equal(t, codes.OK, code)
+}
+
+func TestAuthServerLoginThrottleConcurrently(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUser("user1", "secret", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	userPolicy := service.LockoutPolicy{
+		FreeFailures: 2,
+		BaseDelay:    time.Hour,
+		MaxDelay:     time.Hour,
+	}
+	server := service.NewAuthServer(
+		userStore,
+		service.NewInMemoryInviteStore(),
+		service.NewInMemoryRefreshTokenStore(time.Hour),
+		service.NewInMemoryRevocationList(),
+		service.NewInMemoryAPIKeyStore(),
+		service.NewInMemoryLoginChallengeStore(time.Minute),
+		service.NewLoginThrottle(userPolicy, service.DefaultIPLockoutPolicy, &testAuditSink{}),
+		nil,
+		nil,
+		nil,
+		service.NewJWTManager("secret", time.Minute),
+		nil,
+		false,
+	)
+
+	// the attempts in progress count as failures, so only the free ones check a password
+	const attempts = 10
+	results := make(chan codes.Code, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := server.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "wrong"})
+			results <- status.Code(err)
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	counts := make(map[codes.Code]int)
+	for code := range results {
+		counts[code]++
+	}
+	require.Equal(t, map[codes.Code]int{codes.NotFound: 2, codes.ResourceExhausted: attempts - 2}, counts)
+
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestAuthServerTOTP(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	for _, account := range []struct{ username, role string }{{"admin1", "admin"}, {"user1", "user"}, {"user2", "user"}} {
+		user, err := service.NewUser(account.username, "secret", account.role)
+		require.NoError(t, err)
+		require.NoError(t, userStore.Save(user))
+	}
+
+	server := service.NewAuthServer(
+		userStore,
+		service.NewInMemoryInviteStore(),
+		service.NewInMemoryRefreshTokenStore(time.Hour),
+		service.NewInMemoryRevocationList(),
+		service.NewInMemoryAPIKeyStore(),
+		service.NewInMemoryLoginChallengeStore(time.Minute),
+		nil,
+		nil,
+		nil,
+		nil,
+		service.NewJWTManager("secret", time.Minute),
+		[]string{"admin"},
+		false,
+	)
+	login := func(username string) *pb.LoginResponse {
+		res, err := server.Login(context.Background(), &pb.LoginRequest{Username: username, Password: "secret"})
+		require.NoError(t, err)
+		return res
+	}
+	completeLogin := func(challenge string, totpCode string, recoveryCode string) (*pb.CompleteLoginResponse, error) {
+		return server.CompleteLogin(context.Background(), &pb.CompleteLoginRequest{
+			Challenge:    challenge,
+			TotpCode:     totpCode,
+			RecoveryCode: recoveryCode,
+		})
+	}
+	totpCode := func(secret string, t0 time.Time) string {
+		code, err := service.TOTPCode(secret, t0)
+		require.NoError(t, err)
+		return code
+	}
+
+	// optional enrollment
+	require.NotEmpty(t, login("user1").GetToken())
+	user1 := contextWithTestClaims("user1", "user")
+	_, err := server.ConfirmTotp(user1, &pb.ConfirmTotpRequest{Code: "123456"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	enrolled, err := server.EnrollTotp(user1, &pb.EnrollTotpRequest{})
+	require.NoError(t, err)
+	secret := enrolled.GetEnrollment().GetSecret()
+	require.True(t, strings.HasPrefix(enrolled.GetEnrollment().GetOtpauthUri(), "otpauth://totp/PC%20Book:user1?"))
+
+	now := time.Now()
+	_, err = server.ConfirmTotp(user1, &pb.ConfirmTotpRequest{Code: totpCode(secret, now.Add(-time.Hour))})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	confirmed, err := server.ConfirmTotp(user1, &pb.ConfirmTotpRequest{Code: totpCode(secret, now)})
+	require.NoError(t, err)
+	require.Len(t, confirmed.GetRecoveryCodes(), 10)
+
+	// two-step login, where a code cannot be replayed
+	first := login("user1")
+	require.Empty(t, first.GetToken())
+	require.Empty(t, first.GetRefreshToken())
+	require.NotEmpty(t, first.GetChallenge())
+
+	_, err = completeLogin(first.GetChallenge(), totpCode(secret, now), "")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// a challenge is used once, even with a wrong code
+	_, err = completeLogin(first.GetChallenge(), totpCode(secret, now.Add(30*time.Second)), "")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	completed, err := completeLogin(login("user1").GetChallenge(), totpCode(secret, now.Add(30*time.Second)), "")
+	require.NoError(t, err)
+	require.NotEmpty(t, completed.GetToken())
+	require.NotEmpty(t, completed.GetRefreshToken())
+
+	// a recovery code works once, even when it is used concurrently
+	recoveryCode := strings.ToLower(confirmed.GetRecoveryCodes()[0])
+	challenges := []string{login("user1").GetChallenge(), login("user1").GetChallenge(), login("user1").GetChallenge()}
+	results := make(chan codes.Code, len(challenges))
+	var wg sync.WaitGroup
+	for _, challenge := range challenges {
+		wg.Add(1)
+		go func(challenge string) {
+			defer wg.Done()
+			_, err := completeLogin(challenge, "", recoveryCode)
+			results <- status.Code(err)
+		}(challenge)
+	}
+	wg.Wait()
+	close(results)
+	counts := make(map[codes.Code]int)
+	for code := range results {
+		counts[code]++
+	}
+	require.Equal(t, map[codes.Code]int{codes.OK: 1, codes.Unauthenticated: 2}, counts)
+
+	// a role that requires a second factor cannot log in with the password only, nor be given
+	// to a user who has not enrolled, e.g. with an invite
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "admin1", Password: "secret"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	admin := contextWithTestClaims("admin0", "admin")
+	_, err = server.SetUserRole(admin, &pb.SetUserRoleRequest{Username: "user2", Role: "admin"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = server.CreateInvite(admin, &pb.CreateInviteRequest{Role: "admin"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = server.CreateInvite(admin, &pb.CreateInviteRequest{Role: "seller"})
+	require.NoError(t, err)
+
+	session := login("user2")
+	user2 := contextWithTestClaims("user2", "user")
+	enrolled, err = server.EnrollTotp(user2, &pb.EnrollTotpRequest{})
+	require.NoError(t, err)
+	_, err = server.ConfirmTotp(user2, &pb.ConfirmTotpRequest{Code: totpCode(enrolled.GetEnrollment().GetSecret(), now)})
+	require.NoError(t, err)
+
+	// the sessions without a second factor are revoked when the role changes to one that requires it
+	_, err = server.SetUserRole(admin, &pb.SetUserRoleRequest{Username: "user2", Role: "admin"})
+	require.NoError(t, err)
+	_, err = server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: session.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	first = login("user2")
+	require.Empty(t, first.GetToken())
+	require.NotEmpty(t, first.GetChallenge())
+
+	_, err = completeLogin("unknown", "123456", "")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// testAuditSink keeps the action and resource of the recorded events.
+type testAuditSink struct {
+	mutex   sync.Mutex
+	records []string
+}
+
+func (sink *testAuditSink) Record(event *service.AuditEvent) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	sink.records = append(sink.records, event.Action+" "+event.Resource)
+	return nil
+}
+
+func (sink *testAuditSink) events() []string {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	return append([]string{}, sink.records...)
+}
+
+func TestAuthServerAPIKeys(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	revocationList := service.NewInMemoryRevocationList()
+	apiKeyStore := service.NewInMemoryAPIKeyStore()
+	server := service.NewAuthServer(
+		service.NewInMemoryUserStore(),
+		service.NewInMemoryInviteStore(),
+		service.NewInMemoryRefreshTokenStore(time.Hour),
+		revocationList,
+		apiKeyStore,
+		service.NewInMemoryLoginChallengeStore(time.Minute),
+		nil,
+		nil,
+		nil,
+		nil,
+		jwtManager,
+		nil,
+		false,
+	)
+	interceptor := service.NewAuthInterceptor(jwtManager, revocationList, apiKeyStore, nil, service.NewDefaultPolicy())
+	admin := contextWithTestClaims("admin1", "admin")
+
+	invalid := []*pb.CreateApiKeyRequest{
+		{Name: "ci", Role: "user"},
+		{Name: "ci-importer", Role: "owner"},
+		{Name: "ci-importer", Role: "user", Team: "a b"},
+		{Name: "ci-importer", Role: "user", ExpireTime: timestamppb.New(time.Now().Add(-time.Minute))},
+	}
+	for _, req := range invalid {
+		_, err := server.CreateApiKey(admin, req)
+		require.Equal(t, codes.InvalidArgument, status.Code(err), req.String())
+	}
+
+	created, err := server.CreateApiKey(admin, &pb.CreateApiKeyRequest{Name: "ci-importer", Role: "seller", Team: "acme"})
+	require.NoError(t, err)
+	key := created.GetApiKey()
+	require.True(t, strings.HasPrefix(created.GetKey(), key.GetPrefix()+"_"))
+	require.Equal(t, "admin1", key.GetCreatedBy())
+	require.Nil(t, key.GetExpireTime())
+	require.Nil(t, key.GetLastUseTime())
+
+	expiring, err := server.CreateApiKey(admin, &pb.CreateApiKeyRequest{
+		Name:       "nightly",
+		Role:       "user",
+		ExpireTime: timestamppb.New(time.Now().Add(50 * time.Millisecond)),
+	})
+	require.NoError(t, err)
+
+	// the key authenticates with its role and team, and records its last use
+	var claims *service.UserClaims
+	err = callWithTestAPIKey(interceptor, "/techschool.pcbook.LaptopService/CreateLaptop", created.GetKey(), func(ctx context.Context) {
+		claims, _ = service.UserClaimsFromContext(ctx)
+	})
+	require.NoError(t, err)
+	require.Equal(t, "apikey:"+key.GetPrefix(), claims.Username)
+	require.Equal(t, "seller", claims.Role)
+	require.Equal(t, "acme", claims.Team)
+
+	err = callWithTestAPIKey(interceptor, "/techschool.pcbook.AuthService/ListApiKeys", created.GetKey(), nil)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	err = callWithTestAPIKey(interceptor, "/techschool.pcbook.LaptopService/CreateLaptop", created.GetKey()+"x", nil)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	time.Sleep(100 * time.Millisecond)
+	err = callWithTestAPIKey(interceptor, "/techschool.pcbook.LaptopService/RateLaptop", expiring.GetKey(), nil)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	list, err := server.ListApiKeys(admin, &pb.ListApiKeysRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetApiKeys(), 2)
+	require.Equal(t, key.GetPrefix(), list.GetApiKeys()[0].GetPrefix())
+	require.NotNil(t, list.GetApiKeys()[0].GetLastUseTime())
+	require.NotNil(t, list.GetApiKeys()[1].GetExpireTime())
+
+	// a revoked key is rejected from the next call on
+	revoked, err := server.RevokeApiKey(admin, &pb.RevokeApiKeyRequest{Prefix: key.GetPrefix()})
+	require.NoError(t, err)
+	require.True(t, revoked.GetApiKey().GetRevoked())
+	err = callWithTestAPIKey(interceptor, "/techschool.pcbook.LaptopService/CreateLaptop", created.GetKey(), nil)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = server.RevokeApiKey(admin, &pb.RevokeApiKeyRequest{Prefix: "pcb_unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// callWithTestAPIKey calls an RPC through the interceptor with an API key, and
+// runs check, if any, with the context of the handler.
+func callWithTestAPIKey(interceptor *service.AuthInterceptor, method string, apiKey string, check func(ctx context.Context)) error {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", apiKey))
+	info := &grpc.UnaryServerInfo{FullMethod: method}
+	_, err := interceptor.Unary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		if check != nil {
+			check(ctx)
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// callWithTestToken calls a protected RPC through the interceptor with an access token.
+func callWithTestToken(interceptor *service.AuthInterceptor, token string) error {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+	info := &grpc.UnaryServerInfo{FullMethod: "/techschool.pcbook.AuthService/Logout"}
+	_, err := interceptor.Unary()(ctx, &pb.LogoutRequest{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &pb.LogoutResponse{}, nil
+	})
+	return err
+}
+
+func newTestAuthServer(t *testing.T, inviteOnly bool) *service.AuthServer {
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	return newTestAuthServerWithTokens(t, inviteOnly, jwtManager, service.NewInMemoryRevocationList())
+}
+
+func newTestAuthServerWithTokens(
+	t *testing.T,
+	inviteOnly bool,
+	jwtManager *service.JWTManager,
+	revocationList service.RevocationList,
+) *service.AuthServer {
+	userStore := service.NewInMemoryUserStore()
+	for _, account := range []struct{ username, role string }{{"admin1", "admin"}, {"user1", "user"}} {
+		user, err := service.NewUser(account.username, "secret", account.role)
+		require.NoError(t, err)
+		require.NoError(t, userStore.Save(user))
+	}
+
+	return service.NewAuthServer(
+		userStore,
+		service.NewInMemoryInviteStore(),
+		service.NewInMemoryRefreshTokenStore(time.Hour),
+		revocationList,
+		service.NewInMemoryAPIKeyStore(),
+		service.NewInMemoryLoginChallengeStore(time.Minute),
+		nil,
+		nil,
+		nil,
+		nil,
+		jwtManager,
+		nil,
+		inviteOnly,
+	)
+}
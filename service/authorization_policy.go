@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed default_policy.yaml
+var defaultPolicy []byte
+
+// Policy is an authorization policy that tells which roles can call each gRPC method.
+type Policy struct {
+	DefaultDeny bool         `yaml:"default_deny"` // deny the methods that no rule matches
+	Rules       []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule gives access to the methods that match one of its patterns,
+// either to everyone or to the users with one of its roles.
+type PolicyRule struct {
+	Methods []string `yaml:"methods"` // full method names, where * matches any part of a service or method name
+	Roles   []string `yaml:"roles"`
+	Public  bool     `yaml:"public"`
+}
+
+// NewDefaultPolicy returns the built-in policy of the pcbook services.
+func NewDefaultPolicy() *Policy {
+	policy, err := ParsePolicy(defaultPolicy)
+	if err != nil {
+		panic(fmt.Sprintf("invalid default policy: %v", err))
+	}
+	return policy
+}
+
+// LoadPolicy loads a policy from a YAML or JSON file.
+func LoadPolicy(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read policy file: %w", err)
+	}
+
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load policy file %s: %w", filename, err)
+	}
+	return policy, nil
+}
+
+// ParsePolicy parses and validates a policy in YAML, or in JSON which is a subset of YAML.
+func ParsePolicy(data []byte) (*Policy, error) {
+	policy := &Policy{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(policy)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode policy: %w", err)
+	}
+
+	err = policy.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks that every rule has valid method patterns, and is either public or has roles.
+func (policy *Policy) Validate() error {
+	for i, rule := range policy.Rules {
+		if len(rule.Methods) == 0 {
+			return fmt.Errorf("rule %d has no methods", i+1)
+		}
+		if rule.Public == (len(rule.Roles) > 0) {
+			return fmt.Errorf("rule %d must either be public or have roles", i+1)
+		}
+
+		for _, pattern := range rule.Methods {
+			_, err := path.Match(pattern, "")
+			if err != nil || strings.Count(pattern, "/") != 2 || !strings.HasPrefix(pattern, "/") {
+				return fmt.Errorf("rule %d has an invalid method pattern %q", i+1, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Rule returns the first rule that matches a full method name, or nil.
+func (policy *Policy) Rule(method string) *PolicyRule {
+	for i := range policy.Rules {
+		for _, pattern := range policy.Rules[i].Methods {
+			ok, _ := path.Match(pattern, method)
+			if ok {
+				return &policy.Rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Access returns whether a method is public, and otherwise the roles that can call it.
+// A method that is not public and has no roles is denied to everyone.
+func (policy *Policy) Access(method string) (public bool, roles []string) {
+	rule := policy.Rule(method)
+	if rule == nil {
+		return !policy.DefaultDeny, nil
+	}
+	return rule.Public, rule.Roles
+}
+
+// Uncovered returns the methods that no rule matches.
+func (policy *Policy) Uncovered(methods []string) []string {
+	var uncovered []string
+	for _, method := range methods {
+		if policy.Rule(method) == nil {
+			uncovered = append(uncovered, method)
+		}
+	}
+	return uncovered
+}
+
+// CheckCoverage checks that the policy has a rule for every method registered on a gRPC server,
+// so that a new RPC is never exposed or denied by accident.
+func (policy *Policy) CheckCoverage(server *grpc.Server) error {
+	uncovered := policy.Uncovered(RegisteredMethods(server))
+	if len(uncovered) > 0 {
+		return errors.New("policy has no rule for " + strings.Join(uncovered, ", "))
+	}
+	return nil
+}
+
+// RegisteredMethods returns the sorted full names of the methods registered on a gRPC server.
+func RegisteredMethods(server *grpc.Server) []string {
+	var methods []string
+	for serviceName, info := range server.GetServiceInfo() {
+		for _, method := range info.Methods {
+			methods = append(methods, fmt.Sprintf("/%s/%s", serviceName, method.Name))
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
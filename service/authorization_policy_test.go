@@ -0,0 +1,148 @@
+package service_test
+
+import (
+	"context"
+	"learngrpc/pcbook/pb"
+	"learngrpc/pcbook/service"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	t.Parallel()
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterAuthServiceServer(grpcServer, &pb.UnimplementedAuthServiceServer{})
+	pb.RegisterLaptopServiceServer(grpcServer, &pb.UnimplementedLaptopServiceServer{})
+	pb.RegisterReviewServiceServer(grpcServer, &pb.UnimplementedReviewServiceServer{})
+	pb.RegisterAuditServiceServer(grpcServer, &pb.UnimplementedAuditServiceServer{})
+	reflection.Register(grpcServer)
+
+	policy := service.NewDefaultPolicy()
+	require.NoError(t, policy.CheckCoverage(grpcServer))
+
+	testCases := []struct {
+		method string
+		public bool
+		roles  []string
+	}{
+		{method: "/techschool.pcbook.AuthService/Login", public: true},
+		{method: "/techschool.pcbook.AuthService/ListUsers", roles: []string{"admin"}},
+		{method: "/techschool.pcbook.LaptopService/SearchLaptop", public: true},
+		{method: "/techschool.pcbook.LaptopService/ListLaptopImages", public: true},
+		{method: "/techschool.pcbook.LaptopService/UploadImageChunk", roles: []string{"admin", "seller"}},
+		{method: "/techschool.pcbook.LaptopService/GetImageUsage", roles: []string{"admin"}},
+		{method: "/techschool.pcbook.LaptopService/RateLaptop", roles: []string{"admin", "user"}},
+		{method: "/techschool.pcbook.ReviewService/ModerateReview", roles: []string{"admin"}},
+		{method: "/techschool.pcbook.ReviewService/CreateReview", roles: []string{"admin", "user"}},
+		{method: "/techschool.pcbook.AuditService/QueryAuditRecords", roles: []string{"admin"}},
+		{method: "/techschool.pcbook.LaptopService/DeleteLaptop"},
+	}
+
+	for _, tc := range testCases {
+		public, roles := policy.Access(tc.method)
+		require.Equal(t, tc.public, public, tc.method)
+		require.Equal(t, tc.roles, roles, tc.method)
+	}
+
+	// a new RPC without a rule fails the coverage check
+	uncovered := policy.Uncovered([]string{"/techschool.pcbook.LaptopService/DeleteLaptop"})
+	require.Equal(t, []string{"/techschool.pcbook.LaptopService/DeleteLaptop"}, uncovered)
+}
+
+func TestParsePolicy(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		data  string
+		valid bool
+	}{
+		{
+			name:  "yaml",
+			data:  "default_deny: true\nrules:\n  - methods: [/a.B/*]\n    roles: [admin]\n",
+			valid: true,
+		},
+		{
+			name:  "json",
+			data:  `{"default_deny": false, "rules": [{"methods": ["/a.B/C"], "public": true}]}`,
+			valid: true,
+		},
+		{
+			name: "unknown_field",
+			data: `{"rules": [{"methods": ["/a.B/C"], "role": ["admin"]}]}`,
+		},
+		{
+			name: "no_methods",
+			data: `{"rules": [{"roles": ["admin"]}]}`,
+		},
+		{
+			name: "public_with_roles",
+			data: `{"rules": [{"methods": ["/a.B/C"], "public": true, "roles": ["admin"]}]}`,
+		},
+		{
+			name: "no_access",
+			data: `{"rules": [{"methods": ["/a.B/C"]}]}`,
+		},
+		{
+			name: "bad_pattern",
+			data: `{"rules": [{"methods": ["/a.B/[C"], "public": true}]}`,
+		},
+		{
+			name: "not_a_method",
+			data: `{"rules": [{"methods": ["a.B"], "public": true}]}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		_, err := service.ParsePolicy([]byte(tc.data))
+		if tc.valid {
+			require.NoError(t, err, tc.name)
+		} else {
+			require.Error(t, err, tc.name)
+		}
+	}
+}
+
+func TestAuthInterceptorPolicy(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	interceptor := service.NewAuthInterceptor(jwtManager, service.NewInMemoryRevocationList(), nil, nil, service.NewDefaultPolicy())
+
+	token, err := jwtManager.Generate(&service.User{Username: "user1", Role: "user"}, "")
+	require.NoError(t, err)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+
+	call := func(method string) error {
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		_, err := interceptor.Unary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return err
+	}
+
+	require.NoError(t, call("/techschool.pcbook.ReviewService/CreateReview"))
+	require.Equal(t, codes.PermissionDenied, status.Code(call("/techschool.pcbook.ReviewService/ModerateReview")))
+	require.Equal(t, codes.PermissionDenied, status.Code(call("/techschool.pcbook.LaptopService/DeleteLaptop")))
+
+	// the reloaded policy applies to the next calls
+	policyFile := filepath.Join(t.TempDir(), "policy.yaml")
+	err = os.WriteFile(policyFile, []byte("rules:\n  - methods: [/techschool.pcbook.ReviewService/*]\n    roles: [user]\n"), 0o600)
+	require.NoError(t, err)
+	policy, err := service.LoadPolicy(policyFile)
+	require.NoError(t, err)
+	interceptor.SetPolicy(policy)
+
+	require.NoError(t, call("/techschool.pcbook.ReviewService/ModerateReview"))
+	require.NoError(t, call("/techschool.pcbook.LaptopService/DeleteLaptop"))
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// BannedWordFilter finds banned words in user content, ignoring case.
+type BannedWordFilter struct {
+	words map[string]struct{}
+}
+
+// NewBannedWordFilter creates a new BannedWordFilter for a list of single words.
+func NewBannedWordFilter(words []string) *BannedWordFilter {
+	filter := &BannedWordFilter{
+		words: make(map[string]struct{}),
+	}
+	for _, word := range words {
+		word = strings.ToLower(strings.TrimSpace(word))
+		if word != "" {
+			filter.words[word] = struct{}{}
+		}
+	}
+	return filter
+}
+
+// LoadBannedWordFilter creates a new BannedWordFilter from a file with one word per line.
+// Empty lines and lines starting with # are ignored.
+func LoadBannedWordFilter(filename string) (*BannedWordFilter, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open banned word file: %w", err)
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read banned word file: %w", err)
+	}
+
+	return NewBannedWordFilter(words), nil
+}
+
+// Find returns the first banned word found in the texts, if any.
+// A nil filter bans nothing.
+func (filter *BannedWordFilter) Find(texts ...string) (string, bool) {
+	if filter == nil || len(filter.words) == 0 {
+		return "", false
+	}
+
+	for _, text := range texts {
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			if _, ok := filter.words[word]; ok {
+				return word, true
+			}
+		}
+	}
+	return "", false
+}
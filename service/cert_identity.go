@@ -0,0 +1,117 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"gopkg.in/yaml.v3"
+)
+
+// CertIdentity maps a client certificate to a user, for service-to-service callers.
+// A certificate matches if its subject, in RFC 2253 form like "CN=importer,O=PC Book",
+// is Subject, or if one of its DNS, email, URI or IP subject alternative names is SAN.
+type CertIdentity struct {
+	Subject  string `yaml:"subject"`
+	SAN      string `yaml:"san"`
+	Username string `yaml:"username"`
+	Role     string `yaml:"role"`
+	Team     string `yaml:"team"`
+}
+
+// CertIdentityTable is a table of client certificate identities, where the first match applies.
+type CertIdentityTable struct {
+	Identities []CertIdentity `yaml:"identities"`
+}
+
+// LoadCertIdentityTable loads a table of client certificate identities from a YAML or JSON file.
+func LoadCertIdentityTable(filename string) (*CertIdentityTable, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read identity file: %w", err)
+	}
+
+	table, err := ParseCertIdentityTable(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load identity file %s: %w", filename, err)
+	}
+	return table, nil
+}
+
+// ParseCertIdentityTable parses and validates a table of client certificate identities.
+func ParseCertIdentityTable(data []byte) (*CertIdentityTable, error) {
+	table := &CertIdentityTable{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(table)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode identities: %w", err)
+	}
+
+	for i, identity := range table.Identities {
+		if (identity.Subject == "") == (identity.SAN == "") {
+			return nil, fmt.Errorf("identity %d must have either a subject or a san", i+1)
+		}
+		if identity.Username == "" || identity.Role == "" {
+			return nil, fmt.Errorf("identity %d must have a username and a role", i+1)
+		}
+	}
+	return table, nil
+}
+
+// Lookup returns the first identity that matches a certificate, or nil.
+func (table *CertIdentityTable) Lookup(cert *x509.Certificate) *CertIdentity {
+	subject := cert.Subject.String()
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	for i, identity := range table.Identities {
+		if identity.Subject != "" && identity.Subject == subject {
+			return &table.Identities[i]
+		}
+		for _, name := range names {
+			if identity.SAN != "" && identity.SAN == name {
+				return &table.Identities[i]
+			}
+		}
+	}
+	return nil
+}
+
+// claimsFromPeerCert returns the claims of the identity of the verified client certificate
+// of the peer, or nil if the peer has no verified certificate.
+func (table *CertIdentityTable) claimsFromPeerCert(ctx context.Context) (*UserClaims, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+
+	cert := tlsInfo.State.VerifiedChains[0][0]
+	identity := table.Lookup(cert)
+	if identity == nil {
+		return nil, fmt.Errorf("no identity for client certificate %s", cert.Subject)
+	}
+
+	claims := &UserClaims{
+		Username: identity.Username,
+		Role:     identity.Role,
+		Team:     identity.Team,
+	}
+	return claims, nil
+}
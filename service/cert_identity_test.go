@@ -0,0 +1,147 @@
+package service_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"learngrpc/pcbook/pb"
+	"learngrpc/pcbook/service"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+const testCertIdentities = `
+identities:
+  - subject: CN=importer,O=PC Book
+    username: importer
+    role: admin
+  - san: reporter.pcbook.internal
+    username: reporter
+    role: user
+`
+
+func TestClientCertIdentity(t *testing.T) {
+	t.Parallel()
+
+	certIdentities, err := service.ParseCertIdentityTable([]byte(testCertIdentities))
+	require.NoError(t, err)
+
+	ca := newTestCertificate(t, nil, pkix.Name{CommonName: "PC Book CA"})
+	serverCert := newTestCertificate(t, ca, pkix.Name{CommonName: "localhost"}, "localhost")
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	revocationList := service.NewInMemoryRevocationList()
+	interceptor := service.NewAuthInterceptor(jwtManager, revocationList, nil, certIdentities, service.NewDefaultPolicy())
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca.Leaf)
+	serverCredentials := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caPool,
+	})
+	grpcServer := grpc.NewServer(grpc.Creds(serverCredentials), grpc.UnaryInterceptor(interceptor.Unary()))
+	pb.RegisterAuthServiceServer(grpcServer, newTestAuthServerWithTokens(t, false, jwtManager, revocationList))
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	testCases := []struct {
+		name    string
+		subject pkix.Name
+		dnsName string
+		code    codes.Code
+	}{
+		{name: "subject", subject: pkix.Name{CommonName: "importer", Organization: []string{"PC Book"}}, code: codes.OK},
+		{name: "san", subject: pkix.Name{CommonName: "reporter"}, dnsName: "reporter.pcbook.internal", code: codes.PermissionDenied},
+		{name: "unknown", subject: pkix.Name{CommonName: "stranger"}, code: codes.Unauthenticated},
+	}
+
+	for _, tc := range testCases {
+		var dnsNames []string
+		if tc.dnsName != "" {
+			dnsNames = append(dnsNames, tc.dnsName)
+		}
+		clientCert := newTestCertificate(t, ca, tc.subject, dnsNames...)
+
+		clientCredentials := credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{*clientCert},
+			RootCAs:      caPool,
+			ServerName:   "localhost",
+		})
+		conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(clientCredentials))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		_, err = pb.NewAuthServiceClient(conn).ListUsers(context.Background(), &pb.ListUsersRequest{})
+		require.Equal(t, tc.code, status.Code(err), tc.name)
+	}
+}
+
+func TestParseCertIdentityTable(t *testing.T) {
+	t.Parallel()
+
+	invalid := []string{
+		`{"identities": [{"username": "importer", "role": "admin"}]}`,
+		`{"identities": [{"subject": "CN=a", "san": "a", "username": "importer", "role": "admin"}]}`,
+		`{"identities": [{"subject": "CN=a", "role": "admin"}]}`,
+		`{"identities": [{"subject": "CN=a", "username": "importer", "roles": ["admin"]}]}`,
+	}
+	for _, data := range invalid {
+		_, err := service.ParseCertIdentityTable([]byte(data))
+		require.Error(t, err, data)
+	}
+}
+
+// newTestCertificate creates a certificate signed by the CA, or a self-signed CA if ca is nil.
+func newTestCertificate(t *testing.T, ca *tls.Certificate, subject pkix.Name, dnsNames ...string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      subject,
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, signer := template, interface{}(key)
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
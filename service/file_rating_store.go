@@ -0,0 +1,293 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ratingJournalAdd    = "add"
+	ratingJournalRemove = "remove"
+)
+
+// FileRatingStore is a RatingStore that survives restarts.
+// Every change is appended to a journal file and synced before it is applied in memory,
+// and the journal is compacted to the current ratings when the store is opened.
+type FileRatingStore struct {
+	mutex    sync.Mutex // serializes the writes to the journal
+	filename string
+	file     *os.File
+	size     int64 // the end of the last complete entry of the journal
+	dirty    bool  // whether a failed write left data after size
+	memory   *InMemoryRatingStore
+}
+
+// ratingJournalEntry is a line of the journal of a FileRatingStore.
+type ratingJournalEntry struct {
+	Op       string    `json:"op"`
+	LaptopID string    `json:"laptop_id"`
+	Username string    `json:"username"`
+	Score    float64   `json:"score,omitempty"`
+	RatedAt  time.Time `json:"rated_at"`
+	Source   string    `json:"source,omitempty"`
+}
+
+// NewFileRatingStore opens the journal file of a FileRatingStore, creating it if needed,
+// and loads its ratings. Scores outside scoreRange that were accepted before are kept.
+func NewFileRatingStore(filename string, scoreRange ScoreRange) (*FileRatingStore, error) {
+	store := &FileRatingStore{
+		filename: filename,
+		memory:   NewInMemoryRatingStore(scoreRange),
+	}
+
+	err := store.load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Add adds the rating of a user for a laptop, and returns a copy of the new rating of the laptop.
+func (store *FileRatingStore) Add(laptopID string, username string, score float64) (*Rating, error) {
+	return store.AddFrom(laptopID, username, "", score)
+}
+
+// AddFrom adds the rating of a user for a laptop given through a source, and returns a copy of
+// the new rating of the laptop.
+func (store *FileRatingStore) AddFrom(laptopID string, username string, source string, score float64) (*Rating, error) {
+	err := store.memory.scoreRange.Validate(score)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ratedAt := time.Now()
+	err = store.append(&ratingJournalEntry{
+		Op:       ratingJournalAdd,
+		LaptopID: laptopID,
+		Username: username,
+		Score:    score,
+		RatedAt:  ratedAt,
+		Source:   source,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	return store.memory.add(laptopID, username, source, score, ratedAt), nil
+}
+
+// Remove removes the rating of a user for a laptop, if any.
+func (store *FileRatingStore) Remove(laptopID string, username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	_, err := store.memory.Score(laptopID, username)
+	if err == ErrRatingNotFound {
+		return nil
+	}
+
+	err = store.append(&ratingJournalEntry{
+		Op:       ratingJournalRemove,
+		LaptopID: laptopID,
+		Username: username,
+	})
+	if err != nil {
+		return err
+	}
+
+	return store.memory.Remove(laptopID, username)
+}
+
+// RemoveFrom removes the rating of a user for a laptop if it was given through the source.
+func (store *FileRatingStore) RemoveFrom(laptopID string, username string, source string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current, err := store.memory.ratingSource(laptopID, username)
+	if err == ErrRatingNotFound || current != source {
+		return nil
+	}
+
+	err = store.append(&ratingJournalEntry{
+		Op:       ratingJournalRemove,
+		LaptopID: laptopID,
+		Username: username,
+	})
+	if err != nil {
+		return err
+	}
+
+	return store.memory.RemoveFrom(laptopID, username, source)
+}
+
+// Score returns the score given by a user to a laptop, or ErrRatingNotFound.
+func (store *FileRatingStore) Score(laptopID string, username string) (float64, error) {
+	return store.memory.Score(laptopID, username)
+}
+
+// Stats returns the score distribution of a laptop.
+func (store *FileRatingStore) Stats(laptopID string) (*RatingStats, error) {
+	return store.memory.Stats(laptopID)
+}
+
+// TopRated calls found for the laptops with at least minCount ratings, by decreasing Bayesian score.
+func (store *FileRatingStore) TopRated(minCount uint32, found func(rank *LaptopRank) error) error {
+	return store.memory.TopRated(minCount, found)
+}
+
+// Trending calls found for the laptops with at least minCount ratings since the given time,
+// by decreasing number of ratings since then.
+func (store *FileRatingStore) Trending(since time.Time, minCount uint32, found func(rank *LaptopRank) error) error {
+	return store.memory.Trending(since, minCount, found)
+}
+
+// Close closes the journal file.
+func (store *FileRatingStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.file.Close()
+}
+
+// load replays the journal into memory.
+// An incomplete last line is left by a crash during a write, and is ignored.
+func (store *FileRatingStore) load() error {
+	data, err := os.ReadFile(store.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read rating journal: %w", err)
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+
+		entry := &ratingJournalEntry{}
+		err := json.Unmarshal(line, entry)
+		if err != nil && i == len(lines)-1 {
+			log.Printf("ignoring incomplete last line of rating journal %s", store.filename)
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot decode line %d of rating journal: %w", i+1, err)
+		}
+
+		switch entry.Op {
+		case ratingJournalAdd:
+			store.memory.add(entry.LaptopID, entry.Username, entry.Source, entry.Score, entry.RatedAt)
+		case ratingJournalRemove:
+			store.memory.remove(entry.LaptopID, entry.Username)
+		default:
+			return fmt.Errorf("unknown operation %q on line %d of rating journal", entry.Op, i+1)
+		}
+	}
+
+	return nil
+}
+
+// compact replaces the journal by the current ratings, in the order they were given,
+// and opens it for appending.
+func (store *FileRatingStore) compact() error {
+	buffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&buffer)
+	for _, rating := range store.memory.currentRatings() {
+		err := encoder.Encode(&ratingJournalEntry{
+			Op:       ratingJournalAdd,
+			LaptopID: rating.laptopID,
+			Username: rating.username,
+			Score:    rating.score,
+			RatedAt:  rating.ratedAt,
+			Source:   rating.source,
+		})
+		if err != nil {
+			return fmt.Errorf("cannot encode rating: %w", err)
+		}
+	}
+
+	tmpFilename := store.filename + ".tmp"
+	err := writeFileSync(tmpFilename, buffer.Bytes())
+	if err != nil {
+		return fmt.Errorf("cannot write compacted rating journal: %w", err)
+	}
+
+	err = os.Rename(tmpFilename, store.filename)
+	if err != nil {
+		return fmt.Errorf("cannot replace rating journal: %w", err)
+	}
+
+	store.file, err = os.OpenFile(store.filename, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("cannot open rating journal: %w", err)
+	}
+	store.size = int64(buffer.Len())
+
+	return nil
+}
+
+// append writes an entry at the end of the journal. The caller must hold the lock.
+// A write that fails is truncated away, so that it does not end up in the middle of the journal
+// once later writes succeed. If that fails too, it is retried before the next write.
+func (store *FileRatingStore) append(entry *ratingJournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("cannot encode rating: %w", err)
+	}
+
+	if store.dirty {
+		err = store.file.Truncate(store.size)
+		if err != nil {
+			return fmt.Errorf("cannot truncate rating journal after a failed write: %w", err)
+		}
+		store.dirty = false
+	}
+
+	_, err = store.file.Write(append(line, '\n'))
+	if err == nil {
+		err = store.file.Sync()
+	}
+	if err != nil {
+		store.dirty = store.file.Truncate(store.size) != nil
+		return fmt.Errorf("cannot write rating journal: %w", err)
+	}
+
+	store.size += int64(len(line) + 1)
+	return nil
+}
+
+func writeFileSync(filename string, data []byte) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -0,0 +1,157 @@
+package service_test
+
+import (
+	"learngrpc/pcbook/service"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRatingStore(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "ratings.jsonl")
+	store, err := service.NewFileRatingStore(filename, service.DefaultScoreRange)
+	require.NoError(t, err)
+
+	rating, err := store.Add("laptop1", "user1", 4)
+	require.NoError(t, err)
+	require.Equal(t, &service.Rating{Count: 1, Sum: 4}, rating)
+
+	_, err = store.Add("laptop1", "user2", 8)
+	require.NoError(t, err)
+	_, err = store.Add("laptop1", "user1", 6)
+	require.NoError(t, err)
+	_, err = store.Add("laptop2", "user1", 9)
+	require.NoError(t, err)
+	require.NoError(t, store.Remove("laptop2", "user1"))
+	_, err = store.AddFrom("laptop3", "user1", "review1", 5)
+	require.NoError(t, err)
+
+	_, err = store.Add("laptop1", "user3", 11)
+	require.ErrorIs(t, err, service.ErrInvalidScore)
+
+	// the returned rating is a snapshot
+	rating.Count = 100
+	stats, err := store.Stats("laptop1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), stats.Count)
+
+	require.NoError(t, store.Close())
+
+	// a crash during a write leaves an incomplete last line
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"op":"add","laptop_id":"lap`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	store, err = service.NewFileRatingStore(filename, service.DefaultScoreRange)
+	require.NoError(t, err)
+	defer store.Close()
+
+	score, err := store.Score("laptop1", "user1")
+	require.NoError(t, err)
+	require.Equal(t, 6.0, score)
+
+	_, err = store.Score("laptop2", "user1")
+	require.ErrorIs(t, err, service.ErrRatingNotFound)
+
+	stats, err = store.Stats("laptop1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), stats.Count)
+	require.Equal(t, 7.0, stats.Average)
+
+	var trending []*service.LaptopRank
+	err = store.Trending(time.Now().Add(-time.Hour), 0, func(rank *service.LaptopRank) error {
+		trending = append(trending, rank)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, trending, 2)
+	require.Equal(t, "laptop1", trending[0].LaptopID)
+
+	// the journal was compacted to the current ratings
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, 3, strings.Count(string(data), "\n"))
+
+	// the source of a rating is kept
+	require.NoError(t, store.RemoveFrom("laptop3", "user1", "review2"))
+	_, err = store.Score("laptop3", "user1")
+	require.NoError(t, err)
+	require.NoError(t, store.RemoveFrom("laptop3", "user1", "review1"))
+	_, err = store.Score("laptop3", "user1")
+	require.ErrorIs(t, err, service.ErrRatingNotFound)
+}
+
+func TestFileRatingStorePrunesHistory(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "ratings.jsonl")
+	old := time.Now().Add(-40 * 24 * time.Hour).Format(time.RFC3339Nano)
+	journal := `{"op":"add","laptop_id":"laptop1","username":"user1","score":4,"rated_at":"` + old + `"}
+{"op":"add","laptop_id":"laptop1","username":"user2","score":6,"rated_at":"` + old + `"}
+`
+	err := os.WriteFile(filename, []byte(journal), 0o600)
+	require.NoError(t, err)
+
+	store, err := service.NewFileRatingStore(filename, service.DefaultScoreRange)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err = store.Add("laptop2", "user1", float64(i+1))
+		require.NoError(t, err)
+	}
+
+	// the ratings outside of the trending window are no longer trending, but still count
+	var trending []*service.LaptopRank
+	err = store.Trending(time.Now().Add(-60*24*time.Hour), 0, func(rank *service.LaptopRank) error {
+		trending = append(trending, rank)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []*service.LaptopRank{{LaptopID: "laptop2", Score: 10, Count: 1}}, trending)
+
+	stats, err := store.Stats("laptop1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), stats.Count)
+	require.Equal(t, 5.0, stats.Average)
+
+	var topRated []string
+	err = store.TopRated(0, func(rank *service.LaptopRank) error {
+		topRated = append(topRated, rank.LaptopID)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"laptop2", "laptop1"}, topRated)
+
+	// the pruned ratings are kept by the compaction
+	require.NoError(t, store.Close())
+	store, err = service.NewFileRatingStore(filename, service.DefaultScoreRange)
+	require.NoError(t, err)
+	defer store.Close()
+
+	score, err := store.Score("laptop1", "user2")
+	require.NoError(t, err)
+	require.Equal(t, 6.0, score)
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, 3, strings.Count(string(data), "\n"))
+}
+
+func TestFileRatingStoreRejectsCorruptJournal(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "ratings.jsonl")
+	err := os.WriteFile(filename, []byte("not json\n{\"op\":\"remove\",\"laptop_id\":\"laptop1\",\"username\":\"user1\"}\n"), 0o600)
+	require.NoError(t, err)
+
+	_, err = service.NewFileRatingStore(filename, service.DefaultScoreRange)
+	require.Error(t, err)
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// GatewaySecretHeader is the metadata key of the secret that the REST gateway sends
+// to prove that a request comes from it.
+const GatewaySecretHeader = "x-gateway-secret"
+
+// ForwardedPeerInterceptor is a server interceptor that replaces the address of a trusted proxy,
+// such as the REST gateway, by the address of its client, which the gateway appends to the
+// x-forwarded-for header. A peer is trusted only if its address is within the trusted proxies
+// and it sends the gateway secret: the gateway usually shares its host, and so its address,
+// with direct clients, which could forge the header.
+// It must run first, so that the login throttle and the audit events see the address of the client.
+type ForwardedPeerInterceptor struct {
+	trustedProxies []*net.IPNet
+	gatewaySecret  string
+}
+
+// NewForwardedPeerInterceptor creates a new ForwardedPeerInterceptor that trusts the peers
+// within trustedProxies that send gatewaySecret. No peer is trusted if gatewaySecret is empty.
+func NewForwardedPeerInterceptor(trustedProxies []*net.IPNet, gatewaySecret string) *ForwardedPeerInterceptor {
+	return &ForwardedPeerInterceptor{trustedProxies: trustedProxies, gatewaySecret: gatewaySecret}
+}
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and CIDR ranges.
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var trustedProxies []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		// an address is a range of a single address
+		if !strings.Contains(item, "/") && strings.Contains(item, ":") {
+			item += "/128"
+		} else if !strings.Contains(item, "/") {
+			item += "/32"
+		}
+
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+	return trustedProxies, nil
+}
+
+// Unary returns a new unary server interceptor that replaces the address of trusted proxies.
+func (interceptor *ForwardedPeerInterceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		return handler(interceptor.forwardedPeer(ctx), req)
+	}
+}
+
+// Stream returns a new stream server interceptor that replaces the address of trusted proxies.
+func (interceptor *ForwardedPeerInterceptor) Stream() grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		ctx := interceptor.forwardedPeer(stream.Context())
+		return handler(srv, &serverStreamWithContext{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// forwardedPeer returns a copy of ctx whose peer has the forwarded address, if the peer is a trusted proxy.
+// Only the last address of the header is used: it is the one the proxy got the request from,
+// while the previous ones come from the client.
+func (interceptor *ForwardedPeerInterceptor) forwardedPeer(ctx context.Context) context.Context {
+	p, ok := peer.FromContext(ctx)
+	if !ok || !interceptor.isTrusted(p.Addr) {
+		return ctx
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if !interceptor.hasGatewaySecret(md) {
+		return ctx
+	}
+	values := md.Get("x-forwarded-for")
+	if len(values) == 0 {
+		return ctx
+	}
+	addresses := strings.Split(values[len(values)-1], ",")
+	ip := net.ParseIP(strings.TrimSpace(addresses[len(addresses)-1]))
+	if ip == nil {
+		return ctx
+	}
+
+	// the auth info of the proxy is kept, since it is the one that presented its certificate
+	forwarded := *p
+	forwarded.Addr = &net.TCPAddr{IP: ip}
+	return peer.NewContext(ctx, &forwarded)
+}
+
+func (interceptor *ForwardedPeerInterceptor) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range interceptor.trustedProxies {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasGatewaySecret tells whether md has the gateway secret, and only it.
+func (interceptor *ForwardedPeerInterceptor) hasGatewaySecret(md metadata.MD) bool {
+	values := md.Get(GatewaySecretHeader)
+	if interceptor.gatewaySecret == "" || len(values) != 1 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(values[0]), []byte(interceptor.gatewaySecret)) == 1
+}
@@ -0,0 +1,121 @@
+package service_test
+
+import (
+	"context"
+	"learngrpc/pcbook/pb"
+	"learngrpc/pcbook/service"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestForwardedPeerInterceptor(t *testing.T) {
+	t.Parallel()
+
+	trustedProxies, err := service.ParseTrustedProxies("127.0.0.1, ::1, 10.1.0.0/16")
+	require.NoError(t, err)
+	require.Len(t, trustedProxies, 3)
+
+	_, err = service.ParseTrustedProxies("localhost")
+	require.Error(t, err)
+
+	peerAddress := func(interceptor *service.ForwardedPeerInterceptor, peerIP string, pairs ...string) string {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(peerIP), Port: 1234}})
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(pairs...))
+
+		address := ""
+		_, err := interceptor.Unary()(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			p, ok := peer.FromContext(ctx)
+			require.True(t, ok)
+			address = p.Addr.String()
+			return nil, nil
+		})
+		require.NoError(t, err)
+		return address
+	}
+	interceptor := service.NewForwardedPeerInterceptor(trustedProxies, "gateway")
+	gateway := func(forwardedFor string) []string {
+		return []string{service.GatewaySecretHeader, "gateway", "x-forwarded-for", forwardedFor}
+	}
+
+	// the gateway appends the address it got the request from to the header of the client
+	require.Equal(t, "203.0.113.7:0", peerAddress(interceptor, "127.0.0.1", gateway("203.0.113.7")...))
+	require.Equal(t, "[2001:db8::1]:0", peerAddress(interceptor, "::1", gateway("2001:db8::1")...))
+	require.Equal(t, "203.0.113.7:0", peerAddress(interceptor, "10.1.2.3", gateway("198.51.100.1, 203.0.113.7")...))
+
+	// other peers could forge the header
+	require.Equal(t, "203.0.113.9:1234", peerAddress(interceptor, "203.0.113.9", gateway("198.51.100.1")...))
+	require.Equal(t, "127.0.0.1:1234", peerAddress(interceptor, "127.0.0.1", "x-forwarded-for", "198.51.100.1"))
+	require.Equal(t, "127.0.0.1:1234", peerAddress(interceptor, "127.0.0.1", service.GatewaySecretHeader, "wrong", "x-forwarded-for", "198.51.100.1"))
+	require.Equal(t, "127.0.0.1:1234", peerAddress(interceptor, "127.0.0.1", append(gateway("198.51.100.1"), service.GatewaySecretHeader, "wrong")...))
+	require.Equal(t, "127.0.0.1:1234", peerAddress(interceptor, "127.0.0.1", service.GatewaySecretHeader, "gateway"))
+	require.Equal(t, "127.0.0.1:1234", peerAddress(interceptor, "127.0.0.1", gateway("not an ip")...))
+
+	// no peer is trusted without a secret
+	interceptor = service.NewForwardedPeerInterceptor(trustedProxies, "")
+	require.Equal(t, "127.0.0.1:1234", peerAddress(interceptor, "127.0.0.1", append(gateway("198.51.100.1"), service.GatewaySecretHeader, "")...))
+}
+
+func TestForwardedPeerInterceptorThrottlesDirectClients(t *testing.T) {
+	t.Parallel()
+
+	ipPolicy := service.LockoutPolicy{
+		LockoutFailures: 1,
+		LockoutDuration: time.Hour,
+	}
+	auditSink := &testAuditSink{}
+	authServer := service.NewAuthServer(
+		service.NewInMemoryUserStore(),
+		service.NewInMemoryInviteStore(),
+		service.NewInMemoryRefreshTokenStore(time.Hour),
+		service.NewInMemoryRevocationList(),
+		service.NewInMemoryAPIKeyStore(),
+		service.NewInMemoryLoginChallengeStore(time.Minute),
+		service.NewLoginThrottle(service.LockoutPolicy{}, ipPolicy, auditSink),
+		nil,
+		nil,
+		nil,
+		service.NewJWTManager("secret", time.Minute),
+		nil,
+		false,
+	)
+
+	// the gateway runs on the same host as the direct clients
+	trustedProxies, err := service.ParseTrustedProxies("127.0.0.1, ::1")
+	require.NoError(t, err)
+	interceptor := service.NewForwardedPeerInterceptor(trustedProxies, "gateway")
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(interceptor.Unary()))
+	pb.RegisterAuthServiceServer(grpcServer, authServer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	authClient := pb.NewAuthServiceClient(conn)
+
+	login := func(pairs ...string) codes.Code {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), pairs...)
+		_, err := authClient.Login(ctx, &pb.LoginRequest{Username: "user1", Password: "wrong"})
+		return status.Code(err)
+	}
+
+	// a direct client cannot pick its address to escape its lockout
+	require.Equal(t, codes.NotFound, login("x-forwarded-for", "203.0.113.7"))
+	require.Equal(t, []string{"login.lockout ip:127.0.0.1"}, auditSink.events())
+	require.Equal(t, codes.ResourceExhausted, login("x-forwarded-for", "203.0.113.8"))
+
+	// the clients of the gateway are throttled by their own address
+	require.Equal(t, codes.NotFound, login(service.GatewaySecretHeader, "gateway", "x-forwarded-for", "203.0.113.7"))
+	require.Equal(t, []string{"login.lockout ip:127.0.0.1", "login.lockout ip:203.0.113.7"}, auditSink.events())
+}
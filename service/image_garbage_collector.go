@@ -0,0 +1,100 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ImageGarbageCollector periodically removes images whose laptop no longer exists,
+// and data left behind by uploads that never completed.
+type ImageGarbageCollector struct {
+	imageStore  ImageStore
+	laptopStore LaptopStore
+	gracePeriod time.Duration
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewImageGarbageCollector creates a new ImageGarbageCollector.
+// Incomplete data is only removed once it is older than gracePeriod, so that uploads in progress are kept.
+func NewImageGarbageCollector(imageStore ImageStore, laptopStore LaptopStore, gracePeriod time.Duration) *ImageGarbageCollector {
+	return &ImageGarbageCollector{
+		imageStore:  imageStore,
+		laptopStore: laptopStore,
+		gracePeriod: gracePeriod,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Start runs a collection every interval in the background until Stop is called.
+func (collector *ImageGarbageCollector) Start(interval time.Duration) {
+	collector.wg.Add(1)
+	go func() {
+		defer collector.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-collector.stop:
+				return
+			case <-ticker.C:
+				_, err := collector.Collect()
+				if err != nil {
+					log.Printf("image garbage collection failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the background collection and waits for it to finish.
+func (collector *ImageGarbageCollector) Stop() {
+	close(collector.stop)
+	collector.wg.Wait()
+}
+
+// Collect runs one collection and returns the number of images removed.
+func (collector *ImageGarbageCollector) Collect() (int, error) {
+	usage, err := collector.imageStore.Usage()
+	if err != nil {
+		return 0, fmt.Errorf("cannot get image usage: %w", err)
+	}
+
+	removed := 0
+	for laptopID := range usage.Laptops {
+		laptop, err := collector.laptopStore.Find(laptopID)
+		if err != nil {
+			return removed, fmt.Errorf("cannot find laptop: %w", err)
+		}
+		if laptop != nil {
+			continue
+		}
+
+		images, err := collector.imageStore.List(laptopID)
+		if err != nil {
+			return removed, fmt.Errorf("cannot list laptop images: %w", err)
+		}
+		for _, info := range images {
+			err := collector.imageStore.Delete(info.ID)
+			if err != nil && err != ErrImageNotFound {
+				return removed, fmt.Errorf("cannot delete image: %w", err)
+			}
+			log.Printf("removed image %s of deleted laptop %s", info.ID, laptopID)
+			removed++
+		}
+	}
+
+	incomplete, err := collector.imageStore.RemoveIncomplete(time.Now().Add(-collector.gracePeriod))
+	if err != nil {
+		return removed, fmt.Errorf("cannot remove incomplete images: %w", err)
+	}
+	if incomplete > 0 {
+		log.Printf("removed %d incomplete images", incomplete)
+	}
+
+	return removed + incomplete, nil
+}
@@ -0,0 +1,120 @@
+package service_test
+
+import (
+	"bytes"
+	"fmt"
+	sample "learngrpc/pcbook/samples"
+	"learngrpc/pcbook/service"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageGarbageCollectorDisk(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	imageStore := service.NewDiskImageStore(imageFolder)
+	laptopStore := service.NewInMemoryLaptopStore()
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	keptID, err := imageStore.Save(laptop.Id, ".jpg", *bytes.NewBufferString("kept"))
+	require.NoError(t, err)
+	orphanID, err := imageStore.Save(sample.NewLaptop().Id, ".jpg", *bytes.NewBufferString("orphan"))
+	require.NoError(t, err)
+	err = imageStore.SaveVariant(orphanID, service.ImageVariantThumbnail, 1, 1, *bytes.NewBufferString("thumb"))
+	require.NoError(t, err)
+
+	// a file left behind by a write that never completed
+	incompletePath := filepath.Join(imageFolder, uuid.New().String()+".jpg.part")
+	require.NoError(t, os.WriteFile(incompletePath, []byte("partial"), 0644))
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(incompletePath, old, old))
+
+	// a recent one may still be in progress
+	recentPath := filepath.Join(imageFolder, uuid.New().String()+"_thumbnail_128.jpg.part")
+	require.NoError(t, os.WriteFile(recentPath, []byte("partial"), 0644))
+
+	// the complete file of an image saved before a restart is not in the index, but is kept
+	previousPath := filepath.Join(imageFolder, uuid.New().String()+".jpg")
+	require.NoError(t, os.WriteFile(previousPath, []byte("previous"), 0644))
+	require.NoError(t, os.Chtimes(previousPath, old, old))
+
+	collector := service.NewImageGarbageCollector(imageStore, laptopStore, time.Hour)
+	removed, err := collector.Collect()
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+
+	info, err := imageStore.Find(orphanID)
+	require.NoError(t, err)
+	require.Nil(t, info)
+	info, err = imageStore.Find(keptID)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+
+	require.NoFileExists(t, incompletePath)
+	require.FileExists(t, recentPath)
+	require.FileExists(t, previousPath)
+	files, err := filepath.Glob(fmt.Sprintf("%s/%s*", imageFolder, orphanID))
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	usage, err := imageStore.Usage()
+	require.NoError(t, err)
+	require.Equal(t, 1, usage.Images)
+	require.Equal(t, int64(len("kept")), usage.Bytes)
+}
+
+func TestImageGarbageCollectorS3(t *testing.T) {
+	t.Parallel()
+
+	fake, endpoint := startFakeS3(t)
+	imageStore := service.NewS3ImageStore(service.S3Config{
+		Endpoint:        endpoint,
+		Bucket:          testS3Bucket,
+		AccessKeyID:     testS3AccessKey,
+		SecretAccessKey: "test-secret-key",
+	})
+	laptopStore := service.NewInMemoryLaptopStore()
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	keptID, err := imageStore.Save(laptop.Id, ".jpg", *bytes.NewBufferString("kept"))
+	require.NoError(t, err)
+	_, err = imageStore.Save(sample.NewLaptop().Id, ".jpg", *bytes.NewBufferString("orphan"))
+	require.NoError(t, err)
+
+	// an original whose info and laptop marker were never written
+	incompleteKey := fmt.Sprintf("images/%s/original.jpg", uuid.New().String())
+	fake.mutex.Lock()
+	fake.objects[incompleteKey] = &fakeS3Object{[]byte("partial"), time.Now().Add(-2 * time.Hour)}
+	fake.mutex.Unlock()
+
+	usage, err := imageStore.Usage()
+	require.NoError(t, err)
+	require.Equal(t, 2, usage.Images)
+	require.Len(t, usage.Laptops, 2)
+
+	collector := service.NewImageGarbageCollector(imageStore, laptopStore, time.Hour)
+	removed, err := collector.Collect()
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+
+	// only the info and original of the kept image, and its marker remain
+	require.Equal(t, 2, fake.count("images/"))
+	require.Equal(t, 1, fake.count("laptops/"))
+
+	images, err := imageStore.List(laptop.Id)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	require.Equal(t, keptID, images[0].ID)
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrQuotaExceeded is returned when saving an image would exceed an ImageQuota.
+var ErrQuotaExceeded = errors.New("image quota exceeded")
+
+// ImageQuota limits how many images are stored. A zero limit means unlimited.
+//
+// The quota is enforced by each server on its own. Servers sharing an S3ImageStore bucket do not see
+// the images the others are saving, and only see their saved images once the bucket is listed again,
+// so together they can exceed the quota by what they save in the meantime.
+type ImageQuota struct {
+	MaxImagesPerLaptop int
+	MaxTotalBytes      int64
+}
+
+// IsUnlimited reports whether the quota has no limit at all.
+func (quota ImageQuota) IsUnlimited() bool {
+	return quota.MaxImagesPerLaptop <= 0 && quota.MaxTotalBytes <= 0
+}
+
+// Check returns an error wrapping ErrQuotaExceeded if adding one more image
+// of imageSize bytes to the laptop would exceed the quota.
+func (quota ImageQuota) Check(usage *ImageUsage, laptopID string, imageSize int64) error {
+	if quota.MaxImagesPerLaptop > 0 {
+		images := 0
+		if laptopUsage := usage.Laptops[laptopID]; laptopUsage != nil {
+			images = laptopUsage.Images
+		}
+		if images+1 > quota.MaxImagesPerLaptop {
+			return fmt.Errorf("%w: laptop %s already has %d of %d images", ErrQuotaExceeded, laptopID, images, quota.MaxImagesPerLaptop)
+		}
+	}
+
+	if quota.MaxTotalBytes > 0 && usage.Bytes+imageSize > quota.MaxTotalBytes {
+		return fmt.Errorf("%w: storing %d more bytes would exceed %d of %d bytes", ErrQuotaExceeded, imageSize, usage.Bytes, quota.MaxTotalBytes)
+	}
+
+	return nil
+}
+
+// imageQuotaReservations holds the quota of the images being saved, so that concurrent saves
+// are checked against each other and cannot exceed the quota together.
+type imageQuotaReservations struct {
+	mutex   sync.Mutex
+	pending map[string]*LaptopImageUsage
+}
+
+// reserve checks that one more image of imageSize bytes fits in the quota with the stored and
+// the reserved images, and reserves it. The returned release must be called once the image is
+// saved or failed: a saved image is then counted by the store.
+func (reservations *imageQuotaReservations) reserve(
+	quota ImageQuota,
+	imageStore ImageStore,
+	laptopID string,
+	imageSize int64,
+) (func(), error) {
+	reservations.mutex.Lock()
+	defer reservations.mutex.Unlock()
+
+	usage, err := imageStore.Usage()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get image usage: %w", err)
+	}
+	for id, pending := range reservations.pending {
+		usage.Images += pending.Images
+		usage.Bytes += pending.Bytes
+		if usage.Laptops[id] == nil {
+			usage.Laptops[id] = &LaptopImageUsage{}
+		}
+		usage.Laptops[id].Images += pending.Images
+		usage.Laptops[id].Bytes += pending.Bytes
+	}
+
+	err = quota.Check(usage, laptopID, imageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if reservations.pending == nil {
+		reservations.pending = make(map[string]*LaptopImageUsage)
+	}
+	pending := reservations.pending[laptopID]
+	if pending == nil {
+		pending = &LaptopImageUsage{}
+		reservations.pending[laptopID] = pending
+	}
+	pending.Images++
+	pending.Bytes += imageSize
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			reservations.mutex.Lock()
+			defer reservations.mutex.Unlock()
+
+			pending.Images--
+			pending.Bytes -= imageSize
+			if pending.Images == 0 {
+				delete(reservations.pending, laptopID)
+			}
+		})
+	}
+	return release, nil
+}
@@ -2,16 +2,50 @@ package service
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrImageNotFound is returned when an image or one of its variants does not exist.
+var ErrImageNotFound = errors.New("image not found")
+
+// partialFileSuffix is the suffix of the image files being written by a DiskImageStore,
+// which are renamed without it once complete.
+const partialFileSuffix = ".part"
+
 // ImageStore is an interface for storing images.
 type ImageStore interface {
 	Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error)
+	Find(imageID string) (*ImageInfo, error)
+	List(laptopID string) ([]*ImageInfo, error)
+	Load(imageID string, variant string) ([]byte, error)
+	SaveVariant(imageID string, variant string, width int, height int, imageData bytes.Buffer) error
+	MarkVariantFailed(imageID string, variant string, reason error) error
+	Delete(imageID string) error
+	Usage() (*ImageUsage, error)
+	RemoveIncomplete(before time.Time) (int, error)
+}
+
+// ImageUsage reports how much an ImageStore holds, in total and per laptop.
+// Bytes include the resized variants of the images.
+type ImageUsage struct {
+	Images int
+	Bytes int64
+	Laptops map[string]*LaptopImageUsage
+}
+
+// LaptopImageUsage reports how much an ImageStore holds for one laptop.
+type LaptopImageUsage struct {
+	Images int
+	Bytes int64
 }
 
 // DiskImageStore is an implementation of ImageStore that saves images to disk.
@@ -23,9 +57,33 @@ type DiskImageStore struct {
 
 // ImageInfo contains information about an image.
 type ImageInfo struct {
+	ID string
 	LaptopID string
 	Type string
 	Path string
+	Size int
+	Variants map[string]*ImageVariantInfo
+}
+
+// ImageVariantInfo contains information about a resized variant of an image.
+// Err is set when the variant could not be generated.
+type ImageVariantInfo struct {
+	Path string
+	Width int
+	Height int
+	Size int
+	Err string
+}
+
+// Clone clones the image info.
+func (info *ImageInfo) Clone() *ImageInfo {
+	other := *info
+	other.Variants = make(map[string]*ImageVariantInfo, len(info.Variants))
+	for name, variant := range info.Variants {
+		v := *variant
+		other.Variants[name] = &v
+	}
+	return &other
 }
 
 // NewDiskImageStore creates a new DiskImageStore.
@@ -52,28 +110,271 @@ func (store *DiskImageStore) Save(
 
 		imagePath := fmt.Sprintf("%s/%s%s", store.imageFolder, imageID, imageType)
 
-		file, err := os.Create(imagePath)
+		imageSize := imageData.Len()
+		err = writeImageFile(imagePath, imageData.Bytes())
 		if err != nil {
-			return "", fmt.Errorf("cannot create image file: %w", err)
-		}      
-
-		_, err = imageData.WriteTo(file)
-		if err != nil {
-			return "", fmt.Errorf("cannot write image data to file: %w", err)
+			return "", err
 		}
 
 		store.mutex.Lock()
 		defer store.mutex.Unlock()
 
 		store.images[imageID.String()] = &ImageInfo{
+			ID: imageID.String(),
 			LaptopID: laptopID,
 			Type: imageType,
 			Path: imagePath,
+			Size: imageSize,
+			Variants: make(map[string]*ImageVariantInfo),
 		}
 
 		return imageID.String(), nil
 }
 
+// Find finds an image by ID.
+func (store *DiskImageStore) Find(imageID string) (*ImageInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		return nil, nil
+	}
+
+	return info.Clone(), nil
+}
+
+// List lists the images of a laptop ordered by ID.
+func (store *DiskImageStore) List(laptopID string) ([]*ImageInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var result []*ImageInfo
+	for _, info := range store.images {
+		if info.LaptopID == laptopID {
+			result = append(result, info.Clone())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+
+	return result, nil
+}
+
+// Load reads the data of an image variant from disk.
+func (store *DiskImageStore) Load(imageID string, variant string) ([]byte, error) {
+	info, err := store.Find(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, ErrImageNotFound
+	}
+
+	imagePath := info.Path
+	if variant != ImageVariantOriginal {
+		v := info.Variants[variant]
+		if v == nil || v.Err != "" {
+			return nil, ErrImageNotFound
+		}
+		imagePath = v.Path
+	}
+
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image file: %w", err)
+	}
+
+	return data, nil
+}
+
+// SaveVariant saves a resized variant of an image to disk next to the original.
+func (store *DiskImageStore) SaveVariant(
+	imageID string,
+	variant string,
+	width int,
+	height int,
+	imageData bytes.Buffer,
+) error {
+	info, err := store.Find(imageID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return ErrImageNotFound
+	}
+
+	imagePath := fmt.Sprintf("%s/%s_%s%s", store.imageFolder, imageID, variant, info.Type)
+	size := imageData.Len()
+	err = writeImageFile(imagePath, imageData.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return store.setVariant(imageID, variant, &ImageVariantInfo{
+		Path: imagePath,
+		Width: width,
+		Height: height,
+		Size: size,
+	})
+}
+
+// MarkVariantFailed records that a variant of an image could not be generated.
+func (store *DiskImageStore) MarkVariantFailed(imageID string, variant string, reason error) error {
+	return store.setVariant(imageID, variant, &ImageVariantInfo{
+		Err: reason.Error(),
+	})
+}
+
+// Delete removes an image and its variants from disk.
+func (store *DiskImageStore) Delete(imageID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		return ErrImageNotFound
+	}
+
+	paths := []string{info.Path}
+	for _, variant := range info.Variants {
+		if variant.Path != "" {
+			paths = append(paths, variant.Path)
+		}
+	}
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove image file: %w", err)
+		}
+	}
+	delete(store.images, imageID)
+
+	return nil
+}
+
+// Usage returns the number of images and bytes stored, in total and per laptop.
+func (store *DiskImageStore) Usage() (*ImageUsage, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	usage := &ImageUsage{
+		Laptops: make(map[string]*LaptopImageUsage),
+	}
+	for _, info := range store.images {
+		bytes := int64(info.Size)
+		for _, variant := range info.Variants {
+			bytes += int64(variant.Size)
+		}
+		usage.add(info.LaptopID, 1, bytes)
+	}
+
+	return usage, nil
+}
+
+// RemoveIncomplete removes the partial files in the image folder, such as the leftovers of a write
+// interrupted by a crash, if they were last modified before the given time. The complete files are
+// kept even if they are not in the index, which is empty after a restart.
+func (store *DiskImageStore) RemoveIncomplete(before time.Time) (int, error) {
+	entries, err := os.ReadDir(store.imageFolder)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot read image folder: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, partialFileSuffix) {
+			continue
+		}
+
+		imageID := strings.TrimSuffix(name, partialFileSuffix)
+		imageID = strings.TrimSuffix(imageID, filepath.Ext(imageID))
+		if i := strings.Index(imageID, "_"); i >= 0 {
+			imageID = imageID[:i]
+		}
+		if _, err := uuid.Parse(imageID); err != nil {
+			continue
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil || !fileInfo.ModTime().Before(before) {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(store.imageFolder, name))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("cannot remove incomplete image file: %w", err)
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// writeImageFile writes an image file through a partial file, which is renamed once complete,
+// so that an interrupted write never leaves a file that looks complete.
+func writeImageFile(imagePath string, data []byte) error {
+	partialPath := imagePath + partialFileSuffix
+	err := os.WriteFile(partialPath, data, 0644)
+	if err != nil {
+		os.Remove(partialPath)
+		return fmt.Errorf("cannot write image file: %w", err)
+	}
+
+	err = os.Rename(partialPath, imagePath)
+	if err != nil {
+		os.Remove(partialPath)
+		return fmt.Errorf("cannot rename image file: %w", err)
+	}
+	return nil
+}
+
+// add adds images and bytes to the usage of a laptop, or removes them if negative.
+func (usage *ImageUsage) add(laptopID string, images int, bytes int64) {
+	usage.Images += images
+	usage.Bytes += bytes
+
+	laptopUsage := usage.Laptops[laptopID]
+	if laptopUsage == nil {
+		laptopUsage = &LaptopImageUsage{}
+		usage.Laptops[laptopID] = laptopUsage
+	}
+	laptopUsage.Images += images
+	laptopUsage.Bytes += bytes
+	if laptopUsage.Images <= 0 {
+		delete(usage.Laptops, laptopID)
+	}
+}
+
+func (usage *ImageUsage) clone() *ImageUsage {
+	other := &ImageUsage{
+		Images:  usage.Images,
+		Bytes:   usage.Bytes,
+		Laptops: make(map[string]*LaptopImageUsage, len(usage.Laptops)),
+	}
+	for laptopID, laptopUsage := range usage.Laptops {
+		laptopCopy := *laptopUsage
+		other.Laptops[laptopID] = &laptopCopy
+	}
+	return other
+}
+
+func (store *DiskImageStore) setVariant(imageID string, variant string, variantInfo *ImageVariantInfo) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		return ErrImageNotFound
+	}
+	info.Variants[variant] = variantInfo
+
+	return nil
+}
+
 // saveImageToFile saves an image to a file.
 func saveImageToFile(folder string, laptopID string, imageType string, imageData []byte) (string, error) {
 	return "", nil
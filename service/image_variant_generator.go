@@ -0,0 +1,221 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Names of the image variants.
+const (
+	ImageVariantOriginal  = "original"
+	ImageVariantThumbnail = "thumbnail_128"
+	ImageVariantPreview   = "preview_512"
+)
+
+// ImageVariantSizes maps each resized variant to the maximum length of its longest side.
+var ImageVariantSizes = map[string]int{
+	ImageVariantThumbnail: 128,
+	ImageVariantPreview:   512,
+}
+
+// ImageVariantGenerator generates resized variants of uploaded images in a pool of background workers.
+type ImageVariantGenerator struct {
+	imageStore ImageStore
+	jobs       chan string
+	wg         sync.WaitGroup
+	mutex      sync.Mutex // protects closed, so that no job is sent to the closed queue
+	closed     bool
+}
+
+// NewImageVariantGenerator creates a new ImageVariantGenerator and starts its workers.
+func NewImageVariantGenerator(imageStore ImageStore, workers int, queueSize int) *ImageVariantGenerator {
+	generator := &ImageVariantGenerator{
+		imageStore: imageStore,
+		jobs:       make(chan string, queueSize),
+	}
+
+	for i := 0; i < workers; i++ {
+		generator.wg.Add(1)
+		go generator.work()
+	}
+
+	return generator
+}
+
+// Enqueue schedules the variants of an image for generation.
+// It never blocks: when the queue is full or closed the variants are marked as failed.
+func (generator *ImageVariantGenerator) Enqueue(imageID string) {
+	err := generator.enqueue(imageID)
+	if err != nil {
+		generator.fail(imageID, err)
+	}
+}
+
+func (generator *ImageVariantGenerator) enqueue(imageID string) error {
+	generator.mutex.Lock()
+	defer generator.mutex.Unlock()
+
+	if generator.closed {
+		return fmt.Errorf("variant generator is closed")
+	}
+
+	select {
+	case generator.jobs <- imageID:
+		return nil
+	default:
+		return fmt.Errorf("variant generation queue is full")
+	}
+}
+
+// Close stops accepting new images and waits for the queued ones to be processed.
+// It can be called more than once.
+func (generator *ImageVariantGenerator) Close() {
+	generator.mutex.Lock()
+	if !generator.closed {
+		generator.closed = true
+		close(generator.jobs)
+	}
+	generator.mutex.Unlock()
+
+	generator.wg.Wait()
+}
+
+func (generator *ImageVariantGenerator) work() {
+	defer generator.wg.Done()
+
+	for imageID := range generator.jobs {
+		generator.generate(imageID)
+	}
+}
+
+func (generator *ImageVariantGenerator) generate(imageID string) {
+	info, err := generator.imageStore.Find(imageID)
+	if err != nil || info == nil {
+		log.Printf("cannot find image %s to generate variants: %v", imageID, err)
+		return
+	}
+
+	data, err := generator.imageStore.Load(imageID, ImageVariantOriginal)
+	if err != nil {
+		generator.fail(imageID, err)
+		return
+	}
+
+	src, err := decodeImage(info.Type, data)
+	if err != nil {
+		generator.fail(imageID, err)
+		return
+	}
+
+	for variant, maxSide := range ImageVariantSizes {
+		dst := resizeImage(src, maxSide)
+
+		var buffer bytes.Buffer
+		err := encodeImage(&buffer, info.Type, dst)
+		if err == nil {
+			bounds := dst.Bounds()
+			err = generator.imageStore.SaveVariant(imageID, variant, bounds.Dx(), bounds.Dy(), buffer)
+		}
+		if err != nil {
+			log.Printf("cannot generate %s variant of image %s: %v", variant, imageID, err)
+			generator.imageStore.MarkVariantFailed(imageID, variant, err)
+			continue
+		}
+		log.Printf("generated %s variant of image %s", variant, imageID)
+	}
+}
+
+func (generator *ImageVariantGenerator) fail(imageID string, reason error) {
+	log.Printf("cannot generate variants of image %s: %v", imageID, reason)
+	for variant := range ImageVariantSizes {
+		generator.imageStore.MarkVariantFailed(imageID, variant, reason)
+	}
+}
+
+func decodeImage(imageType string, data []byte) (image.Image, error) {
+	switch strings.ToLower(imageType) {
+	case ".jpg", ".jpeg":
+		return jpeg.Decode(bytes.NewReader(data))
+	case ".png":
+		return png.Decode(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("unsupported image type: %s", imageType)
+	}
+}
+
+func encodeImage(buffer *bytes.Buffer, imageType string, img image.Image) error {
+	switch strings.ToLower(imageType) {
+	case ".jpg", ".jpeg":
+		return jpeg.Encode(buffer, img, &jpeg.Options{Quality: 85})
+	case ".png":
+		return png.Encode(buffer, img)
+	default:
+		return fmt.Errorf("unsupported image type: %s", imageType)
+	}
+}
+
+// resizeImage scales an image down so that its longest side is at most maxSide,
+// averaging the source pixels covered by each destination pixel.
+// Images that are already small enough keep their size.
+func resizeImage(src image.Image, maxSide int) image.Image {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	width, height := srcWidth, srcHeight
+	if width > maxSide || height > maxSide {
+		if width >= height {
+			width, height = maxSide, srcHeight*maxSide/srcWidth
+		} else {
+			width, height = srcWidth*maxSide/srcHeight, maxSide
+		}
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*srcHeight/height
+		y1 := bounds.Min.Y + (y+1)*srcHeight/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*srcWidth/width
+			x1 := bounds.Min.X + (x+1)*srcWidth/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrInviteNotFound is returned when an invite code does not exist, was already used or has expired.
+var ErrInviteNotFound = errors.New("invite not found")
+
+// Invite is a single-use code to register a user with a role and a team.
+type Invite struct {
+	Code      string
+	Role      string
+	Team      string
+	ExpiresAt time.Time
+}
+
+// InviteStore is a store for invite codes.
+type InviteStore interface {
+	Create(role string, team string, ttl time.Duration) (*Invite, error) // Create creates a new invite for a role and a team
+	Redeem(code string) (*Invite, error)                                 // Redeem uses an invite, which cannot be used again
+}
+
+// InMemoryInviteStore is an in-memory store for invite codes.
+type InMemoryInviteStore struct {
+	mutex   sync.Mutex
+	invites map[string]*Invite
+}
+
+// NewInMemoryInviteStore creates a new InMemoryInviteStore.
+func NewInMemoryInviteStore() *InMemoryInviteStore {
+	return &InMemoryInviteStore{
+		invites: make(map[string]*Invite),
+	}
+}
+
+// Create creates a new invite for a role and a team that expires after ttl.
+func (store *InMemoryInviteStore) Create(role string, team string, ttl time.Duration) (*Invite, error) {
+	code, err := randomString(16)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate invite code: %w", err)
+	}
+
+	invite := &Invite{
+		Code:      code,
+		Role:      role,
+		Team:      team,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for code, other := range store.invites {
+		if now.After(other.ExpiresAt) {
+			delete(store.invites, code)
+		}
+	}
+	store.invites[invite.Code] = invite
+
+	other := *invite
+	return &other, nil
+}
+
+// Redeem uses an invite, which cannot be used again.
+// It returns ErrInviteNotFound if the code is unknown, already used or expired.
+func (store *InMemoryInviteStore) Redeem(code string) (*Invite, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	invite := store.invites[code]
+	if invite == nil {
+		return nil, ErrInviteNotFound
+	}
+	delete(store.invites, code)
+
+	if time.Now().After(invite.ExpiresAt) {
+		return nil, ErrInviteNotFound
+	}
+	return invite, nil
+}
+
+// randomString returns size random bytes encoded in base64url.
+func randomString(size int) (string, error) {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+)
+
+const (
+	jwksPath   = "/.well-known/jwks.json"
+	jwksMaxAge = "max-age=300"
+)
+
+// RegisterJWKSHandler registers a REST handler on the gateway mux that publishes
+// the public keys of the JWT manager, so that other services can verify the tokens.
+func RegisterJWKSHandler(mux *runtime.ServeMux, jwtManager *JWTManager) error {
+	return mux.HandlePath(http.MethodGet, jwksPath, func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", jwksMaxAge)
+
+		err := json.NewEncoder(w).Encode(jwtManager.JSONWebKeySet())
+		if err != nil {
+			log.Printf("cannot write JSON web key set: %v", err)
+		}
+	})
+}
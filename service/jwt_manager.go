@@ -2,44 +2,105 @@ package service
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
 // JWTManager is a JSON web token manager.
+// It signs tokens with its current key, and verifies them with the current key
+// or a previous key that is still in its rotation window.
 type JWTManager struct {
-	secretKey string
+	mutex sync.RWMutex
+	currentKey *SigningKey
+	previousKeys []*previousSigningKey
 	tokenDuration time.Duration
 }
 
+// previousSigningKey is a key that verifies the tokens it signed until they have expired.
+type previousSigningKey struct {
+	*SigningKey
+	until time.Time
+}
+
 // UserClaims is a custom JWT claims that contains some user's information.
 type UserClaims struct {
 	jwt.StandardClaims
 	Username string `json:"username"`
 	Role string `json:"role"`
+	Team string `json:"team,omitempty"`
+	SessionID string `json:"sid,omitempty"` // the refresh token family the token was issued for
 }
 
-// NewJWTManager creates a new JWTManager.
+// NewJWTManager creates a new JWTManager that signs tokens with HS256 and a shared secret.
 func NewJWTManager(secretKey string, tokenDuration time.Duration) *JWTManager {
 	return &JWTManager{
-		secretKey: secretKey,
+		currentKey: NewHMACSigningKey(secretKey),
 		tokenDuration: tokenDuration,
 	}
 }
 
-// Generate generates a new JWT token.
-func (manager *JWTManager) Generate(user *User) (string, error) {
+// NewJWTManagerWithKey creates a new JWTManager that signs tokens with a private key.
+func NewJWTManagerWithKey(key *SigningKey, tokenDuration time.Duration) (*JWTManager, error) {
+	if !key.CanSign() {
+		return nil, fmt.Errorf("signing key %s has no private key", key.ID)
+	}
+
+	return &JWTManager{
+		currentKey: key,
+		tokenDuration: tokenDuration,
+	}, nil
+}
+
+// AddPreviousKey accepts the tokens signed with a previous key until the given time.
+func (manager *JWTManager) AddPreviousKey(key *SigningKey, until time.Time) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.previousKeys = append(manager.previousKeys, &previousSigningKey{key, until})
+}
+
+// Rotate signs the new tokens with a new key, and keeps accepting the tokens signed
+// with the current key during the rotation window, which should not be shorter than the token duration.
+func (manager *JWTManager) Rotate(key *SigningKey, rotationWindow time.Duration) error {
+	if !key.CanSign() {
+		return fmt.Errorf("signing key %s has no private key", key.ID)
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.previousKeys = append(manager.previousKeys, &previousSigningKey{manager.currentKey, time.Now().Add(rotationWindow)})
+	manager.currentKey = key
+	return nil
+}
+
+// Generate generates a new JWT token with a unique ID, for the given session if any.
+func (manager *JWTManager) Generate(user *User, sessionID string) (string, error) {
+	id, err := randomString(16)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate token id: %w", err)
+	}
+
 	claims := UserClaims{
 		StandardClaims: jwt.StandardClaims{
+			Id: id,
 			ExpiresAt: time.Now().Add(manager.tokenDuration).Unix(),
 		},
 		Username: user.Username,
 		Role: user.Role,
+		Team: user.Team,
+		SessionID: sessionID,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(manager.secretKey))
+	manager.mutex.RLock()
+	key := manager.currentKey
+	manager.mutex.RUnlock()
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.privateKey)
 }
 
 // Verify verifies a JWT token.
@@ -48,12 +109,17 @@ func (manager *JWTManager) Verify(accessToken string) (*UserClaims, error) {
 		accessToken,
 		&UserClaims{}, 
 		func(token *jwt.Token) (interface{}, error) {
-			_, ok := token.Method.(*jwt.SigningMethodHMAC)
-			if !ok {
+			keyID, _ := token.Header["kid"].(string)
+			key := manager.verifyingKey(keyID)
+			if key == nil {
+				return nil, fmt.Errorf("unknown signing key: %q", keyID)
+			}
+
+			if token.Method.Alg() != key.Method.Alg() {
 				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 			}
 
-			return []byte(manager.secretKey), nil
+			return key.publicKey, nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("invalid token: %w", err)
@@ -65,4 +131,47 @@ func (manager *JWTManager) Verify(accessToken string) (*UserClaims, error) {
 	}
 
 	return claims, nil
-}
\ No newline at end of file
+}
+
+// TokenDuration returns how long the generated tokens are valid.
+func (manager *JWTManager) TokenDuration() time.Duration {
+	return manager.tokenDuration
+}
+
+// JSONWebKeySet returns the public keys that verify tokens, without the shared secrets.
+func (manager *JWTManager) JSONWebKeySet() JSONWebKeySet {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	keySet := JSONWebKeySet{Keys: []JSONWebKey{}}
+	if !manager.currentKey.IsSymmetric() {
+		keySet.Keys = append(keySet.Keys, manager.currentKey.JSONWebKey())
+	}
+
+	now := time.Now()
+	for _, key := range manager.previousKeys {
+		if !key.IsSymmetric() && now.Before(key.until) {
+			keySet.Keys = append(keySet.Keys, key.JSONWebKey())
+		}
+	}
+
+	return keySet
+}
+
+// verifyingKey returns the current or previous key with the given ID, if any.
+func (manager *JWTManager) verifyingKey(keyID string) *SigningKey {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	if manager.currentKey.ID == keyID {
+		return manager.currentKey
+	}
+
+	now := time.Now()
+	for _, key := range manager.previousKeys {
+		if key.ID == keyID && now.Before(key.until) {
+			return key.SigningKey
+		}
+	}
+	return nil
+}
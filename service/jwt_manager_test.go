@@ -0,0 +1,180 @@
+package service_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"learngrpc/pcbook/service"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTManagerSigningKeys(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name string
+		key  interface{}
+		alg  string
+		kty  string
+	}{
+		{name: "rs256", key: rsaKey, alg: "RS256", kty: "RSA"},
+		{name: "es256", key: ecKey, alg: "ES256", kty: "EC"},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			key, err := service.LoadSigningKey(writeTestPrivateKey(t, tc.key))
+			require.NoError(t, err)
+			require.Equal(t, tc.alg, key.Method.Alg())
+
+			jwtManager, err := service.NewJWTManagerWithKey(key, time.Minute)
+			require.NoError(t, err)
+
+			token, err := jwtManager.Generate(&service.User{Username: "user1", Role: "user"}, "")
+			require.NoError(t, err)
+			requireTokenHeader(t, token, tc.alg, key.ID)
+
+			claims, err := jwtManager.Verify(token)
+			require.NoError(t, err)
+			require.Equal(t, "user1", claims.Username)
+
+			keySet := jwtManager.JSONWebKeySet()
+			require.Len(t, keySet.Keys, 1)
+			require.Equal(t, key.ID, keySet.Keys[0].KeyID)
+			require.Equal(t, tc.kty, keySet.Keys[0].KeyType)
+
+			// a verifier with only the public key accepts the token, but cannot sign
+			publicKey, err := service.NewSigningKey(publicKeyOf(tc.key))
+			require.NoError(t, err)
+			require.Equal(t, key.ID, publicKey.ID)
+			require.False(t, publicKey.CanSign())
+			_, err = service.NewJWTManagerWithKey(publicKey, time.Minute)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestJWTManagerRotation(t *testing.T) {
+	t.Parallel()
+
+	oldKey := newTestSigningKey(t)
+	newKey := newTestSigningKey(t)
+
+	jwtManager, err := service.NewJWTManagerWithKey(oldKey, time.Minute)
+	require.NoError(t, err)
+	oldToken, err := jwtManager.Generate(&service.User{Username: "user1", Role: "user"}, "")
+	require.NoError(t, err)
+
+	err = jwtManager.Rotate(newKey, time.Minute)
+	require.NoError(t, err)
+	newToken, err := jwtManager.Generate(&service.User{Username: "user1", Role: "user"}, "")
+	require.NoError(t, err)
+	requireTokenHeader(t, newToken, "ES256", newKey.ID)
+
+	_, err = jwtManager.Verify(oldToken)
+	require.NoError(t, err)
+	_, err = jwtManager.Verify(newToken)
+	require.NoError(t, err)
+	require.Len(t, jwtManager.JSONWebKeySet().Keys, 2)
+
+	// once the rotation window is over, only the new key is accepted and published
+	expiredManager, err := service.NewJWTManagerWithKey(newKey, time.Minute)
+	require.NoError(t, err)
+	expiredManager.AddPreviousKey(oldKey, time.Now().Add(-time.Second))
+
+	_, err = expiredManager.Verify(oldToken)
+	require.Error(t, err)
+	_, err = expiredManager.Verify(newToken)
+	require.NoError(t, err)
+	require.Len(t, expiredManager.JSONWebKeySet().Keys, 1)
+
+	// a token signed with the shared secret of another manager is rejected
+	hmacToken, err := service.NewJWTManager("secret", time.Minute).Generate(&service.User{Username: "user1", Role: "admin"}, "")
+	require.NoError(t, err)
+	_, err = jwtManager.Verify(hmacToken)
+	require.Error(t, err)
+}
+
+func TestJWKSHandler(t *testing.T) {
+	t.Parallel()
+
+	key := newTestSigningKey(t)
+	jwtManager, err := service.NewJWTManagerWithKey(key, time.Minute)
+	require.NoError(t, err)
+
+	mux := runtime.NewServeMux()
+	err = service.RegisterJWKSHandler(mux, jwtManager)
+	require.NoError(t, err)
+
+	restServer := httptest.NewServer(mux)
+	t.Cleanup(restServer.Close)
+
+	res, err := http.Get(restServer.URL + "/.well-known/jwks.json")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+	keySet := service.JSONWebKeySet{}
+	err = json.NewDecoder(res.Body).Decode(&keySet)
+	require.NoError(t, err)
+	require.Equal(t, []service.JSONWebKey{key.JSONWebKey()}, keySet.Keys)
+}
+
+func newTestSigningKey(t *testing.T) *service.SigningKey {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	key, err := service.NewSigningKey(privateKey)
+	require.NoError(t, err)
+	return key
+}
+
+func writeTestPrivateKey(t *testing.T, key interface{}) string {
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	filename := filepath.Join(t.TempDir(), "jwt-key.pem")
+	err = os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data}), 0o600)
+	require.NoError(t, err)
+	return filename
+}
+
+func publicKeyOf(key interface{}) interface{} {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey
+	case *ecdsa.PrivateKey:
+		return &key.PublicKey
+	}
+	return nil
+}
+
+func requireTokenHeader(t *testing.T, token string, alg string, keyID string) {
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &jwt.StandardClaims{})
+	require.NoError(t, err)
+	require.Equal(t, alg, parsed.Header["alg"])
+	require.Equal(t, keyID, parsed.Header["kid"])
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"learngrpc/pcbook/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LaptopAction is an action on a laptop, worded to complete "cannot ... laptop".
+type LaptopAction string
+
+const (
+	LaptopCreate      LaptopAction = "create"
+	LaptopUploadImage LaptopAction = "upload images to"
+)
+
+// LaptopAuthorizer decides if the caller with the given claims can perform an action on a laptop.
+// It returns a PermissionDenied error that explains the decision if not.
+type LaptopAuthorizer interface {
+	Authorize(claims *UserClaims, action LaptopAction, laptop *pb.Laptop) error
+}
+
+// OwnershipAuthorizer lets admins perform any action on any laptop.
+// Other users, such as sellers, can only create laptops for their own team,
+// and only change the laptops they created or that their team owns.
+type OwnershipAuthorizer struct{}
+
+// NewOwnershipAuthorizer creates a new OwnershipAuthorizer.
+func NewOwnershipAuthorizer() *OwnershipAuthorizer {
+	return &OwnershipAuthorizer{}
+}
+
+// Authorize decides if the caller can perform an action on a laptop.
+func (authorizer *OwnershipAuthorizer) Authorize(claims *UserClaims, action LaptopAction, laptop *pb.Laptop) error {
+	if claims == nil {
+		return status.Errorf(codes.Unauthenticated, "cannot %s laptop %s without a verified user", action, laptop.GetId())
+	}
+	if claims.Role == "admin" {
+		return nil
+	}
+
+	if action == LaptopCreate {
+		if laptop.GetTeam() != claims.Team {
+			return status.Errorf(
+				codes.PermissionDenied,
+				"user %s with role %s cannot create laptop %s for team %q: users can only create laptops for their own team %q",
+				claims.Username, claims.Role, laptop.GetId(), laptop.GetTeam(), claims.Team,
+			)
+		}
+		return nil
+	}
+
+	if laptop.GetOwner() == claims.Username {
+		return nil
+	}
+	if laptop.GetTeam() != "" && laptop.GetTeam() == claims.Team {
+		return nil
+	}
+
+	return status.Errorf(
+		codes.PermissionDenied,
+		"user %s with role %s cannot %s laptop %s: it is owned by user %q of team %q, and only its owner, its team or an admin can",
+		claims.Username, claims.Role, action, laptop.GetId(), laptop.GetOwner(), laptop.GetTeam(),
+	)
+}
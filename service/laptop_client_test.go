@@ -2,20 +2,30 @@ package service_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"image/jpeg"
 	"io"
+	"learngrpc/pcbook/client"
 	"learngrpc/pcbook/pb"
+	"math"
 	sample "learngrpc/pcbook/samples"
 	"learngrpc/pcbook/serializer"
 	"learngrpc/pcbook/service"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestClientCreateLaptop(t *testing.T) {
@@ -156,54 +166,421 @@ func TestClientUploadImage(t *testing.T) {
 	require.NoError(t, os.Remove(to))
 }
 
-func TestClientRateLaptop(t *testing.T) {
+func TestClientResumableImageUpload(t *testing.T) {
 	t.Parallel()
 
+	testImageFolder := "../tmp"
+	imageStore := service.NewDiskImageStore(testImageFolder)
 	laptopStore := service.NewInMemoryLaptopStore()
-	ratingStore := service.NewInMemoryRatingStore()
 
-	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
 	laptopClient := newTestLaptopClient(t, serverAddress)
 
-	stream, err := laptopClient.RateLaptop(context.Background())
+	imageData, err := os.ReadFile("../from/macbook-air-gold-2015-16.jpg")
+	require.NoError(t, err)
+	half := uint64(len(imageData) / 2)
+
+	startRes, err := laptopClient.StartImageUpload(context.Background(), &pb.StartImageUploadRequest{
+		Info: &pb.ImageInfo{
+			LaptopId: laptop.Id,
+			ImageType: ".jpg",
+		},
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, startRes.GetUploadId())
+	uploadID := startRes.GetUploadId()
+
+	chunkRes, err := laptopClient.UploadImageChunk(context.Background(), &pb.UploadImageChunkRequest{
+		UploadId: uploadID,
+		Offset: 0,
+		ChunkData: imageData[:half],
+	})
+	require.NoError(t, err)
+	require.Equal(t, half, chunkRes.GetCommittedSize())
+
+	// resending a committed chunk does not duplicate data
+	chunkRes, err = laptopClient.UploadImageChunk(context.Background(), &pb.UploadImageChunkRequest{
+		UploadId: uploadID,
+		Offset: 0,
+		ChunkData: imageData[:half],
+	})
+	require.NoError(t, err)
+	require.Equal(t, half, chunkRes.GetCommittedSize())
+
+	// a chunk past the committed size leaves a gap
+	_, err = laptopClient.UploadImageChunk(context.Background(), &pb.UploadImageChunkRequest{
+		UploadId: uploadID,
+		Offset: half + 1,
+		ChunkData: imageData[half+1:],
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	statusRes, err := laptopClient.GetImageUploadStatus(context.Background(), &pb.GetImageUploadStatusRequest{UploadId: uploadID})
+	require.NoError(t, err)
+	require.Equal(t, half, statusRes.GetCommittedSize())
+
+	_, err = laptopClient.UploadImageChunk(context.Background(), &pb.UploadImageChunkRequest{
+		UploadId: uploadID,
+		Offset: statusRes.GetCommittedSize(),
+		ChunkData: imageData[statusRes.GetCommittedSize():],
+	})
+	require.NoError(t, err)
+
+	res, err := laptopClient.FinishImageUpload(context.Background(), &pb.FinishImageUploadRequest{UploadId: uploadID})
+	require.NoError(t, err)
+	require.Equal(t, len(imageData), int(res.GetSize()))
+
+	savedImagePath := fmt.Sprintf("%s/%s%s", testImageFolder, res.GetId(), ".jpg")
+	savedData, err := os.ReadFile(savedImagePath)
 	require.NoError(t, err)
+	require.Equal(t, imageData, savedData)
+	require.NoError(t, os.Remove(savedImagePath))
+
+	// the session is gone after finishing
+	_, err = laptopClient.GetImageUploadStatus(context.Background(), &pb.GetImageUploadStatusRequest{UploadId: uploadID})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientUploadImageRetry(t *testing.T) {
+	t.Parallel()
+
+	testImageFolder := t.TempDir()
+	imageStore := service.NewDiskImageStore(testImageFolder)
+	laptopStore := service.NewInMemoryLaptopStore()
 
 	laptop := sample.NewLaptop()
-	err = laptopStore.Save(laptop)
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	// the response of the first chunk and of the first finish is lost after the call took effect
+	var mutex sync.Mutex
+	dropped := make(map[string]bool)
+	dropResponse := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		res, err := handler(ctx, req)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err == nil && !dropped[info.FullMethod] &&
+			(strings.HasSuffix(info.FullMethod, "/UploadImageChunk") || strings.HasSuffix(info.FullMethod, "/FinishImageUpload")) {
+			dropped[info.FullMethod] = true
+			return nil, status.Errorf(codes.Unavailable, "response lost")
+		}
+		return res, err
+	}
+
+	laptopServer := service.NewLaptopServer(laptopStore, imageStore, nil, service.NewInMemoryUploadSessionStore(time.Minute), nil, service.ImageQuota{}, nil)
+	serverAddress := serveTestLaptopServer(t, laptopServer, grpc.UnaryInterceptor(dropResponse))
+
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	imagePath := "../from/macbook-air-gold-2015-16.jpg"
+	imageID, err := client.NewLaptopClient(conn).UploadImage(laptop.Id, imagePath)
+	require.NoError(t, err)
+	require.Len(t, dropped, 2)
+
+	imageData, err := os.ReadFile(imagePath)
+	require.NoError(t, err)
+	savedData, err := os.ReadFile(filepath.Join(testImageFolder, imageID+".jpg"))
+	require.NoError(t, err)
+	require.Equal(t, imageData, savedData)
+
+	usage, err := imageStore.Usage()
+	require.NoError(t, err)
+	require.Equal(t, 1, usage.Images)
+}
+
+func TestClientDownloadImageVariants(t *testing.T) {
+	t.Parallel()
+
+	testImageFolder := "../tmp"
+	imageStore := service.NewDiskImageStore(testImageFolder)
+	laptopStore := service.NewInMemoryLaptopStore()
+	variantGenerator := service.NewImageVariantGenerator(imageStore, 2, 10)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	laptopServer := service.NewLaptopServer(laptopStore, imageStore, nil, service.NewInMemoryUploadSessionStore(time.Minute), variantGenerator, service.ImageQuota{}, nil)
+	serverAddress := serveTestLaptopServer(t, laptopServer)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	imageData, err := os.ReadFile("../from/macbook-air-gold-2015-16.jpg")
+	require.NoError(t, err)
+	imageID := uploadImageSession(t, laptopClient, laptop.Id, ".jpg", imageData)
+
+	// the variants of an image that cannot be decoded fail without failing the upload
+	brokenID := uploadImageSession(t, laptopClient, laptop.Id, ".png", []byte("not a png"))
+
+	// wait for the workers to finish
+	variantGenerator.Close()
+
+	// the variants of an image uploaded after the generator is closed fail
+	lateID := uploadImageSession(t, laptopClient, laptop.Id, ".jpg", imageData)
+	variantGenerator.Close()
+	lateInfo, err := imageStore.Find(lateID)
+	require.NoError(t, err)
+	require.Len(t, lateInfo.Variants, len(service.ImageVariantSizes))
+	for _, variant := range lateInfo.Variants {
+		require.Contains(t, variant.Err, "closed")
+	}
+	require.NoError(t, imageStore.Delete(lateID))
+
+	listRes, err := laptopClient.ListLaptopImages(context.Background(), &pb.ListLaptopImagesRequest{LaptopId: laptop.Id})
+	require.NoError(t, err)
+	require.Len(t, listRes.GetImages(), 2)
+
+	for _, image := range listRes.GetImages() {
+		require.Len(t, image.GetVariants(), 3)
+		for _, variant := range image.GetVariants() {
+			expected := pb.Image_VariantInfo_READY
+			if image.GetId() == brokenID && variant.GetVariant() != pb.Image_ORIGINAL {
+				expected = pb.Image_VariantInfo_FAILED
+				require.NotEmpty(t, variant.GetError())
+			}
+			require.Equal(t, expected, variant.GetState())
+		}
+	}
+
+	listRes, err = laptopClient.ListLaptopImages(context.Background(), &pb.ListLaptopImagesRequest{
+		LaptopId: laptop.Id,
+		Variant: pb.Image_THUMBNAIL_128,
+	})
+	require.NoError(t, err)
+	for _, image := range listRes.GetImages() {
+		require.Len(t, image.GetVariants(), 1)
+		require.Equal(t, pb.Image_THUMBNAIL_128, image.GetVariants()[0].GetVariant())
+	}
+
+	testCases := []struct {
+		variant pb.Image_Variant
+		maxSide int
+	}{
+		{pb.Image_THUMBNAIL_128, 128},
+		{pb.Image_PREVIEW_512, 512},
+	}
+	for _, tc := range testCases {
+		data := downloadImage(t, laptopClient, imageID, tc.variant)
+		config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		require.NoError(t, err)
+		require.LessOrEqual(t, config.Width, tc.maxSide)
+		require.LessOrEqual(t, config.Height, tc.maxSide)
+		require.True(t, config.Width == tc.maxSide || config.Height == tc.maxSide)
+	}
+	require.Equal(t, imageData, downloadImage(t, laptopClient, imageID, pb.Image_ORIGINAL))
+
+	stream, err := laptopClient.DownloadImage(context.Background(), &pb.DownloadImageRequest{
+		ImageId: brokenID,
+		Variant: pb.Image_THUMBNAIL_128,
+	})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	files, err := filepath.Glob(fmt.Sprintf("%s/%s*", testImageFolder, imageID))
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	brokenFiles, err := filepath.Glob(fmt.Sprintf("%s/%s*", testImageFolder, brokenID))
+	require.NoError(t, err)
+	for _, file := range append(files, brokenFiles...) {
+		require.NoError(t, os.Remove(file))
+	}
+}
+
+func TestClientRateLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore(service.DefaultScoreRange)
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptopServer := service.NewLaptopServer(laptopStore, nil, ratingStore, nil, nil, service.ImageQuota{}, nil)
+	interceptor := service.NewAuthInterceptor(jwtManager, service.NewInMemoryRevocationList(), nil, nil, service.NewDefaultPolicy())
+	serverAddress := serveTestLaptopServer(t, laptopServer, grpc.StreamInterceptor(interceptor.Stream()))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	// rating again replaces the previous score of the user
+	user1 := contextWithTestToken(t, jwtManager, "user1", "user")
+	responses, err := rateLaptopTest(t, laptopClient, user1, laptop.Id, []float64{7, 8.5})
+	require.NoError(t, err)
+	require.Len(t, responses, 2)
+	require.Equal(t, uint32(1), responses[0].GetRatedCount())
+	require.Equal(t, 7.0, responses[0].GetAverageScore())
+	require.Equal(t, uint32(1), responses[1].GetRatedCount())
+	require.Equal(t, 8.5, responses[1].GetAverageScore())
+
+	user2 := contextWithTestToken(t, jwtManager, "user2", "user")
+	responses, err = rateLaptopTest(t, laptopClient, user2, laptop.Id, []float64{10})
+	require.NoError(t, err)
+	require.Len(t, responses, 1)
+	require.Equal(t, laptop.GetId(), responses[0].GetLaptopId())
+	require.Equal(t, uint32(2), responses[0].GetRatedCount())
+	require.Equal(t, 9.25, responses[0].GetAverageScore())
+
+	for _, score := range []float64{0, -1, 10.5, math.NaN(), math.Inf(1)} {
+		_, err = rateLaptopTest(t, laptopClient, user2, laptop.Id, []float64{score})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), "score %v", score)
+	}
+
+	_, err = rateLaptopTest(t, laptopClient, context.Background(), laptop.Id, []float64{5})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestClientRateLaptopConcurrently(t *testing.T) {
+	t.Parallel()
+
+	fileRatingStore, err := service.NewFileRatingStore(filepath.Join(t.TempDir(), "ratings.jsonl"), service.DefaultScoreRange)
 	require.NoError(t, err)
+	// closed once the parallel subtests are done
+	t.Cleanup(func() { fileRatingStore.Close() })
+
+	testCases := []struct {
+		name        string
+		ratingStore service.RatingStore
+	}{
+		{
+			name:        "in_memory",
+			ratingStore: service.NewInMemoryRatingStore(service.DefaultScoreRange),
+		},
+		{
+			name:        "file",
+			ratingStore: fileRatingStore,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			laptopStore := service.NewInMemoryLaptopStore()
+			jwtManager := service.NewJWTManager("secret", time.Minute)
+
+			laptopServer := service.NewLaptopServer(laptopStore, nil, tc.ratingStore, nil, nil, service.ImageQuota{}, nil)
+			interceptor := service.NewAuthInterceptor(jwtManager, service.NewInMemoryRevocationList(), nil, nil, service.NewDefaultPolicy())
+			serverAddress := serveTestLaptopServer(t, laptopServer, grpc.StreamInterceptor(interceptor.Stream()))
+			laptopClient := newTestLaptopClient(t, serverAddress)
+
+			laptop := sample.NewLaptop()
+			require.NoError(t, laptopStore.Save(laptop))
+
+			const users = 20
+			const ratingsPerUser = 25
+
+			// every user streams its ratings at the same time, and ends with the score user%10+1
+			contexts := make([]context.Context, users)
+			for u := range contexts {
+				contexts[u] = contextWithTestToken(t, jwtManager, fmt.Sprintf("user%d", u), "user")
+			}
+
+			errs := make(chan error, users)
+			for u := 0; u < users; u++ {
+				go func(u int) {
+					errs <- rateLaptopConcurrently(laptopClient, contexts[u], laptop.Id, u, ratingsPerUser, users)
+				}(u)
+			}
+			for u := 0; u < users; u++ {
+				require.NoError(t, <-errs)
+			}
+
+			stats, err := tc.ratingStore.Stats(laptop.Id)
+			require.NoError(t, err)
+			require.Equal(t, uint32(users), stats.Count)
+
+			sum := 0.0
+			for u := 0; u < users; u++ {
+				sum += float64(u%10 + 1)
+			}
+			require.InDelta(t, sum/users, stats.Average, 1e-9)
+		})
+	}
+}
+
+// rateLaptopConcurrently sends the ratings of a user and checks that every response is consistent.
+func rateLaptopConcurrently(laptopClient pb.LaptopServiceClient, ctx context.Context, laptopID string, user int, ratings int, users int) error {
+	stream, err := laptopClient.RateLaptop(ctx)
+	if err != nil {
+		return err
+	}
+
+	for r := ratings - 1; r >= 0; r-- {
+		score := float64((user+r)%10 + 1)
+		err := stream.Send(&pb.RateLaptopRequest{LaptopId: laptopID, Score: score})
+		if err != nil {
+			return err
+		}
+
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if res.GetRatedCount() < 1 || res.GetRatedCount() > uint32(users) {
+			return fmt.Errorf("rated count %d is not between 1 and %d", res.GetRatedCount(), users)
+		}
+		if res.GetAverageScore() < 1 || res.GetAverageScore() > 10 {
+			return fmt.Errorf("average score %v is not between 1 and 10", res.GetAverageScore())
+		}
+	}
 
-	scores := []float64{7, 8.5, 10}
-	averages := []float64{7, 7.75, 8.5}
+	return stream.CloseSend()
+}
+
+func rateLaptopTest(t *testing.T, laptopClient pb.LaptopServiceClient, ctx context.Context, laptopID string, scores []float64) ([]*pb.RateLaptopResponse, error) {
+	stream, err := laptopClient.RateLaptop(ctx)
+	require.NoError(t, err)
 
-	n := len(scores)
-	for i:=0; i<n; i++ {
+	for _, score := range scores {
 		req := &pb.RateLaptopRequest{
-			LaptopId: laptop.Id,
-			Score: scores[i],
+			LaptopId: laptopID,
+			Score: score,
 		}
 		err = stream.Send(req)
-		require.NoError(t, err)
+		if err != nil {
+			break
+		}
 	}
 
 	err = stream.CloseSend()
 	require.NoError(t, err)
 
-	for idx:=0; ; idx++ {		
+	var responses []*pb.RateLaptopResponse
+	for {
 		res, err := stream.Recv()
 		if err == io.EOF {
-			require.Equal(t, n, idx)
-			return
+			return responses, nil
 		}
-		require.NoError(t, err)
-		require.Equal(t, laptop.GetId(), res.GetLaptopId())
-		require.Equal(t, uint32(idx+1) , res.GetRatedCount())
-		require.Equal(t, averages[idx], res.AverageScore)
+		if err != nil {
+			return responses, err
+		}
+		responses = append(responses, res)
 	}
+}
 
+func contextWithTestToken(t *testing.T, jwtManager *service.JWTManager, username string, role string) context.Context {
+	token, err := jwtManager.Generate(&service.User{Username: username, Role: role}, "")
+	require.NoError(t, err)
+
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
 }
+
 func startTestLaptopServer(t *testing.T, laptopStore service.LaptopStore, imageStore service.ImageStore, ratingStore service.RatingStore) string {
-	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
-	grpcServer := grpc.NewServer()
+	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore, service.NewInMemoryUploadSessionStore(time.Minute), nil, service.ImageQuota{}, nil)
+	return serveTestLaptopServer(t, laptopServer)
+}
+
+func serveTestLaptopServer(t *testing.T, laptopServer *service.LaptopServer, opts ...grpc.ServerOption) string {
+	grpcServer := grpc.NewServer(opts...)
 	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
 
 	listener, err := net.Listen("tcp", ":0") // random available port
@@ -290,6 +667,52 @@ func uploadImageTest(t *testing.T, laptopClient pb.LaptopServiceClient, laptopID
 	require.NoError(t, os.Remove(savedImaePath))
 }
 
+func uploadImageSession(t *testing.T, laptopClient pb.LaptopServiceClient, laptopID string, imageType string, imageData []byte) string {
+	startRes, err := laptopClient.StartImageUpload(context.Background(), &pb.StartImageUploadRequest{
+		Info: &pb.ImageInfo{
+			LaptopId: laptopID,
+			ImageType: imageType,
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = laptopClient.UploadImageChunk(context.Background(), &pb.UploadImageChunkRequest{
+		UploadId: startRes.GetUploadId(),
+		ChunkData: imageData,
+	})
+	require.NoError(t, err)
+
+	res, err := laptopClient.FinishImageUpload(context.Background(), &pb.FinishImageUploadRequest{UploadId: startRes.GetUploadId()})
+	require.NoError(t, err)
+	require.Equal(t, len(imageData), int(res.GetSize()))
+
+	return res.GetId()
+}
+
+func downloadImage(t *testing.T, laptopClient pb.LaptopServiceClient, imageID string, variant pb.Image_Variant) []byte {
+	stream, err := laptopClient.DownloadImage(context.Background(), &pb.DownloadImageRequest{
+		ImageId: imageID,
+		Variant: variant,
+	})
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, imageID, res.GetInfo().GetId())
+
+	var data bytes.Buffer
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data.Write(res.GetChunkData())
+	}
+
+	return data.Bytes()
+}
+
 func copyFile(from, to string) error {
 	  sfi, err := os.Stat(from)
 		if err != nil {
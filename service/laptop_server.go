@@ -3,31 +3,59 @@ package service
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"learngrpc/pcbook/pb"
 	"log"
+	"sort"
+	"time"
 
 	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const maxImageSize = 1 << 20 // 1 MB
+const downloadChunkSize = 32 * 1024
+const maxBatchSize = 100
+const defaultRankingLimit = 10
+const maxRankingLimit = 100
+const defaultTrendingWindow = 7 * 24 * time.Hour
+const maxTrendingWindow = 30 * 24 * time.Hour // the rating stores only keep the history of this window
+
+// errRankingFull stops the iteration over a ranking once enough laptops are found.
+var errRankingFull = errors.New("ranking is full")
 
 // LaptopServer is a service that provides laptop services.
 type LaptopServer struct {
 	laptopStore LaptopStore
 	imageStore ImageStore
 	ratingStore RatingStore
+	uploadStore UploadSessionStore
+	variantGenerator *ImageVariantGenerator
+	imageQuota ImageQuota
+	authorizer LaptopAuthorizer
+	quotaReservations *imageQuotaReservations
 	pb.UnimplementedLaptopServiceServer
 }
 
 // NewLaptopServer creates a new LaptopServer.
-func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore) *LaptopServer {
-	return &LaptopServer{laptopStore, imageStore, ratingStore, pb.UnimplementedLaptopServiceServer{}}
+// If variantGenerator is nil, no resized variants are generated for uploaded images.
+// If authorizer is nil, any caller allowed by the AuthInterceptor can change any laptop.
+func NewLaptopServer(
+	laptopStore LaptopStore,
+	imageStore ImageStore,
+	ratingStore RatingStore,
+	uploadStore UploadSessionStore,
+	variantGenerator *ImageVariantGenerator,
+	imageQuota ImageQuota,
+	authorizer LaptopAuthorizer,
+) *LaptopServer {
+	return &LaptopServer{laptopStore, imageStore, ratingStore, uploadStore, variantGenerator, imageQuota, authorizer, &imageQuotaReservations{}, pb.UnimplementedLaptopServiceServer{}}
 }
 
-// CreateLaptop creates a new laptop.
+// CreateLaptop creates a new laptop, owned by the caller and by their team unless another team is given.
 func (s *LaptopServer) CreateLaptop(
 	ctx context.Context,
 	req *pb.CreateLaptopRequest,
@@ -51,10 +79,25 @@ func (s *LaptopServer) CreateLaptop(
 
 		}
 
+		// the owner is always the verified caller
+		laptop.Owner = ""
+		claims, ok := UserClaimsFromContext(ctx)
+		if ok {
+			laptop.Owner = claims.Username
+			if laptop.GetTeam() == "" {
+				laptop.Team = claims.Team
+			}
+		}
+
+		err := s.authorizeLaptop(ctx, LaptopCreate, laptop)
+		if err != nil {
+			return nil, err
+		}
+
 		// some heavy processing
 		// time.Sleep(6 * time.Second)
 		
-		err := contexError(ctx)
+		err = contexError(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -125,6 +168,16 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 		return logError(status.Errorf(codes.NotFound, "laptop not found: %v", laptopID))
 	}
 
+	err = s.authorizeLaptop(stream.Context(), LaptopUploadImage, laptop)
+	if err != nil {
+		return err
+	}
+
+	err = s.checkImageQuota(laptopID, 0)
+	if err != nil {
+		return err
+	}
+
 	imageData := bytes.Buffer{}
 	imageSize := 0
 	bulkSize := 10 * 1024
@@ -166,11 +219,19 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 			}
 	}
 
+	release, err := s.reserveImageQuota(laptopID, int64(imageSize))
+	if err != nil {
+		return err
+	}
+
 	imageID, err := s.imageStore.Save(laptopID, imageType, imageData)
+	release()
 	if err != nil {
 		return logError(status.Errorf(codes.Internal, "cannot save image to store: %v", err))
 	}
 
+	s.generateVariants(imageID)
+
 	res := &pb.UploadImageResponse{
 		Id: imageID,
 		Size: uint32(imageSize),
@@ -184,8 +245,446 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 	return nil;
 }
 
+// StartImageUpload is a unary RPC to start a resumable image upload session.
+func (s *LaptopServer) StartImageUpload(
+	ctx context.Context,
+	req *pb.StartImageUploadRequest,
+) (*pb.StartImageUploadResponse, error) {
+	laptopID := req.GetInfo().GetLaptopId()
+	imageType := req.GetInfo().GetImageType()
+	log.Printf("received a start-image-upload request for laptop %s with imageType %s", laptopID, imageType)
+
+	laptop, err := s.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "laptop store internal error: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop not found: %v", laptopID))
+	}
+
+	err = s.authorizeLaptop(ctx, LaptopUploadImage, laptop)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkImageQuota(laptopID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.uploadStore.Create(laptopID, imageType)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot create upload session: %v", err))
+	}
+
+	res := &pb.StartImageUploadResponse{
+		UploadId:   session.ID,
+		ExpireTime: timestamppb.New(session.ExpiresAt),
+	}
+	return res, nil
+}
+
+// UploadImageChunk is a unary RPC to write a chunk of image data at an offset of an upload session.
+func (s *LaptopServer) UploadImageChunk(
+	ctx context.Context,
+	req *pb.UploadImageChunkRequest,
+) (*pb.UploadImageChunkResponse, error) {
+	err := contexError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadID := req.GetUploadId()
+	imageSize := req.GetOffset() + uint64(len(req.GetChunkData()))
+	if imageSize > maxImageSize {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "image size is too large: %d > %d", imageSize, maxImageSize))
+	}
+
+	if s.authorizer != nil {
+		session, err := s.uploadStore.Find(uploadID)
+		if err != nil {
+			return nil, uploadSessionError(uploadID, err)
+		}
+		err = s.authorizeUpload(ctx, session.LaptopID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	session, err := s.uploadStore.Append(uploadID, req.GetOffset(), req.GetChunkData())
+	if err != nil {
+		return nil, uploadSessionError(uploadID, err)
+	}
+
+	res := &pb.UploadImageChunkResponse{
+		UploadId:      session.ID,
+		CommittedSize: session.CommittedSize(),
+	}
+	return res, nil
+}
+
+// GetImageUploadStatus is a unary RPC to get the number of bytes committed to an upload session.
+func (s *LaptopServer) GetImageUploadStatus(
+	ctx context.Context,
+	req *pb.GetImageUploadStatusRequest,
+) (*pb.GetImageUploadStatusResponse, error) {
+	uploadID := req.GetUploadId()
+	session, err := s.uploadStore.Find(uploadID)
+	if err != nil {
+		return nil, uploadSessionError(uploadID, err)
+	}
+
+	err = s.authorizeUpload(ctx, session.LaptopID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.GetImageUploadStatusResponse{
+		UploadId:      session.ID,
+		CommittedSize: session.CommittedSize(),
+		ExpireTime:    timestamppb.New(session.ExpiresAt),
+	}
+	return res, nil
+}
+
+// FinishImageUpload is a unary RPC to save the image of an upload session to the image store.
+// It can be retried: once the image is saved, the same response is returned for the session.
+func (s *LaptopServer) FinishImageUpload(
+	ctx context.Context,
+	req *pb.FinishImageUploadRequest,
+) (*pb.UploadImageResponse, error) {
+	uploadID := req.GetUploadId()
+	session, result, err := s.uploadStore.Finish(uploadID)
+	if err != nil {
+		return nil, uploadSessionError(uploadID, err)
+	}
+
+	if result == nil {
+		result, err = s.saveUploadedImage(ctx, session)
+		if err != nil {
+			abortErr := s.uploadStore.Abort(uploadID)
+			if abortErr != nil {
+				log.Printf("cannot abort upload session %s: %v", uploadID, abortErr)
+			}
+			return nil, err
+		}
+	} else {
+		err = s.authorizeUpload(ctx, result.LaptopID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &pb.UploadImageResponse{
+		Id:   result.ImageID,
+		Size: uint32(result.Size),
+	}
+	return res, nil
+}
+
+// saveUploadedImage saves the image of a claimed upload session and completes the session.
+func (s *LaptopServer) saveUploadedImage(ctx context.Context, session *UploadSession) (*UploadResult, error) {
+	err := s.authorizeUpload(ctx, session.LaptopID)
+	if err != nil {
+		return nil, err
+	}
+
+	imageSize := session.Data.Len()
+	release, err := s.reserveImageQuota(session.LaptopID, int64(imageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	imageID, err := s.imageStore.Save(session.LaptopID, session.ImageType, session.Data)
+	release()
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot save image to store: %v", err))
+	}
+
+	result := &UploadResult{
+		LaptopID: session.LaptopID,
+		ImageID:  imageID,
+		Size:     imageSize,
+	}
+	err = s.uploadStore.Complete(session.ID, result)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot complete upload session: %v", err))
+	}
+
+	s.generateVariants(imageID)
+
+	log.Printf("saved image with id: %s size: %d from upload %s", imageID, imageSize, session.ID)
+	return result, nil
+}
+
+// authorizeLaptop checks that the caller can perform an action on a laptop.
+func (s *LaptopServer) authorizeLaptop(ctx context.Context, action LaptopAction, laptop *pb.Laptop) error {
+	if s.authorizer == nil {
+		return nil
+	}
+
+	claims, _ := UserClaimsFromContext(ctx)
+	err := s.authorizer.Authorize(claims, action, laptop)
+	if err != nil {
+		return logError(err)
+	}
+	return nil
+}
+
+// authorizeUpload checks that the caller can upload images to the laptop of an upload session.
+func (s *LaptopServer) authorizeUpload(ctx context.Context, laptopID string) error {
+	if s.authorizer == nil {
+		return nil
+	}
+
+	laptop, err := s.laptopStore.Find(laptopID)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "laptop store internal error: %v", err))
+	}
+	if laptop == nil {
+		return logError(status.Errorf(codes.NotFound, "laptop not found: %v", laptopID))
+	}
+
+	return s.authorizeLaptop(ctx, LaptopUploadImage, laptop)
+}
+
+func uploadSessionError(uploadID string, err error) error {
+	switch err {
+	case ErrUploadNotFound:
+		return logError(status.Errorf(codes.NotFound, "upload session not found or expired: %v", uploadID))
+	case ErrUploadOffsetMismatch:
+		return logError(status.Errorf(codes.FailedPrecondition, "%v: %v", err, uploadID))
+	case ErrUploadFinishing:
+		return logError(status.Errorf(codes.Aborted, "%v: %v", err, uploadID))
+	default:
+		return logError(status.Errorf(codes.Internal, "upload session store internal error: %v", err))
+	}
+}
+
+// checkImageQuota returns a ResourceExhausted error if saving an image of imageSize bytes
+// to the laptop would exceed the image quota, with the images being saved.
+func (s *LaptopServer) checkImageQuota(laptopID string, imageSize int64) error {
+	release, err := s.reserveImageQuota(laptopID, imageSize)
+	if err != nil {
+		return err
+	}
+	release()
+	return nil
+}
+
+// reserveImageQuota reserves the quota of an image of imageSize bytes for the laptop until release is called,
+// or returns a ResourceExhausted error if it would exceed the image quota.
+func (s *LaptopServer) reserveImageQuota(laptopID string, imageSize int64) (func(), error) {
+	if s.imageQuota.IsUnlimited() {
+		return func() {}, nil
+	}
+
+	release, err := s.quotaReservations.reserve(s.imageQuota, s.imageStore, laptopID, imageSize)
+	if errors.Is(err, ErrQuotaExceeded) {
+		return nil, logError(status.Errorf(codes.ResourceExhausted, "%v", err))
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "%v", err))
+	}
+	return release, nil
+}
+
+// GetImageUsage is a unary RPC to report the images stored and the image quota.
+// If a laptop ID is given, only the usage of that laptop is listed.
+func (s *LaptopServer) GetImageUsage(
+	ctx context.Context,
+	req *pb.GetImageUsageRequest,
+) (*pb.GetImageUsageResponse, error) {
+	usage, err := s.imageStore.Usage()
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot get image usage: %v", err))
+	}
+
+	res := &pb.GetImageUsageResponse{
+		ImageCount: uint32(usage.Images),
+		Bytes: uint64(usage.Bytes),
+		MaxImagesPerLaptop: uint32(s.imageQuota.MaxImagesPerLaptop),
+		MaxTotalBytes: uint64(s.imageQuota.MaxTotalBytes),
+	}
+	for laptopID, laptopUsage := range usage.Laptops {
+		if req.GetLaptopId() != "" && req.GetLaptopId() != laptopID {
+			continue
+		}
+		res.Laptops = append(res.Laptops, &pb.LaptopImageUsage{
+			LaptopId: laptopID,
+			ImageCount: uint32(laptopUsage.Images),
+			Bytes: uint64(laptopUsage.Bytes),
+		})
+	}
+	sort.Slice(res.Laptops, func(i, j int) bool { return res.Laptops[i].LaptopId < res.Laptops[j].LaptopId })
+
+	return res, nil
+}
+
+func (s *LaptopServer) generateVariants(imageID string) {
+	if s.variantGenerator != nil {
+		s.variantGenerator.Enqueue(imageID)
+	}
+}
+
+// ListLaptopImages is a unary RPC to list the images of a laptop with their variants.
+// If a variant is selected, only that variant is reported for each image.
+func (s *LaptopServer) ListLaptopImages(
+	ctx context.Context,
+	req *pb.ListLaptopImagesRequest,
+) (*pb.ListLaptopImagesResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("received a list-laptop-images request for laptop %s", laptopID)
+
+	variant, err := imageVariantName(req.GetVariant())
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := s.imageStore.List(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "image store internal error: %v", err))
+	}
+
+	res := &pb.ListLaptopImagesResponse{}
+	for _, info := range images {
+		res.Images = append(res.Images, toPbImage(info, variant))
+	}
+	return res, nil
+}
+
+// DownloadImage is a server streaming RPC to download an image or one of its variants.
+// The first response contains the image info, the next ones the image data.
+func (s *LaptopServer) DownloadImage(
+	req *pb.DownloadImageRequest,
+	stream pb.LaptopService_DownloadImageServer,
+) error {
+	imageID := req.GetImageId()
+	log.Printf("received a download-image request for image %s variant %v", imageID, req.GetVariant())
+
+	variant, err := imageVariantName(req.GetVariant())
+	if err != nil {
+		return err
+	}
+	if variant == "" {
+		variant = ImageVariantOriginal
+	}
+
+	info, err := s.imageStore.Find(imageID)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "image store internal error: %v", err))
+	}
+	if info == nil {
+		return logError(status.Errorf(codes.NotFound, "image not found: %v", imageID))
+	}
+
+	data, err := s.imageStore.Load(imageID, variant)
+	if err == ErrImageNotFound {
+		return logError(status.Errorf(codes.NotFound, "%s variant of image %s is not available", variant, imageID))
+	}
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot load image: %v", err))
+	}
+
+	err = stream.Send(&pb.DownloadImageResponse{
+		Data: &pb.DownloadImageResponse_Info{
+			Info: toPbImage(info, variant),
+		},
+	})
+	if err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot send image info: %v", err))
+	}
+
+	for len(data) > 0 {
+		err := contexError(stream.Context())
+		if err != nil {
+			return err
+		}
+
+		n := downloadChunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+
+		err = stream.Send(&pb.DownloadImageResponse{
+			Data: &pb.DownloadImageResponse_ChunkData{
+				ChunkData: data[:n],
+			},
+		})
+		if err != nil {
+			return logError(status.Errorf(codes.Unknown, "cannot send image data: %v", err))
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
+
+var imageVariantNames = map[pb.Image_Variant]string{
+	pb.Image_ORIGINAL: ImageVariantOriginal,
+	pb.Image_THUMBNAIL_128: ImageVariantThumbnail,
+	pb.Image_PREVIEW_512: ImageVariantPreview,
+}
+
+// imageVariantName returns the store name of a variant, or an empty string if no variant is selected.
+func imageVariantName(variant pb.Image_Variant) (string, error) {
+	if variant == pb.Image_UNSPECIFIED {
+		return "", nil
+	}
+
+	name, ok := imageVariantNames[variant]
+	if !ok {
+		return "", logError(status.Errorf(codes.InvalidArgument, "unknown image variant: %v", variant))
+	}
+	return name, nil
+}
+
+func toPbImage(info *ImageInfo, selected string) *pb.Image {
+	image := &pb.Image{
+		Id: info.ID,
+		LaptopId: info.LaptopID,
+		ImageType: info.Type,
+		Size: uint64(info.Size),
+	}
+
+	for _, variant := range []pb.Image_Variant{pb.Image_ORIGINAL, pb.Image_THUMBNAIL_128, pb.Image_PREVIEW_512} {
+		name := imageVariantNames[variant]
+		if selected != "" && selected != name {
+			continue
+		}
+
+		variantInfo := &pb.Image_VariantInfo{
+			Variant: variant,
+			State: pb.Image_VariantInfo_PENDING,
+		}
+		if name == ImageVariantOriginal {
+			variantInfo.State = pb.Image_VariantInfo_READY
+			variantInfo.Size = uint64(info.Size)
+		} else if v := info.Variants[name]; v != nil {
+			if v.Err != "" {
+				variantInfo.State = pb.Image_VariantInfo_FAILED
+				variantInfo.Error = v.Err
+			} else {
+				variantInfo.State = pb.Image_VariantInfo_READY
+				variantInfo.Width = uint32(v.Width)
+				variantInfo.Height = uint32(v.Height)
+				variantInfo.Size = uint64(v.Size)
+			}
+		}
+		image.Variants = append(image.Variants, variantInfo)
+	}
+
+	return image
+}
+
 // RateLaptop is a server streaming RPC to rate a laptop.
+// Each user has one rating per laptop, rating again replaces the previous score.
 func (s *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) error {
+	claims, ok := UserClaimsFromContext(stream.Context())
+	if !ok {
+		return logError(status.Errorf(codes.Unauthenticated, "user claims are not provided"))
+	}
+
 	for {
 		err := contexError(stream.Context())
 		if err != nil {
@@ -202,7 +701,7 @@ func (s *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) erro
 
 		laptopID := req.GetLaptopId()
 		score := req.GetScore()
-		log.Printf("received rate-laptop request with score: %f for laptop %s", score, laptopID)
+		log.Printf("received rate-laptop request with score: %f for laptop %s from user %s", score, laptopID, claims.Username)
 
 		found, err := s.laptopStore.Find(laptopID)
 		if err != nil {
@@ -212,7 +711,10 @@ func (s *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) erro
 			return logError(status.Errorf(codes.NotFound, "laptop not found: %v", laptopID))
 		}
 
-		rating, err := s.ratingStore.Add(laptopID, score)
+		rating, err := s.ratingStore.Add(laptopID, claims.Username, score)
+		if errors.Is(err, ErrInvalidScore) {
+			return logError(status.Errorf(codes.InvalidArgument, "%v", err))
+		}
 		if err != nil {
 			return logError(status.Errorf(codes.Internal, "rating store internal error: %v", err))
 		}
@@ -234,6 +736,173 @@ func (s *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) erro
 	return nil
 }
 
+// GetLaptopRating is a unary RPC to get the score distribution of a laptop.
+func (s *LaptopServer) GetLaptopRating(
+	ctx context.Context,
+	req *pb.GetLaptopRatingRequest,
+) (*pb.GetLaptopRatingResponse, error) {
+	rating, err := s.laptopRating(req.GetLaptopId())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetLaptopRatingResponse{Rating: rating}, nil
+}
+
+// BatchGetLaptopRatings is a unary RPC to get the score distributions of many laptops.
+// It fails if any of the laptops does not exist.
+func (s *LaptopServer) BatchGetLaptopRatings(
+	ctx context.Context,
+	req *pb.BatchGetLaptopRatingsRequest,
+) (*pb.BatchGetLaptopRatingsResponse, error) {
+	laptopIDs := req.GetLaptopIds()
+	if len(laptopIDs) > maxBatchSize {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "too many laptop ids: %d > %d", len(laptopIDs), maxBatchSize))
+	}
+
+	res := &pb.BatchGetLaptopRatingsResponse{}
+	for _, laptopID := range laptopIDs {
+		err := contexError(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		rating, err := s.laptopRating(laptopID)
+		if err != nil {
+			return nil, err
+		}
+		res.Ratings = append(res.Ratings, rating)
+	}
+
+	return res, nil
+}
+
+func (s *LaptopServer) laptopRating(laptopID string) (*pb.LaptopRating, error) {
+	found, err := s.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "laptop store internal error: %v", err))
+	}
+	if found == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop not found: %v", laptopID))
+	}
+
+	stats, err := s.ratingStore.Stats(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "rating store internal error: %v", err))
+	}
+
+	return toPbLaptopRating(laptopID, stats), nil
+}
+
+// ListTopRatedLaptops is a unary RPC to list the laptops with the best Bayesian score.
+func (s *LaptopServer) ListTopRatedLaptops(
+	ctx context.Context,
+	req *pb.ListTopRatedLaptopsRequest,
+) (*pb.ListTopRatedLaptopsResponse, error) {
+	laptops, err := s.rankLaptops(ctx, req.GetLimit(), req.GetFilter(), func(found func(rank *LaptopRank) error) error {
+		return s.ratingStore.TopRated(req.GetMinRatedCount(), found)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ListTopRatedLaptopsResponse{Laptops: laptops}, nil
+}
+
+// ListTrendingLaptops is a unary RPC to list the laptops rated the most within a recent time window.
+func (s *LaptopServer) ListTrendingLaptops(
+	ctx context.Context,
+	req *pb.ListTrendingLaptopsRequest,
+) (*pb.ListTrendingLaptopsResponse, error) {
+	window := defaultTrendingWindow
+	if req.GetWindow() != nil {
+		err := req.GetWindow().CheckValid()
+		if err != nil || req.GetWindow().AsDuration() <= 0 {
+			return nil, logError(status.Errorf(codes.InvalidArgument, "window must be a positive duration"))
+		}
+		if req.GetWindow().AsDuration() > maxTrendingWindow {
+			return nil, logError(status.Errorf(codes.InvalidArgument, "window must be at most %v", maxTrendingWindow))
+		}
+		window = req.GetWindow().AsDuration()
+	}
+	since := time.Now().Add(-window)
+
+	laptops, err := s.rankLaptops(ctx, req.GetLimit(), req.GetFilter(), func(found func(rank *LaptopRank) error) error {
+		return s.ratingStore.Trending(since, req.GetMinRatedCount(), found)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ListTrendingLaptopsResponse{Laptops: laptops}, nil
+}
+
+// rankLaptops returns the first limit laptops of a ranking that match the filter, if any.
+func (s *LaptopServer) rankLaptops(
+	ctx context.Context,
+	limit uint32,
+	filter *pb.LaptopFilter,
+	ranking func(found func(rank *LaptopRank) error) error,
+) ([]*pb.RankedLaptop, error) {
+	if limit == 0 {
+		limit = defaultRankingLimit
+	}
+	if limit > maxRankingLimit {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "limit must not exceed %d", maxRankingLimit))
+	}
+
+	var laptops []*pb.RankedLaptop
+	err := ranking(func(rank *LaptopRank) error {
+		err := contexError(ctx)
+		if err != nil {
+			return err
+		}
+
+		laptop, err := s.laptopStore.Find(rank.LaptopID)
+		if err != nil {
+			return logError(status.Errorf(codes.Internal, "laptop store internal error: %v", err))
+		}
+		if laptop == nil || (filter != nil && !isQualified(filter, laptop)) {
+			return nil
+		}
+
+		laptops = append(laptops, &pb.RankedLaptop{
+			Laptop: laptop,
+			Score: rank.Score,
+			RatedCount: rank.Count,
+		})
+		if uint32(len(laptops)) == limit {
+			return errRankingFull
+		}
+		return nil
+	})
+	if err != nil && err != errRankingFull {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, logError(status.Errorf(codes.Internal, "rating store internal error: %v", err))
+	}
+
+	return laptops, nil
+}
+
+func toPbLaptopRating(laptopID string, stats *RatingStats) *pb.LaptopRating {
+	rating := &pb.LaptopRating{
+		LaptopId: laptopID,
+		RatedCount: stats.Count,
+		AverageScore: stats.Average,
+		MedianScore: stats.Median,
+		BayesianScore: stats.BayesianScore,
+	}
+	for _, bucket := range stats.Histogram {
+		rating.Histogram = append(rating.Histogram, &pb.LaptopRating_Bucket{
+			Score: bucket.Score,
+			Count: bucket.Count,
+		})
+	}
+	return rating
+}
+
 func logError(err error) error {
 	if err != nil {
 		log.Print(err)
@@ -2,14 +2,18 @@ package service_test
 
 import (
 	"context"
+	"fmt"
 	"learngrpc/pcbook/pb"
 	sample "learngrpc/pcbook/samples"
 	"learngrpc/pcbook/service"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 func TestCreateLaptop(t *testing.T) {
@@ -65,7 +69,7 @@ func TestCreateLaptop(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			server := service.NewLaptopServer(tc.store, nil, nil)
+			server := service.NewLaptopServer(tc.store, nil, nil, nil, nil, service.ImageQuota{}, nil)
 			req := &pb.CreateLaptopRequest{
 				Laptop: tc.laptop,
 			}
@@ -89,3 +93,423 @@ func TestCreateLaptop(t *testing.T) {
 	}
 }
 
+
+func TestUploadSessionExpires(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	uploadStore := service.NewInMemoryUploadSessionStore(50 * time.Millisecond)
+	server := service.NewLaptopServer(laptopStore, nil, nil, uploadStore, nil, service.ImageQuota{}, nil)
+
+	startRes, err := server.StartImageUpload(context.Background(), &pb.StartImageUploadRequest{
+		Info: &pb.ImageInfo{LaptopId: laptop.Id, ImageType: ".jpg"},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = server.UploadImageChunk(context.Background(), &pb.UploadImageChunkRequest{
+		UploadId: startRes.GetUploadId(),
+		ChunkData: []byte("data"),
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestFinishImageUploadRetry(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	imageStore := service.NewDiskImageStore(t.TempDir())
+	server := service.NewLaptopServer(laptopStore, imageStore, nil, service.NewInMemoryUploadSessionStore(time.Minute), nil, service.ImageQuota{}, nil)
+
+	startRes, err := server.StartImageUpload(context.Background(), &pb.StartImageUploadRequest{
+		Info: &pb.ImageInfo{LaptopId: laptop.Id, ImageType: ".jpg"},
+	})
+	require.NoError(t, err)
+	_, err = server.UploadImageChunk(context.Background(), &pb.UploadImageChunkRequest{
+		UploadId:  startRes.GetUploadId(),
+		ChunkData: []byte("data"),
+	})
+	require.NoError(t, err)
+
+	// concurrent calls save the image once, and the others are told to retry
+	var wg sync.WaitGroup
+	responses := make([]*pb.UploadImageResponse, 10)
+	errs := make([]error, len(responses))
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i], errs[i] = server.FinishImageUpload(context.Background(), &pb.FinishImageUploadRequest{UploadId: startRes.GetUploadId()})
+		}(i)
+	}
+	wg.Wait()
+
+	retry, err := server.FinishImageUpload(context.Background(), &pb.FinishImageUploadRequest{UploadId: startRes.GetUploadId()})
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), retry.GetSize())
+
+	for i, res := range responses {
+		if errs[i] != nil {
+			require.Equal(t, codes.Aborted, status.Code(errs[i]))
+			continue
+		}
+		require.Equal(t, retry.GetId(), res.GetId())
+	}
+
+	usage, err := imageStore.Usage()
+	require.NoError(t, err)
+	require.Equal(t, 1, usage.Images)
+
+	// the finished session takes no more chunks
+	_, err = server.UploadImageChunk(context.Background(), &pb.UploadImageChunkRequest{
+		UploadId:  startRes.GetUploadId(),
+		Offset:    4,
+		ChunkData: []byte("more"),
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestLaptopOwnership(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	uploadStore := service.NewInMemoryUploadSessionStore(time.Minute)
+	server := service.NewLaptopServer(laptopStore, nil, nil, uploadStore, nil, service.ImageQuota{}, service.NewOwnershipAuthorizer())
+
+	admin := contextWithTestClaims("admin1", "admin")
+	seller1 := contextWithTeamClaims("seller1", "seller", "acme")
+	seller2 := contextWithTeamClaims("seller2", "seller", "acme")
+	seller3 := contextWithTeamClaims("seller3", "seller", "globex")
+
+	// the owner is the caller, whatever the request says
+	laptop := sample.NewLaptop()
+	laptop.Owner = "seller3"
+	res, err := server.CreateLaptop(seller1, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+
+	saved, err := laptopStore.Find(res.GetId())
+	require.NoError(t, err)
+	require.Equal(t, "seller1", saved.GetOwner())
+	require.Equal(t, "acme", saved.GetTeam())
+
+	other := sample.NewLaptop()
+	other.Team = "globex"
+	_, err = server.CreateLaptop(seller1, &pb.CreateLaptopRequest{Laptop: other})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "their own team \"acme\"")
+
+	_, err = server.CreateLaptop(admin, &pb.CreateLaptopRequest{Laptop: other})
+	require.NoError(t, err)
+
+	_, err = server.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	testCases := []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{name: "owner", ctx: seller1, code: codes.OK},
+		{name: "same_team", ctx: seller2, code: codes.OK},
+		{name: "other_team", ctx: seller3, code: codes.PermissionDenied},
+		{name: "admin", ctx: admin, code: codes.OK},
+	}
+
+	for _, tc := range testCases {
+		_, err := server.StartImageUpload(tc.ctx, &pb.StartImageUploadRequest{
+			Info: &pb.ImageInfo{LaptopId: saved.GetId(), ImageType: ".jpg"},
+		})
+		require.Equal(t, tc.code, status.Code(err), tc.name)
+	}
+
+	// the session of an owner cannot be used by another team
+	startRes, err := server.StartImageUpload(seller1, &pb.StartImageUploadRequest{
+		Info: &pb.ImageInfo{LaptopId: saved.GetId(), ImageType: ".jpg"},
+	})
+	require.NoError(t, err)
+
+	_, err = server.UploadImageChunk(seller3, &pb.UploadImageChunkRequest{UploadId: startRes.GetUploadId(), ChunkData: []byte("data")})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "owned by user \"seller1\" of team \"acme\"")
+
+	_, err = server.UploadImageChunk(seller2, &pb.UploadImageChunkRequest{UploadId: startRes.GetUploadId(), ChunkData: []byte("data")})
+	require.NoError(t, err)
+}
+
+func contextWithTeamClaims(username string, role string, team string) context.Context {
+	return service.ContextWithUserClaims(context.Background(), &service.UserClaims{
+		Username: username,
+		Role:     role,
+		Team:     team,
+	})
+}
+
+func TestUploadImageQuota(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	imageStore := service.NewDiskImageStore(t.TempDir())
+	quota := service.ImageQuota{
+		MaxImagesPerLaptop: 2,
+		MaxTotalBytes: 10,
+	}
+	server := service.NewLaptopServer(laptopStore, imageStore, nil, service.NewInMemoryUploadSessionStore(time.Minute), nil, quota, nil)
+
+	upload := func(data string) error {
+		startRes, err := server.StartImageUpload(context.Background(), &pb.StartImageUploadRequest{
+			Info: &pb.ImageInfo{LaptopId: laptop.Id, ImageType: ".jpg"},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = server.UploadImageChunk(context.Background(), &pb.UploadImageChunkRequest{
+			UploadId: startRes.GetUploadId(),
+			ChunkData: []byte(data),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = server.FinishImageUpload(context.Background(), &pb.FinishImageUploadRequest{UploadId: startRes.GetUploadId()})
+		return err
+	}
+
+	require.NoError(t, upload("12345"))
+
+	// exceeds the total bytes
+	err = upload("1234567")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	require.NoError(t, upload("12345"))
+
+	// exceeds the images per laptop
+	err = upload("")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	res, err := server.GetImageUsage(context.Background(), &pb.GetImageUsageRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), res.GetImageCount())
+	require.Equal(t, uint64(10), res.GetBytes())
+	require.Equal(t, uint32(2), res.GetMaxImagesPerLaptop())
+	require.Equal(t, uint64(10), res.GetMaxTotalBytes())
+	require.Len(t, res.GetLaptops(), 1)
+	require.Equal(t, laptop.Id, res.GetLaptops()[0].GetLaptopId())
+	require.Equal(t, uint32(2), res.GetLaptops()[0].GetImageCount())
+}
+
+func TestUploadImageQuotaConcurrently(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	imageStore := service.NewDiskImageStore(t.TempDir())
+	quota := service.ImageQuota{MaxImagesPerLaptop: 3}
+	server := service.NewLaptopServer(laptopStore, imageStore, nil, service.NewInMemoryUploadSessionStore(time.Minute), nil, quota, nil)
+
+	uploadIDs := make([]string, 10)
+	for i := range uploadIDs {
+		startRes, err := server.StartImageUpload(context.Background(), &pb.StartImageUploadRequest{
+			Info: &pb.ImageInfo{LaptopId: laptop.Id, ImageType: ".jpg"},
+		})
+		require.NoError(t, err)
+		_, err = server.UploadImageChunk(context.Background(), &pb.UploadImageChunkRequest{
+			UploadId:  startRes.GetUploadId(),
+			ChunkData: []byte("data"),
+		})
+		require.NoError(t, err)
+		uploadIDs[i] = startRes.GetUploadId()
+	}
+
+	// the sessions are finished together, and only the quota of them can be saved
+	var wg sync.WaitGroup
+	results := make([]codes.Code, len(uploadIDs))
+	for i, uploadID := range uploadIDs {
+		wg.Add(1)
+		go func(i int, uploadID string) {
+			defer wg.Done()
+			_, err := server.FinishImageUpload(context.Background(), &pb.FinishImageUploadRequest{UploadId: uploadID})
+			results[i] = status.Code(err)
+		}(i, uploadID)
+	}
+	wg.Wait()
+
+	saved := 0
+	for _, code := range results {
+		if code == codes.OK {
+			saved++
+			continue
+		}
+		require.Equal(t, codes.ResourceExhausted, code)
+	}
+	require.Equal(t, quota.MaxImagesPerLaptop, saved)
+
+	usage, err := imageStore.Usage()
+	require.NoError(t, err)
+	require.Equal(t, quota.MaxImagesPerLaptop, usage.Images)
+}
+
+func TestGetLaptopRating(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	rated := sample.NewLaptop()
+	unrated := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(rated))
+	require.NoError(t, laptopStore.Save(unrated))
+
+	ratingStore := service.NewInMemoryRatingStore(service.DefaultScoreRange)
+	for i, score := range []float64{2, 9, 10, 10.0} {
+		_, err := ratingStore.Add(rated.Id, fmt.Sprintf("user%d", i), score)
+		require.NoError(t, err)
+	}
+	// replaces the score of user0
+	_, err := ratingStore.Add(rated.Id, "user0", 5)
+	require.NoError(t, err)
+
+	server := service.NewLaptopServer(laptopStore, nil, ratingStore, nil, nil, service.ImageQuota{}, nil)
+
+	res, err := server.GetLaptopRating(context.Background(), &pb.GetLaptopRatingRequest{LaptopId: rated.Id})
+	require.NoError(t, err)
+
+	rating := res.GetRating()
+	require.Equal(t, rated.Id, rating.GetLaptopId())
+	require.Equal(t, uint32(4), rating.GetRatedCount())
+	require.Equal(t, 8.5, rating.GetAverageScore())
+	require.Equal(t, 9.5, rating.GetMedianScore())
+	// 5 virtual ratings at the mean of all laptops, which is the average of this laptop
+	require.InDelta(t, 8.5, rating.GetBayesianScore(), 1e-9)
+
+	histogram := rating.GetHistogram()
+	require.Len(t, histogram, 10)
+	for _, bucket := range histogram {
+		expected := map[float64]uint32{5: 1, 9: 1, 10: 2}[bucket.GetScore()]
+		require.Equal(t, expected, bucket.GetCount(), "score %v", bucket.GetScore())
+	}
+
+	res, err = server.GetLaptopRating(context.Background(), &pb.GetLaptopRatingRequest{LaptopId: unrated.Id})
+	require.NoError(t, err)
+	require.Zero(t, res.GetRating().GetRatedCount())
+	require.InDelta(t, 8.5, res.GetRating().GetBayesianScore(), 1e-9)
+
+	_, err = server.GetLaptopRating(context.Background(), &pb.GetLaptopRatingRequest{LaptopId: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	batchRes, err := server.BatchGetLaptopRatings(context.Background(), &pb.BatchGetLaptopRatingsRequest{
+		LaptopIds: []string{unrated.Id, rated.Id},
+	})
+	require.NoError(t, err)
+	require.Len(t, batchRes.GetRatings(), 2)
+	require.Equal(t, unrated.Id, batchRes.GetRatings()[0].GetLaptopId())
+	require.Equal(t, rated.Id, batchRes.GetRatings()[1].GetLaptopId())
+
+	_, err = server.BatchGetLaptopRatings(context.Background(), &pb.BatchGetLaptopRatingsRequest{
+		LaptopIds: []string{rated.Id, "unknown"},
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = server.BatchGetLaptopRatings(context.Background(), &pb.BatchGetLaptopRatingsRequest{
+		LaptopIds: make([]string, 101),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestListTopRatedAndTrendingLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptops := make([]*pb.Laptop, 3)
+	for i := range laptops {
+		laptops[i] = sample.NewLaptop()
+		laptops[i].PriceUsd = float64(1000 * (i + 1))
+		require.NoError(t, laptopStore.Save(laptops[i]))
+	}
+
+	ratingStore := service.NewInMemoryRatingStore(service.DefaultScoreRange)
+	rate := func(laptop *pb.Laptop, scores ...float64) {
+		for i, score := range scores {
+			_, err := ratingStore.Add(laptop.Id, fmt.Sprintf("user%d", i), score)
+			require.NoError(t, err)
+		}
+	}
+	// a single perfect score ranks below many good ones
+	rate(laptops[0], 10)
+	rate(laptops[1], 9, 9, 9, 9, 9, 9, 9, 9)
+	rate(laptops[2], 3, 4, 3)
+
+	server := service.NewLaptopServer(laptopStore, nil, ratingStore, nil, nil, service.ImageQuota{}, nil)
+
+	topRatedIDs := func(req *pb.ListTopRatedLaptopsRequest) []string {
+		res, err := server.ListTopRatedLaptops(context.Background(), req)
+		require.NoError(t, err)
+		var ids []string
+		for _, laptop := range res.GetLaptops() {
+			ids = append(ids, laptop.GetLaptop().GetId())
+		}
+		return ids
+	}
+
+	require.Equal(t, []string{laptops[1].Id, laptops[0].Id, laptops[2].Id}, topRatedIDs(&pb.ListTopRatedLaptopsRequest{}))
+	require.Equal(t, []string{laptops[1].Id}, topRatedIDs(&pb.ListTopRatedLaptopsRequest{Limit: 1}))
+	require.Equal(t, []string{laptops[1].Id, laptops[2].Id}, topRatedIDs(&pb.ListTopRatedLaptopsRequest{MinRatedCount: 2}))
+
+	filter := &pb.LaptopFilter{MaxPriceUsd: 1500, MinRam: &pb.Memory{}}
+	require.Equal(t, []string{laptops[0].Id}, topRatedIDs(&pb.ListTopRatedLaptopsRequest{Filter: filter}))
+
+	// the ranking follows new ratings
+	rate(laptops[2], 10, 10, 10, 10, 10, 10, 10, 10, 10, 10)
+	require.Equal(t, laptops[2].Id, topRatedIDs(&pb.ListTopRatedLaptopsRequest{})[0])
+
+	_, err := server.ListTopRatedLaptops(context.Background(), &pb.ListTopRatedLaptopsRequest{Limit: 101})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = ratingStore.Add(laptops[0].Id, "user1", 8)
+	require.NoError(t, err)
+	_, err = ratingStore.Add(laptops[0].Id, "user2", 6)
+	require.NoError(t, err)
+	// replaces an older rating, which no longer counts as trending
+	_, err = ratingStore.Add(laptops[1].Id, "user0", 1)
+	require.NoError(t, err)
+
+	res, err := server.ListTrendingLaptops(context.Background(), &pb.ListTrendingLaptopsRequest{
+		Window: durationpb.New(50 * time.Millisecond),
+	})
+	require.NoError(t, err)
+	require.Len(t, res.GetLaptops(), 2)
+	require.Equal(t, laptops[0].Id, res.GetLaptops()[0].GetLaptop().GetId())
+	require.Equal(t, uint32(2), res.GetLaptops()[0].GetRatedCount())
+	require.Equal(t, 7.0, res.GetLaptops()[0].GetScore())
+	require.Equal(t, laptops[1].Id, res.GetLaptops()[1].GetLaptop().GetId())
+	require.Equal(t, uint32(1), res.GetLaptops()[1].GetRatedCount())
+
+	res, err = server.ListTrendingLaptops(context.Background(), &pb.ListTrendingLaptopsRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.GetLaptops(), 3)
+	require.Equal(t, laptops[2].Id, res.GetLaptops()[0].GetLaptop().GetId())
+	require.Equal(t, uint32(10), res.GetLaptops()[0].GetRatedCount())
+
+	_, err = server.ListTrendingLaptops(context.Background(), &pb.ListTrendingLaptopsRequest{
+		Window: durationpb.New(-time.Second),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = server.ListTrendingLaptops(context.Background(), &pb.ListTrendingLaptopsRequest{
+		Window: durationpb.New(31 * 24 * time.Hour),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
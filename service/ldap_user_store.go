@@ -0,0 +1,509 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultLDAPUserFilter        = "(uid=%s)"
+	defaultLDAPUsernameAttribute = "uid"
+	defaultLDAPGroupAttribute    = "memberOf"
+	defaultLDAPPoolSize          = 4
+	defaultLDAPCacheTTL          = 5 * time.Minute
+	defaultLDAPTimeout           = 10 * time.Second
+)
+
+// LDAPConfig configures the users of an LDAP directory, who log in with their directory password.
+type LDAPConfig struct {
+	URL          string `yaml:"url"`           // ldap://host:389 or ldaps://host:636
+	BindDN       string `yaml:"bind_dn"`       // the service account that searches the users, anonymous if empty
+	BindPassword string `yaml:"bind_password"` // the password of the service account
+	BaseDN       string `yaml:"base_dn"`       // the subtree of the users
+	// UserFilter finds the entry of a username, which replaces %s escaped. It is (uid=%s) if empty.
+	UserFilter string `yaml:"user_filter"`
+	// UsernameAttribute is the attribute of the user entries with their exact username, uid if empty.
+	// Since the filter usually ignores case, only a username equal to its value matches the entry.
+	UsernameAttribute string `yaml:"username_attribute"`
+	// GroupAttribute is the attribute of the user entries with the DNs of their groups, memberOf if empty.
+	GroupAttribute string `yaml:"group_attribute"`
+	// GroupRoles maps groups, by DN or by name, to roles, where the first group of the user that matches applies.
+	GroupRoles []GroupRole `yaml:"group_roles"`
+	// DefaultRole is the role of the users in none of the groups, who are rejected if it is empty.
+	DefaultRole string        `yaml:"default_role"`
+	PoolSize    int           `yaml:"pool_size"` // the idle connections kept open, 4 if 0
+	CacheTTL    time.Duration `yaml:"cache_ttl"` // how long a lookup is cached, 5m if 0
+	Timeout     time.Duration `yaml:"timeout"`   // the timeout of a connection or request, 10s if 0
+}
+
+// LoadLDAPConfig loads an LDAP configuration from a YAML or JSON file.
+func LoadLDAPConfig(filename string) (*LDAPConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read ldap config file: %w", err)
+	}
+
+	config, err := ParseLDAPConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load ldap config file %s: %w", filename, err)
+	}
+	return config, nil
+}
+
+// ParseLDAPConfig parses and validates an LDAP configuration.
+func ParseLDAPConfig(data []byte) (*LDAPConfig, error) {
+	config := &LDAPConfig{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode ldap config: %w", err)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks that the configuration has an LDAP URL, a base DN, a valid user filter and known roles.
+func (config *LDAPConfig) Validate() error {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return fmt.Errorf("ldap config must have an ldap:// or ldaps:// url")
+	}
+	if config.BaseDN == "" {
+		return fmt.Errorf("ldap config must have a base_dn")
+	}
+	if config.UserFilter != "" && strings.Count(config.UserFilter, "%s") != 1 {
+		return fmt.Errorf("user filter must have one %%s for the username")
+	}
+	for i, groupRole := range config.GroupRoles {
+		if groupRole.Group == "" {
+			return fmt.Errorf("group role %d must have a group", i+1)
+		}
+		if !knownRoles[groupRole.Role] {
+			return fmt.Errorf("group role %d has unknown role %q", i+1, groupRole.Role)
+		}
+	}
+	if config.DefaultRole != "" && !knownRoles[config.DefaultRole] {
+		return fmt.Errorf("unknown default role %q", config.DefaultRole)
+	}
+	if config.PoolSize < 0 || config.CacheTTL < 0 || config.Timeout < 0 {
+		return fmt.Errorf("pool_size, cache_ttl and timeout must not be negative")
+	}
+	return nil
+}
+
+// LDAPUserStore is a user store whose users log in with the password of their LDAP directory entry,
+// and get the role of their directory groups. The directory users are recorded in a local store
+// at their first lookup, with no password and the directory URL as issuer, so that their
+// two-factor authentication and disabled state can be kept. The local store can also have local
+// users with a password, e.g. an administrator who can log in when the directory is down.
+type LDAPUserStore struct {
+	config LDAPConfig
+	local  UserStore
+	idle   chan *ldap.Conn // the pooled connections, bound as the service account
+
+	mutex sync.Mutex
+	cache map[string]ldapCacheEntry
+}
+
+// ldapEntry is the directory entry of a user.
+type ldapEntry struct {
+	DN       string
+	Username string   // the value of the username attribute
+	Groups   []string // the DNs of the groups of the user
+}
+
+type ldapCacheEntry struct {
+	entry     *ldapEntry // nil if the user is not in the directory
+	expiresAt time.Time
+}
+
+// NewLDAPUserStore creates a new LDAPUserStore with a local store. The connections are opened when needed.
+func NewLDAPUserStore(config LDAPConfig, local UserStore) *LDAPUserStore {
+	if config.UserFilter == "" {
+		config.UserFilter = defaultLDAPUserFilter
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = defaultLDAPUsernameAttribute
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = defaultLDAPGroupAttribute
+	}
+	if config.PoolSize == 0 {
+		config.PoolSize = defaultLDAPPoolSize
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = defaultLDAPCacheTTL
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultLDAPTimeout
+	}
+
+	return &LDAPUserStore{
+		config: config,
+		local:  local,
+		idle:   make(chan *ldap.Conn, config.PoolSize),
+		cache:  make(map[string]ldapCacheEntry),
+	}
+}
+
+// Save saves a local user to the store. It returns ErrAlreadyExists if the username is in the directory,
+// even with another case.
+func (store *LDAPUserStore) Save(user *User) error {
+	if user.Issuer != store.config.URL {
+		entry, err := store.lookup(user.Username, true)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			return ErrAlreadyExists
+		}
+	}
+	return store.local.Save(user)
+}
+
+// Find finds a user by username. A directory user gets the role of its groups, and is disabled
+// if it left the directory or the mapped groups.
+func (store *LDAPUserStore) Find(username string) (*User, error) {
+	user, err := store.local.Find(username)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil && user.Issuer != store.config.URL {
+		return user, nil
+	}
+
+	entry, err := store.userEntry(username, false)
+	if err != nil {
+		return nil, err
+	}
+	return store.sync(username, user, entry)
+}
+
+// Modify changes an existing user of the local store in one step. The role of a directory user
+// is replaced by the role of its groups at its next lookup.
+func (store *LDAPUserStore) Modify(username string, change func(user *User) error) (*User, error) {
+	return store.local.Modify(username, change)
+}
+
+// List returns the users of the local store, where the directory users appear after their first lookup.
+func (store *LDAPUserStore) List(offset int, limit int) ([]*User, int, error) {
+	return store.local.List(offset, limit)
+}
+
+// Authenticate checks the password of a local user, or binds to the directory as the user.
+// The entry of the user is looked up again, so that the role is up to date at each login.
+func (store *LDAPUserStore) Authenticate(username string, password string) (*User, error) {
+	user, err := store.local.Find(username)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil && user.Issuer != store.config.URL {
+		if !user.IsCorrectPassword(password) {
+			return nil, nil
+		}
+		return user, nil
+	}
+
+	// an empty password is an unauthenticated bind, which succeeds without checking anything
+	if password == "" {
+		return nil, nil
+	}
+
+	entry, err := store.userEntry(username, true)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	ok, err := store.bind(entry.DN, password)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	user, err = store.sync(username, user, entry)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		// the password is correct but the groups of the user give no role
+		user = &User{Username: username, Issuer: store.config.URL, Disabled: true}
+	}
+	return user, nil
+}
+
+// Close closes the idle connections.
+func (store *LDAPUserStore) Close() {
+	for {
+		select {
+		case conn := <-store.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// sync records or updates the directory user of an entry in the local store.
+func (store *LDAPUserStore) sync(username string, user *User, entry *ldapEntry) (*User, error) {
+	role, team := "", ""
+	if entry != nil {
+		role, team = store.role(entry.Groups)
+	}
+
+	if role == "" {
+		if user != nil {
+			// the user left the directory or its groups, and can no longer log in or refresh its tokens
+			user.Disabled = true
+		}
+		return user, nil
+	}
+
+	if user == nil {
+		user = &User{
+			Username: username,
+			Role:     role,
+			Team:     team,
+			Issuer:   store.config.URL,
+		}
+		err := store.local.Save(user)
+		if errors.Is(err, ErrAlreadyExists) {
+			// recorded concurrently by another lookup
+			return store.local.Find(username)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+
+	// the groups in the directory are the source of truth
+	if user.Role != role || user.Team != team {
+		return store.local.Modify(username, func(user *User) error {
+			user.Role = role
+			user.Team = team
+			return nil
+		})
+	}
+	return user, nil
+}
+
+// role returns the role and team of the first group that matches, or the default role.
+func (store *LDAPUserStore) role(groupDNs []string) (string, string) {
+	for _, groupRole := range store.config.GroupRoles {
+		for _, dn := range groupDNs {
+			if strings.EqualFold(groupRole.Group, dn) || strings.EqualFold(groupRole.Group, ldapGroupName(dn)) {
+				return groupRole.Role, groupRole.Team
+			}
+		}
+	}
+	return store.config.DefaultRole, ""
+}
+
+// ldapGroupName returns the value of the first RDN of a group DN, e.g. admins for cn=admins,ou=groups,dc=example,dc=com.
+func ldapGroupName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return ""
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+// userEntry returns the directory entry of a username, or nil if there is none or it has another username,
+// e.g. Alice for alice. Since the local records of the directory users are keyed by their exact username,
+// another case would get a record of its own, without the disabled state or the second factor of the user.
+func (store *LDAPUserStore) userEntry(username string, fresh bool) (*ldapEntry, error) {
+	entry, err := store.lookup(username, fresh)
+	if err != nil || entry == nil || entry.Username != username {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// lookup returns the directory entry of a username, or nil if there is none.
+// Unless fresh is true, it returns the cached entry if it has not expired.
+func (store *LDAPUserStore) lookup(username string, fresh bool) (*ldapEntry, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if !fresh {
+		store.mutex.Lock()
+		cached, ok := store.cache[username]
+		store.mutex.Unlock()
+		if ok && now.Before(cached.expiresAt) {
+			return cached.entry, nil
+		}
+	}
+
+	entry, err := store.search(username)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for key, cached := range store.cache {
+		if !now.Before(cached.expiresAt) {
+			delete(store.cache, key)
+		}
+	}
+	store.cache[username] = ldapCacheEntry{entry: entry, expiresAt: now.Add(store.config.CacheTTL)}
+	return entry, nil
+}
+
+func (store *LDAPUserStore) search(username string) (*ldapEntry, error) {
+	req := ldap.NewSearchRequest(
+		store.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2, // more than one entry is an error
+		int(store.config.Timeout.Seconds()),
+		false,
+		fmt.Sprintf(store.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{store.config.UsernameAttribute, store.config.GroupAttribute},
+		nil,
+	)
+
+	var result *ldap.SearchResult
+	err := store.do(func(conn *ldap.Conn) error {
+		var err error
+		result, err = conn.Search(req)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot search ldap user %s: %w", username, err)
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, nil
+	case 1:
+		entry := result.Entries[0]
+		usernames := entry.GetEqualFoldAttributeValues(store.config.UsernameAttribute)
+		if len(usernames) != 1 {
+			return nil, fmt.Errorf("ldap user %s has %d values of %s instead of one", username, len(usernames), store.config.UsernameAttribute)
+		}
+		return &ldapEntry{
+			DN:       entry.DN,
+			Username: usernames[0],
+			Groups:   entry.GetEqualFoldAttributeValues(store.config.GroupAttribute),
+		}, nil
+	default:
+		return nil, fmt.Errorf("ldap user filter matches %d entries for %s", len(result.Entries), username)
+	}
+}
+
+// bind checks the password of an entry by binding as it, and tells if it is correct.
+func (store *LDAPUserStore) bind(dn string, password string) (bool, error) {
+	ok := false
+	err := store.do(func(conn *ldap.Conn) error {
+		err := conn.Bind(dn, password)
+
+		// the connection is bound as the user, or anonymous after a failed bind,
+		// and must be bound back before it is reused
+		rebindErr := store.bindService(conn)
+		if rebindErr != nil {
+			conn.Close()
+		}
+
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return err
+		}
+		ok = err == nil
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("cannot bind to ldap as %s: %w", dn, err)
+	}
+	return ok, nil
+}
+
+// do runs an operation on a pooled connection, and retries it once on a new connection
+// if the pooled one was closed, e.g. by the server after an idle timeout.
+func (store *LDAPUserStore) do(op func(conn *ldap.Conn) error) error {
+	for {
+		conn, pooled, err := store.conn()
+		if err != nil {
+			return err
+		}
+
+		err = op(conn)
+		if err != nil && conn.IsClosing() {
+			conn.Close()
+			if pooled {
+				continue
+			}
+			return err
+		}
+
+		store.release(conn)
+		return err
+	}
+}
+
+// conn returns an idle connection, or opens a new one. It tells if the connection was idle.
+func (store *LDAPUserStore) conn() (*ldap.Conn, bool, error) {
+	for {
+		select {
+		case conn := <-store.idle:
+			if !conn.IsClosing() {
+				return conn, true, nil
+			}
+		default:
+			conn, err := store.dial()
+			return conn, false, err
+		}
+	}
+}
+
+// release keeps a connection open for the next operations, unless the pool is full.
+func (store *LDAPUserStore) release(conn *ldap.Conn) {
+	if conn.IsClosing() {
+		return
+	}
+
+	select {
+	case store.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (store *LDAPUserStore) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(store.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: store.config.Timeout}))
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to ldap: %w", err)
+	}
+	conn.SetTimeout(store.config.Timeout)
+
+	err = store.bindService(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot bind to ldap as the service account: %w", err)
+	}
+	return conn, nil
+}
+
+func (store *LDAPUserStore) bindService(conn *ldap.Conn) error {
+	if store.config.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(store.config.BindDN, store.config.BindPassword)
+}
@@ -0,0 +1,504 @@
+package service_test
+
+import (
+	"context"
+	"learngrpc/pcbook/pb"
+	"learngrpc/pcbook/service"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testLDAPBindDN   = "cn=pcbook,ou=services,dc=example,dc=com"
+	testLDAPPassword = "directory-secret"
+)
+
+func TestLDAPUserStore(t *testing.T) {
+	t.Parallel()
+
+	directory := newFakeLDAPServer(t)
+	directory.addUser("alice", "cn=pcbook-admins,ou=groups,dc=example,dc=com", "cn=engineering,ou=groups,dc=example,dc=com")
+	directory.addUser("bob", "cn=Sellers,ou=groups,dc=example,dc=com")
+	directory.addUser("carol", "cn=engineering,ou=groups,dc=example,dc=com")
+	directory.addUser("dave", "cn=marketing,ou=groups,dc=example,dc=com")
+
+	local := service.NewInMemoryUserStore()
+	localAdmin, err := service.NewUser("admin1", "secret", "admin")
+	require.NoError(t, err)
+	require.NoError(t, local.Save(localAdmin))
+
+	store := newTestLDAPUserStore(t, directory, local, testLDAPPassword)
+
+	// the password is checked by binding as the user, and the first group that matches gives the role
+	user, err := store.Authenticate("alice", testLDAPPassword+"-alice")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	require.Equal(t, "admin", user.Role)
+	require.Equal(t, directory.URL, user.Issuer)
+	require.Empty(t, user.HashedPassword)
+	require.False(t, user.Disabled)
+
+	for _, password := range []string{"wrong", ""} {
+		user, err = store.Authenticate("alice", password)
+		require.NoError(t, err)
+		require.Nil(t, user)
+	}
+	user, err = store.Authenticate("zoe", testLDAPPassword+"-zoe")
+	require.NoError(t, err)
+	require.Nil(t, user)
+
+	// the filter ignores case, but another case of the username would be another local user
+	user, err = store.Authenticate("Alice", testLDAPPassword+"-alice")
+	require.NoError(t, err)
+	require.Nil(t, user)
+	user, err = store.Find("ALICE")
+	require.NoError(t, err)
+	require.Nil(t, user)
+
+	user, err = store.Authenticate("dave", testLDAPPassword+"-dave")
+	require.NoError(t, err)
+	require.True(t, user.Disabled)
+
+	// local users keep their password, and need no directory
+	searches := directory.searchCount()
+	user, err = store.Authenticate("admin1", "secret")
+	require.NoError(t, err)
+	require.Equal(t, "admin", user.Role)
+	require.Equal(t, searches, directory.searchCount())
+
+	// the group names match case-insensitively, and the lookups are cached
+	user, err = store.Find("bob")
+	require.NoError(t, err)
+	require.Equal(t, "seller", user.Role)
+	require.Equal(t, "acme", user.Team)
+
+	searches = directory.searchCount()
+	user, err = store.Find("bob")
+	require.NoError(t, err)
+	require.Equal(t, "seller", user.Role)
+	require.Equal(t, searches, directory.searchCount())
+
+	// a login looks the groups up again
+	directory.addUser("bob", "cn=engineering,ou=groups,dc=example,dc=com")
+	user, err = store.Authenticate("bob", testLDAPPassword+"-bob")
+	require.NoError(t, err)
+	require.Equal(t, "user", user.Role)
+	require.Empty(t, user.Team)
+
+	// the directory users are recorded locally, and disabled when they leave the directory
+	users, total, err := store.List(0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 3, total)
+	require.Equal(t, "alice", users[1].Username)
+
+	user, err = store.Find("carol")
+	require.NoError(t, err)
+	require.False(t, user.Disabled)
+
+	directory.removeUser("carol")
+	user, err = store.Authenticate("carol", testLDAPPassword+"-carol")
+	require.NoError(t, err)
+	require.Nil(t, user)
+	user, err = store.Find("carol")
+	require.NoError(t, err)
+	require.True(t, user.Disabled)
+
+	// the directory usernames cannot be taken by local users
+	other, err := service.NewUser("alice", "secret", "user")
+	require.NoError(t, err)
+	require.ErrorIs(t, store.Save(other), service.ErrAlreadyExists)
+	other, err = service.NewUser("Alice", "secret", "user")
+	require.NoError(t, err)
+	require.ErrorIs(t, store.Save(other), service.ErrAlreadyExists)
+
+	// the connections are pooled, and replaced when the server closes them
+	require.Equal(t, 1, directory.connectionCount())
+
+	directory.closeConnections()
+	user, err = store.Authenticate("alice", testLDAPPassword+"-alice")
+	require.NoError(t, err)
+	require.Equal(t, "admin", user.Role)
+	require.Equal(t, 2, directory.connectionCount())
+}
+
+func TestLDAPUserStoreServiceAccount(t *testing.T) {
+	t.Parallel()
+
+	directory := newFakeLDAPServer(t)
+	directory.addUser("alice", "cn=pcbook-admins,ou=groups,dc=example,dc=com")
+
+	store := newTestLDAPUserStore(t, directory, service.NewInMemoryUserStore(), "wrong")
+	_, err := store.Find("alice")
+	require.Error(t, err)
+	_, err = store.Authenticate("alice", testLDAPPassword+"-alice")
+	require.Error(t, err)
+
+	// a connection is bound back to the service account after any failed bind as a user
+	directory.addUser("bob", "cn=pcbook-admins,ou=groups,dc=example,dc=com")
+	directory.failBind("alice", ldap.LDAPResultUnwillingToPerform)
+	store = newTestLDAPUserStore(t, directory, service.NewInMemoryUserStore(), testLDAPPassword)
+	_, err = store.Authenticate("alice", testLDAPPassword+"-alice")
+	require.Error(t, err)
+	user, err := store.Find("bob")
+	require.NoError(t, err)
+	require.Equal(t, "admin", user.Role)
+}
+
+func TestAuthServerLoginWithLDAP(t *testing.T) {
+	t.Parallel()
+
+	directory := newFakeLDAPServer(t)
+	directory.addUser("alice", "cn=pcbook-admins,ou=groups,dc=example,dc=com")
+	directory.addUser("dave", "cn=marketing,ou=groups,dc=example,dc=com")
+
+	store := newTestLDAPUserStore(t, directory, service.NewInMemoryUserStore(), testLDAPPassword)
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	server := service.NewAuthServer(
+		store,
+		service.NewInMemoryInviteStore(),
+		service.NewInMemoryRefreshTokenStore(time.Hour),
+		service.NewInMemoryRevocationList(),
+		service.NewInMemoryAPIKeyStore(),
+		service.NewInMemoryLoginChallengeStore(time.Minute),
+		nil,
+		nil,
+		store,
+		nil,
+		jwtManager,
+		nil,
+		false,
+	)
+
+	res, err := server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: testLDAPPassword + "-alice"})
+	require.NoError(t, err)
+	claims, err := jwtManager.Verify(res.GetToken())
+	require.NoError(t, err)
+	require.Equal(t, "admin", claims.Role)
+
+	// the session of a directory user is refreshed with its current role
+	refreshed, err := server.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: res.GetRefreshToken()})
+	require.NoError(t, err)
+	claims, err = jwtManager.Verify(refreshed.GetToken())
+	require.NoError(t, err)
+	require.Equal(t, "admin", claims.Role)
+
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "wrong"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "Alice", Password: testLDAPPassword + "-alice"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "dave", Password: testLDAPPassword + "-dave"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the directory passwords cannot be changed here
+	ctx := contextWithTestClaims("alice", "admin")
+	_, err = server.ChangePassword(ctx, &pb.ChangePasswordRequest{OldPassword: testLDAPPassword + "-alice", NewPassword: "new"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	directory.close()
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: testLDAPPassword + "-alice"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestParseLDAPConfig(t *testing.T) {
+	t.Parallel()
+
+	config, err := service.ParseLDAPConfig([]byte(`
+url: ldaps://ldap.example.com
+base_dn: ou=people,dc=example,dc=com
+group_roles:
+  - group: admins
+    role: admin
+cache_ttl: 30s
+`))
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, config.CacheTTL)
+
+	invalid := []string{
+		`{"base_dn": "dc=example,dc=com"}`,
+		`{"url": "https://ldap.example.com", "base_dn": "dc=example,dc=com"}`,
+		`{"url": "ldap://ldap.example.com"}`,
+		`{"url": "ldap://ldap.example.com", "base_dn": "dc=example,dc=com", "user_filter": "(uid=alice)"}`,
+		`{"url": "ldap://ldap.example.com", "base_dn": "dc=example,dc=com", "group_roles": [{"group": "a", "role": "owner"}]}`,
+		`{"url": "ldap://ldap.example.com", "base_dn": "dc=example,dc=com", "default_role": "owner"}`,
+		`{"url": "ldap://ldap.example.com", "base_dn": "dc=example,dc=com", "pool_size": -1}`,
+		`{"url": "ldap://ldap.example.com", "base_dn": "dc=example,dc=com", "group_filter": "(member=%s)"}`,
+	}
+	for _, data := range invalid {
+		_, err := service.ParseLDAPConfig([]byte(data))
+		require.Error(t, err, data)
+	}
+}
+
+func newTestLDAPUserStore(t *testing.T, directory *fakeLDAPServer, local service.UserStore, bindPassword string) *service.LDAPUserStore {
+	config, err := service.ParseLDAPConfig([]byte(`
+url: ` + directory.URL + `
+bind_dn: ` + testLDAPBindDN + `
+bind_password: ` + bindPassword + `
+base_dn: ou=people,dc=example,dc=com
+user_filter: (&(objectClass=person)(uid=%s))
+group_roles:
+  - group: cn=pcbook-admins,ou=groups,dc=example,dc=com
+    role: admin
+  - group: sellers
+    role: seller
+    team: acme
+  - group: engineering
+    role: user
+cache_ttl: 1h
+timeout: 5s
+`))
+	require.NoError(t, err)
+
+	store := service.NewLDAPUserStore(*config, local)
+	t.Cleanup(store.Close)
+	return store
+}
+
+// fakeLDAPServer is an LDAP directory that supports simple binds and searches with
+// equality and presence filters, where the password of each user is the service
+// account password followed by a dash and the username.
+type fakeLDAPServer struct {
+	URL      string
+	listener net.Listener
+
+	mutex       sync.Mutex
+	entries     map[string]map[string][]string // the attributes by DN, with lowercase names
+	passwords   map[string]string
+	bindErrors  map[string]uint16 // the result codes of the binds that fail whatever the password, by DN
+	conns       []net.Conn
+	connections int
+	searches    int
+}
+
+func newFakeLDAPServer(t *testing.T) *fakeLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &fakeLDAPServer{
+		URL:        "ldap://" + listener.Addr().String(),
+		listener:   listener,
+		entries:    make(map[string]map[string][]string),
+		passwords:  map[string]string{testLDAPBindDN: testLDAPPassword},
+		bindErrors: make(map[string]uint16),
+	}
+	go server.serve()
+	t.Cleanup(server.close)
+	return server
+}
+
+// addUser adds or replaces the entry of a user with the DNs of its groups.
+func (server *fakeLDAPServer) addUser(username string, groups ...string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	dn := "uid=" + username + ",ou=people,dc=example,dc=com"
+	server.entries[dn] = map[string][]string{
+		"objectclass": {"top", "person"},
+		"uid":         {username},
+		"memberof":    groups,
+	}
+	server.passwords[dn] = testLDAPPassword + "-" + username
+}
+
+func (server *fakeLDAPServer) removeUser(username string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	dn := "uid=" + username + ",ou=people,dc=example,dc=com"
+	delete(server.entries, dn)
+	delete(server.passwords, dn)
+}
+
+// failBind makes the binds as a user fail with a result code.
+func (server *fakeLDAPServer) failBind(username string, code uint16) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.bindErrors["uid="+username+",ou=people,dc=example,dc=com"] = code
+}
+
+func (server *fakeLDAPServer) searchCount() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.searches
+}
+
+func (server *fakeLDAPServer) connectionCount() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.connections
+}
+
+func (server *fakeLDAPServer) closeConnections() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.conns = nil
+}
+
+func (server *fakeLDAPServer) close() {
+	server.listener.Close()
+	server.closeConnections()
+}
+
+func (server *fakeLDAPServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		server.mutex.Lock()
+		server.conns = append(server.conns, conn)
+		server.connections++
+		server.mutex.Unlock()
+
+		go server.handle(conn)
+	}
+}
+
+func (server *fakeLDAPServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	boundDN := ""
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+		messageID := request.Children[0].Value
+		op := request.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultSuccess)
+			if dn != "" || password != "" {
+				server.mutex.Lock()
+				expected, ok := server.passwords[dn]
+				bindError, failed := server.bindErrors[dn]
+				server.mutex.Unlock()
+				if failed {
+					code = bindError
+				} else if !ok || password != expected {
+					code = ldap.LDAPResultInvalidCredentials
+				}
+			}
+			// a failed bind leaves the connection anonymous
+			boundDN = ""
+			if code == ldap.LDAPResultSuccess {
+				boundDN = dn
+			}
+			responses = append(responses, ldapResult(messageID, ldap.ApplicationBindResponse, code))
+
+		case ldap.ApplicationSearchRequest:
+			if boundDN != testLDAPBindDN {
+				responses = append(responses, ldapResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				break
+			}
+			responses = append(responses, server.search(messageID, op.Children[0].Value.(string), op.Children[6])...)
+			responses = append(responses, ldapResult(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+
+		default:
+			return
+		}
+
+		for _, response := range responses {
+			_, err = conn.Write(response.Bytes())
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (server *fakeLDAPServer) search(messageID interface{}, baseDN string, filter *ber.Packet) []*ber.Packet {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.searches++
+	var entries []*ber.Packet
+	for dn, attributes := range server.entries {
+		if !strings.HasSuffix(dn, baseDN) || !matchLDAPFilter(filter, attributes) {
+			continue
+		}
+
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+		attributeList := ber.NewSequence("")
+		for name, values := range attributes {
+			attribute := ber.NewSequence("")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+			valueSet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, value := range values {
+				valueSet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+			}
+			attribute.AppendChild(valueSet)
+			attributeList.AppendChild(attribute)
+		}
+		entry.AppendChild(attributeList)
+		entries = append(entries, ldapMessage(messageID, entry))
+	}
+	return entries
+}
+
+func matchLDAPFilter(filter *ber.Packet, attributes map[string][]string) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchLDAPFilter(child, attributes) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchLDAPFilter(child, attributes) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !matchLDAPFilter(filter.Children[0], attributes)
+	case ldap.FilterEqualityMatch:
+		for _, value := range attributes[strings.ToLower(filter.Children[0].Data.String())] {
+			if strings.EqualFold(value, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(attributes[strings.ToLower(filter.Data.String())]) > 0
+	}
+	return false
+}
+
+func ldapResult(messageID interface{}, tag ber.Tag, code uint16) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ldap.LDAPResultCodeMap[code], ""))
+	return ldapMessage(messageID, result)
+}
+
+func ldapMessage(messageID interface{}, op *ber.Packet) *ber.Packet {
+	message := ber.NewSequence("")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+	message.AppendChild(op)
+	return message
+}
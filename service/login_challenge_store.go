@@ -0,0 +1,106 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrLoginChallengeNotFound is returned when a login challenge does not exist, has expired
+// or was already used.
+var ErrLoginChallengeNotFound = errors.New("login challenge not found")
+
+// LoginChallenge is the state of a login whose password was correct,
+// and which waits for a second factor.
+type LoginChallenge struct {
+	ID        string
+	Username  string
+	ExpiresAt time.Time
+}
+
+// LoginChallengeStore is a store for login challenges.
+type LoginChallengeStore interface {
+	// Create creates a new challenge for a user.
+	Create(username string) (*LoginChallenge, error)
+	// Find returns the challenge with the given ID, or ErrLoginChallengeNotFound.
+	Find(id string) (*LoginChallenge, error)
+	// Delete deletes a challenge before it is used, or returns ErrLoginChallengeNotFound
+	// if it was already deleted or has expired, so that it is only used once.
+	Delete(id string) error
+}
+
+// InMemoryLoginChallengeStore is an in-memory store for login challenges.
+type InMemoryLoginChallengeStore struct {
+	mutex      sync.Mutex
+	ttl        time.Duration
+	challenges map[string]*LoginChallenge
+}
+
+// NewInMemoryLoginChallengeStore creates a new InMemoryLoginChallengeStore whose challenges expire after ttl.
+func NewInMemoryLoginChallengeStore(ttl time.Duration) *InMemoryLoginChallengeStore {
+	return &InMemoryLoginChallengeStore{
+		ttl:        ttl,
+		challenges: make(map[string]*LoginChallenge),
+	}
+}
+
+// Create creates a new challenge for a user.
+func (store *InMemoryLoginChallengeStore) Create(username string) (*LoginChallenge, error) {
+	id, err := randomString(32)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate login challenge: %w", err)
+	}
+
+	challenge := &LoginChallenge{
+		ID:        id,
+		Username:  username,
+		ExpiresAt: time.Now().Add(store.ttl),
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for id, other := range store.challenges {
+		if now.After(other.ExpiresAt) {
+			delete(store.challenges, id)
+		}
+	}
+	store.challenges[challenge.ID] = challenge
+
+	other := *challenge
+	return &other, nil
+}
+
+// Find returns the challenge with the given ID, or ErrLoginChallengeNotFound.
+func (store *InMemoryLoginChallengeStore) Find(id string) (*LoginChallenge, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	challenge := store.challenges[id]
+	if challenge == nil || time.Now().After(challenge.ExpiresAt) {
+		return nil, ErrLoginChallengeNotFound
+	}
+
+	other := *challenge
+	return &other, nil
+}
+
+// Delete deletes a challenge before it is used, or returns ErrLoginChallengeNotFound
+// if it was already deleted or has expired.
+func (store *InMemoryLoginChallengeStore) Delete(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	challenge := store.challenges[id]
+	if challenge == nil {
+		return ErrLoginChallengeNotFound
+	}
+
+	delete(store.challenges, id)
+	if time.Now().After(challenge.ExpiresAt) {
+		return ErrLoginChallengeNotFound
+	}
+	return nil
+}
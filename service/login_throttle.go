@@ -0,0 +1,268 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// LockoutPolicy tells how long to wait after failed login attempts.
+// After FreeFailures failures in a row, each attempt must wait BaseDelay,
+// doubled for each further failure up to MaxDelay. After LockoutFailures failures,
+// no attempt is allowed for LockoutDuration. The failures are forgotten
+// LockoutDuration after the last one.
+type LockoutPolicy struct {
+	FreeFailures    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutFailures int
+	LockoutDuration time.Duration
+}
+
+// DefaultUserLockoutPolicy is the default lockout policy of a username.
+var DefaultUserLockoutPolicy = LockoutPolicy{
+	FreeFailures:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Minute,
+	LockoutFailures: 10,
+	LockoutDuration: 15 * time.Minute,
+}
+
+// DefaultIPLockoutPolicy is the default lockout policy of a client IP,
+// which allows more failures since users behind a proxy share an IP.
+var DefaultIPLockoutPolicy = LockoutPolicy{
+	FreeFailures:    20,
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Minute,
+	LockoutFailures: 100,
+	LockoutDuration: 15 * time.Minute,
+}
+
+// delay returns how long to wait after the given number of failures in a row.
+func (policy LockoutPolicy) delay(failures int) time.Duration {
+	if policy.LockoutFailures > 0 && failures >= policy.LockoutFailures {
+		return policy.LockoutDuration
+	}
+	if failures < policy.FreeFailures || policy.BaseDelay <= 0 {
+		return 0
+	}
+
+	delay := policy.BaseDelay
+	for i := policy.FreeFailures; i < failures; i++ {
+		delay *= 2
+		if delay >= policy.MaxDelay {
+			return policy.MaxDelay
+		}
+	}
+	return delay
+}
+
+// LoginThrottle tracks the failed login attempts of each username and client IP,
+// and delays or locks out the next attempts of either one.
+type LoginThrottle struct {
+	mutex      sync.Mutex
+	userPolicy LockoutPolicy
+	ipPolicy   LockoutPolicy
+	users      map[string]*loginFailures
+	ips        map[string]*loginFailures
+	auditSink  AuditSink
+}
+
+type loginFailures struct {
+	count       int
+	pending     int // attempts that began and did not end yet
+	lastFailure time.Time
+	nextAllowed time.Time
+}
+
+// wait returns how long a new attempt must wait: until the next allowed attempt, and while other
+// attempts are pending, as long as it would have to wait if they all failed.
+func (failures *loginFailures) wait(policy LockoutPolicy, now time.Time) time.Duration {
+	wait := failures.nextAllowed.Sub(now)
+	if failures.pending > 0 {
+		if delay := policy.delay(failures.count + failures.pending); delay > wait {
+			wait = delay
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// NewLoginThrottle creates a new LoginThrottle that records an audit event for each lockout.
+func NewLoginThrottle(userPolicy LockoutPolicy, ipPolicy LockoutPolicy, auditSink AuditSink) *LoginThrottle {
+	return &LoginThrottle{
+		userPolicy: userPolicy,
+		ipPolicy:   ipPolicy,
+		users:      make(map[string]*loginFailures),
+		ips:        make(map[string]*loginFailures),
+		auditSink:  auditSink,
+	}
+}
+
+// Begin begins a login attempt for the username from the IP. If the attempt must wait, it returns how long.
+// Otherwise it returns 0, and the attempt counts as a failure of the username and of the IP
+// until it ends with RecordSuccess, RecordFailure or Release, so that concurrent attempts
+// cannot try more passwords than the policies allow one after the other.
+func (throttle *LoginThrottle) Begin(username string, ip string) time.Duration {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	now := time.Now()
+	throttle.sweep(now)
+
+	user := loginFailuresOf(throttle.users, username)
+	wait := user.wait(throttle.userPolicy, now)
+	var client *loginFailures
+	if ip != "" {
+		client = loginFailuresOf(throttle.ips, ip)
+		if clientWait := client.wait(throttle.ipPolicy, now); clientWait > wait {
+			wait = clientWait
+		}
+	}
+
+	if wait > 0 {
+		throttle.forgetIfUnused(username, ip)
+		return wait
+	}
+
+	user.pending++
+	if client != nil {
+		client.pending++
+	}
+	return 0
+}
+
+// RecordFailure ends a login attempt for the username from the IP, which failed.
+func (throttle *LoginThrottle) RecordFailure(username string, ip string) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	now := time.Now()
+	throttle.release(username, ip)
+
+	throttle.recordFailure(throttle.users, throttle.userPolicy, "user:"+username, username, ip, now)
+	if ip != "" {
+		throttle.recordFailure(throttle.ips, throttle.ipPolicy, "ip:"+ip, ip, ip, now)
+	}
+}
+
+// RecordSuccess ends a login attempt for the username from the IP, which succeeded,
+// and forgets the failed login attempts of the username.
+// The failures of the IP are kept, so that logging in to one account
+// does not allow guessing the passwords of others.
+func (throttle *LoginThrottle) RecordSuccess(username string, ip string) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	throttle.release(username, ip)
+	throttle.forget(username)
+	throttle.forgetIfUnused(username, ip)
+}
+
+// Release ends a login attempt for the username from the IP that neither succeeded nor failed,
+// e.g. because of an internal error.
+func (throttle *LoginThrottle) Release(username string, ip string) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	throttle.release(username, ip)
+	throttle.forgetIfUnused(username, ip)
+}
+
+// Unlock forgets the failed login attempts of the username, and tells if it had any.
+func (throttle *LoginThrottle) Unlock(username string) bool {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	failures := throttle.users[username]
+	ok := failures != nil && failures.count > 0
+	throttle.forget(username)
+	throttle.forgetIfUnused(username, "")
+	return ok
+}
+
+// loginFailuresOf returns the failures of a username or IP, which are added if needed.
+func loginFailuresOf(entries map[string]*loginFailures, key string) *loginFailures {
+	failures := entries[key]
+	if failures == nil {
+		failures = &loginFailures{}
+		entries[key] = failures
+	}
+	return failures
+}
+
+// release ends a pending attempt of the username and of the IP. The caller must hold the lock.
+func (throttle *LoginThrottle) release(username string, ip string) {
+	for _, failures := range []*loginFailures{throttle.users[username], throttle.ips[ip]} {
+		if failures != nil && failures.pending > 0 {
+			failures.pending--
+		}
+	}
+}
+
+// forget forgets the failures of the username, but not its pending attempts.
+// The caller must hold the lock.
+func (throttle *LoginThrottle) forget(username string) {
+	if failures := throttle.users[username]; failures != nil {
+		failures.count = 0
+		failures.nextAllowed = time.Time{}
+	}
+}
+
+// forgetIfUnused deletes the entries of the username and of the IP
+// that have neither failures nor pending attempts. The caller must hold the lock.
+func (throttle *LoginThrottle) forgetIfUnused(username string, ip string) {
+	if failures := throttle.users[username]; failures != nil && failures.count == 0 && failures.pending == 0 {
+		delete(throttle.users, username)
+	}
+	if failures := throttle.ips[ip]; failures != nil && failures.count == 0 && failures.pending == 0 {
+		delete(throttle.ips, ip)
+	}
+}
+
+func (throttle *LoginThrottle) recordFailure(
+	entries map[string]*loginFailures,
+	policy LockoutPolicy,
+	resource string,
+	key string,
+	ip string,
+	now time.Time,
+) {
+	failures := loginFailuresOf(entries, key)
+	failures.count++
+	failures.lastFailure = now
+	failures.nextAllowed = now.Add(policy.delay(failures.count))
+
+	if policy.LockoutFailures <= 0 || failures.count < policy.LockoutFailures {
+		return
+	}
+
+	event := &AuditEvent{
+		Time:     now,
+		Action:   "login.lockout",
+		Resource: resource,
+		Peer:     ip,
+		Detail:   fmt.Sprintf("locked out for %s after %d failed login attempts", policy.LockoutDuration, failures.count),
+	}
+	err := throttle.auditSink.Record(event)
+	if err != nil {
+		log.Printf("cannot record lockout of %s: %v", resource, err)
+	}
+}
+
+// sweep forgets the failures that are older than the lockout duration, unless attempts are pending.
+func (throttle *LoginThrottle) sweep(now time.Time) {
+	for key, failures := range throttle.users {
+		if failures.pending == 0 && now.Sub(failures.lastFailure) > throttle.userPolicy.LockoutDuration && now.After(failures.nextAllowed) {
+			delete(throttle.users, key)
+		}
+	}
+	for key, failures := range throttle.ips {
+		if failures.pending == 0 && now.Sub(failures.lastFailure) > throttle.ipPolicy.LockoutDuration && now.After(failures.nextAllowed) {
+			delete(throttle.ips, key)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"io"
+	"learngrpc/pcbook/pb"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	multipartUploadPath      = "/v1/laptop/upload_image"
+	multipartUploadChunkSize = 32 * 1024
+)
+
+// RegisterMultipartUploadHandler registers a REST handler on the gateway mux that accepts
+// a multipart/form-data image upload, with a laptop_id field followed by a file part.
+// The file is forwarded in chunks to the UploadImage stream of the gRPC server,
+// and the UploadImageResponse is returned as JSON.
+func RegisterMultipartUploadHandler(mux *runtime.ServeMux, laptopClient pb.LaptopServiceClient) error {
+	return mux.HandlePath(http.MethodPost, multipartUploadPath, func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		_, outboundMarshaler := runtime.MarshalerForRequest(mux, r)
+
+		ctx, err := runtime.AnnotateContext(r.Context(), mux, r, "/techschool.pcbook.LaptopService/UploadImage")
+		if err != nil {
+			runtime.HTTPError(r.Context(), mux, outboundMarshaler, w, r, err)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+64*1024)
+		res, err := forwardMultipartUpload(ctx, laptopClient, r)
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outboundMarshaler, w, r, logError(err))
+			return
+		}
+
+		runtime.ForwardResponseMessage(ctx, mux, outboundMarshaler, w, r, res)
+	})
+}
+
+func forwardMultipartUpload(ctx context.Context, laptopClient pb.LaptopServiceClient, r *http.Request) (*pb.UploadImageResponse, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, status.Errorf(codes.InvalidArgument, "content type must be multipart/form-data")
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot read multipart body: %v", err)
+	}
+
+	laptopID := r.URL.Query().Get("laptop_id")
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, status.Errorf(codes.InvalidArgument, "file part is not provided")
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot read multipart part: %v", err)
+		}
+
+		if part.FileName() == "" {
+			if part.FormName() == "laptop_id" {
+				value, err := io.ReadAll(io.LimitReader(part, 256))
+				if err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, "cannot read laptop_id field: %v", err)
+				}
+				laptopID = string(value)
+			}
+			continue
+		}
+
+		if laptopID == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "laptop_id field must come before the file part")
+		}
+		return sendUploadStream(ctx, laptopClient, laptopID, filepath.Ext(part.FileName()), part)
+	}
+}
+
+func sendUploadStream(
+	ctx context.Context,
+	laptopClient pb.LaptopServiceClient,
+	laptopID string,
+	imageType string,
+	file io.Reader,
+) (*pb.UploadImageResponse, error) {
+	log.Printf("forwarding multipart upload for laptop %s with imageType %s", laptopID, imageType)
+
+	// cancel the stream rather than closing it on a read error, so that no partial image is saved
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := laptopClient.UploadImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stream.Send(&pb.UploadImageRequest{
+		Data: &pb.UploadImageRequest_Info{
+			Info: &pb.ImageInfo{
+				LaptopId:  laptopID,
+				ImageType: imageType,
+			},
+		},
+	})
+	if err != nil {
+		// the server closed the stream, its status is returned by CloseAndRecv
+		_, err = stream.CloseAndRecv()
+		return nil, err
+	}
+
+	buffer := make([]byte, multipartUploadChunkSize)
+	for {
+		n, err := readChunk(file, buffer)
+		if n > 0 {
+			sendErr := stream.Send(&pb.UploadImageRequest{
+				Data: &pb.UploadImageRequest_ChunkData{
+					ChunkData: buffer[:n],
+				},
+			})
+			if sendErr != nil {
+				_, sendErr = stream.CloseAndRecv()
+				return nil, sendErr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// e.g. a truncated body, whose part ends with io.ErrUnexpectedEOF
+			return nil, status.Errorf(codes.InvalidArgument, "cannot read file part: %v", err)
+		}
+	}
+
+	return stream.CloseAndRecv()
+}
+
+// readChunk fills the buffer from the file, and returns io.EOF only when the file ends cleanly.
+// Unlike io.ReadFull, it returns the errors of the file as is, so that a short last chunk
+// is not mistaken for a truncated file.
+func readChunk(file io.Reader, buffer []byte) (int, error) {
+	n := 0
+	for n < len(buffer) {
+		m, err := file.Read(buffer[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
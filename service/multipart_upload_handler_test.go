@@ -0,0 +1,117 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"learngrpc/pcbook/pb"
+	sample "learngrpc/pcbook/samples"
+	"learngrpc/pcbook/service"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestMultipartUploadHandler(t *testing.T) {
+	t.Parallel()
+
+	testImageFolder := t.TempDir()
+	imageStore := service.NewDiskImageStore(testImageFolder)
+	laptopStore := service.NewInMemoryLaptopStore()
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+
+	mux := runtime.NewServeMux()
+	err = pb.RegisterLaptopServiceHandler(context.Background(), mux, conn)
+	require.NoError(t, err)
+	err = service.RegisterMultipartUploadHandler(mux, pb.NewLaptopServiceClient(conn))
+	require.NoError(t, err)
+
+	restServer := httptest.NewServer(mux)
+	t.Cleanup(restServer.Close)
+
+	imageData, err := os.ReadFile("../from/macbook-air-gold-2015-16.jpg")
+	require.NoError(t, err)
+
+	res := postMultipartImage(t, restServer.URL, laptop.Id, "macbook.jpg", imageData)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	body := struct {
+		ID   string `json:"id"`
+		Size uint32 `json:"size"`
+	}{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	require.NotEmpty(t, body.ID)
+	require.Equal(t, uint32(len(imageData)), body.Size)
+
+	savedData, err := os.ReadFile(fmt.Sprintf("%s/%s.jpg", testImageFolder, body.ID))
+	require.NoError(t, err)
+	require.Equal(t, imageData, savedData)
+
+	res = postMultipartImage(t, restServer.URL, sample.NewLaptop().Id, "macbook.jpg", imageData)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res = postMultipartImage(t, restServer.URL, "", "macbook.jpg", imageData)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err = http.Post(restServer.URL+"/v1/laptop/upload_image", "application/json", bytes.NewBufferString("{}"))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// a body cut in the middle of the file, without the closing boundary, saves nothing
+	var truncated bytes.Buffer
+	writer := multipart.NewWriter(&truncated)
+	require.NoError(t, writer.WriteField("laptop_id", laptop.Id))
+	part, err := writer.CreateFormFile("image", "macbook.jpg")
+	require.NoError(t, err)
+	_, err = part.Write(imageData[:len(imageData)/2])
+	require.NoError(t, err)
+
+	res, err = http.Post(restServer.URL+"/v1/laptop/upload_image", writer.FormDataContentType(), &truncated)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	usage, err := imageStore.Usage()
+	require.NoError(t, err)
+	require.Equal(t, 1, usage.Images)
+}
+
+func postMultipartImage(t *testing.T, url string, laptopID string, fileName string, imageData []byte) *http.Response {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if laptopID != "" {
+		require.NoError(t, writer.WriteField("laptop_id", laptopID))
+	}
+	part, err := writer.CreateFormFile("image", fileName)
+	require.NoError(t, err)
+	_, err = io.Copy(part, bytes.NewReader(imageData))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	req, err := http.NewRequest(http.MethodPost, url+"/v1/laptop/upload_image", &body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return res
+}
@@ -0,0 +1,328 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultOIDCUsernameClaim = "preferred_username"
+	defaultOIDCGroupsClaim   = "groups"
+	oidcHTTPTimeout          = 10 * time.Second
+	minJWKSRefreshInterval   = time.Minute
+)
+
+// ErrOIDCNoRole is returned when the user of a valid ID token is in none of the mapped groups,
+// and there is no default role.
+var ErrOIDCNoRole = errors.New("no role for the groups of the user")
+
+// oidcMFAMethods are the authentication methods of the amr claim, as defined by RFC 8176,
+// that prove that the identity provider checked a second factor.
+var oidcMFAMethods = map[string]bool{
+	"mfa": true,
+	"otp": true,
+	"hwk": true,
+}
+
+// OIDCConfig configures the login with the ID tokens of an OpenID Connect identity provider.
+type OIDCConfig struct {
+	Issuer        string `yaml:"issuer"`
+	ClientID      string `yaml:"client_id"`      // the audience of the ID tokens
+	JWKSURL       string `yaml:"jwks_url"`       // discovered from the issuer if empty
+	UsernameClaim string `yaml:"username_claim"` // preferred_username if empty
+	GroupsClaim   string `yaml:"groups_claim"`   // groups if empty
+	// GroupRoles maps groups to roles, where the first group of the user that matches applies.
+	GroupRoles []GroupRole `yaml:"group_roles"`
+	// DefaultRole is the role of the users in none of the groups, who are rejected if it is empty.
+	DefaultRole string `yaml:"default_role"`
+}
+
+// GroupRole gives a role, and a team if any, to the members of a group of an identity provider or directory.
+type GroupRole struct {
+	Group string `yaml:"group"`
+	Role  string `yaml:"role"`
+	Team  string `yaml:"team"`
+}
+
+// OIDCIdentity is the identity of a user verified from an ID token.
+type OIDCIdentity struct {
+	Subject  string
+	Username string
+	Groups   []string
+	Role     string
+	Team     string
+	MFA      bool // if the identity provider checked a second factor
+}
+
+// LoadOIDCConfig loads an OIDC configuration from a YAML or JSON file.
+func LoadOIDCConfig(filename string) (*OIDCConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read oidc config file: %w", err)
+	}
+
+	config, err := ParseOIDCConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load oidc config file %s: %w", filename, err)
+	}
+	return config, nil
+}
+
+// ParseOIDCConfig parses and validates an OIDC configuration.
+func ParseOIDCConfig(data []byte) (*OIDCConfig, error) {
+	config := &OIDCConfig{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode oidc config: %w", err)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks that the configuration has an issuer, a client ID and known roles.
+func (config *OIDCConfig) Validate() error {
+	if config.Issuer == "" || config.ClientID == "" {
+		return fmt.Errorf("oidc config must have an issuer and a client_id")
+	}
+	for i, groupRole := range config.GroupRoles {
+		if groupRole.Group == "" {
+			return fmt.Errorf("group role %d must have a group", i+1)
+		}
+		if !knownRoles[groupRole.Role] {
+			return fmt.Errorf("group role %d has unknown role %q", i+1, groupRole.Role)
+		}
+	}
+	if config.DefaultRole != "" && !knownRoles[config.DefaultRole] {
+		return fmt.Errorf("unknown default role %q", config.DefaultRole)
+	}
+	return nil
+}
+
+// OIDCVerifier verifies the ID tokens of an OpenID Connect identity provider with its published keys.
+type OIDCVerifier struct {
+	config     OIDCConfig
+	httpClient *http.Client
+
+	mutex     sync.Mutex // protects the keys, and serializes their fetches
+	jwksURL   string
+	keys      map[string]*SigningKey
+	fetchedAt time.Time
+}
+
+// NewOIDCVerifier creates a new OIDCVerifier. The keys are fetched at the first verification,
+// and again when a token is signed with an unknown key, e.g. after the provider rotated its keys.
+// If httpClient is nil, a client with a timeout is used.
+func NewOIDCVerifier(config OIDCConfig, httpClient *http.Client) *OIDCVerifier {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: oidcHTTPTimeout}
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = defaultOIDCUsernameClaim
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = defaultOIDCGroupsClaim
+	}
+
+	return &OIDCVerifier{
+		config:     config,
+		httpClient: httpClient,
+		jwksURL:    config.JWKSURL,
+		keys:       make(map[string]*SigningKey),
+	}
+}
+
+// Issuer returns the issuer of the ID tokens.
+func (verifier *OIDCVerifier) Issuer() string {
+	return verifier.config.Issuer
+}
+
+// Verify verifies an ID token, and returns the identity of its user with the role of its groups.
+// It returns ErrOIDCNoRole if the token is valid but the user has no role.
+func (verifier *OIDCVerifier) Verify(ctx context.Context, idToken string) (*OIDCIdentity, error) {
+	parser := &jwt.Parser{ValidMethods: []string{"RS256", "ES256"}}
+	claims := jwt.MapClaims{}
+
+	_, err := parser.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		key, err := verifier.key(ctx, keyID)
+		if err != nil {
+			return nil, err
+		}
+
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.publicKey, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+
+	if !claims.VerifyIssuer(verifier.config.Issuer, true) {
+		return nil, fmt.Errorf("unexpected issuer: %v", claims["iss"])
+	}
+	if !claims.VerifyAudience(verifier.config.ClientID, true) {
+		return nil, fmt.Errorf("unexpected audience: %v", claims["aud"])
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("id token has no expiry or has expired")
+	}
+
+	identity := &OIDCIdentity{
+		Groups: stringsClaim(claims[verifier.config.GroupsClaim]),
+	}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Username, _ = claims[verifier.config.UsernameClaim].(string)
+	if identity.Subject == "" || identity.Username == "" {
+		return nil, fmt.Errorf("id token has no sub or %s claim", verifier.config.UsernameClaim)
+	}
+
+	for _, method := range stringsClaim(claims["amr"]) {
+		if oidcMFAMethods[method] {
+			identity.MFA = true
+		}
+	}
+
+	identity.Role, identity.Team = verifier.role(identity.Groups)
+	if identity.Role == "" {
+		return identity, ErrOIDCNoRole
+	}
+	return identity, nil
+}
+
+// role returns the role and team of the first group that matches, or the default role.
+func (verifier *OIDCVerifier) role(groups []string) (string, string) {
+	member := make(map[string]bool)
+	for _, group := range groups {
+		member[group] = true
+	}
+
+	for _, groupRole := range verifier.config.GroupRoles {
+		if member[groupRole.Group] {
+			return groupRole.Role, groupRole.Team
+		}
+	}
+	return verifier.config.DefaultRole, ""
+}
+
+// key returns the key with the given ID, fetching the keys of the provider if it is unknown.
+func (verifier *OIDCVerifier) key(ctx context.Context, keyID string) (*SigningKey, error) {
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+
+	key := verifier.keys[keyID]
+	if key != nil {
+		return key, nil
+	}
+
+	// tokens with random key IDs must not make the server flood the provider
+	if time.Since(verifier.fetchedAt) < minJWKSRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key: %q", keyID)
+	}
+
+	err := verifier.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key = verifier.keys[keyID]
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key: %q", keyID)
+	}
+	return key, nil
+}
+
+// fetchKeys replaces the keys with the ones the provider publishes. The caller must hold the lock.
+func (verifier *OIDCVerifier) fetchKeys(ctx context.Context) error {
+	verifier.fetchedAt = time.Now()
+
+	if verifier.jwksURL == "" {
+		discovery := struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		err := verifier.getJSON(ctx, strings.TrimSuffix(verifier.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+		if err != nil {
+			return fmt.Errorf("cannot discover oidc provider: %w", err)
+		}
+		if discovery.Issuer != verifier.config.Issuer || discovery.JWKSURI == "" {
+			return fmt.Errorf("oidc provider of issuer %s has issuer %q and jwks_uri %q", verifier.config.Issuer, discovery.Issuer, discovery.JWKSURI)
+		}
+		verifier.jwksURL = discovery.JWKSURI
+	}
+
+	keySet := JSONWebKeySet{}
+	err := verifier.getJSON(ctx, verifier.jwksURL, &keySet)
+	if err != nil {
+		return fmt.Errorf("cannot fetch oidc provider keys: %w", err)
+	}
+
+	keys := make(map[string]*SigningKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.SigningKey()
+		if err != nil {
+			// the provider may publish keys of other types that it does not use for ID tokens
+			continue
+		}
+		keys[key.ID] = key
+	}
+
+	verifier.keys = keys
+	return nil
+}
+
+func (verifier *OIDCVerifier) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := verifier.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// stringsClaim returns the strings of a claim that is either a string or an array of strings.
+func stringsClaim(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []interface{}:
+		values := make([]string, 0, len(claim))
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
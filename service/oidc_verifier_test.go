@@ -0,0 +1,230 @@
+package service_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"learngrpc/pcbook/pb"
+	"learngrpc/pcbook/service"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthServerExchangeToken(t *testing.T) {
+	t.Parallel()
+
+	issuer := newFakeIssuer(t)
+	config, err := service.ParseOIDCConfig([]byte(`
+issuer: ` + issuer.URL + `
+client_id: pcbook
+group_roles:
+  - group: pcbook-admins
+    role: admin
+  - group: pcbook-sellers
+    role: seller
+    team: acme
+  - group: engineering
+    role: user
+`))
+	require.NoError(t, err)
+
+	userStore := service.NewInMemoryUserStore()
+	localUser, err := service.NewUser("user1", "secret", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(localUser))
+	// a user of the provider recorded with no subject cannot be linked to one
+	require.NoError(t, userStore.Save(&service.User{Username: "dave", Role: "user", Issuer: issuer.URL}))
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	server := service.NewAuthServer(
+		userStore,
+		service.NewInMemoryInviteStore(),
+		service.NewInMemoryRefreshTokenStore(time.Hour),
+		service.NewInMemoryRevocationList(),
+		service.NewInMemoryAPIKeyStore(),
+		service.NewInMemoryLoginChallengeStore(time.Minute),
+		nil,
+		service.NewOIDCVerifier(*config, nil),
+		nil,
+		nil,
+		jwtManager,
+		[]string{"admin"},
+		false,
+	)
+	exchange := func(claims jwt.MapClaims) (*pb.ExchangeTokenResponse, error) {
+		return server.ExchangeToken(context.Background(), &pb.ExchangeTokenRequest{IdToken: issuer.sign(t, claims)})
+	}
+
+	// the user is provisioned at its first exchange
+	res, err := exchange(issuer.claims("alice", "engineering"))
+	require.NoError(t, err)
+	require.Equal(t, "user", res.GetUser().GetRole())
+	require.Equal(t, issuer.URL, res.GetUser().GetIssuer())
+	require.NotEmpty(t, res.GetRefreshToken())
+
+	claims, err := jwtManager.Verify(res.GetToken())
+	require.NoError(t, err)
+	require.Equal(t, "alice", claims.Username)
+	require.Equal(t, "user", claims.Role)
+
+	// the groups are the source of truth, and a role that requires a second factor needs it at the provider
+	_, err = exchange(issuer.claims("alice", "pcbook-admins"))
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	admin := issuer.claims("alice", "engineering", "pcbook-admins")
+	admin["amr"] = []string{"pwd", "mfa"}
+	res, err = exchange(admin)
+	require.NoError(t, err)
+	require.Equal(t, "admin", res.GetUser().GetRole())
+
+	res, err = exchange(issuer.claims("bob", "pcbook-sellers"))
+	require.NoError(t, err)
+	require.Equal(t, "seller", res.GetUser().GetRole())
+	require.Equal(t, "acme", res.GetUser().GetTeam())
+
+	// provisioned users have no password
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: ""})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		claims func(claims jwt.MapClaims)
+		token  func(claims jwt.MapClaims) string
+		code   codes.Code
+	}{
+		{name: "no_group", claims: func(claims jwt.MapClaims) { claims["groups"] = []string{"sales"} }, code: codes.PermissionDenied},
+		{name: "local_user", claims: func(claims jwt.MapClaims) { claims["preferred_username"] = "user1" }, code: codes.PermissionDenied},
+		{name: "other_subject", claims: func(claims jwt.MapClaims) { claims["preferred_username"] = "alice" }, code: codes.PermissionDenied},
+		{name: "no_subject", claims: func(claims jwt.MapClaims) { claims["preferred_username"] = "dave" }, code: codes.PermissionDenied},
+		{name: "invalid_username", claims: func(claims jwt.MapClaims) { claims["preferred_username"] = "carol@example.com" }, code: codes.PermissionDenied},
+		{name: "other_audience", claims: func(claims jwt.MapClaims) { claims["aud"] = "other" }, code: codes.Unauthenticated},
+		{name: "other_issuer", claims: func(claims jwt.MapClaims) { claims["iss"] = "https://idp.example.com" }, code: codes.Unauthenticated},
+		{name: "expired", claims: func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Minute).Unix() }, code: codes.Unauthenticated},
+		{name: "no_expiry", claims: func(claims jwt.MapClaims) { delete(claims, "exp") }, code: codes.Unauthenticated},
+		{
+			name: "other_key",
+			token: func(claims jwt.MapClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+				token.Header["kid"] = issuer.keyID
+				signed, err := token.SignedString(otherKey)
+				require.NoError(t, err)
+				return signed
+			},
+			code: codes.Unauthenticated,
+		},
+		{
+			name: "hmac",
+			token: func(claims jwt.MapClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+				token.Header["kid"] = issuer.keyID
+				signed, err := token.SignedString([]byte("secret"))
+				require.NoError(t, err)
+				return signed
+			},
+			code: codes.Unauthenticated,
+		},
+	}
+
+	for _, tc := range testCases {
+		claims := issuer.claims("carol", "engineering")
+		idToken := ""
+		if tc.claims != nil {
+			tc.claims(claims)
+			idToken = issuer.sign(t, claims)
+		} else {
+			idToken = tc.token(claims)
+		}
+
+		_, err := server.ExchangeToken(context.Background(), &pb.ExchangeTokenRequest{IdToken: idToken})
+		require.Equal(t, tc.code, status.Code(err), tc.name)
+	}
+
+	// the provider is only discovered once
+	require.Equal(t, int32(1), atomic.LoadInt32(&issuer.discoveries))
+
+	_, err = newTestAuthServer(t, false).ExchangeToken(context.Background(), &pb.ExchangeTokenRequest{IdToken: "token"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestParseOIDCConfig(t *testing.T) {
+	t.Parallel()
+
+	invalid := []string{
+		`{"client_id": "pcbook"}`,
+		`{"issuer": "https://idp.example.com"}`,
+		`{"issuer": "https://idp.example.com", "client_id": "pcbook", "group_roles": [{"group": "a", "role": "owner"}]}`,
+		`{"issuer": "https://idp.example.com", "client_id": "pcbook", "group_roles": [{"role": "user"}]}`,
+		`{"issuer": "https://idp.example.com", "client_id": "pcbook", "default_role": "owner"}`,
+		`{"issuer": "https://idp.example.com", "client_id": "pcbook", "roles": {"a": "user"}}`,
+	}
+	for _, data := range invalid {
+		_, err := service.ParseOIDCConfig([]byte(data))
+		require.Error(t, err, data)
+	}
+}
+
+// fakeIssuer is an OpenID Connect provider that publishes its discovery document and its key.
+type fakeIssuer struct {
+	*httptest.Server
+	key         *ecdsa.PrivateKey
+	keyID       string
+	discoveries int32
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	key, err := service.NewSigningKey(&privateKey.PublicKey)
+	require.NoError(t, err)
+
+	issuer := &fakeIssuer{key: privateKey, keyID: key.ID}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&issuer.discoveries, 1)
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   issuer.URL,
+			"jwks_uri": issuer.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(service.JSONWebKeySet{Keys: []service.JSONWebKey{key.JSONWebKey()}})
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// claims returns the claims of a valid ID token for a user in some groups.
+func (issuer *fakeIssuer) claims(username string, groups ...string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":                issuer.URL,
+		"aud":                "pcbook",
+		"sub":                "sub-" + username,
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"iat":                time.Now().Unix(),
+		"preferred_username": username,
+		"groups":             groups,
+	}
+}
+
+func (issuer *fakeIssuer) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = issuer.keyID
+	signed, err := token.SignedString(issuer.key)
+	require.NoError(t, err)
+	return signed
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	argon2idPrefix     = "$argon2id$"
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+// PasswordHasher hashes passwords with an algorithm and its parameters.
+// The algorithm of a hash is identified by its prefix, so that checkPasswordHash
+// can check the hashes of any hasher.
+type PasswordHasher interface {
+	// Hash returns the hash of a password, with a new random salt.
+	Hash(password string) (string, error)
+	// NeedsRehash tells if a hash uses another algorithm or other parameters than the hasher.
+	NeedsRehash(hashedPassword string) bool
+}
+
+// BcryptHasher hashes passwords with bcrypt, whose hashes start with $2a$, $2b$ or $2y$.
+type BcryptHasher struct {
+	Cost int `yaml:"cost"`
+}
+
+// Hash returns the bcrypt hash of a password.
+func (hasher *BcryptHasher) Hash(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), hasher.Cost)
+	if err != nil {
+		return "", fmt.Errorf("cannot hash password: %w", err)
+	}
+	return string(hashedPassword), nil
+}
+
+// NeedsRehash tells if a hash is not a bcrypt hash of the cost of the hasher.
+func (hasher *BcryptHasher) NeedsRehash(hashedPassword string) bool {
+	cost, err := bcrypt.Cost([]byte(hashedPassword))
+	return err != nil || cost != hasher.Cost
+}
+
+// Argon2idHasher hashes passwords with argon2id, whose hashes have the PHC string format
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>.
+type Argon2idHasher struct {
+	Time    uint32 `yaml:"time"`    // the number of passes over the memory
+	Memory  uint32 `yaml:"memory"`  // the memory in KiB
+	Threads uint8  `yaml:"threads"` // the degree of parallelism
+}
+
+// Hash returns the argon2id hash of a password.
+func (hasher *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2idSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, hasher.Time, hasher.Memory, hasher.Threads, argon2idKeyLength)
+	hashedPassword := fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		hasher.Memory,
+		hasher.Time,
+		hasher.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+	return hashedPassword, nil
+}
+
+// NeedsRehash tells if a hash is not an argon2id hash of the parameters of the hasher.
+func (hasher *Argon2idHasher) NeedsRehash(hashedPassword string) bool {
+	params, _, _, err := parseArgon2idHash(hashedPassword)
+	return err != nil || *params != *hasher
+}
+
+// checkPasswordHash checks a password against a hash of any supported algorithm.
+func checkPasswordHash(hashedPassword string, password string) bool {
+	if !strings.HasPrefix(hashedPassword, argon2idPrefix) {
+		err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+		return err == nil
+	}
+
+	params, salt, key, err := parseArgon2idHash(hashedPassword)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// parseArgon2idHash returns the parameters, salt and key of an argon2id hash.
+func parseArgon2idHash(hashedPassword string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(hashedPassword, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, errors.New("not an argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+
+	params := &Argon2idHasher{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id key")
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// maxBcryptPasswordBytes is the length after which bcrypt ignores the rest of a password.
+	maxBcryptPasswordBytes   = 72
+	defaultMinPasswordLength = 1
+	defaultMaxPasswordLength = maxBcryptPasswordBytes
+)
+
+// PasswordPolicy configures the passwords that users can choose, and how they are hashed.
+// The hashes of other algorithms or parameters are still accepted, and replaced at the next login.
+type PasswordPolicy struct {
+	MinLength int      `yaml:"min_length"` // the minimum number of characters, 1 if not set
+	MaxLength int      `yaml:"max_length"` // the maximum number of characters, 72 if not set
+	DenyList  []string `yaml:"deny_list"`  // the common passwords that are rejected, whatever their case
+	// Algorithm is the algorithm of the new hashes, bcrypt or argon2id. It is bcrypt if not set.
+	Algorithm string         `yaml:"algorithm"`
+	Bcrypt    BcryptHasher   `yaml:"bcrypt"`   // the cost is bcrypt.DefaultCost if not set
+	Argon2id  Argon2idHasher `yaml:"argon2id"` // 1 pass over 64 MiB with 4 threads if not set
+}
+
+// DefaultPasswordPolicy returns the policy used without a password policy file,
+// which accepts any non-empty password that bcrypt can hash, with its default cost.
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength: defaultMinPasswordLength,
+		MaxLength: defaultMaxPasswordLength,
+		Algorithm: "bcrypt",
+		Bcrypt:    BcryptHasher{Cost: bcrypt.DefaultCost},
+		Argon2id:  Argon2idHasher{Time: 1, Memory: 64 * 1024, Threads: 4},
+	}
+}
+
+// LoadPasswordPolicy loads a password policy from a YAML or JSON file.
+func LoadPasswordPolicy(filename string) (*PasswordPolicy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read password policy file: %w", err)
+	}
+
+	policy, err := ParsePasswordPolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load password policy file %s: %w", filename, err)
+	}
+	return policy, nil
+}
+
+// ParsePasswordPolicy parses and validates a password policy, whose missing fields have their default value.
+func ParsePasswordPolicy(data []byte) (*PasswordPolicy, error) {
+	policy := DefaultPasswordPolicy()
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(policy)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode password policy: %w", err)
+	}
+
+	err = policy.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks that the lengths are consistent and that the hasher of the algorithm has valid parameters.
+func (policy *PasswordPolicy) Validate() error {
+	if policy.MinLength < 1 {
+		return fmt.Errorf("min_length must be at least 1")
+	}
+	if policy.MaxLength < policy.MinLength {
+		return fmt.Errorf("max_length must not be less than min_length")
+	}
+	for i, password := range policy.DenyList {
+		if password == "" {
+			return fmt.Errorf("deny list entry %d must not be empty", i+1)
+		}
+	}
+
+	switch policy.Algorithm {
+	case "bcrypt":
+		if policy.MaxLength > maxBcryptPasswordBytes {
+			return fmt.Errorf("max_length must not exceed %d with bcrypt", maxBcryptPasswordBytes)
+		}
+		if policy.Bcrypt.Cost < bcrypt.MinCost || policy.Bcrypt.Cost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case "argon2id":
+		if policy.Argon2id.Time < 1 || policy.Argon2id.Threads < 1 {
+			return fmt.Errorf("argon2id time and threads must be at least 1")
+		}
+		if policy.Argon2id.Memory < 8*uint32(policy.Argon2id.Threads) {
+			return fmt.Errorf("argon2id memory must be at least 8 KiB per thread")
+		}
+	default:
+		return fmt.Errorf("unknown password hash algorithm %q", policy.Algorithm)
+	}
+	return nil
+}
+
+// Check returns an error that tells the user why a password is rejected, or nil if it is accepted.
+func (policy *PasswordPolicy) Check(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		return fmt.Errorf("password must have at least %d characters", policy.MinLength)
+	}
+	if length > policy.MaxLength {
+		return fmt.Errorf("password must have at most %d characters", policy.MaxLength)
+	}
+	if policy.Algorithm == "bcrypt" && len(password) > maxBcryptPasswordBytes {
+		return fmt.Errorf("password must have at most %d bytes", maxBcryptPasswordBytes)
+	}
+	for _, denied := range policy.DenyList {
+		if strings.EqualFold(password, denied) {
+			return fmt.Errorf("password is too common")
+		}
+	}
+	return nil
+}
+
+// Hasher returns the hasher of the new hashes.
+func (policy *PasswordPolicy) Hasher() PasswordHasher {
+	if policy.Algorithm == "argon2id" {
+		return &policy.Argon2id
+	}
+	return &policy.Bcrypt
+}
@@ -0,0 +1,85 @@
+package service_test
+
+import (
+	"learngrpc/pcbook/service"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePasswordPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := service.ParsePasswordPolicy([]byte(`
+min_length: 10
+max_length: 128
+deny_list: [password123, qwertyuiop]
+algorithm: argon2id
+argon2id:
+  memory: 1024
+`))
+	require.NoError(t, err)
+	require.Equal(t, service.Argon2idHasher{Time: 1, Memory: 1024, Threads: 4}, policy.Argon2id)
+
+	require.NoError(t, policy.Check("correct horse battery"))
+	require.EqualError(t, policy.Check("short"), "password must have at least 10 characters")
+	require.EqualError(t, policy.Check(strings.Repeat("a", 129)), "password must have at most 128 characters")
+	require.EqualError(t, policy.Check("Password123"), "password is too common")
+
+	// with bcrypt, which ignores the bytes after the 72nd, a longer password is rejected
+	require.NoError(t, service.DefaultPasswordPolicy().Check(strings.Repeat("é", 36)))
+	require.Error(t, service.DefaultPasswordPolicy().Check(strings.Repeat("é", 37)))
+	require.Error(t, service.DefaultPasswordPolicy().Check(""))
+
+	invalid := []string{
+		"min_length: 0",
+		"min_length: 20\nmax_length: 10",
+		"max_length: 100",
+		"deny_list: ['']",
+		"algorithm: md5",
+		"bcrypt:\n  cost: 40",
+		"algorithm: argon2id\nargon2id:\n  time: 0",
+		"algorithm: argon2id\nargon2id:\n  memory: 16",
+		"unknown: true",
+	}
+	for _, data := range invalid {
+		_, err := service.ParsePasswordPolicy([]byte(data))
+		require.Error(t, err, data)
+	}
+}
+
+func TestPasswordHashers(t *testing.T) {
+	t.Parallel()
+
+	bcryptHasher := &service.BcryptHasher{Cost: 4}
+	argon2idHasher := &service.Argon2idHasher{Time: 1, Memory: 64, Threads: 1}
+
+	for _, hasher := range []service.PasswordHasher{bcryptHasher, argon2idHasher} {
+		user := &service.User{Username: "user1"}
+		require.NoError(t, user.SetPassword("secret", hasher))
+		require.True(t, user.IsCorrectPassword("secret"))
+		require.False(t, user.IsCorrectPassword("wrong"))
+		require.False(t, hasher.NeedsRehash(user.HashedPassword))
+
+		other := &service.User{Username: "user2"}
+		require.NoError(t, other.SetPassword("secret", hasher))
+		require.NotEqual(t, user.HashedPassword, other.HashedPassword, "hashes must be salted")
+	}
+
+	hashedPassword, err := argon2idHasher.Hash("secret")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hashedPassword, "$argon2id$v=19$m=64,t=1,p=1$"))
+	require.True(t, bcryptHasher.NeedsRehash(hashedPassword))
+	require.True(t, (&service.Argon2idHasher{Time: 2, Memory: 64, Threads: 1}).NeedsRehash(hashedPassword))
+
+	hashedPassword, err = bcryptHasher.Hash("secret")
+	require.NoError(t, err)
+	require.True(t, argon2idHasher.NeedsRehash(hashedPassword))
+	require.True(t, (&service.BcryptHasher{Cost: 5}).NeedsRehash(hashedPassword))
+
+	for _, hashedPassword := range []string{"", "secret", "$argon2id$v=19$m=64,t=1,p=1$c2FsdA", "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5"} {
+		user := &service.User{Username: "user1", HashedPassword: hashedPassword}
+		require.False(t, user.IsCorrectPassword("secret"), hashedPassword)
+	}
+}
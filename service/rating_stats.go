@@ -0,0 +1,82 @@
+package service
+
+import (
+	"math"
+	"sort"
+)
+
+// bayesianPriorWeight is the number of virtual ratings at the mean score of all laptops
+// that are added to a laptop's own ratings to compute its Bayesian score.
+// It keeps a laptop with a single high score from ranking above well-established ones.
+const bayesianPriorWeight = 5
+
+// RatingStats describes the distribution of the scores of a laptop.
+type RatingStats struct {
+	Count         uint32
+	Average       float64
+	Median        float64
+	BayesianScore float64
+	Histogram     []RatingBucket
+}
+
+// RatingBucket counts the scores s with Score <= s < Score+1.
+// The bucket of the maximum score also counts the maximum score itself.
+type RatingBucket struct {
+	Score float64
+	Count uint32
+}
+
+// computeRatingStats computes the statistics of the scores of a laptop.
+// priorMean is the mean score of all laptops, used for the Bayesian score.
+func computeRatingStats(scores []float64, scoreRange ScoreRange, priorMean float64) *RatingStats {
+	stats := &RatingStats{
+		Count: uint32(len(scores)),
+	}
+
+	// there is no histogram for a range that was not validated
+	minBucket := math.Floor(scoreRange.Min)
+	maxBucket := math.Floor(scoreRange.Max)
+	if scoreRange.ValidateRange() == nil {
+		for score := minBucket; score <= maxBucket; score++ {
+			stats.Histogram = append(stats.Histogram, RatingBucket{Score: score})
+		}
+	}
+
+	sum := 0.0
+	for _, score := range scores {
+		sum += score
+		bucket := int(math.Floor(score) - minBucket)
+		if bucket >= 0 && bucket < len(stats.Histogram) {
+			stats.Histogram[bucket].Count++
+		}
+	}
+
+	if len(scores) > 0 {
+		sorted := append([]float64(nil), scores...)
+		sort.Float64s(sorted)
+
+		middle := len(sorted) / 2
+		if len(sorted)%2 == 1 {
+			stats.Median = sorted[middle]
+		} else {
+			stats.Median = (sorted[middle-1] + sorted[middle]) / 2
+		}
+		stats.Average = sum / float64(len(scores))
+	}
+
+	stats.BayesianScore = bayesianScore(sum, len(scores), priorMean)
+
+	return stats
+}
+
+func bayesianScore(sum float64, count int, priorMean float64) float64 {
+	return (bayesianPriorWeight*priorMean + sum) / float64(bayesianPriorWeight+count)
+}
+
+// priorMean returns the mean score of all ratings, or the middle of the score range if there is none.
+func priorMean(total Rating, scoreRange ScoreRange) float64 {
+	if total.Count == 0 {
+		return (scoreRange.Min + scoreRange.Max) / 2
+	}
+	return total.Sum / float64(total.Count)
+}
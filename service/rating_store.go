@@ -1,10 +1,36 @@
 package service
 
-import "sync"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrInvalidScore is returned when a score is outside the accepted range.
+var ErrInvalidScore = errors.New("invalid score")
+
+// ErrRatingNotFound is returned when a user has not rated a laptop.
+var ErrRatingNotFound = errors.New("rating not found")
 
 // RatingStore is a store for storing laptop ratings.
 type RatingStore interface {
-	Add(laptopID string, score float64) (*Rating, error) // Add adds a new rating for a laptop
+	Add(laptopID string, username string, score float64) (*Rating, error) // Add adds or replaces the rating of a user for a laptop
+	Score(laptopID string, username string) (float64, error)              // Score returns the score given by a user to a laptop
+	Remove(laptopID string, username string) error                        // Remove removes the rating of a user for a laptop, if any
+	// AddFrom adds or replaces the rating of a user for a laptop given through a source, such as a review.
+	// The source of a rating given directly is empty.
+	AddFrom(laptopID string, username string, source string, score float64) (*Rating, error)
+	// RemoveFrom removes the rating of a user for a laptop if it was given through the source
+	RemoveFrom(laptopID string, username string, source string) error
+	Stats(laptopID string) (*RatingStats, error)                          // Stats returns the score distribution of a laptop
+	// TopRated calls found for the laptops with at least minCount ratings, by decreasing Bayesian score
+	TopRated(minCount uint32, found func(rank *LaptopRank) error) error
+	// Trending calls found for the laptops with at least minCount ratings since the given time,
+	// by decreasing number of ratings since then
+	Trending(since time.Time, minCount uint32, found func(rank *LaptopRank) error) error
 }
 
 // Rating is a laptop rating.
@@ -13,37 +39,441 @@ type Rating struct {
 	Sum float64
 }
 
+// LaptopRank is the position of a laptop in a ranking.
+type LaptopRank struct {
+	LaptopID string
+	Score    float64
+	Count    uint32
+}
+
+// ScoreRange is the inclusive range of accepted scores.
+type ScoreRange struct {
+	Min float64
+	Max float64
+}
+
+// DefaultScoreRange is the range of scores used by the clients.
+var DefaultScoreRange = ScoreRange{Min: 1, Max: 10}
+
+// maxScoreRangeBuckets is the maximum number of histogram buckets of a score range, one per integer score.
+const maxScoreRangeBuckets = 1000
+
+// ValidateRange returns an error if the range is empty, not finite, or spans more than
+// maxScoreRangeBuckets integer scores, whose histograms would be too large.
+func (scoreRange ScoreRange) ValidateRange() error {
+	if math.IsNaN(scoreRange.Min) || math.IsInf(scoreRange.Min, 0) || math.IsNaN(scoreRange.Max) || math.IsInf(scoreRange.Max, 0) {
+		return fmt.Errorf("score range %v to %v is not finite", scoreRange.Min, scoreRange.Max)
+	}
+	if scoreRange.Min >= scoreRange.Max {
+		return fmt.Errorf("minimum score %v is not below maximum score %v", scoreRange.Min, scoreRange.Max)
+	}
+	if math.Floor(scoreRange.Max)-math.Floor(scoreRange.Min) >= maxScoreRangeBuckets {
+		return fmt.Errorf("score range %v to %v spans more than %d integer scores", scoreRange.Min, scoreRange.Max, maxScoreRangeBuckets)
+	}
+	return nil
+}
+
+// Validate returns an error wrapping ErrInvalidScore if the score is NaN or outside the range.
+func (scoreRange ScoreRange) Validate(score float64) error {
+	if math.IsNaN(score) || score < scoreRange.Min || score > scoreRange.Max {
+		return fmt.Errorf("%w: %v is not between %v and %v", ErrInvalidScore, score, scoreRange.Min, scoreRange.Max)
+	}
+	return nil
+}
+
 // InMemoryRatingStore is an in-memory store for storing laptop ratings.
 type InMemoryRatingStore struct {
 	mutex   sync.RWMutex
+	scoreRange ScoreRange
 	ratings map[string]*Rating
+	scores  map[string]map[string]*userRating // laptop ID -> username -> rating
+	total   Rating                            // all ratings of all laptops
+
+	// history holds the ratings of the last maxTrendingWindow ordered by time, so that recent ratings
+	// are found by binary search. It also holds up to as many replaced or removed ratings, which are
+	// skipped and pruned with the expired ones once they make up half of the history.
+	history      []*userRating
+	staleHistory int // number of replaced or removed ratings in history
+
+	// ranked is the ranking by decreasing Bayesian score with the prior mean rankingMean, where a rating
+	// only moves the rank of its laptop. It is replaced instead of changed, so it can be read without the lock.
+	// ranks holds the current rank of each laptop, to find it in ranked.
+	ranked      []*LaptopRank
+	ranks       map[string]*LaptopRank
+	rankingMean float64
 }
 
-// NewInMemoryRatingStore creates a new InMemoryRatingStore.
-func NewInMemoryRatingStore() *InMemoryRatingStore {
+// userRating is the score given by a user to a laptop.
+type userRating struct {
+	laptopID string
+	username string
+	score    float64
+	ratedAt  time.Time
+	source   string // what the score was given through, empty for a direct rating
+}
+
+// rankingMeanTolerance is the fraction of the score range by which the mean of all ratings can move
+// before the ranking is rebuilt with the new prior mean. Each rating moves the mean by less than the
+// range divided by the number of ratings, so the ranking is rebuilt less and less often.
+const rankingMeanTolerance = 0.01
+
+// NewInMemoryRatingStore creates a new InMemoryRatingStore that accepts scores within scoreRange.
+func NewInMemoryRatingStore(scoreRange ScoreRange) *InMemoryRatingStore {
 	return &InMemoryRatingStore{
+		scoreRange: scoreRange,
 		ratings: make(map[string]*Rating),
+		scores:  make(map[string]map[string]*userRating),
+		ranks:   make(map[string]*LaptopRank),
+		rankingMean: priorMean(Rating{}, scoreRange),
 	}
 }
 
-// Add adds a new rating for a laptop.
-func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating, error) {
+// Add adds the rating of a user for a laptop, and returns a copy of the new rating of the laptop.
+// If the user has already rated the laptop, the previous score is replaced.
+func (store *InMemoryRatingStore) Add(laptopID string, username string, score float64) (*Rating, error) {
+	return store.AddFrom(laptopID, username, "", score)
+}
+
+// AddFrom adds the rating of a user for a laptop given through a source, and returns a copy of
+// the new rating of the laptop. If the user has already rated the laptop, the previous score is replaced,
+// whatever its source.
+func (store *InMemoryRatingStore) AddFrom(laptopID string, username string, source string, score float64) (*Rating, error) {
+	err := store.scoreRange.Validate(score)
+	if err != nil {
+		return nil, err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
+	return store.add(laptopID, username, source, score, time.Now()), nil
+}
+
+// add adds a rating given at ratedAt, which must not be before any previous rating.
+// The caller must hold the write lock.
+func (store *InMemoryRatingStore) add(laptopID string, username string, source string, score float64, ratedAt time.Time) *Rating {
+	userScores := store.scores[laptopID]
+	if userScores == nil {
+		userScores = make(map[string]*userRating)
+		store.scores[laptopID] = userScores
+	}
+
 	rating := store.ratings[laptopID]
 	if rating == nil {
-		 rating = &Rating{
-			Count: 1,
-			Sum: score,
-		 }	
+		rating = &Rating{}
+	}
+
+	previous := userScores[username]
+	if previous != nil {
+		rating.Sum += score - previous.score
+		store.total.Sum += score - previous.score
+		store.staleHistory++
 	} else {
 		rating.Count++
 		rating.Sum += score
-	} 
-	
+		store.total.Count++
+		store.total.Sum += score
+	}
+
+	current := &userRating{
+		laptopID: laptopID,
+		username: username,
+		score:    score,
+		ratedAt:  ratedAt,
+		source:   source,
+	}
+	userScores[username] = current
+	store.history = append(store.history, current)
+	store.pruneHistory(ratedAt)
+
 	store.ratings[laptopID] = rating
+	store.rerank(laptopID)
+
+	// the stored rating keeps changing after the lock is released
+	other := *rating
+	return &other
+}
+
+// Score returns the score given by a user to a laptop, or ErrRatingNotFound.
+func (store *InMemoryRatingStore) Score(laptopID string, username string) (float64, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	rating := store.scores[laptopID][username]
+	if rating == nil {
+		return 0, ErrRatingNotFound
+	}
+	return rating.score, nil
+}
+
+// Remove removes the rating of a user for a laptop, if any.
+func (store *InMemoryRatingStore) Remove(laptopID string, username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.remove(laptopID, username)
+	return nil
+}
+
+// RemoveFrom removes the rating of a user for a laptop if it was given through the source.
+// A rating that has since been replaced through another source is kept.
+func (store *InMemoryRatingStore) RemoveFrom(laptopID string, username string, source string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	rating := store.scores[laptopID][username]
+	if rating != nil && rating.source == source {
+		store.remove(laptopID, username)
+	}
+	return nil
+}
+
+// ratingSource returns the source of the rating of a user for a laptop, or ErrRatingNotFound.
+func (store *InMemoryRatingStore) ratingSource(laptopID string, username string) (string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	rating := store.scores[laptopID][username]
+	if rating == nil {
+		return "", ErrRatingNotFound
+	}
+	return rating.source, nil
+}
+
+// remove removes a rating. The caller must hold the write lock.
+func (store *InMemoryRatingStore) remove(laptopID string, username string) {
+	previous := store.scores[laptopID][username]
+	if previous == nil {
+		return
+	}
+	delete(store.scores[laptopID], username)
+	store.staleHistory++
+
+	rating := store.ratings[laptopID]
+	rating.Count--
+	rating.Sum -= previous.score
+	store.total.Count--
+	store.total.Sum -= previous.score
+	if rating.Count == 0 {
+		delete(store.ratings, laptopID)
+		delete(store.scores, laptopID)
+	}
+
+	store.rerank(laptopID)
+}
+
+// pruneHistory drops the ratings given before the trending window ending at now, and the replaced
+// or removed ones, once they make up half of the history. As at least a quarter of the history is
+// then dropped, the history is only copied every so many ratings. The caller must hold the write lock.
+func (store *InMemoryRatingStore) pruneHistory(now time.Time) {
+	expired := sort.Search(len(store.history), func(i int) bool {
+		return !store.history[i].ratedAt.Before(now.Add(-maxTrendingWindow))
+	})
+	if (expired+store.staleHistory)*2 <= len(store.history) {
+		return
+	}
+
+	history := make([]*userRating, 0, len(store.history)-expired)
+	for _, rating := range store.history[expired:] {
+		if store.isCurrent(rating) {
+			history = append(history, rating)
+		}
+	}
+	store.history = history
+	store.staleHistory = 0
+}
+
+// isCurrent reports whether a rating of the history has not been replaced or removed since.
+// The caller must hold the lock.
+func (store *InMemoryRatingStore) isCurrent(rating *userRating) bool {
+	return store.scores[rating.laptopID][rating.username] == rating
+}
+
+// currentRatings returns the current ratings of all laptops ordered by time.
+// The caller must hold the lock.
+func (store *InMemoryRatingStore) currentRatings() []*userRating {
+	ratings := make([]*userRating, 0, store.total.Count)
+	for _, userScores := range store.scores {
+		for _, rating := range userScores {
+			ratings = append(ratings, rating)
+		}
+	}
+	sort.Slice(ratings, func(i, j int) bool {
+		return ratings[i].ratedAt.Before(ratings[j].ratedAt)
+	})
+	return ratings
+}
+
+// Stats returns the score distribution of a laptop.
+// A laptop without ratings has a zero count and the Bayesian score of the mean of all laptops.
+func (store *InMemoryRatingStore) Stats(laptopID string) (*RatingStats, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	scores := make([]float64, 0, len(store.scores[laptopID]))
+	for _, rating := range store.scores[laptopID] {
+		scores = append(scores, rating.score)
+	}
+
+	return computeRatingStats(scores, store.scoreRange, priorMean(store.total, store.scoreRange)), nil
+}
+
+// TopRated calls found for the laptops with at least minCount ratings, by decreasing Bayesian score.
+// The prior mean of the ranking is only updated once the mean of all ratings moved by more than
+// rankingMeanTolerance of the score range, so the scores can differ that much from the ones of Stats.
+// Iteration stops at the first error returned by found, which is returned.
+func (store *InMemoryRatingStore) TopRated(minCount uint32, found func(rank *LaptopRank) error) error {
+	store.mutex.RLock()
+	ranked := store.ranked
+	store.mutex.RUnlock()
+
+	for _, rank := range ranked {
+		if rank.Count < minCount {
+			continue
+		}
+
+		other := *rank
+		err := found(&other)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rerank moves a laptop to the rank of its current rating, or removes it if it has none.
+// The whole ranking is only rebuilt when the prior mean has moved too far.
+// The caller must hold the write lock.
+func (store *InMemoryRatingStore) rerank(laptopID string) {
+	mean := priorMean(store.total, store.scoreRange)
+	if math.Abs(mean-store.rankingMean) > rankingMeanTolerance*(store.scoreRange.Max-store.scoreRange.Min) {
+		store.rebuildRanking(mean)
+		return
+	}
+
+	// the ranking is copied, since it can be read without the lock
+	ranked := make([]*LaptopRank, 0, len(store.ranked)+1)
+	previous := store.ranks[laptopID]
+	if previous != nil {
+		i := sort.Search(len(store.ranked), func(i int) bool {
+			return !rankedBefore(store.ranked[i], previous)
+		})
+		ranked = append(ranked, store.ranked[:i]...)
+		ranked = append(ranked, store.ranked[i+1:]...)
+		delete(store.ranks, laptopID)
+	} else {
+		ranked = append(ranked, store.ranked...)
+	}
+
+	rating := store.ratings[laptopID]
+	if rating != nil {
+		rank := &LaptopRank{
+			LaptopID: laptopID,
+			Score:    bayesianScore(rating.Sum, int(rating.Count), store.rankingMean),
+			Count:    rating.Count,
+		}
+		j := sort.Search(len(ranked), func(j int) bool {
+			return !rankedBefore(ranked[j], rank)
+		})
+		ranked = append(ranked, nil)
+		copy(ranked[j+1:], ranked[j:])
+		ranked[j] = rank
+		store.ranks[laptopID] = rank
+	}
+
+	store.ranked = ranked
+}
+
+// rebuildRanking ranks all laptops again with a new prior mean. The caller must hold the write lock.
+func (store *InMemoryRatingStore) rebuildRanking(mean float64) {
+	ranked := make([]*LaptopRank, 0, len(store.ratings))
+	ranks := make(map[string]*LaptopRank, len(store.ratings))
+	for laptopID, rating := range store.ratings {
+		rank := &LaptopRank{
+			LaptopID: laptopID,
+			Score:    bayesianScore(rating.Sum, int(rating.Count), mean),
+			Count:    rating.Count,
+		}
+		ranked = append(ranked, rank)
+		ranks[laptopID] = rank
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		return rankedBefore(ranked[i], ranked[j])
+	})
+
+	store.ranked = ranked
+	store.ranks = ranks
+	store.rankingMean = mean
+}
+
+// rankedBefore tells whether a rank comes before another one in the ranking by Bayesian score,
+// where the ties are broken by the number of ratings and then by laptop ID.
+func rankedBefore(rank *LaptopRank, other *LaptopRank) bool {
+	if rank.Score != other.Score {
+		return rank.Score > other.Score
+	}
+	if rank.Count != other.Count {
+		return rank.Count > other.Count
+	}
+	return rank.LaptopID < other.LaptopID
+}
+
+// Trending calls found for the laptops with at least minCount ratings since the given time,
+// by decreasing number of ratings since then. The score of a rank is the average of these ratings.
+// Ratings that were later replaced by the same user are not counted,
+// nor are the ratings given before the last maxTrendingWindow, which are no longer kept.
+// Iteration stops at the first error returned by found, which is returned.
+func (store *InMemoryRatingStore) Trending(since time.Time, minCount uint32, found func(rank *LaptopRank) error) error {
+	store.mutex.RLock()
+
+	start := sort.Search(len(store.history), func(i int) bool {
+		return !store.history[i].ratedAt.Before(since)
+	})
 
-	return rating, nil
+	recent := make(map[string]*Rating)
+	for _, rating := range store.history[start:] {
+		if !store.isCurrent(rating) {
+			continue
+		}
+
+		sum := recent[rating.laptopID]
+		if sum == nil {
+			sum = &Rating{}
+			recent[rating.laptopID] = sum
+		}
+		sum.Count++
+		sum.Sum += rating.score
+	}
+
+	store.mutex.RUnlock()
+
+	ranked := make([]*LaptopRank, 0, len(recent))
+	for laptopID, sum := range recent {
+		if sum.Count < minCount {
+			continue
+		}
+		ranked = append(ranked, &LaptopRank{
+			LaptopID: laptopID,
+			Score:    sum.Sum / float64(sum.Count),
+			Count:    sum.Count,
+		})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].LaptopID < ranked[j].LaptopID
+	})
+
+	for _, rank := range ranked {
+		err := found(rank)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
@@ -0,0 +1,78 @@
+package service_test
+
+import (
+	"fmt"
+	"learngrpc/pcbook/service"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryRatingStoreTopRated(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryRatingStore(service.DefaultScoreRange)
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		laptopID := fmt.Sprintf("laptop%d", random.Intn(50))
+		username := fmt.Sprintf("user%d", random.Intn(20))
+		if random.Intn(10) == 0 {
+			require.NoError(t, store.Remove(laptopID, username))
+			continue
+		}
+		_, err := store.Add(laptopID, username, float64(1+random.Intn(10)))
+		require.NoError(t, err)
+	}
+
+	// every rated laptop is ranked once, in order, with its current count and about its Bayesian score
+	var ranked []*service.LaptopRank
+	err := store.TopRated(0, func(rank *service.LaptopRank) error {
+		ranked = append(ranked, rank)
+		return nil
+	})
+	require.NoError(t, err)
+
+	seen := make(map[string]bool)
+	for i, rank := range ranked {
+		require.False(t, seen[rank.LaptopID])
+		seen[rank.LaptopID] = true
+		if i > 0 {
+			require.GreaterOrEqual(t, ranked[i-1].Score, rank.Score)
+		}
+
+		stats, err := store.Stats(rank.LaptopID)
+		require.NoError(t, err)
+		require.Equal(t, stats.Count, rank.Count)
+		require.Less(t, math.Abs(stats.BayesianScore-rank.Score), 0.1)
+	}
+	for i := 0; i < 50; i++ {
+		stats, err := store.Stats(fmt.Sprintf("laptop%d", i))
+		require.NoError(t, err)
+		require.Equal(t, stats.Count > 0, seen[fmt.Sprintf("laptop%d", i)])
+	}
+}
+
+func TestScoreRangeValidateRange(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, service.DefaultScoreRange.ValidateRange())
+	require.NoError(t, service.ScoreRange{Min: 0, Max: 100}.ValidateRange())
+	require.NoError(t, service.ScoreRange{Min: 0.5, Max: 1}.ValidateRange())
+
+	require.Error(t, service.ScoreRange{Min: 5, Max: 5}.ValidateRange())
+	require.Error(t, service.ScoreRange{Min: 10, Max: 1}.ValidateRange())
+	require.Error(t, service.ScoreRange{Min: 0, Max: 1e9}.ValidateRange())
+	require.Error(t, service.ScoreRange{Min: math.Inf(-1), Max: 10}.ValidateRange())
+	require.Error(t, service.ScoreRange{Min: 1, Max: math.NaN()}.ValidateRange())
+
+	// a store with an unbounded range has no histogram
+	store := service.NewInMemoryRatingStore(service.ScoreRange{Min: 0, Max: 1e9})
+	_, err := store.Add("laptop1", "user1", 5e8)
+	require.NoError(t, err)
+	stats, err := store.Stats("laptop1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), stats.Count)
+	require.Empty(t, stats.Histogram)
+}
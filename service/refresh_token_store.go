@@ -0,0 +1,188 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrRefreshTokenNotFound is returned when a refresh token does not exist, has expired or was revoked.
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+// ErrRefreshTokenReused is returned when a refresh token that was already rotated is used again.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// RefreshToken is a single-use token to get a new token pair.
+// The tokens rotated from the same login form a family, identified by FamilyID.
+type RefreshToken struct {
+	Token     string // only set when the token is issued, the store keeps a hash of it
+	Username  string
+	FamilyID  string
+	MFA       bool // if the login of the family passed two-factor authentication
+	ExpiresAt time.Time
+}
+
+// RefreshTokenStore is a store for refresh tokens.
+type RefreshTokenStore interface {
+	// Issue issues the first refresh token of a new family for a user,
+	// which logged in with two-factor authentication if mfa is true.
+	Issue(username string, mfa bool) (*RefreshToken, error)
+	// Rotate uses a refresh token and issues the next token of its family.
+	// If the token was already used, the whole family is revoked, and the used token
+	// is returned with ErrRefreshTokenReused so that the caller knows which family it was.
+	Rotate(token string) (*RefreshToken, error)
+	// RevokeFamily revokes all the tokens of a family.
+	RevokeFamily(familyID string) error
+	// RevokeUser revokes all the token families of a user, and returns the IDs of those that were not
+	// revoked or expired yet, so that the access tokens of these sessions can be revoked too.
+	RevokeUser(username string) ([]string, error)
+}
+
+// InMemoryRefreshTokenStore is an in-memory store for refresh tokens.
+type InMemoryRefreshTokenStore struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	tokens   map[string]*refreshTokenEntry // by token hash
+	families map[string]*refreshTokenFamily
+}
+
+type refreshTokenEntry struct {
+	RefreshToken
+	used bool
+}
+
+type refreshTokenFamily struct {
+	username  string
+	revoked   bool
+	mfa       bool
+	expiresAt time.Time // when the last token of the family expires
+	hashes    []string
+}
+
+// NewInMemoryRefreshTokenStore creates a new InMemoryRefreshTokenStore whose tokens expire after ttl.
+func NewInMemoryRefreshTokenStore(ttl time.Duration) *InMemoryRefreshTokenStore {
+	return &InMemoryRefreshTokenStore{
+		ttl:      ttl,
+		tokens:   make(map[string]*refreshTokenEntry),
+		families: make(map[string]*refreshTokenFamily),
+	}
+}
+
+// Issue issues the first refresh token of a new family for a user.
+func (store *InMemoryRefreshTokenStore) Issue(username string, mfa bool) (*RefreshToken, error) {
+	familyID, err := randomString(16)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate token family id: %w", err)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.sweep()
+	store.families[familyID] = &refreshTokenFamily{username: username, mfa: mfa}
+	return store.issue(username, familyID)
+}
+
+// Rotate uses a refresh token and issues the next token of its family.
+func (store *InMemoryRefreshTokenStore) Rotate(token string) (*RefreshToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entry := store.tokens[hashRefreshToken(token)]
+	if entry == nil || time.Now().After(entry.ExpiresAt) {
+		return nil, ErrRefreshTokenNotFound
+	}
+
+	family := store.families[entry.FamilyID]
+	if family.revoked {
+		return nil, ErrRefreshTokenNotFound
+	}
+
+	if entry.used {
+		family.revoked = true
+		used := entry.RefreshToken
+		return &used, ErrRefreshTokenReused
+	}
+
+	entry.used = true
+	return store.issue(entry.Username, entry.FamilyID)
+}
+
+// RevokeFamily revokes all the tokens of a family.
+func (store *InMemoryRefreshTokenStore) RevokeFamily(familyID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	family := store.families[familyID]
+	if family != nil {
+		family.revoked = true
+	}
+	return nil
+}
+
+// RevokeUser revokes all the token families of a user, and returns the IDs of those that were active.
+func (store *InMemoryRefreshTokenStore) RevokeUser(username string) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.sweep()
+
+	var familyIDs []string
+	for familyID, family := range store.families {
+		if family.username != username || family.revoked {
+			continue
+		}
+		family.revoked = true
+		familyIDs = append(familyIDs, familyID)
+	}
+	return familyIDs, nil
+}
+
+// issue adds a new token to an existing family. The caller must hold the lock.
+func (store *InMemoryRefreshTokenStore) issue(username string, familyID string) (*RefreshToken, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate refresh token: %w", err)
+	}
+
+	family := store.families[familyID]
+	entry := &refreshTokenEntry{
+		RefreshToken: RefreshToken{
+			Username:  username,
+			FamilyID:  familyID,
+			MFA:       family.mfa,
+			ExpiresAt: time.Now().Add(store.ttl),
+		},
+	}
+
+	hash := hashRefreshToken(token)
+	store.tokens[hash] = entry
+
+	family.expiresAt = entry.ExpiresAt
+	family.hashes = append(family.hashes, hash)
+
+	issued := entry.RefreshToken
+	issued.Token = token
+	return &issued, nil
+}
+
+// sweep deletes the families whose tokens have all expired. The caller must hold the lock.
+func (store *InMemoryRefreshTokenStore) sweep() {
+	now := time.Now()
+	for familyID, family := range store.families {
+		if now.After(family.expiresAt) {
+			for _, hash := range family.hashes {
+				delete(store.tokens, hash)
+			}
+			delete(store.families, familyID)
+		}
+	}
+}
+
+func hashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,528 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"learngrpc/pcbook/pb"
+	"log"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	maxReviewTitleLength  = 200
+	maxReviewBodyLength   = 10000
+	maxReviewListItems    = 10
+	maxReviewItemLength   = 200
+	defaultReviewPageSize = 20
+	maxReviewPageSize     = 100
+	maxReportReasonLength = 500
+)
+
+var moderationStates = map[ModerationState]pb.Review_ModerationState{
+	ModerationPending:  pb.Review_PENDING,
+	ModerationApproved: pb.Review_APPROVED,
+	ModerationRejected: pb.Review_REJECTED,
+	ModerationFlagged:  pb.Review_FLAGGED,
+}
+
+// ReviewServer is the server for the laptop review service.
+// The score of a review is the rating of its author for the laptop, given through the review,
+// so that reviews and the rating aggregate never disagree. It replaces any earlier rating of the author,
+// and a later RateLaptop call replaces it in turn. Rejected reviews do not count in the aggregate.
+// New and edited reviews wait for a moderator, and only approved reviews are listed publicly.
+type ReviewServer struct {
+	mutex       sync.Mutex // serializes the changes of reviews and of their ratings
+	reviewStore ReviewStore
+	laptopStore LaptopStore
+	ratingStore RatingStore
+	wordFilter  *BannedWordFilter
+	pb.UnimplementedReviewServiceServer
+}
+
+// NewReviewServer creates a new ReviewServer.
+// Reviews containing a word of wordFilter are flagged for the moderators. wordFilter may be nil.
+func NewReviewServer(reviewStore ReviewStore, laptopStore LaptopStore, ratingStore RatingStore, wordFilter *BannedWordFilter) *ReviewServer {
+	return &ReviewServer{
+		reviewStore: reviewStore,
+		laptopStore: laptopStore,
+		ratingStore: ratingStore,
+		wordFilter:  wordFilter,
+	}
+}
+
+// CreateReview is a unary RPC to post the review of the caller for a laptop.
+func (server *ReviewServer) CreateReview(ctx context.Context, req *pb.CreateReviewRequest) (*pb.CreateReviewResponse, error) {
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "user claims are not provided"))
+	}
+
+	laptopID := req.GetLaptopId()
+	log.Printf("received a create-review request for laptop %s from %s", laptopID, claims.Username)
+
+	content := ReviewContent{
+		Title: req.GetTitle(),
+		Body:  req.GetBody(),
+		Score: req.GetScore(),
+		Pros:  req.GetPros(),
+		Cons:  req.GetCons(),
+	}
+	err := validateReviewContent(content)
+	if err != nil {
+		return nil, err
+	}
+
+	laptop, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "laptop store internal error: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop not found: %v", laptopID))
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	review, err := server.reviewStore.Create(laptopID, claims.Username, content, server.moderate(content))
+	if errors.Is(err, ErrReviewExists) {
+		return nil, logError(status.Errorf(codes.AlreadyExists, "user %s has already reviewed laptop %s", claims.Username, laptopID))
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot create review: %v", err))
+	}
+
+	_, err = server.ratingStore.AddFrom(laptopID, claims.Username, review.ID, content.Score)
+	if err != nil {
+		// the review is only kept if its score is accepted
+		deleteErr := server.reviewStore.Delete(review.ID)
+		if deleteErr != nil {
+			log.Printf("cannot delete review %s: %v", review.ID, deleteErr)
+		}
+		return nil, ratingError(err)
+	}
+
+	return &pb.CreateReviewResponse{Review: toPbReview(review)}, nil
+}
+
+// UpdateReview is a unary RPC to edit a review of the caller.
+func (server *ReviewServer) UpdateReview(ctx context.Context, req *pb.UpdateReviewRequest) (*pb.UpdateReviewResponse, error) {
+	content := ReviewContent{
+		Title: req.GetTitle(),
+		Body:  req.GetBody(),
+		Score: req.GetScore(),
+		Pros:  req.GetPros(),
+		Cons:  req.GetCons(),
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	review, err := server.findOwnReview(ctx, req.GetReviewId())
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateReviewContent(content)
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := server.reviewStore.Update(review.ID, content, server.moderate(content))
+	if errors.Is(err, ErrReviewNotFound) {
+		return nil, logError(status.Errorf(codes.NotFound, "review not found: %v", req.GetReviewId()))
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot update review: %v", err))
+	}
+
+	_, err = server.ratingStore.AddFrom(review.LaptopID, review.Username, review.ID, content.Score)
+	if err != nil {
+		// the review is only changed if its score is accepted
+		_, restoreErr := server.reviewStore.Update(review.ID, review.ReviewContent, review.Moderation)
+		if restoreErr != nil {
+			log.Printf("cannot restore review %s: %v", review.ID, restoreErr)
+		}
+		return nil, ratingError(err)
+	}
+
+	return &pb.UpdateReviewResponse{Review: toPbReview(updated)}, nil
+}
+
+// DeleteReview is a unary RPC to delete a review of the caller, with its rating.
+func (server *ReviewServer) DeleteReview(ctx context.Context, req *pb.DeleteReviewRequest) (*pb.DeleteReviewResponse, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	review, err := server.findOwnReview(ctx, req.GetReviewId())
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.reviewStore.Delete(review.ID)
+	if errors.Is(err, ErrReviewNotFound) {
+		return nil, logError(status.Errorf(codes.NotFound, "review not found: %v", req.GetReviewId()))
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot delete review: %v", err))
+	}
+
+	// a later RateLaptop call of the author is kept
+	err = server.ratingStore.RemoveFrom(review.LaptopID, review.Username, review.ID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "rating store internal error: %v", err))
+	}
+
+	return &pb.DeleteReviewResponse{}, nil
+}
+
+// ListReviews is a unary RPC to list the reviews of a laptop page by page.
+func (server *ReviewServer) ListReviews(ctx context.Context, req *pb.ListReviewsRequest) (*pb.ListReviewsResponse, error) {
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultReviewPageSize
+	}
+	if pageSize > maxReviewPageSize {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "page size must not exceed %d", maxReviewPageSize))
+	}
+
+	offset, err := decodePageToken(req.GetPageToken())
+	if err != nil {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "page token is invalid"))
+	}
+
+	order := ReviewOrderNewest
+	if req.GetOrder() == pb.ListReviewsRequest_MOST_HELPFUL {
+		order = ReviewOrderMostHelpful
+	}
+
+	reviews, total, err := server.reviewStore.List(req.GetLaptopId(), ModerationApproved, order, offset, pageSize)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot list reviews: %v", err))
+	}
+
+	res := &pb.ListReviewsResponse{}
+	for _, review := range reviews {
+		// a later RateLaptop call of the author replaces the score of the review
+		score, err := server.ratingStore.Score(review.LaptopID, review.Username)
+		if err == nil {
+			review.Score = score
+		} else if !errors.Is(err, ErrRatingNotFound) {
+			return nil, logError(status.Errorf(codes.Internal, "rating store internal error: %v", err))
+		}
+		res.Reviews = append(res.Reviews, toPbReview(review))
+	}
+	if offset+len(reviews) < total {
+		res.NextPageToken = encodePageToken(offset + len(reviews))
+	}
+
+	return res, nil
+}
+
+// VoteReviewHelpful is a unary RPC to vote that a review of another user is helpful, or to withdraw the vote.
+func (server *ReviewServer) VoteReviewHelpful(ctx context.Context, req *pb.VoteReviewHelpfulRequest) (*pb.VoteReviewHelpfulResponse, error) {
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "user claims are not provided"))
+	}
+
+	review, err := server.findPublicReview(req.GetReviewId())
+	if err != nil {
+		return nil, err
+	}
+	if review.Username == claims.Username {
+		return nil, logError(status.Errorf(codes.PermissionDenied, "cannot vote for your own review"))
+	}
+
+	review, err = server.reviewStore.Vote(review.ID, claims.Username, req.GetHelpful())
+	if errors.Is(err, ErrReviewNotFound) {
+		return nil, logError(status.Errorf(codes.NotFound, "review not found: %v", req.GetReviewId()))
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot vote for review: %v", err))
+	}
+
+	res := &pb.VoteReviewHelpfulResponse{
+		ReviewId:     review.ID,
+		HelpfulCount: review.HelpfulCount,
+	}
+	return res, nil
+}
+
+// ReportReview is a unary RPC to report a review of another user to the moderators.
+// The review is hidden until a moderator approves it again.
+func (server *ReviewServer) ReportReview(ctx context.Context, req *pb.ReportReviewRequest) (*pb.ReportReviewResponse, error) {
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "user claims are not provided"))
+	}
+
+	if req.GetReason() == "" || len(req.GetReason()) > maxReportReasonLength {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "reason must have 1 to %d characters", maxReportReasonLength))
+	}
+
+	review, err := server.findPublicReview(req.GetReviewId())
+	if err != nil {
+		return nil, err
+	}
+	if review.Username == claims.Username {
+		return nil, logError(status.Errorf(codes.PermissionDenied, "cannot report your own review"))
+	}
+
+	_, err = server.reviewStore.Report(review.ID, claims.Username, req.GetReason())
+	if errors.Is(err, ErrReviewNotFound) {
+		return nil, logError(status.Errorf(codes.NotFound, "review not found: %v", req.GetReviewId()))
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot report review: %v", err))
+	}
+	log.Printf("review %s was reported by %s", review.ID, claims.Username)
+
+	return &pb.ReportReviewResponse{}, nil
+}
+
+// ListModerationQueue is a unary RPC to list the reviews waiting for a moderator, oldest first.
+func (server *ReviewServer) ListModerationQueue(ctx context.Context, req *pb.ListModerationQueueRequest) (*pb.ListModerationQueueResponse, error) {
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultReviewPageSize
+	}
+	if pageSize > maxReviewPageSize {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "page size must not exceed %d", maxReviewPageSize))
+	}
+
+	offset, err := decodePageToken(req.GetPageToken())
+	if err != nil {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "page token is invalid"))
+	}
+
+	states := []ModerationState{ModerationPending, ModerationFlagged}
+	if len(req.GetStates()) > 0 {
+		states = nil
+		for _, pbState := range req.GetStates() {
+			state, ok := toModerationState(pbState)
+			if !ok {
+				return nil, logError(status.Errorf(codes.InvalidArgument, "unknown moderation state: %v", pbState))
+			}
+			states = append(states, state)
+		}
+	}
+
+	reviews, total, err := server.reviewStore.Queue(states, offset, pageSize)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot list moderation queue: %v", err))
+	}
+
+	res := &pb.ListModerationQueueResponse{}
+	for _, review := range reviews {
+		res.Reviews = append(res.Reviews, toPbReview(review))
+	}
+	if offset+len(reviews) < total {
+		res.NextPageToken = encodePageToken(offset + len(reviews))
+	}
+
+	return res, nil
+}
+
+// ModerateReview is a unary RPC to approve or reject a review.
+func (server *ReviewServer) ModerateReview(ctx context.Context, req *pb.ModerateReviewRequest) (*pb.ModerateReviewResponse, error) {
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "user claims are not provided"))
+	}
+
+	var reason string
+	switch req.GetState() {
+	case pb.Review_APPROVED:
+		reason = "approved by " + claims.Username
+	case pb.Review_REJECTED:
+		reason = "rejected by " + claims.Username
+	default:
+		return nil, logError(status.Errorf(codes.InvalidArgument, "state must be APPROVED or REJECTED"))
+	}
+	if req.GetReason() != "" {
+		reason = fmt.Sprintf("%s: %s", reason, req.GetReason())
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	previous, err := server.reviewStore.Find(req.GetReviewId())
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find review: %v", err))
+	}
+	if previous == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "review not found: %v", req.GetReviewId()))
+	}
+
+	state, _ := toModerationState(req.GetState())
+	review, err := server.reviewStore.Moderate(previous.ID, Moderation{State: state, Reason: reason})
+	if errors.Is(err, ErrReviewNotFound) {
+		return nil, logError(status.Errorf(codes.NotFound, "review not found: %v", req.GetReviewId()))
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot moderate review: %v", err))
+	}
+	log.Printf("review %s was %s", review.ID, reason)
+
+	err = server.countReviewScore(previous, review)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "rating store internal error: %v", err))
+	}
+
+	return &pb.ModerateReviewResponse{Review: toPbReview(review)}, nil
+}
+
+// countReviewScore removes the score of a review from the rating aggregate when it is rejected,
+// and adds it back when it is approved again, unless its author has rated the laptop since.
+// The caller must hold the lock.
+func (server *ReviewServer) countReviewScore(previous *Review, review *Review) error {
+	if review.State == ModerationRejected {
+		return server.ratingStore.RemoveFrom(review.LaptopID, review.Username, review.ID)
+	}
+	if previous.State != ModerationRejected {
+		return nil
+	}
+
+	_, err := server.ratingStore.Score(review.LaptopID, review.Username)
+	if !errors.Is(err, ErrRatingNotFound) {
+		return err
+	}
+	_, err = server.ratingStore.AddFrom(review.LaptopID, review.Username, review.ID, review.Score)
+	return err
+}
+
+// moderate returns the moderation state of new content.
+func (server *ReviewServer) moderate(content ReviewContent) Moderation {
+	texts := append([]string{content.Title, content.Body}, content.Pros...)
+	texts = append(texts, content.Cons...)
+
+	word, found := server.wordFilter.Find(texts...)
+	if found {
+		return Moderation{
+			State:  ModerationFlagged,
+			Reason: fmt.Sprintf("contains banned word %q", word),
+		}
+	}
+	return Moderation{State: ModerationPending}
+}
+
+// findPublicReview finds a review that is listed publicly.
+func (server *ReviewServer) findPublicReview(reviewID string) (*Review, error) {
+	review, err := server.reviewStore.Find(reviewID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find review: %v", err))
+	}
+	if review == nil || review.State != ModerationApproved {
+		return nil, logError(status.Errorf(codes.NotFound, "review not found: %v", reviewID))
+	}
+	return review, nil
+}
+
+// findOwnReview finds a review that was written by the caller.
+func (server *ReviewServer) findOwnReview(ctx context.Context, reviewID string) (*Review, error) {
+	claims, ok := UserClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "user claims are not provided"))
+	}
+
+	review, err := server.reviewStore.Find(reviewID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find review: %v", err))
+	}
+	if review == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "review not found: %v", reviewID))
+	}
+	if review.Username != claims.Username {
+		return nil, logError(status.Errorf(codes.PermissionDenied, "review %s was written by another user", reviewID))
+	}
+
+	return review, nil
+}
+
+func validateReviewContent(content ReviewContent) error {
+	if content.Title == "" || len(content.Title) > maxReviewTitleLength {
+		return logError(status.Errorf(codes.InvalidArgument, "title must have 1 to %d characters", maxReviewTitleLength))
+	}
+	if len(content.Body) > maxReviewBodyLength {
+		return logError(status.Errorf(codes.InvalidArgument, "body must not exceed %d characters", maxReviewBodyLength))
+	}
+
+	for _, items := range [][]string{content.Pros, content.Cons} {
+		if len(items) > maxReviewListItems {
+			return logError(status.Errorf(codes.InvalidArgument, "pros and cons must not exceed %d items", maxReviewListItems))
+		}
+		for _, item := range items {
+			if item == "" || len(item) > maxReviewItemLength {
+				return logError(status.Errorf(codes.InvalidArgument, "pros and cons must have 1 to %d characters", maxReviewItemLength))
+			}
+		}
+	}
+
+	return nil
+}
+
+func ratingError(err error) error {
+	if errors.Is(err, ErrInvalidScore) {
+		return logError(status.Errorf(codes.InvalidArgument, "%v", err))
+	}
+	return logError(status.Errorf(codes.Internal, "cannot save rating: %v", err))
+}
+
+func encodePageToken(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodePageToken(token string) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, err
+	}
+
+	offset, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	return offset, nil
+}
+
+func toModerationState(pbState pb.Review_ModerationState) (ModerationState, bool) {
+	for state, other := range moderationStates {
+		if other == pbState {
+			return state, true
+		}
+	}
+	return 0, false
+}
+
+func toPbReview(review *Review) *pb.Review {
+	return &pb.Review{
+		Id:               review.ID,
+		LaptopId:         review.LaptopID,
+		Username:         review.Username,
+		Title:            review.Title,
+		Body:             review.Body,
+		Score:            review.Score,
+		Pros:             review.Pros,
+		Cons:             review.Cons,
+		HelpfulCount:     review.HelpfulCount,
+		CreateTime:       timestamppb.New(review.CreatedAt),
+		UpdateTime:       timestamppb.New(review.UpdatedAt),
+		State:            moderationStates[review.State],
+		ModerationReason: review.Reason,
+		ReportCount:      review.ReportCount,
+	}
+}
@@ -0,0 +1,354 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"learngrpc/pcbook/pb"
+	sample "learngrpc/pcbook/samples"
+	"learngrpc/pcbook/service"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReviewServer(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	ratingStore := service.NewInMemoryRatingStore(service.DefaultScoreRange)
+	server := service.NewReviewServer(service.NewInMemoryReviewStore(), laptopStore, ratingStore, nil)
+
+	alice := contextWithTestClaims("alice", "user")
+	bob := contextWithTestClaims("bob", "user")
+
+	created, err := server.CreateReview(alice, &pb.CreateReviewRequest{
+		LaptopId: laptop.Id,
+		Title:    "Great battery",
+		Body:     "Lasts a whole day.",
+		Score:    9,
+		Pros:     []string{"battery", "screen"},
+		Cons:     []string{"weight"},
+	})
+	require.NoError(t, err)
+	review := created.GetReview()
+	require.NotEmpty(t, review.GetId())
+	require.Equal(t, "alice", review.GetUsername())
+	require.Equal(t, []string{"battery", "screen"}, review.GetPros())
+
+	// the review score is the rating of its author
+	stats, err := ratingStore.Stats(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), stats.Count)
+	require.Equal(t, 9.0, stats.Average)
+
+	_, err = server.CreateReview(alice, &pb.CreateReviewRequest{LaptopId: laptop.Id, Title: "Again", Score: 5})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	_, err = server.CreateReview(bob, &pb.CreateReviewRequest{LaptopId: laptop.Id, Title: "Too good", Score: 11})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = server.CreateReview(bob, &pb.CreateReviewRequest{LaptopId: laptop.Id, Score: 5})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = server.CreateReview(bob, &pb.CreateReviewRequest{LaptopId: "unknown", Title: "Where", Score: 5})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = server.CreateReview(context.Background(), &pb.CreateReviewRequest{LaptopId: laptop.Id, Title: "Anonymous", Score: 5})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// the rejected score did not leave a review behind
+	bobReview, err := server.CreateReview(bob, &pb.CreateReviewRequest{LaptopId: laptop.Id, Title: "Noisy fan", Score: 4})
+	require.NoError(t, err)
+
+	_, err = server.UpdateReview(bob, &pb.UpdateReviewRequest{ReviewId: review.GetId(), Title: "Hacked", Score: 1})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	updated, err := server.UpdateReview(alice, &pb.UpdateReviewRequest{ReviewId: review.GetId(), Title: "Good battery", Score: 7})
+	require.NoError(t, err)
+	require.Equal(t, "Good battery", updated.GetReview().GetTitle())
+	require.Equal(t, 7.0, updated.GetReview().GetScore())
+	require.Empty(t, updated.GetReview().GetPros())
+
+	stats, err = ratingStore.Stats(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), stats.Count)
+	require.Equal(t, 5.5, stats.Average)
+
+	approveTestReview(t, server, review.GetId())
+	approveTestReview(t, server, bobReview.GetReview().GetId())
+
+	// the review is left as it was when its new score is refused
+	_, err = server.UpdateReview(alice, &pb.UpdateReviewRequest{ReviewId: review.GetId(), Title: "Best battery", Score: 11})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	requirePublicReviews(t, server, laptop.Id, bobReview.GetReview().GetId(), review.GetId())
+
+	stats, err = ratingStore.Stats(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, 5.5, stats.Average)
+
+	_, err = server.VoteReviewHelpful(alice, &pb.VoteReviewHelpfulRequest{ReviewId: review.GetId(), Helpful: true})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	voted, err := server.VoteReviewHelpful(bob, &pb.VoteReviewHelpfulRequest{ReviewId: review.GetId(), Helpful: true})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), voted.GetHelpfulCount())
+
+	// voting twice is counted once
+	voted, err = server.VoteReviewHelpful(bob, &pb.VoteReviewHelpfulRequest{ReviewId: review.GetId(), Helpful: true})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), voted.GetHelpfulCount())
+
+	list, err := server.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: laptop.Id})
+	require.NoError(t, err)
+	require.Len(t, list.GetReviews(), 2)
+	require.Equal(t, bobReview.GetReview().GetId(), list.GetReviews()[0].GetId())
+
+	list, err = server.ListReviews(context.Background(), &pb.ListReviewsRequest{
+		LaptopId: laptop.Id,
+		Order:    pb.ListReviewsRequest_MOST_HELPFUL,
+	})
+	require.NoError(t, err)
+	require.Equal(t, review.GetId(), list.GetReviews()[0].GetId())
+	require.Equal(t, uint32(1), list.GetReviews()[0].GetHelpfulCount())
+
+	// a later rating of the author is the score of the review
+	_, err = ratingStore.Add(laptop.Id, "alice", 8)
+	require.NoError(t, err)
+	list, err = server.ListReviews(context.Background(), &pb.ListReviewsRequest{
+		LaptopId: laptop.Id,
+		Order:    pb.ListReviewsRequest_MOST_HELPFUL,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 8.0, list.GetReviews()[0].GetScore())
+
+	_, err = server.DeleteReview(bob, &pb.DeleteReviewRequest{ReviewId: review.GetId()})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = server.DeleteReview(alice, &pb.DeleteReviewRequest{ReviewId: review.GetId()})
+	require.NoError(t, err)
+
+	// the later rating of the author does not belong to the review
+	stats, err = ratingStore.Stats(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), stats.Count)
+	require.Equal(t, 6.0, stats.Average)
+
+	_, err = server.DeleteReview(bob, &pb.DeleteReviewRequest{ReviewId: bobReview.GetReview().GetId()})
+	require.NoError(t, err)
+
+	stats, err = ratingStore.Stats(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), stats.Count)
+	require.Equal(t, 8.0, stats.Average)
+
+	_, err = server.VoteReviewHelpful(bob, &pb.VoteReviewHelpfulRequest{ReviewId: review.GetId(), Helpful: true})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestListReviewsPagination(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	server := service.NewReviewServer(service.NewInMemoryReviewStore(), laptopStore, service.NewInMemoryRatingStore(service.DefaultScoreRange), nil)
+
+	for i := 0; i < 5; i++ {
+		res, err := server.CreateReview(contextWithTestClaims(fmt.Sprintf("user%d", i), "user"), &pb.CreateReviewRequest{
+			LaptopId: laptop.Id,
+			Title:    fmt.Sprintf("review %d", i),
+			Score:    5,
+		})
+		require.NoError(t, err)
+		approveTestReview(t, server, res.GetReview().GetId())
+	}
+
+	seen := make(map[string]bool)
+	pageToken := ""
+	pages := 0
+	for {
+		res, err := server.ListReviews(context.Background(), &pb.ListReviewsRequest{
+			LaptopId:  laptop.Id,
+			PageSize:  2,
+			PageToken: pageToken,
+		})
+		require.NoError(t, err)
+		pages++
+
+		for _, review := range res.GetReviews() {
+			require.False(t, seen[review.GetId()])
+			seen[review.GetId()] = true
+		}
+
+		pageToken = res.GetNextPageToken()
+		if pageToken == "" {
+			break
+		}
+	}
+	require.Equal(t, 3, pages)
+	require.Len(t, seen, 5)
+
+	_, err := server.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: laptop.Id, PageToken: "invalid"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestReviewModeration(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	wordFilter := service.NewBannedWordFilter([]string{"Scam"})
+	ratingStore := service.NewInMemoryRatingStore(service.DefaultScoreRange)
+	server := service.NewReviewServer(service.NewInMemoryReviewStore(), laptopStore, ratingStore, wordFilter)
+
+	alice := contextWithTestClaims("alice", "user")
+	bob := contextWithTestClaims("bob", "user")
+	admin := contextWithTestClaims("admin1", "admin")
+
+	clean, err := server.CreateReview(alice, &pb.CreateReviewRequest{LaptopId: laptop.Id, Title: "Solid", Score: 8})
+	require.NoError(t, err)
+	require.Equal(t, pb.Review_PENDING, clean.GetReview().GetState())
+
+	banned, err := server.CreateReview(bob, &pb.CreateReviewRequest{
+		LaptopId: laptop.Id,
+		Title:    "Avoid",
+		Score:    1,
+		Cons:     []string{"total SCAM!"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, pb.Review_FLAGGED, banned.GetReview().GetState())
+	require.Contains(t, banned.GetReview().GetModerationReason(), "scam")
+
+	requirePublicReviews(t, server, laptop.Id)
+
+	queue, err := server.ListModerationQueue(admin, &pb.ListModerationQueueRequest{})
+	require.NoError(t, err)
+	require.Len(t, queue.GetReviews(), 2)
+	require.Equal(t, clean.GetReview().GetId(), queue.GetReviews()[0].GetId())
+
+	queue, err = server.ListModerationQueue(admin, &pb.ListModerationQueueRequest{
+		States: []pb.Review_ModerationState{pb.Review_FLAGGED},
+	})
+	require.NoError(t, err)
+	require.Len(t, queue.GetReviews(), 1)
+	require.Equal(t, banned.GetReview().GetId(), queue.GetReviews()[0].GetId())
+
+	_, err = server.ModerateReview(admin, &pb.ModerateReviewRequest{ReviewId: clean.GetReview().GetId(), State: pb.Review_FLAGGED})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// hidden reviews cannot be reported or voted for
+	_, err = server.ReportReview(bob, &pb.ReportReviewRequest{ReviewId: clean.GetReview().GetId(), Reason: "spam"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	approveTestReview(t, server, clean.GetReview().GetId())
+	rejected, err := server.ModerateReview(admin, &pb.ModerateReviewRequest{
+		ReviewId: banned.GetReview().GetId(),
+		State:    pb.Review_REJECTED,
+		Reason:   "abusive",
+	})
+	require.NoError(t, err)
+	require.Equal(t, pb.Review_REJECTED, rejected.GetReview().GetState())
+	require.Equal(t, "rejected by admin1: abusive", rejected.GetReview().GetModerationReason())
+
+	// the score of a rejected review does not count
+	stats, err := ratingStore.Stats(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), stats.Count)
+	require.Equal(t, 8.0, stats.Average)
+
+	requirePublicReviews(t, server, laptop.Id, clean.GetReview().GetId())
+
+	_, err = server.ReportReview(alice, &pb.ReportReviewRequest{ReviewId: clean.GetReview().GetId(), Reason: "mine"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = server.ReportReview(bob, &pb.ReportReviewRequest{ReviewId: clean.GetReview().GetId()})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = server.ReportReview(bob, &pb.ReportReviewRequest{ReviewId: clean.GetReview().GetId(), Reason: "spam"})
+	require.NoError(t, err)
+
+	// a reported review is hidden until it is approved again
+	requirePublicReviews(t, server, laptop.Id)
+
+	queue, err = server.ListModerationQueue(admin, &pb.ListModerationQueueRequest{})
+	require.NoError(t, err)
+	require.Len(t, queue.GetReviews(), 1)
+	require.Equal(t, pb.Review_FLAGGED, queue.GetReviews()[0].GetState())
+	require.Equal(t, uint32(1), queue.GetReviews()[0].GetReportCount())
+
+	approveTestReview(t, server, clean.GetReview().GetId())
+	requirePublicReviews(t, server, laptop.Id, clean.GetReview().GetId())
+
+	// an edited review has to be moderated again
+	_, err = server.UpdateReview(alice, &pb.UpdateReviewRequest{ReviewId: clean.GetReview().GetId(), Title: "Still solid", Score: 8})
+	require.NoError(t, err)
+	requirePublicReviews(t, server, laptop.Id)
+
+	// a review approved after all counts again
+	approveTestReview(t, server, banned.GetReview().GetId())
+	stats, err = ratingStore.Stats(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), stats.Count)
+	require.Equal(t, 4.5, stats.Average)
+}
+
+func TestBannedWordFilter(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "banned.txt")
+	err := os.WriteFile(filename, []byte("# comment\n\nfoo\n  Bar  \n"), 0o600)
+	require.NoError(t, err)
+
+	filter, err := service.LoadBannedWordFilter(filename)
+	require.NoError(t, err)
+
+	_, found := filter.Find("food is fine", "a barn")
+	require.False(t, found)
+
+	word, found := filter.Find("nice", "BAR, really")
+	require.True(t, found)
+	require.Equal(t, "bar", word)
+
+	_, found = filter.Find("comment")
+	require.False(t, found)
+
+	var nilFilter *service.BannedWordFilter
+	_, found = nilFilter.Find("foo")
+	require.False(t, found)
+}
+
+func approveTestReview(t *testing.T, server *service.ReviewServer, reviewID string) {
+	_, err := server.ModerateReview(contextWithTestClaims("admin1", "admin"), &pb.ModerateReviewRequest{
+		ReviewId: reviewID,
+		State:    pb.Review_APPROVED,
+	})
+	require.NoError(t, err)
+}
+
+func requirePublicReviews(t *testing.T, server *service.ReviewServer, laptopID string, reviewIDs ...string) {
+	res, err := server.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: laptopID})
+	require.NoError(t, err)
+
+	var ids []string
+	for _, review := range res.GetReviews() {
+		ids = append(ids, review.GetId())
+	}
+	require.Equal(t, reviewIDs, ids)
+}
+
+func contextWithTestClaims(username string, role string) context.Context {
+	return service.ContextWithUserClaims(context.Background(), &service.UserClaims{
+		Username: username,
+		Role:     role,
+	})
+}
@@ -0,0 +1,345 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrReviewNotFound is returned when a review does not exist.
+var ErrReviewNotFound = errors.New("review not found")
+
+// ErrReviewExists is returned when a user has already reviewed a laptop.
+var ErrReviewExists = errors.New("review already exists")
+
+// ReviewOrder is the order of a review listing.
+type ReviewOrder int
+
+const (
+	// ReviewOrderNewest lists the most recently created reviews first.
+	ReviewOrderNewest ReviewOrder = iota
+	// ReviewOrderMostHelpful lists the reviews with the most helpful votes first.
+	ReviewOrderMostHelpful
+)
+
+// ModerationState is the moderation state of a review.
+type ModerationState int
+
+const (
+	// ModerationPending is the state of a review waiting for a moderator.
+	ModerationPending ModerationState = iota
+	// ModerationApproved is the state of a review that is listed publicly.
+	ModerationApproved
+	// ModerationRejected is the state of a review refused by a moderator.
+	ModerationRejected
+	// ModerationFlagged is the state of a review that contains a banned word or was reported by a user.
+	ModerationFlagged
+)
+
+// Moderation is the moderation state of a review and the reason for it.
+type Moderation struct {
+	State  ModerationState
+	Reason string
+}
+
+// ReviewStore is a store for laptop reviews.
+type ReviewStore interface {
+	// Create creates the review of a user for a laptop
+	Create(laptopID string, username string, content ReviewContent, moderation Moderation) (*Review, error)
+	// Find finds a review by ID
+	Find(reviewID string) (*Review, error)
+	// Update replaces the content of a review, which has to be moderated again
+	Update(reviewID string, content ReviewContent, moderation Moderation) (*Review, error)
+	// Delete deletes a review and its votes
+	Delete(reviewID string) error
+	// List returns at most limit reviews of a laptop in a state from offset, and the total number of them
+	List(laptopID string, state ModerationState, order ReviewOrder, offset int, limit int) ([]*Review, int, error)
+	// Vote adds or withdraws the helpful vote of a user for a review
+	Vote(reviewID string, username string, helpful bool) (*Review, error)
+	// Report records the report of a user against a review and flags it
+	Report(reviewID string, username string, reason string) (*Review, error)
+	// Moderate sets the moderation state of a review
+	Moderate(reviewID string, moderation Moderation) (*Review, error)
+	// Queue returns at most limit reviews in any of the states from offset, oldest first, and the total number of them
+	Queue(states []ModerationState, offset int, limit int) ([]*Review, int, error)
+}
+
+// ReviewContent is the part of a review written by its author.
+type ReviewContent struct {
+	Title string
+	Body  string
+	Score float64
+	Pros  []string
+	Cons  []string
+}
+
+// Review is the review of a laptop by a user.
+type Review struct {
+	ID       string
+	LaptopID string
+	Username string
+	ReviewContent
+	Moderation
+	HelpfulCount uint32
+	ReportCount  uint32
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// Clone returns a deep copy of the review.
+func (review *Review) Clone() *Review {
+	other := *review
+	other.Pros = append([]string(nil), review.Pros...)
+	other.Cons = append([]string(nil), review.Cons...)
+	return &other
+}
+
+// InMemoryReviewStore is an in-memory store for laptop reviews.
+type InMemoryReviewStore struct {
+	mutex   sync.RWMutex
+	reviews map[string]*Review
+	laptops map[string]map[string]string   // laptop ID -> username -> review ID
+	votes   map[string]map[string]struct{} // review ID -> usernames of the helpful votes
+	reports map[string]map[string]struct{} // review ID -> usernames of the reports
+}
+
+// NewInMemoryReviewStore creates a new InMemoryReviewStore.
+func NewInMemoryReviewStore() *InMemoryReviewStore {
+	return &InMemoryReviewStore{
+		reviews: make(map[string]*Review),
+		laptops: make(map[string]map[string]string),
+		votes:   make(map[string]map[string]struct{}),
+		reports: make(map[string]map[string]struct{}),
+	}
+}
+
+// Create creates the review of a user for a laptop.
+// It returns ErrReviewExists if the user has already reviewed the laptop.
+func (store *InMemoryReviewStore) Create(laptopID string, username string, content ReviewContent, moderation Moderation) (*Review, error) {
+	reviewID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate review ID: %w", err)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	userReviews := store.laptops[laptopID]
+	if userReviews == nil {
+		userReviews = make(map[string]string)
+		store.laptops[laptopID] = userReviews
+	}
+	if _, ok := userReviews[username]; ok {
+		return nil, ErrReviewExists
+	}
+
+	now := time.Now()
+	review := &Review{
+		ID:            reviewID.String(),
+		LaptopID:      laptopID,
+		Username:      username,
+		ReviewContent: content,
+		Moderation:    moderation,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	review = review.Clone()
+
+	store.reviews[review.ID] = review
+	userReviews[username] = review.ID
+
+	return review.Clone(), nil
+}
+
+// Find finds a review by ID.
+func (store *InMemoryReviewStore) Find(reviewID string) (*Review, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	review := store.reviews[reviewID]
+	if review == nil {
+		return nil, nil
+	}
+	return review.Clone(), nil
+}
+
+// Update replaces the content of a review, which has to be moderated again.
+func (store *InMemoryReviewStore) Update(reviewID string, content ReviewContent, moderation Moderation) (*Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.reviews[reviewID]
+	if review == nil {
+		return nil, ErrReviewNotFound
+	}
+
+	review.ReviewContent = content
+	review.Pros = append([]string(nil), content.Pros...)
+	review.Cons = append([]string(nil), content.Cons...)
+	review.Moderation = moderation
+	review.UpdatedAt = time.Now()
+
+	return review.Clone(), nil
+}
+
+// Delete deletes a review and its votes.
+func (store *InMemoryReviewStore) Delete(reviewID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.reviews[reviewID]
+	if review == nil {
+		return ErrReviewNotFound
+	}
+
+	delete(store.reviews, reviewID)
+	delete(store.votes, reviewID)
+	delete(store.reports, reviewID)
+	delete(store.laptops[review.LaptopID], review.Username)
+	if len(store.laptops[review.LaptopID]) == 0 {
+		delete(store.laptops, review.LaptopID)
+	}
+
+	return nil
+}
+
+// List returns at most limit reviews of a laptop in a state from offset, and the total number of them.
+// Reviews with the same order are listed by ID, so that pages do not overlap.
+func (store *InMemoryReviewStore) List(laptopID string, state ModerationState, order ReviewOrder, offset int, limit int) ([]*Review, int, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	reviews := make([]*Review, 0, len(store.laptops[laptopID]))
+	for _, reviewID := range store.laptops[laptopID] {
+		review := store.reviews[reviewID]
+		if review.State == state {
+			reviews = append(reviews, review)
+		}
+	}
+
+	sort.Slice(reviews, func(i, j int) bool {
+		if order == ReviewOrderMostHelpful && reviews[i].HelpfulCount != reviews[j].HelpfulCount {
+			return reviews[i].HelpfulCount > reviews[j].HelpfulCount
+		}
+		if !reviews[i].CreatedAt.Equal(reviews[j].CreatedAt) {
+			return reviews[i].CreatedAt.After(reviews[j].CreatedAt)
+		}
+		return reviews[i].ID < reviews[j].ID
+	})
+
+	return pageOfReviews(reviews, offset, limit), len(reviews), nil
+}
+
+// Vote adds or withdraws the helpful vote of a user for a review.
+// Voting twice the same way has no effect.
+func (store *InMemoryReviewStore) Vote(reviewID string, username string, helpful bool) (*Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.reviews[reviewID]
+	if review == nil {
+		return nil, ErrReviewNotFound
+	}
+
+	voters := store.votes[reviewID]
+	if voters == nil {
+		voters = make(map[string]struct{})
+		store.votes[reviewID] = voters
+	}
+
+	if helpful {
+		voters[username] = struct{}{}
+	} else {
+		delete(voters, username)
+	}
+	review.HelpfulCount = uint32(len(voters))
+
+	return review.Clone(), nil
+}
+
+// Report records the report of a user against a review and flags it.
+// A user reporting the same review again has no effect.
+func (store *InMemoryReviewStore) Report(reviewID string, username string, reason string) (*Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.reviews[reviewID]
+	if review == nil {
+		return nil, ErrReviewNotFound
+	}
+
+	reporters := store.reports[reviewID]
+	if reporters == nil {
+		reporters = make(map[string]struct{})
+		store.reports[reviewID] = reporters
+	}
+	if _, ok := reporters[username]; ok {
+		return review.Clone(), nil
+	}
+	reporters[username] = struct{}{}
+	review.ReportCount = uint32(len(reporters))
+
+	if review.State == ModerationPending || review.State == ModerationApproved {
+		review.Moderation = Moderation{
+			State:  ModerationFlagged,
+			Reason: fmt.Sprintf("reported by %s: %s", username, reason),
+		}
+		review.UpdatedAt = time.Now()
+	}
+
+	return review.Clone(), nil
+}
+
+// Moderate sets the moderation state of a review.
+func (store *InMemoryReviewStore) Moderate(reviewID string, moderation Moderation) (*Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.reviews[reviewID]
+	if review == nil {
+		return nil, ErrReviewNotFound
+	}
+
+	review.Moderation = moderation
+	review.UpdatedAt = time.Now()
+
+	return review.Clone(), nil
+}
+
+// Queue returns at most limit reviews in any of the states from offset, and the total number of them.
+// The reviews are ordered by the time of their last change, oldest first.
+func (store *InMemoryReviewStore) Queue(states []ModerationState, offset int, limit int) ([]*Review, int, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var reviews []*Review
+	for _, review := range store.reviews {
+		for _, state := range states {
+			if review.State == state {
+				reviews = append(reviews, review)
+				break
+			}
+		}
+	}
+
+	sort.Slice(reviews, func(i, j int) bool {
+		if !reviews[i].UpdatedAt.Equal(reviews[j].UpdatedAt) {
+			return reviews[i].UpdatedAt.Before(reviews[j].UpdatedAt)
+		}
+		return reviews[i].ID < reviews[j].ID
+	})
+
+	return pageOfReviews(reviews, offset, limit), len(reviews), nil
+}
+
+func pageOfReviews(reviews []*Review, offset int, limit int) []*Review {
+	var result []*Review
+	for i := offset; i < len(reviews) && len(result) < limit; i++ {
+		result = append(result, reviews[i].Clone())
+	}
+	return result
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// RevocationList is a list of revoked access token IDs and session IDs.
+// An entry only needs to be kept until the tokens it revokes have expired.
+type RevocationList interface {
+	// Revoke revokes the tokens with the given token or session ID until the given time.
+	Revoke(id string, until time.Time) error
+	// IsRevoked checks if the given token or session ID is revoked.
+	IsRevoked(id string) (bool, error)
+}
+
+// InMemoryRevocationList is an in-memory list of revoked IDs.
+type InMemoryRevocationList struct {
+	mutex   sync.RWMutex
+	revoked map[string]time.Time
+}
+
+// NewInMemoryRevocationList creates a new InMemoryRevocationList.
+func NewInMemoryRevocationList() *InMemoryRevocationList {
+	return &InMemoryRevocationList{
+		revoked: make(map[string]time.Time),
+	}
+}
+
+// Revoke revokes the tokens with the given token or session ID until the given time.
+func (list *InMemoryRevocationList) Revoke(id string, until time.Time) error {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	now := time.Now()
+	for other, otherUntil := range list.revoked {
+		if now.After(otherUntil) {
+			delete(list.revoked, other)
+		}
+	}
+
+	if until.After(list.revoked[id]) {
+		list.revoked[id] = until
+	}
+	return nil
+}
+
+// IsRevoked checks if the given token or session ID is revoked.
+func (list *InMemoryRevocationList) IsRevoked(id string) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+
+	until, ok := list.revoked[id]
+	return ok && time.Now().Before(until), nil
+}
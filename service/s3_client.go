@@ -0,0 +1,249 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errS3NotFound is returned when an object does not exist in the bucket.
+var errS3NotFound = errors.New("s3 object not found")
+
+// S3Config contains the settings to talk to an S3-compatible object storage.
+type S3Config struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// s3Client is a minimal S3 client using path-style requests signed with AWS Signature Version 4.
+type s3Client struct {
+	config     S3Config
+	httpClient *http.Client
+}
+
+func newS3Client(config S3Config) *s3Client {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+
+	return &s3Client{
+		config:     config,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// s3Object describes an object returned by a bucket listing.
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3ListBucketResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+func (client *s3Client) putObject(key string, data []byte) error {
+	res, err := client.do(http.MethodPut, key, nil, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (client *s3Client) getObject(key string) ([]byte, error) {
+	res, err := client.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read s3 object %s: %w", key, err)
+	}
+	return data, nil
+}
+
+func (client *s3Client) deleteObject(key string) error {
+	res, err := client.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// listObjects returns all objects whose key starts with prefix, following continuation tokens.
+func (client *s3Client) listObjects(prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		res, err := client.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		result := s3ListBucketResult{}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode s3 list result: %w", err)
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (client *s3Client) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + client.config.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+
+	rawQuery := ""
+	if query != nil {
+		rawQuery = s3CanonicalQuery(query)
+	}
+	requestURL := client.config.Endpoint + s3EscapePath(path)
+	if rawQuery != "" {
+		requestURL += "?" + rawQuery
+	}
+
+	req, err := http.NewRequest(method, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create s3 request: %w", err)
+	}
+	client.sign(req, path, rawQuery, body, time.Now().UTC())
+
+	res, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot send s3 request: %w", err)
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errS3NotFound
+	}
+	if res.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s failed with status %d: %s", method, path, res.StatusCode, message)
+	}
+
+	return res, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to a request.
+func (client *s3Client) sign(req *http.Request, path string, rawQuery string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := s3Hash(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URL.Host, payloadHash, amzDate)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(path),
+		rawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, client.config.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		s3Hash([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+client.config.SecretAccessKey), date)
+	key = s3HMAC(key, client.config.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		client.config.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func s3Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything except the unreserved characters, as required by SigV4.
+func s3Escape(s string, keepSlash bool) string {
+	var builder strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', keepSlash && b == '/':
+			builder.WriteByte(b)
+		default:
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,455 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// S3ImageStore is an implementation of ImageStore that saves images to an S3-compatible object storage,
+// so that all servers behind a load balancer share the same images.
+//
+// Objects are laid out in the bucket as:
+//
+//	images/<image id>/info.json         the ImageInfo of the image
+//	images/<image id>/<variant><type>   the original image and its variants
+//	laptops/<laptop id>/<image id>      an empty marker to list the images of a laptop
+//
+// Listing the bucket is slow, so the usage is listed at most every s3UsageRefreshInterval,
+// and kept up to date with the changes of this server in between. The changes of the other
+// servers sharing the bucket are only seen once it is listed again.
+type S3ImageStore struct {
+	mutex  sync.Mutex
+	client *s3Client
+
+	usageMutex    sync.Mutex
+	usage         *ImageUsage // nil until the bucket is listed
+	usageListedAt time.Time
+}
+
+// s3UsageRefreshInterval is how long the usage of an S3ImageStore is used before the bucket is listed again.
+const s3UsageRefreshInterval = time.Minute
+
+// NewS3ImageStore creates a new S3ImageStore.
+func NewS3ImageStore(config S3Config) *S3ImageStore {
+	return &S3ImageStore{
+		client: newS3Client(config),
+	}
+}
+
+// Save saves an image to the bucket.
+func (store *S3ImageStore) Save(
+	laptopID string,
+	imageType string,
+	imageData bytes.Buffer,
+) (string, error) {
+	imageID, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("cannot generate image ID: %w", err)
+	}
+
+	info := &ImageInfo{
+		ID:       imageID.String(),
+		LaptopID: laptopID,
+		Type:     imageType,
+		Path:     s3ImageKey(imageID.String(), ImageVariantOriginal, imageType),
+		Size:     imageData.Len(),
+		Variants: make(map[string]*ImageVariantInfo),
+	}
+
+	err = store.client.putObject(info.Path, imageData.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("cannot upload image: %w", err)
+	}
+
+	infoSize, err := store.putInfo(info)
+	if err != nil {
+		return "", err
+	}
+
+	err = store.client.putObject(s3LaptopImageKey(laptopID, info.ID), nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot upload laptop image marker: %w", err)
+	}
+
+	store.updateUsage(func(usage *ImageUsage) {
+		usage.add(laptopID, 1, int64(info.Size)+infoSize)
+	})
+
+	return info.ID, nil
+}
+
+// Find finds an image by ID.
+func (store *S3ImageStore) Find(imageID string) (*ImageInfo, error) {
+	data, err := store.client.getObject(s3InfoKey(imageID))
+	if err == errS3NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot download image info: %w", err)
+	}
+
+	info := &ImageInfo{}
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image info: %w", err)
+	}
+	if info.Variants == nil {
+		info.Variants = make(map[string]*ImageVariantInfo)
+	}
+
+	return info, nil
+}
+
+// List lists the images of a laptop ordered by ID.
+func (store *S3ImageStore) List(laptopID string) ([]*ImageInfo, error) {
+	objects, err := store.client.listObjects(s3LaptopImageKey(laptopID, ""))
+	if err != nil {
+		return nil, fmt.Errorf("cannot list laptop images: %w", err)
+	}
+
+	var result []*ImageInfo
+	for _, object := range objects {
+		info, err := store.Find(path.Base(object.Key))
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			result = append(result, info)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+
+	return result, nil
+}
+
+// Load downloads the data of an image variant.
+func (store *S3ImageStore) Load(imageID string, variant string) ([]byte, error) {
+	info, err := store.Find(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, ErrImageNotFound
+	}
+
+	key := info.Path
+	if variant != ImageVariantOriginal {
+		v := info.Variants[variant]
+		if v == nil || v.Err != "" {
+			return nil, ErrImageNotFound
+		}
+		key = v.Path
+	}
+
+	data, err := store.client.getObject(key)
+	if err == errS3NotFound {
+		return nil, ErrImageNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot download image: %w", err)
+	}
+
+	return data, nil
+}
+
+// SaveVariant uploads a resized variant of an image next to the original.
+func (store *S3ImageStore) SaveVariant(
+	imageID string,
+	variant string,
+	width int,
+	height int,
+	imageData bytes.Buffer,
+) error {
+	info, err := store.Find(imageID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return ErrImageNotFound
+	}
+
+	key := s3ImageKey(imageID, variant, info.Type)
+	size := imageData.Len()
+	err = store.client.putObject(key, imageData.Bytes())
+	if err != nil {
+		return fmt.Errorf("cannot upload image variant: %w", err)
+	}
+	store.updateUsage(func(usage *ImageUsage) {
+		usage.add(info.LaptopID, 0, int64(size))
+	})
+
+	return store.setVariant(imageID, variant, &ImageVariantInfo{
+		Path:   key,
+		Width:  width,
+		Height: height,
+		Size:   size,
+	})
+}
+
+// MarkVariantFailed records that a variant of an image could not be generated.
+func (store *S3ImageStore) MarkVariantFailed(imageID string, variant string, reason error) error {
+	return store.setVariant(imageID, variant, &ImageVariantInfo{
+		Err: reason.Error(),
+	})
+}
+
+// Delete removes an image, its variants and its laptop marker from the bucket.
+func (store *S3ImageStore) Delete(imageID string) error {
+	info, err := store.Find(imageID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return ErrImageNotFound
+	}
+
+	objects, err := store.client.listObjects(s3ImagePrefix(imageID))
+	if err != nil {
+		return fmt.Errorf("cannot list image objects: %w", err)
+	}
+
+	// remove the marker first so that the image disappears from the listings,
+	// and the info last so that a failed delete can be retried
+	keys := []string{s3LaptopImageKey(info.LaptopID, imageID)}
+	var bytes int64
+	for _, object := range objects {
+		bytes += object.Size
+		if object.Key != s3InfoKey(imageID) {
+			keys = append(keys, object.Key)
+		}
+	}
+	keys = append(keys, s3InfoKey(imageID))
+
+	// the image no longer counts once it has disappeared from the listings
+	err = store.client.deleteObject(keys[0])
+	if err != nil && err != errS3NotFound {
+		return fmt.Errorf("cannot delete image object: %w", err)
+	}
+	store.updateUsage(func(usage *ImageUsage) {
+		usage.add(info.LaptopID, -1, -bytes)
+	})
+
+	for _, key := range keys[1:] {
+		err := store.client.deleteObject(key)
+		if err != nil && err != errS3NotFound {
+			return fmt.Errorf("cannot delete image object: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Usage returns the number of images and bytes stored, in total and per laptop.
+// Objects of incomplete uploads count towards the total bytes only.
+func (store *S3ImageStore) Usage() (*ImageUsage, error) {
+	store.usageMutex.Lock()
+	defer store.usageMutex.Unlock()
+
+	if store.usage == nil || time.Since(store.usageListedAt) >= s3UsageRefreshInterval {
+		listedAt := time.Now()
+		usage, err := store.listUsage()
+		if err != nil {
+			return nil, err
+		}
+		store.usage = usage
+		store.usageListedAt = listedAt
+	}
+
+	return store.usage.clone(), nil
+}
+
+// updateUsage applies a change of this server to the usage, if the bucket has been listed.
+func (store *S3ImageStore) updateUsage(update func(usage *ImageUsage)) {
+	store.usageMutex.Lock()
+	defer store.usageMutex.Unlock()
+
+	if store.usage != nil {
+		update(store.usage)
+	}
+}
+
+// listUsage lists the bucket to find its usage.
+func (store *S3ImageStore) listUsage() (*ImageUsage, error) {
+	images, err := store.listImages()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &ImageUsage{
+		Laptops: make(map[string]*LaptopImageUsage),
+	}
+	for _, image := range images {
+		if image.complete() {
+			usage.add(image.laptopID, 1, image.bytes)
+		} else {
+			usage.Bytes += image.bytes
+		}
+	}
+
+	return usage, nil
+}
+
+// RemoveIncomplete removes the objects of images whose upload did not finish,
+// if they were last modified before the given time.
+// An image is complete once both its info and its laptop marker have been written.
+func (store *S3ImageStore) RemoveIncomplete(before time.Time) (int, error) {
+	images, err := store.listImages()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, image := range images {
+		if image.complete() || !image.modified.Before(before) {
+			continue
+		}
+
+		for _, key := range image.keys {
+			err := store.client.deleteObject(key)
+			if err != nil && err != errS3NotFound {
+				return removed, fmt.Errorf("cannot delete incomplete image object: %w", err)
+			}
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		// the bytes of the incomplete images are only known from a listing
+		store.usageMutex.Lock()
+		store.usage = nil
+		store.usageMutex.Unlock()
+	}
+
+	return removed, nil
+}
+
+// s3StoredImage groups the objects of one image found in the bucket.
+type s3StoredImage struct {
+	laptopID string
+	hasInfo  bool
+	keys     []string
+	bytes    int64
+	modified time.Time
+}
+
+func (image *s3StoredImage) complete() bool {
+	return image.hasInfo && image.laptopID != ""
+}
+
+func (store *S3ImageStore) listImages() (map[string]*s3StoredImage, error) {
+	images := make(map[string]*s3StoredImage)
+	get := func(imageID string) *s3StoredImage {
+		image := images[imageID]
+		if image == nil {
+			image = &s3StoredImage{}
+			images[imageID] = image
+		}
+		return image
+	}
+
+	markers, err := store.client.listObjects("laptops/")
+	if err != nil {
+		return nil, fmt.Errorf("cannot list laptop images: %w", err)
+	}
+	for _, marker := range markers {
+		parts := strings.Split(marker.Key, "/")
+		if len(parts) != 3 {
+			continue
+		}
+		image := get(parts[2])
+		image.laptopID = parts[1]
+		image.keys = append(image.keys, marker.Key)
+		image.updateModified(marker.LastModified)
+	}
+
+	objects, err := store.client.listObjects("images/")
+	if err != nil {
+		return nil, fmt.Errorf("cannot list images: %w", err)
+	}
+	for _, object := range objects {
+		parts := strings.Split(object.Key, "/")
+		if len(parts) != 3 {
+			continue
+		}
+		image := get(parts[1])
+		image.hasInfo = image.hasInfo || object.Key == s3InfoKey(parts[1])
+		image.keys = append(image.keys, object.Key)
+		image.bytes += object.Size
+		image.updateModified(object.LastModified)
+	}
+
+	return images, nil
+}
+
+func (image *s3StoredImage) updateModified(modified time.Time) {
+	if modified.After(image.modified) {
+		image.modified = modified
+	}
+}
+
+func (store *S3ImageStore) setVariant(imageID string, variant string, variantInfo *ImageVariantInfo) error {
+	// serialize the read-modify-write of the info object within this server
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	info, err := store.Find(imageID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return ErrImageNotFound
+	}
+	previous, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("cannot encode image info: %w", err)
+	}
+	info.Variants[variant] = variantInfo
+
+	infoSize, err := store.putInfo(info)
+	if err != nil {
+		return err
+	}
+	store.updateUsage(func(usage *ImageUsage) {
+		usage.add(info.LaptopID, 0, infoSize-int64(len(previous)))
+	})
+
+	return nil
+}
+
+// putInfo uploads the info object of an image, and returns its size.
+func (store *S3ImageStore) putInfo(info *ImageInfo) (int64, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return 0, fmt.Errorf("cannot encode image info: %w", err)
+	}
+
+	err = store.client.putObject(s3InfoKey(info.ID), data)
+	if err != nil {
+		return 0, fmt.Errorf("cannot upload image info: %w", err)
+	}
+	return int64(len(data)), nil
+}
+
+func s3InfoKey(imageID string) string {
+	return fmt.Sprintf("images/%s/info.json", imageID)
+}
+
+func s3ImagePrefix(imageID string) string {
+	return fmt.Sprintf("images/%s/", imageID)
+}
+
+func s3ImageKey(imageID string, variant string, imageType string) string {
+	return fmt.Sprintf("images/%s/%s%s", imageID, variant, imageType)
+}
+
+func s3LaptopImageKey(laptopID string, imageID string) string {
+	return fmt.Sprintf("laptops/%s/%s", laptopID, imageID)
+}
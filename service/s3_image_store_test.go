@@ -0,0 +1,277 @@
+package service_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"learngrpc/pcbook/pb"
+	sample "learngrpc/pcbook/samples"
+	"learngrpc/pcbook/service"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testS3Bucket    = "pcbook"
+	testS3AccessKey = "test-access-key"
+)
+
+// fakeS3 is an in-process stand-in for an S3-compatible server.
+// It serves path-style object requests and ListObjectsV2 for a single bucket.
+type fakeS3 struct {
+	mutex    sync.Mutex
+	objects  map[string]*fakeS3Object
+	pageSize int
+	lists    int // number of list requests served
+}
+
+type fakeS3Object struct {
+	data     []byte
+	modified time.Time
+}
+
+func startFakeS3(t *testing.T) (*fakeS3, string) {
+	fake := &fakeS3{
+		objects:  make(map[string]*fakeS3Object),
+		pageSize: 2,
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, server.URL
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential="+testS3AccessKey+"/") ||
+		r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+
+	bucketPrefix := "/" + testS3Bucket
+	if !strings.HasPrefix(r.URL.Path, bucketPrefix) {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucketPrefix), "/")
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		fake.list(w, r)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fake.objects[key] = &fakeS3Object{data, time.Now().UTC()}
+	case r.Method == http.MethodGet:
+		object, ok := fake.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(object.data)
+	case r.Method == http.MethodDelete:
+		delete(fake.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+func (fake *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	fake.lists++
+
+	var keys []string
+	for key := range fake.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string    `xml:"Key"`
+		Size         int       `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	}
+	result := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}{}
+
+	end := start + fake.pageSize
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	} else {
+		end = len(keys)
+	}
+	for _, key := range keys[start:end] {
+		result.Contents = append(result.Contents, content{key, len(fake.objects[key].data), fake.objects[key].modified})
+	}
+
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (fake *fakeS3) count(prefix string) int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	n := 0
+	for key := range fake.objects {
+		if strings.HasPrefix(key, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestS3ImageStore(t *testing.T) {
+	t.Parallel()
+
+	fake, endpoint := startFakeS3(t)
+	imageStore := service.NewS3ImageStore(service.S3Config{
+		Endpoint:        endpoint,
+		Bucket:          testS3Bucket,
+		AccessKeyID:     testS3AccessKey,
+		SecretAccessKey: "test-secret-key",
+	})
+	laptopStore := service.NewInMemoryLaptopStore()
+	variantGenerator := service.NewImageVariantGenerator(imageStore, 2, 10)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	laptopServer := service.NewLaptopServer(laptopStore, imageStore, nil, service.NewInMemoryUploadSessionStore(time.Minute), variantGenerator, service.ImageQuota{}, nil)
+	serverAddress := serveTestLaptopServer(t, laptopServer)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	imageData, err := os.ReadFile("../from/macbook-air-gold-2015-16.jpg")
+	require.NoError(t, err)
+
+	// more images than the fake returns in one list page
+	n := 3
+	for i := 0; i < n; i++ {
+		uploadImageSession(t, laptopClient, laptop.Id, ".jpg", imageData)
+	}
+	variantGenerator.Close()
+
+	// info, original and 2 variants per image
+	require.Equal(t, 4*n, fake.count("images/"))
+
+	images, err := imageStore.List(laptop.Id)
+	require.NoError(t, err)
+	require.Len(t, images, n)
+	for _, info := range images {
+		require.Equal(t, laptop.Id, info.LaptopID)
+		require.Len(t, info.Variants, 2)
+		for _, variant := range info.Variants {
+			require.Empty(t, variant.Err)
+		}
+	}
+
+	original := downloadImage(t, laptopClient, images[0].ID, pb.Image_ORIGINAL)
+	require.True(t, bytes.Equal(imageData, original))
+	thumbnail := downloadImage(t, laptopClient, images[0].ID, pb.Image_THUMBNAIL_128)
+	require.Equal(t, images[0].Variants[service.ImageVariantThumbnail].Size, len(thumbnail))
+
+	info, err := imageStore.Find("unknown")
+	require.NoError(t, err)
+	require.Nil(t, info)
+
+	_, err = imageStore.Load("unknown", service.ImageVariantOriginal)
+	require.ErrorIs(t, err, service.ErrImageNotFound)
+}
+
+func TestS3ImageStoreUsage(t *testing.T) {
+	t.Parallel()
+
+	fake, endpoint := startFakeS3(t)
+	config := service.S3Config{
+		Endpoint:        endpoint,
+		Bucket:          testS3Bucket,
+		AccessKeyID:     testS3AccessKey,
+		SecretAccessKey: "test-secret-key",
+	}
+	imageStore := service.NewS3ImageStore(config)
+
+	usage, err := imageStore.Usage()
+	require.NoError(t, err)
+	require.Equal(t, 0, usage.Images)
+
+	// the changes of the server are applied without listing the bucket again,
+	// as a listing would find them
+	requireListedUsage := func() *service.ImageUsage {
+		lists := fake.listCount()
+		usage, err := imageStore.Usage()
+		require.NoError(t, err)
+		require.Equal(t, lists, fake.listCount())
+
+		listed, err := service.NewS3ImageStore(config).Usage()
+		require.NoError(t, err)
+		require.Equal(t, listed, usage)
+		return usage
+	}
+
+	imageID, err := imageStore.Save("laptop1", ".jpg", *bytes.NewBufferString("image1"))
+	require.NoError(t, err)
+	_, err = imageStore.Save("laptop1", ".jpg", *bytes.NewBufferString("image2"))
+	require.NoError(t, err)
+	err = imageStore.SaveVariant(imageID, service.ImageVariantThumbnail, 1, 1, *bytes.NewBufferString("thumb"))
+	require.NoError(t, err)
+
+	usage = requireListedUsage()
+	require.Equal(t, 2, usage.Images)
+	require.Equal(t, 2, usage.Laptops["laptop1"].Images)
+
+	// the returned usage is a copy
+	usage.Laptops["laptop1"].Images = 100
+
+	require.NoError(t, imageStore.Delete(imageID))
+	usage = requireListedUsage()
+	require.Equal(t, 1, usage.Images)
+	require.Equal(t, 1, usage.Laptops["laptop1"].Images)
+}
+
+func (fake *fakeS3) listCount() int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return fake.lists
+}
+
+func TestS3ImageStoreRejectsWrongCredentials(t *testing.T) {
+	t.Parallel()
+
+	_, endpoint := startFakeS3(t)
+	imageStore := service.NewS3ImageStore(service.S3Config{
+		Endpoint:        endpoint,
+		Bucket:          testS3Bucket,
+		AccessKeyID:     "wrong-access-key",
+		SecretAccessKey: "test-secret-key",
+	})
+
+	_, err := imageStore.Save("laptop", ".jpg", bytes.Buffer{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "403")
+}
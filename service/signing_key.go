@@ -0,0 +1,239 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// SigningKey is a key to sign or verify JSON web tokens.
+// A key without a private part can only verify tokens, e.g. a previous key during a rotation.
+type SigningKey struct {
+	ID         string // the kid header of the tokens signed with the key
+	Method     jwt.SigningMethod
+	privateKey interface{}
+	publicKey  interface{}
+}
+
+// JSONWebKey is the public part of an asymmetric signing key, as defined by RFC 7517.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is a set of public keys, as published at /.well-known/jwks.json.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// NewHMACSigningKey creates a HS256 key from a shared secret.
+// Its tokens can only be verified by the holders of the secret, so it is never published.
+func NewHMACSigningKey(secret string) *SigningKey {
+	hash := sha256.Sum256([]byte(secret))
+	return &SigningKey{
+		ID:         "hs256-" + base64.RawURLEncoding.EncodeToString(hash[:6]),
+		Method:     jwt.SigningMethodHS256,
+		privateKey: []byte(secret),
+		publicKey:  []byte(secret),
+	}
+}
+
+// NewSigningKey creates a RS256 or ES256 key from a RSA or P-256 ECDSA key, private or public.
+// The key ID is the RFC 7638 thumbprint of the public key.
+func NewSigningKey(key interface{}) (*SigningKey, error) {
+	signingKey := &SigningKey{}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signingKey.privateKey = key
+		signingKey.publicKey = &key.PublicKey
+	case *ecdsa.PrivateKey:
+		signingKey.privateKey = key
+		signingKey.publicKey = &key.PublicKey
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		signingKey.publicKey = key
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	switch publicKey := signingKey.publicKey.(type) {
+	case *rsa.PublicKey:
+		signingKey.Method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if publicKey.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported elliptic curve %s", publicKey.Curve.Params().Name)
+		}
+		signingKey.Method = jwt.SigningMethodES256
+	}
+
+	jwk := signingKey.JSONWebKey()
+	signingKey.ID = jwk.thumbprint()
+	return signingKey, nil
+}
+
+// LoadSigningKey loads a RS256 or ES256 key from a PEM file,
+// which contains either a private key (PKCS #1, SEC 1 or PKCS #8) or a public key (PKIX).
+func LoadSigningKey(filename string) (*SigningKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in key file %s", filename)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in key file %s", block.Type, filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse key file %s: %w", filename, err)
+	}
+
+	return NewSigningKey(key)
+}
+
+// CanSign checks if the key has a private part to sign tokens.
+func (key *SigningKey) CanSign() bool {
+	return key.privateKey != nil
+}
+
+// IsSymmetric checks if the key is a shared secret that must not be published.
+func (key *SigningKey) IsSymmetric() bool {
+	_, ok := key.publicKey.([]byte)
+	return ok
+}
+
+// JSONWebKey returns the public part of an asymmetric key.
+func (key *SigningKey) JSONWebKey() JSONWebKey {
+	jwk := JSONWebKey{
+		KeyID:     key.ID,
+		Use:       "sig",
+		Algorithm: key.Method.Alg(),
+	}
+
+	switch publicKey := key.publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = publicKey.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, size)))
+	}
+
+	return jwk
+}
+
+// SigningKey returns the key that verifies the tokens signed with the private part of the JSON web key,
+// such as a key published by an identity provider. The key keeps the ID it was published with.
+func (jwk JSONWebKey) SigningKey() (*SigningKey, error) {
+	var publicKey interface{}
+
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode modulus of key %s: %w", jwk.KeyID, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode exponent of key %s: %w", jwk.KeyID, err)
+		}
+		publicKey = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported elliptic curve %s of key %s", jwk.Curve, jwk.KeyID)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode x of key %s: %w", jwk.KeyID, err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode y of key %s: %w", jwk.KeyID, err)
+		}
+		ecKey := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !ecKey.Curve.IsOnCurve(ecKey.X, ecKey.Y) {
+			return nil, fmt.Errorf("key %s is not on curve P-256", jwk.KeyID)
+		}
+		publicKey = ecKey
+	default:
+		return nil, fmt.Errorf("unsupported key type %q of key %s", jwk.KeyType, jwk.KeyID)
+	}
+
+	key, err := NewSigningKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if jwk.Algorithm != "" && jwk.Algorithm != key.Method.Alg() {
+		return nil, fmt.Errorf("unsupported algorithm %s of key %s", jwk.Algorithm, jwk.KeyID)
+	}
+	if jwk.KeyID != "" {
+		key.ID = jwk.KeyID
+	}
+	return key, nil
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the key,
+// which is the hash of its required members in lexicographic order.
+func (jwk JSONWebKey) thumbprint() string {
+	var members interface{}
+	switch jwk.KeyType {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.KeyType, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Curve, jwk.KeyType, jwk.X, jwk.Y}
+	}
+
+	data, _ := json.Marshal(members)
+	hash := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
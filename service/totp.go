@@ -0,0 +1,138 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod     = 30 * time.Second
+	totpDigits     = 6
+	totpSkew       = 1  // steps accepted before and after the current one, for clock drift
+	totpSecretSize = 20 // bytes, the size of a SHA-1 HMAC key recommended by RFC 4226
+	totpIssuer     = "PC Book"
+
+	recoveryCodeCount = 10
+	recoveryCodeSize  = 10 // base32 characters of 48 random bits
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret generates a new random TOTP secret encoded in base32.
+func NewTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate totp secret: %w", err)
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI returns the otpauth URI of a TOTP secret, which authenticator apps read from a QR code.
+func TOTPURI(username string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + username,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+// TOTPCode returns the RFC 6238 code of a base32 secret at the given time.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpCodeAt(key, totpStep(t)), nil
+}
+
+// VerifyTOTP checks a code against a base32 secret at the given time, and returns the time step
+// of the code. The codes of lastStep and before are rejected, so that a code cannot be replayed.
+func VerifyTOTP(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(t)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCodeAt(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode totp secret: %w", err)
+	}
+	return key, nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod.Seconds())
+}
+
+// totpCodeAt computes the HOTP code of RFC 4226 for a counter.
+func totpCodeAt(key []byte, counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// NewRecoveryCodes generates one-time recovery codes like "ABCDE-FGHIJ", and returns them with their hashes.
+func NewRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		data := make([]byte, recoveryCodeSize*5/8)
+		_, err := rand.Read(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot generate recovery code: %w", err)
+		}
+
+		code := totpEncoding.EncodeToString(data)
+		code = code[:recoveryCodeSize/2] + "-" + code[recoveryCodeSize/2:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring the case and the dash.
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,41 @@
+package service_test
+
+import (
+	"learngrpc/pcbook/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	t.Parallel()
+
+	// the SHA-1 test vectors of RFC 6238, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+	}
+
+	for _, tc := range testCases {
+		code, err := service.TOTPCode(secret, time.Unix(tc.unix, 0))
+		require.NoError(t, err)
+		require.Equal(t, tc.code, code, tc.unix)
+	}
+
+	// a code is accepted in the next time step for clock drift, but only once
+	now := time.Unix(1111111111, 0)
+	step, ok := service.VerifyTOTP(secret, "050471", now.Add(30*time.Second), 0)
+	require.True(t, ok)
+	_, ok = service.VerifyTOTP(secret, "050471", now, step)
+	require.False(t, ok)
+	_, ok = service.VerifyTOTP(secret, "050471", now.Add(time.Minute), 0)
+	require.False(t, ok)
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrUploadNotFound is returned when an upload session does not exist or has expired.
+var ErrUploadNotFound = errors.New("upload session not found")
+
+// ErrUploadOffsetMismatch is returned when a chunk does not continue the committed data.
+var ErrUploadOffsetMismatch = errors.New("upload offset does not match committed size")
+
+// ErrUploadFinishing is returned when an upload session is being finished by another call.
+var ErrUploadFinishing = errors.New("upload session is being finished")
+
+// UploadSessionStore is a store for resumable image upload sessions.
+type UploadSessionStore interface {
+	Create(laptopID string, imageType string) (*UploadSession, error)
+	Append(uploadID string, offset uint64, chunk []byte) (*UploadSession, error)
+	Find(uploadID string) (*UploadSession, error)
+	// Finish claims a session so that only one call saves its image, or returns the result
+	// of the session if it is already finished. The claim ends with Complete or Abort.
+	Finish(uploadID string) (*UploadSession, *UploadResult, error)
+	// Complete removes a claimed session and keeps its result for the retries of Finish.
+	Complete(uploadID string, result *UploadResult) error
+	// Abort releases a claimed session, which can then be finished again.
+	Abort(uploadID string) error
+}
+
+// UploadResult is the image saved from a finished upload session.
+type UploadResult struct {
+	LaptopID string
+	ImageID  string
+	Size     int
+}
+
+// UploadSession is an image upload in progress.
+type UploadSession struct {
+	ID        string
+	LaptopID  string
+	ImageType string
+	Data      bytes.Buffer
+	ExpiresAt time.Time
+	finishing bool // claimed by a call of Finish
+}
+
+// CommittedSize returns the number of bytes received so far.
+func (session *UploadSession) CommittedSize() uint64 {
+	return uint64(session.Data.Len())
+}
+
+// Clone clones the upload session.
+func (session *UploadSession) Clone() *UploadSession {
+	other := &UploadSession{
+		ID:        session.ID,
+		LaptopID:  session.LaptopID,
+		ImageType: session.ImageType,
+		ExpiresAt: session.ExpiresAt,
+	}
+	other.Data.Write(session.Data.Bytes())
+	return other
+}
+
+// InMemoryUploadSessionStore is an in-memory store for upload sessions.
+// A session expires when no chunk has been received for sessionTTL,
+// and the result of a finished session is kept for sessionTTL.
+type InMemoryUploadSessionStore struct {
+	mutex      sync.RWMutex
+	sessionTTL time.Duration
+	sessions   map[string]*UploadSession
+	results    map[string]*finishedUpload
+}
+
+type finishedUpload struct {
+	result    *UploadResult
+	expiresAt time.Time
+}
+
+// NewInMemoryUploadSessionStore creates a new InMemoryUploadSessionStore.
+func NewInMemoryUploadSessionStore(sessionTTL time.Duration) *InMemoryUploadSessionStore {
+	return &InMemoryUploadSessionStore{
+		sessionTTL: sessionTTL,
+		sessions:   make(map[string]*UploadSession),
+		results:    make(map[string]*finishedUpload),
+	}
+}
+
+// Create starts a new upload session.
+func (store *InMemoryUploadSessionStore) Create(laptopID string, imageType string) (*UploadSession, error) {
+	uploadID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate upload ID: %w", err)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.removeExpired(time.Now())
+
+	session := &UploadSession{
+		ID:        uploadID.String(),
+		LaptopID:  laptopID,
+		ImageType: imageType,
+		ExpiresAt: time.Now().Add(store.sessionTTL),
+	}
+	store.sessions[session.ID] = session
+
+	return session.Clone(), nil
+}
+
+// Append writes a chunk at the given offset and extends the session expiry.
+// Bytes that were already committed are skipped, so resending a chunk is harmless.
+func (store *InMemoryUploadSessionStore) Append(uploadID string, offset uint64, chunk []byte) (*UploadSession, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	session := store.find(uploadID)
+	if session == nil {
+		return nil, ErrUploadNotFound
+	}
+	if session.finishing {
+		return nil, ErrUploadFinishing
+	}
+
+	committed := session.CommittedSize()
+	if offset > committed {
+		return nil, ErrUploadOffsetMismatch
+	}
+
+	skip := committed - offset
+	if skip < uint64(len(chunk)) {
+		session.Data.Write(chunk[skip:])
+	}
+	session.ExpiresAt = time.Now().Add(store.sessionTTL)
+
+	return session.Clone(), nil
+}
+
+// Find finds an upload session by ID.
+func (store *InMemoryUploadSessionStore) Find(uploadID string) (*UploadSession, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	session := store.find(uploadID)
+	if session == nil {
+		return nil, ErrUploadNotFound
+	}
+
+	return session.Clone(), nil
+}
+
+// Finish claims an upload session, or returns the result of the session if it is already finished.
+// It returns ErrUploadFinishing if another call claimed the session.
+func (store *InMemoryUploadSessionStore) Finish(uploadID string) (*UploadSession, *UploadResult, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	finished := store.results[uploadID]
+	if finished != nil && time.Now().Before(finished.expiresAt) {
+		result := *finished.result
+		return nil, &result, nil
+	}
+
+	session := store.find(uploadID)
+	if session == nil {
+		return nil, nil, ErrUploadNotFound
+	}
+	if session.finishing {
+		return nil, nil, ErrUploadFinishing
+	}
+	session.finishing = true
+
+	return session.Clone(), nil, nil
+}
+
+// Complete removes a claimed upload session and keeps its result.
+func (store *InMemoryUploadSessionStore) Complete(uploadID string, result *UploadResult) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	session := store.sessions[uploadID]
+	if session == nil || !session.finishing {
+		return ErrUploadNotFound
+	}
+	delete(store.sessions, uploadID)
+
+	copied := *result
+	store.results[uploadID] = &finishedUpload{
+		result:    &copied,
+		expiresAt: time.Now().Add(store.sessionTTL),
+	}
+	return nil
+}
+
+// Abort releases a claimed upload session.
+func (store *InMemoryUploadSessionStore) Abort(uploadID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	session := store.sessions[uploadID]
+	if session == nil {
+		return ErrUploadNotFound
+	}
+	session.finishing = false
+	session.ExpiresAt = time.Now().Add(store.sessionTTL)
+
+	return nil
+}
+
+func (store *InMemoryUploadSessionStore) find(uploadID string) *UploadSession {
+	session := store.sessions[uploadID]
+	if session == nil || time.Now().After(session.ExpiresAt) {
+		return nil
+	}
+	return session
+}
+
+func (store *InMemoryUploadSessionStore) removeExpired(now time.Time) {
+	for id, session := range store.sessions {
+		if now.After(session.ExpiresAt) && !session.finishing {
+			delete(store.sessions, id)
+		}
+	}
+	for id, finished := range store.results {
+		if now.After(finished.expiresAt) {
+			delete(store.results, id)
+		}
+	}
+}
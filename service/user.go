@@ -1,7 +1,8 @@
 package service
 
 import (
-	"fmt"
+	"crypto/subtle"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -11,28 +12,80 @@ type User struct {
 	Username string
 	HashedPassword string
 	Role string
+	Team string // the team whose laptops the user can manage, if any
+	Disabled bool
+	Issuer string // the OIDC issuer or LDAP directory URL of a user managed outside, who has no password
+	Subject string // the subject of an OIDC user at its issuer, which identifies it unlike its username
+	TOTPSecret string // the confirmed TOTP secret, if the user enrolled in two-factor authentication
+	PendingTOTPSecret string // the TOTP secret waiting for a first code to confirm the enrollment
+	TOTPLastStep int64 // the time step of the last accepted code, which cannot be used again
+	RecoveryCodeHashes []string // the hashes of the unused one-time recovery codes
 }
 
-// NewUser creates a new user.
+// NewUser creates a new user, whose password is hashed with bcrypt and its default cost.
 func NewUser(username, password, role string) (*User, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return nil, fmt.Errorf("cannot hash password: %w", err)
-	}
-
 	user :=&User{
 		Username: username,
-		HashedPassword: string(hashedPassword),
 		Role: role,
 	}
 
+	err := user.SetPassword(password, &BcryptHasher{Cost: bcrypt.DefaultCost})
+	if err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
-// IsCorrectPassword checks if the password is correct.
+// SetPassword replaces the password of the user, hashed with hasher.
+func (u *User) SetPassword(password string, hasher PasswordHasher) error {
+	hashedPassword, err := hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	u.HashedPassword = hashedPassword
+	return nil
+}
+
+// IsCorrectPassword checks if the password is correct, whatever the algorithm of its hash.
 func (u *User) IsCorrectPassword(password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(u.HashedPassword), []byte(password))
-	return err == nil
+	return checkPasswordHash(u.HashedPassword, password)
+}
+
+// HasTOTP checks if the user enrolled in two-factor authentication.
+func (u *User) HasTOTP() bool {
+	return u.TOTPSecret != ""
+}
+
+// CheckTOTP checks a code against the confirmed or else the pending TOTP secret,
+// and records its time step so that it cannot be used again.
+func (u *User) CheckTOTP(code string, now time.Time) bool {
+	secret := u.TOTPSecret
+	if secret == "" {
+		secret = u.PendingTOTPSecret
+	}
+	if secret == "" {
+		return false
+	}
+
+	step, ok := VerifyTOTP(secret, code, now, u.TOTPLastStep)
+	if ok {
+		u.TOTPLastStep = step
+	}
+	return ok
+}
+
+// UseRecoveryCode checks a recovery code and removes it, since each code can only be used once.
+func (u *User) UseRecoveryCode(code string) bool {
+	hash := hashRecoveryCode(code)
+	for i, other := range u.RecoveryCodeHashes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(other)) == 1 {
+			u.RecoveryCodeHashes = append(u.RecoveryCodeHashes[:i:i], u.RecoveryCodeHashes[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
 // Clone clones the user.
@@ -41,5 +94,13 @@ func (u *User) Clone() *User {
 		Username: u.Username,
 		HashedPassword: u.HashedPassword,
 		Role: u.Role,
+		Team: u.Team,
+		Disabled: u.Disabled,
+		Issuer: u.Issuer,
+		Subject: u.Subject,
+		TOTPSecret: u.TOTPSecret,
+		PendingTOTPSecret: u.PendingTOTPSecret,
+		TOTPLastStep: u.TOTPLastStep,
+		RecoveryCodeHashes: append([]string(nil), u.RecoveryCodeHashes...),
 	}
 }
\ No newline at end of file
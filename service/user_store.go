@@ -1,11 +1,28 @@
 package service
 
-import "sync"
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrUserNotFound is returned when a user does not exist.
+var ErrUserNotFound = errors.New("user not found")
 
 // UserStore is a store for storing users.
 type UserStore interface {
 	Save(user *User) error
 	Find(username string) (*User, error)	
+	// Modify changes an existing user in one step, so that the checks of change hold
+	// and the concurrent changes of other fields are kept
+	Modify(username string, change func(user *User) error) (*User, error)
+	List(offset int, limit int) ([]*User, int, error) // List returns at most limit users by username from offset, and the total number of users
+}
+
+// Authenticator checks the passwords of users managed outside of the user store, e.g. by a directory.
+type Authenticator interface {
+	// Authenticate returns the user if the password is correct, or nil if the username or password is invalid.
+	Authenticate(username string, password string) (*User, error)
 }
 
 // InMemoryUserStore is an in-memory store for storing users.
@@ -46,4 +63,45 @@ func (store *InMemoryUserStore) Find(username string) (*User, error)	{
 	}
 
 	return user.Clone(), nil	
-}
\ No newline at end of file
+}
+
+// Modify calls change with a copy of an existing user under the store lock, and replaces the user
+// with the changed copy, which is returned. If change returns an error, the user is left as is
+// and the error is returned.
+func (store *InMemoryUserStore) Modify(username string, change func(user *User) error) (*User, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user := store.users[username]
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+
+	changed := user.Clone()
+	err := change(changed)
+	if err != nil {
+		return nil, err
+	}
+
+	store.users[username] = changed
+	return changed.Clone(), nil
+}
+
+// List returns at most limit users ordered by username from offset, and the total number of users.
+func (store *InMemoryUserStore) List(offset int, limit int) ([]*User, int, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	usernames := make([]string, 0, len(store.users))
+	for username := range store.users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var users []*User
+	for i := offset; i < len(usernames) && len(users) < limit; i++ {
+		users = append(users, store.users[usernames[i]].Clone())
+	}
+
+	return users, len(usernames), nil
+}